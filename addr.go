@@ -8,7 +8,25 @@
 
 package main
 
-import "net"
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Cache of interface addresses, by ifindex (0 for all interfaces),
+// for AddrIsOnLink, which is called for every received packet
+var (
+	addrCache     = make(map[int]*addrCacheEntry)
+	addrCacheLock sync.Mutex
+)
+
+// addrCacheEntry is the addrCache entry
+type addrCacheEntry struct {
+	addrs   []net.Addr // Interface addresses
+	err     error      // Error, if addresses can't be obtained
+	expires time.Time  // Entry expiration time
+}
 
 // AddrIsLocal tells if IP address is local (i.e., belongs to
 // one of local interfaces)
@@ -50,3 +68,64 @@ func AddrIs4(addr net.IP) bool {
 func AddrIs4UDP(addr *net.UDPAddr) bool {
 	return AddrIs4(addr.IP)
 }
+
+// AddrIsOnLink tells if IP address is on-link for the interface
+// with the specified index, or for any interface, if ifindex is 0:
+// it is link-local or belongs to one of the interface's subnets
+func AddrIsOnLink(addr net.IP, ifindex int) bool {
+	if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return true
+	}
+
+	addrs, err := addrIfAddrs(ifindex)
+	if err != nil {
+		return true // Can't tell, don't raise false alarm
+	}
+
+	for _, a := range addrs {
+		if subnet, ok := a.(*net.IPNet); ok && subnet.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addrIfAddrs returns addresses of the interface with the specified
+// index, or of all interfaces, if ifindex is 0
+//
+// Addresses are cached for netmonInterval, so network configuration
+// changes are noticed as fast as by NetmonRun, which also flushes
+// the cache, when it notices changes (see AddrCacheFlush)
+func addrIfAddrs(ifindex int) ([]net.Addr, error) {
+	addrCacheLock.Lock()
+	defer addrCacheLock.Unlock()
+
+	now := time.Now()
+	ent := addrCache[ifindex]
+	if ent != nil && now.Before(ent.expires) {
+		return ent.addrs, ent.err
+	}
+
+	ent = &addrCacheEntry{expires: now.Add(netmonInterval)}
+	if ifindex != 0 {
+		var iface *net.Interface
+		iface, ent.err = net.InterfaceByIndex(ifindex)
+		if ent.err == nil {
+			ent.addrs, ent.err = iface.Addrs()
+		}
+	} else {
+		ent.addrs, ent.err = net.InterfaceAddrs()
+	}
+
+	addrCache[ifindex] = ent
+	return ent.addrs, ent.err
+}
+
+// AddrCacheFlush flushes cached interface addresses. It is called
+// when network configuration changes
+func AddrCacheFlush() {
+	addrCacheLock.Lock()
+	addrCache = make(map[int]*addrCacheEntry)
+	addrCacheLock.Unlock()
+}
@@ -0,0 +1,168 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The announce command
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Record TTLs, recommended by RFC 6762, section 10
+const (
+	announceHostTTL  = 120  // Host names and SRV records
+	announceOtherTTL = 4500 // Other records
+)
+
+// announceServicesName is the DNS-SD service type enumeration name
+// (RFC 6763, section 9)
+const announceServicesName = "_services._dns-sd._udp.local."
+
+// AnnounceRun publishes the host name, specified by the first of
+// OptCommandArgs, its addresses, specified by the rest of arguments
+// (if none, addresses of the selected interfaces are used) and
+// services, specified by OptServices
+//
+// Records are published by ResponderRun, and its error is returned
+func AnnounceRun(ctx context.Context, w io.Writer) error {
+	records := announceRecords()
+	return ResponderRun(ctx, w, records)
+}
+
+// announceRecords builds the set of records to be published
+func announceRecords() []ResponderRecord {
+	host, err := QueryFqdn(OptCommandArgs[0])
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	// Collect addresses
+	var ips []net.IP
+	for _, arg := range OptCommandArgs[1:] {
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			LogFatal("%q: invalid IP address", arg)
+		}
+		ips = append(ips, ip)
+	}
+
+	if len(ips) == 0 {
+		addrs, _, _, err := IfAddrs()
+		if err != nil {
+			LogFatal("%s", err)
+		}
+
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	if len(ips) == 0 {
+		LogFatal("No addresses to announce")
+	}
+
+	// Create address records
+	var records []ResponderRecord
+	for _, ip := range ips {
+		var rr dns.RR
+		hdr := dns.RR_Header{Name: host, Class: dns.ClassINET,
+			Ttl: announceHostTTL}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: hdr, A: ip4}
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+		}
+
+		records = append(records, ResponderRecord{rr, true})
+	}
+
+	// Create service records
+	for _, spec := range OptServices {
+		records = append(records, announceService(spec, host)...)
+	}
+
+	return records
+}
+
+// announceService creates records for the service, specified as
+// "instance,type,port[,key=value...]"
+func announceService(spec, host string) []ResponderRecord {
+	fields := strings.Split(spec, ",")
+	if len(fields) < 3 || fields[0] == "" ||
+		!strings.HasPrefix(fields[1], "_") {
+		LogFatal("%q: invalid service", spec)
+	}
+
+	port, err := strconv.ParseUint(fields[2], 10, 16)
+	if err != nil {
+		LogFatal("%q: invalid port %q", spec, fields[2])
+	}
+
+	// Service instance name is a single label, which may contain
+	// dots, so they must be escaped
+	svctype := dns.Fqdn(strings.TrimSuffix(fields[1], ".local") +
+		".local")
+	instance := strings.ReplaceAll(fields[0], ".", `\.`) + "." + svctype
+
+	if _, ok := dns.IsDomainName(instance); !ok {
+		LogFatal("%q: invalid service name", spec)
+	}
+
+	// TXT record must contain at least one (maybe empty) string
+	// (RFC 6763, section 6.1)
+	txt := fields[3:]
+	if len(txt) == 0 {
+		txt = []string{""}
+	}
+
+	hdr := func(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype,
+			Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	return []ResponderRecord{
+		{
+			RR: &dns.PTR{
+				Hdr: hdr(announceServicesName, dns.TypePTR,
+					announceOtherTTL),
+				Ptr: svctype,
+			},
+		},
+		{
+			RR: &dns.PTR{
+				Hdr: hdr(svctype, dns.TypePTR,
+					announceOtherTTL),
+				Ptr: instance,
+			},
+		},
+		{
+			RR: &dns.SRV{
+				Hdr: hdr(instance, dns.TypeSRV,
+					announceHostTTL),
+				Port:   uint16(port),
+				Target: host,
+			},
+			Unique: true,
+		},
+		{
+			RR: &dns.TXT{
+				Hdr: hdr(instance, dns.TypeTXT,
+					announceOtherTTL),
+				Txt: txt,
+			},
+			Unique: true,
+		},
+	}
+}
@@ -0,0 +1,211 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/mcdig.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Mcdig_Query_FullMethodName  = "/mcdig.Mcdig/Query"
+	Mcdig_Browse_FullMethodName = "/mcdig.Mcdig/Browse"
+	Mcdig_Watch_FullMethodName  = "/mcdig.Mcdig/Watch"
+)
+
+// McdigClient is the client API for Mcdig service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type McdigClient interface {
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error)
+	Browse(ctx context.Context, in *BrowseRequest, opts ...grpc.CallOption) (*BrowseResponse, error)
+	Watch(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (Mcdig_WatchClient, error)
+}
+
+type mcdigClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMcdigClient(cc grpc.ClientConnInterface) McdigClient {
+	return &mcdigClient{cc}
+}
+
+func (c *mcdigClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error) {
+	out := new(QueryResponse)
+	err := c.cc.Invoke(ctx, Mcdig_Query_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mcdigClient) Browse(ctx context.Context, in *BrowseRequest, opts ...grpc.CallOption) (*BrowseResponse, error) {
+	out := new(BrowseResponse)
+	err := c.cc.Invoke(ctx, Mcdig_Browse_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mcdigClient) Watch(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (Mcdig_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Mcdig_ServiceDesc.Streams[0], Mcdig_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mcdigWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Mcdig_WatchClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type mcdigWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *mcdigWatchClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// McdigServer is the server API for Mcdig service.
+// All implementations must embed UnimplementedMcdigServer
+// for forward compatibility
+type McdigServer interface {
+	Query(context.Context, *QueryRequest) (*QueryResponse, error)
+	Browse(context.Context, *BrowseRequest) (*BrowseResponse, error)
+	Watch(*QueryRequest, Mcdig_WatchServer) error
+	mustEmbedUnimplementedMcdigServer()
+}
+
+// UnimplementedMcdigServer must be embedded to have forward compatible implementations.
+type UnimplementedMcdigServer struct {
+}
+
+func (UnimplementedMcdigServer) Query(context.Context, *QueryRequest) (*QueryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedMcdigServer) Browse(context.Context, *BrowseRequest) (*BrowseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Browse not implemented")
+}
+func (UnimplementedMcdigServer) Watch(*QueryRequest, Mcdig_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedMcdigServer) mustEmbedUnimplementedMcdigServer() {}
+
+// UnsafeMcdigServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to McdigServer will
+// result in compilation errors.
+type UnsafeMcdigServer interface {
+	mustEmbedUnimplementedMcdigServer()
+}
+
+func RegisterMcdigServer(s grpc.ServiceRegistrar, srv McdigServer) {
+	s.RegisterService(&Mcdig_ServiceDesc, srv)
+}
+
+func _Mcdig_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(McdigServer).Query(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mcdig_Query_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(McdigServer).Query(ctx, req.(*QueryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mcdig_Browse_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BrowseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(McdigServer).Browse(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Mcdig_Browse_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(McdigServer).Browse(ctx, req.(*BrowseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mcdig_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(QueryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(McdigServer).Watch(m, &mcdigWatchServer{stream})
+}
+
+type Mcdig_WatchServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type mcdigWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *mcdigWatchServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Mcdig_ServiceDesc is the grpc.ServiceDesc for Mcdig service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Mcdig_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mcdig.Mcdig",
+	HandlerType: (*McdigServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Query",
+			Handler:    _Mcdig_Query_Handler,
+		},
+		{
+			MethodName: "Browse",
+			Handler:    _Mcdig_Browse_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Mcdig_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/mcdig.proto",
+}
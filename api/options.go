@@ -0,0 +1,86 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Per-query options
+
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys of per-query parameters of Query, Browse and Watch. Options
+// below pass them, so other clients may use them directly
+const (
+	MetadataInterface = "mcdig-interface" // Interface name
+	MetadataNetwork   = "mcdig-network"   // "udp4" or "udp6"
+	MetadataTxCount   = "mcdig-tx-count"  // Count of transmissions
+	MetadataTxPeriod  = "mcdig-tx-period" // Period, as "250ms"
+	MetadataQU        = "mcdig-qu"        // "true" for QU questions
+)
+
+// Option configures the Resolver (see NewResolver)
+//
+// Options are per Resolver, not per process, so Resolvers with
+// different options may be used concurrently, sharing the same
+// connection to the daemon. Unless set, the daemon's command line
+// settings are used
+type Option func(*options)
+
+// options contains the Resolver configuration
+type options struct {
+	timeout time.Duration // Lookup timeout, 0 if none
+	md      metadata.MD   // Query parameters
+}
+
+// WithInterface sends queries only via the named network interface
+//
+// Answers are taken from the daemon's cache, shared by all clients,
+// so records, received via other interfaces, are not filtered out
+func WithInterface(name string) Option {
+	return func(o *options) {
+		o.md.Set(MetadataInterface, name)
+	}
+}
+
+// WithNetwork sends queries only via IPv4 ("udp4") or IPv6
+// ("udp6") MDNS sockets
+//
+// This is the only transport selection: the daemon queries
+// only via MDNS, so unicast DNS, DNS Push and NetBIOS, available
+// from the command line, can't be requested
+func WithNetwork(network string) Option {
+	return func(o *options) {
+		o.md.Set(MetadataNetwork, network)
+	}
+}
+
+// WithTimeout limits the time of each lookup, if context passed
+// to the lookup has no deadline
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithRetransmit sets the count of query transmissions and the
+// period between them. Lookup returns after the last period
+func WithRetransmit(count int, period time.Duration) Option {
+	return func(o *options) {
+		o.md.Set(MetadataTxCount, strconv.Itoa(count))
+		o.md.Set(MetadataTxPeriod, period.String())
+	}
+}
+
+// WithQU requests unicast responses (QU questions, RFC 6762,
+// section 5.4)
+func WithQU(qu bool) Option {
+	return func(o *options) {
+		o.md.Set(MetadataQU, strconv.FormatBool(qu))
+	}
+}
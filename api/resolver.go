@@ -0,0 +1,285 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// net.Resolver-style lookups of .local names
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Resolver resolves .local names via the mcdig daemon (see the
+// grpc command). Its lookup methods have the same signatures and
+// semantics as methods of *net.Resolver, so it can be used where
+// applications already use *net.Resolver
+//
+// Deadline and cancellation of the context are propagated to the
+// daemon. Without deadline, lookup takes the daemon's query time
+type Resolver struct {
+	client  McdigClient // The daemon client
+	options options     // Resolver options
+}
+
+// NewResolver creates a new Resolver, using the connection to
+// the mcdig daemon, configured by options
+func NewResolver(cc grpc.ClientConnInterface, opts ...Option) *Resolver {
+	r := &Resolver{
+		client:  NewMcdigClient(cc),
+		options: options{md: metadata.MD{}},
+	}
+
+	for _, opt := range opts {
+		opt(&r.options)
+	}
+
+	return r
+}
+
+// LookupHost looks up the given host and returns a slice of its
+// IPv4 and IPv6 addresses
+func (r *Resolver) LookupHost(ctx context.Context,
+	host string) ([]string, error) {
+
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, len(addrs))
+	for i, addr := range addrs {
+		out[i] = addr.String()
+	}
+
+	return out, nil
+}
+
+// LookupIPAddr looks up the given host, querying its A and AAAA
+// records in parallel, and returns a slice of its IPv4 and IPv6
+// addresses. IPv4 addresses come first
+func (r *Resolver) LookupIPAddr(ctx context.Context,
+	host string) ([]net.IPAddr, error) {
+
+	types := []uint16{dns.TypeA, dns.TypeAAAA}
+	answers := make([][]dns.RR, len(types))
+	errs := make([]error, len(types))
+
+	wait := sync.WaitGroup{}
+	for i, qtype := range types {
+		wait.Add(1)
+		go func(i int, qtype uint16) {
+			answers[i], errs[i] = r.lookup(ctx, host, qtype)
+			wait.Done()
+		}(i, qtype)
+	}
+	wait.Wait()
+
+	var addrs []net.IPAddr
+	for _, rrs := range answers {
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.IPAddr{IP: rr.A})
+			case *dns.AAAA:
+				addrs = append(addrs, net.IPAddr{IP: rr.AAAA})
+			}
+		}
+	}
+
+	// Partial failure is not an error, if some addresses are known
+	if len(addrs) == 0 {
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, resolverNotFound(host)
+	}
+
+	return addrs, nil
+}
+
+// LookupSRV tries to resolve an SRV query of the given service,
+// protocol, and domain name. The proto is "tcp" or "udp". The
+// returned records are sorted by priority and weight
+//
+// LookupSRV constructs the DNS name to look up following RFC 2782.
+// That is, it looks up _service._proto.name. To accommodate
+// services publishing SRV records under non-standard names (e.g.,
+// DNS-SD service instances), if both service and proto are empty
+// strings, LookupSRV looks up name directly
+func (r *Resolver) LookupSRV(ctx context.Context,
+	service, proto, name string) (string, []*net.SRV, error) {
+
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+
+	rrs, err := r.lookup(ctx, target, dns.TypeSRV)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var cname string
+	var srvs []*net.SRV
+	for _, rr := range rrs {
+		if rr, ok := rr.(*dns.SRV); ok {
+			cname = rr.Hdr.Name
+			srvs = append(srvs, &net.SRV{
+				Target:   rr.Target,
+				Port:     rr.Port,
+				Priority: rr.Priority,
+				Weight:   rr.Weight,
+			})
+		}
+	}
+
+	if len(srvs) == 0 {
+		return "", nil, resolverNotFound(target)
+	}
+
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+
+	return cname, srvs, nil
+}
+
+// LookupTXT returns the DNS TXT records for the given domain name
+//
+// As with *net.Resolver, strings of each TXT record are
+// concatenated, and each record is returned as a single string
+func (r *Resolver) LookupTXT(ctx context.Context,
+	name string) ([]string, error) {
+
+	rrs, err := r.lookup(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	var txts []string
+	for _, rr := range rrs {
+		if rr, ok := rr.(*dns.TXT); ok {
+			txts = append(txts, strings.Join(rr.Txt, ""))
+		}
+	}
+
+	if len(txts) == 0 {
+		return nil, resolverNotFound(name)
+	}
+
+	return txts, nil
+}
+
+// lookup queries records of the given name and type and returns
+// the answer records. Errors are returned as *net.DNSError
+func (r *Resolver) lookup(ctx context.Context,
+	name string, qtype uint16) ([]dns.RR, error) {
+
+	if !resolverIsLocal(name) {
+		return nil, &net.DNSError{
+			Err:        "not a .local name",
+			Name:       name,
+			IsNotFound: true,
+		}
+	}
+
+	if _, ok := ctx.Deadline(); !ok && r.options.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.options.timeout)
+		defer cancel()
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Join(
+		r.options.md, resolverOutgoing(ctx)))
+
+	rsp, err := r.client.Query(ctx, &QueryRequest{
+		Name: strings.TrimSuffix(name, "."),
+		Type: dns.TypeToString[qtype],
+	})
+
+	if err != nil {
+		return nil, resolverError(name, err)
+	}
+
+	var rrs []dns.RR
+	for _, rec := range rsp.Answer {
+		rr, err := rec.RR()
+		if err != nil {
+			return nil, &net.DNSError{
+				Err:  err.Error(),
+				Name: name,
+			}
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, nil
+}
+
+// RR parses the Record into dns.RR
+func (rec *Record) RR() (dns.RR, error) {
+	return dns.NewRR(fmt.Sprintf("%s %d %s %s %s",
+		rec.Name, rec.Ttl, rec.Class, rec.Type, rec.Data))
+}
+
+// resolverIsLocal tells if the name belongs to the .local domain.
+// Single-label names imply .local
+func resolverIsLocal(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	labels, ok := dns.IsDomainName(name)
+	return ok && (labels == 1 || dns.IsSubDomain("local.", name))
+}
+
+// resolverOutgoing returns metadata, already attached to ctx
+func resolverOutgoing(ctx context.Context) metadata.MD {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return md
+}
+
+// resolverNotFound returns the "no such host" error
+func resolverNotFound(name string) error {
+	return &net.DNSError{
+		Err:        "no such host",
+		Name:       name,
+		IsNotFound: true,
+	}
+}
+
+// resolverError converts the gRPC error into *net.DNSError
+func resolverError(name string, err error) error {
+	e := &net.DNSError{
+		Err:  err.Error(),
+		Name: name,
+	}
+
+	switch status.Code(err) {
+	case codes.DeadlineExceeded:
+		e.Err = "i/o timeout"
+		e.IsTimeout = true
+	case codes.Canceled:
+		e.Err = context.Canceled.Error()
+	case codes.Unavailable:
+		e.IsTemporary = true
+	}
+
+	return e
+}
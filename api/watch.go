@@ -0,0 +1,91 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Subscription to received records
+
+package api
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/metadata"
+)
+
+// SourceMeta tells where the record was received from
+type SourceMeta struct {
+	Source    string // Source address, "ip:port", empty if unknown
+	Interface string // Receiving interface, empty if unknown
+}
+
+// OnRecord subscribes the callback to records of the given name
+// and type, so applications may react to answers in real time
+// (e.g., update a device registry) without polling. It returns
+// when ctx is canceled (with nil error) or the daemon fails
+//
+// Records, already known to the daemon, are passed first. Then
+// the callback is called for each record that appears or replaces
+// other records of its RRset, and for each record that expires or
+// says goodbye. Removed records are passed with zero TTL, like
+// MDNS goodbye records (RFC 6762, section 10.1)
+//
+// The callback is called on the calling goroutine, so OnRecord
+// is usually called on a dedicated goroutine
+func (r *Resolver) OnRecord(ctx context.Context, name string,
+	qtype uint16, callback func(rr dns.RR, meta SourceMeta)) error {
+
+	if !resolverIsLocal(name) {
+		return &net.DNSError{
+			Err:        "not a .local name",
+			Name:       name,
+			IsNotFound: true,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Join(
+		r.options.md, resolverOutgoing(ctx)))
+
+	stream, err := r.client.Watch(ctx, &QueryRequest{
+		Name: strings.TrimSuffix(name, "."),
+		Type: dns.TypeToString[qtype],
+	})
+
+	for err == nil {
+		var ev *Event
+		ev, err = stream.Recv()
+		if err != nil {
+			break
+		}
+
+		var rr dns.RR
+		rr, err = ev.Record.RR()
+		if err != nil {
+			return &net.DNSError{
+				Err:  err.Error(),
+				Name: name,
+			}
+		}
+
+		if ev.Event == "removed" {
+			rr.Header().Ttl = 0
+		}
+
+		callback(rr, SourceMeta{
+			Source:    ev.Source,
+			Interface: ev.Interface,
+		})
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return resolverError(name, err)
+}
@@ -0,0 +1,723 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Avahi-compatible D-Bus interface subset
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/miekg/dns"
+)
+
+// Avahi D-Bus names
+const (
+	avahiBusName       = "org.freedesktop.Avahi"
+	avahiServerIface   = "org.freedesktop.Avahi.Server"
+	avahiServer2Iface  = "org.freedesktop.Avahi.Server2"
+	avahiBrowserIface  = "org.freedesktop.Avahi.ServiceBrowser"
+	avahiResolverIface = "org.freedesktop.Avahi.ServiceResolver"
+	avahiErrorPrefix   = "org.freedesktop.Avahi."
+	avahiAPIVersion    = 515 // As of Avahi 0.8
+	avahiServerRunning = 2   // AVAHI_SERVER_RUNNING
+	avahiResultMcast   = 4   // AVAHI_LOOKUP_RESULT_MULTICAST
+	avahiProtoInet     = 0   // AVAHI_PROTO_INET
+	avahiProtoInet6    = 1   // AVAHI_PROTO_INET6
+)
+
+// avahiServer implements the subset of the Avahi server D-Bus API
+// (service browsing and resolving) on top of the Daemon, so simple
+// clients, written against Avahi, work without Avahi
+type avahiServer struct {
+	ctx       context.Context                    // Daemon context
+	conn      *dbus.Conn                         // D-Bus connection
+	daemon    *Daemon                            // The daemon
+	browsers  map[dbus.ObjectPath]*avahiBrowser  // Active browsers
+	resolvers map[dbus.ObjectPath]*avahiResolver // Active resolvers
+	cookie    uint32                             // Local service cookie
+	nextID    int                                // Next object ID
+	lock      sync.Mutex                         // Access lock
+}
+
+// avahiBrowser represents the ServiceBrowser object
+type avahiBrowser struct {
+	server  *avahiServer       // Owning server
+	path    dbus.ObjectPath    // Object path
+	owner   string             // Unique bus name of the client
+	iface   int32              // Interface, as requested
+	proto   int32              // Protocol, as requested
+	svctype string             // Service type, FQDN
+	cancel  context.CancelFunc // Cancels the browser
+	started bool               // Browser is started
+}
+
+// avahiResolver represents the ServiceResolver object
+type avahiResolver struct {
+	server  *avahiServer       // Owning server
+	path    dbus.ObjectPath    // Object path
+	owner   string             // Unique bus name of the client
+	iface   int32              // Interface, as requested
+	proto   int32              // Protocol, as requested
+	name    string             // Instance name
+	svctype string             // Service type, as requested
+	fqdn    string             // Service type, FQDN
+	aproto  int32              // Address protocol, as requested
+	cancel  context.CancelFunc // Cancels the resolver
+	started bool               // Resolver is started
+}
+
+// AvahiRun registers on the D-Bus system bus as org.freedesktop.Avahi
+// and serves requests, until ctx is canceled. It doesn't return
+// in a case of errors
+func AvahiRun(ctx context.Context, daemon *Daemon) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		LogFatal("D-Bus: %s", err)
+	}
+
+	s := &avahiServer{
+		ctx:       ctx,
+		conn:      conn,
+		daemon:    daemon,
+		browsers:  make(map[dbus.ObjectPath]*avahiBrowser),
+		resolvers: make(map[dbus.ObjectPath]*avahiResolver),
+		cookie:    rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(),
+	}
+
+	for _, iface := range []string{avahiServerIface, avahiServer2Iface} {
+		err = conn.Export(s, "/", iface)
+		if err != nil {
+			LogFatal("D-Bus: %s", err)
+		}
+	}
+
+	// Track clients, so objects of disconnected clients are freed
+	err = conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"))
+	if err != nil {
+		LogFatal("D-Bus: %s", err)
+	}
+
+	signals := make(chan *dbus.Signal, 64)
+	conn.Signal(signals)
+
+	reply, err := conn.RequestName(avahiBusName, dbus.NameFlagDoNotQueue)
+	switch {
+	case err != nil:
+		LogFatal("D-Bus: %s", err)
+	case reply != dbus.RequestNameReplyPrimaryOwner:
+		LogFatal("D-Bus: %s: name already taken", avahiBusName)
+	}
+
+	LogDebug("D-Bus: registered as %s", avahiBusName)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case sig := <-signals:
+				s.nameOwnerChanged(sig)
+			}
+		}
+	}()
+}
+
+// GetVersionString returns the server version string
+func (s *avahiServer) GetVersionString() (string, *dbus.Error) {
+	return "mcdig", nil
+}
+
+// GetAPIVersion returns the API version
+func (s *avahiServer) GetAPIVersion() (uint32, *dbus.Error) {
+	return avahiAPIVersion, nil
+}
+
+// GetState returns the server state
+func (s *avahiServer) GetState() (int32, *dbus.Error) {
+	return avahiServerRunning, nil
+}
+
+// GetHostName returns the host name
+func (s *avahiServer) GetHostName() (string, *dbus.Error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return "", avahiError("Failure", err.Error())
+	}
+	return strings.SplitN(name, ".", 2)[0], nil
+}
+
+// GetHostNameFqdn returns the host name within the .local domain
+func (s *avahiServer) GetHostNameFqdn() (string, *dbus.Error) {
+	name, err := s.GetHostName()
+	if err != nil {
+		return "", err
+	}
+	return name + ".local", nil
+}
+
+// GetDomainName returns the domain name
+func (s *avahiServer) GetDomainName() (string, *dbus.Error) {
+	return "local", nil
+}
+
+// GetLocalServiceCookie returns the local service cookie
+func (s *avahiServer) GetLocalServiceCookie() (uint32, *dbus.Error) {
+	return s.cookie, nil
+}
+
+// IsNSSSupportAvailable tells if nss-mdns is available
+func (s *avahiServer) IsNSSSupportAvailable() (bool, *dbus.Error) {
+	return false, nil
+}
+
+// GetNetworkInterfaceNameByIndex returns interface name by index
+func (s *avahiServer) GetNetworkInterfaceNameByIndex(
+	index int32) (string, *dbus.Error) {
+
+	iface, err := net.InterfaceByIndex(int(index))
+	if err != nil {
+		return "", avahiError("OSError", err.Error())
+	}
+	return iface.Name, nil
+}
+
+// GetNetworkInterfaceIndexByName returns interface index by name
+func (s *avahiServer) GetNetworkInterfaceIndexByName(
+	name string) (int32, *dbus.Error) {
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, avahiError("OSError", err.Error())
+	}
+	return int32(iface.Index), nil
+}
+
+// ServiceBrowserNew creates and starts the ServiceBrowser
+func (s *avahiServer) ServiceBrowserNew(sender dbus.Sender,
+	iface, proto int32, svctype, domain string,
+	flags uint32) (dbus.ObjectPath, *dbus.Error) {
+
+	b, err := s.browserNew(sender, iface, proto, svctype, domain)
+	if err != nil {
+		return "", err
+	}
+
+	b.Start()
+	return b.path, nil
+}
+
+// ServiceBrowserPrepare creates the ServiceBrowser, which is
+// started later by its Start method
+func (s *avahiServer) ServiceBrowserPrepare(sender dbus.Sender,
+	iface, proto int32, svctype, domain string,
+	flags uint32) (dbus.ObjectPath, *dbus.Error) {
+
+	b, err := s.browserNew(sender, iface, proto, svctype, domain)
+	if err != nil {
+		return "", err
+	}
+
+	return b.path, nil
+}
+
+// ResolveService resolves the service instance
+func (s *avahiServer) ResolveService(iface, proto int32,
+	name, svctype, domain string, aproto int32, flags uint32) (
+	int32, int32, string, string, string, string,
+	int32, string, uint16, [][]byte, uint32, *dbus.Error) {
+
+	fail := func(err *dbus.Error) (int32, int32, string, string,
+		string, string, int32, string, uint16, [][]byte,
+		uint32, *dbus.Error) {
+		return 0, 0, "", "", "", "", 0, "", 0, nil, 0, err
+	}
+
+	fqdn, err := avahiServiceType(svctype, domain)
+	if err != nil {
+		return fail(err)
+	}
+
+	svc := s.resolve(s.ctx, fqdn, name, aproto)
+	if svc == nil {
+		return fail(avahiError("TimeoutError", "Timeout reached"))
+	}
+
+	r := s.resolved(svc, iface, proto, aproto)
+	return r.iface, r.proto, name, svctype, "local", r.host,
+		r.aproto, r.addr, svc.Port, r.txt, avahiResultMcast, nil
+}
+
+// ServiceResolverNew creates and starts the ServiceResolver
+func (s *avahiServer) ServiceResolverNew(sender dbus.Sender,
+	iface, proto int32, name, svctype, domain string,
+	aproto int32, flags uint32) (dbus.ObjectPath, *dbus.Error) {
+
+	r, err := s.resolverNew(sender, iface, proto, name, svctype,
+		domain, aproto)
+	if err != nil {
+		return "", err
+	}
+
+	r.Start()
+	return r.path, nil
+}
+
+// ServiceResolverPrepare creates the ServiceResolver, which is
+// started later by its Start method
+func (s *avahiServer) ServiceResolverPrepare(sender dbus.Sender,
+	iface, proto int32, name, svctype, domain string,
+	aproto int32, flags uint32) (dbus.ObjectPath, *dbus.Error) {
+
+	r, err := s.resolverNew(sender, iface, proto, name, svctype,
+		domain, aproto)
+	if err != nil {
+		return "", err
+	}
+
+	return r.path, nil
+}
+
+// avahiResolved contains the resolved service instance, as reported
+// by ResolveService and the ServiceResolver's Found signal
+type avahiResolved struct {
+	iface  int32    // Interface the instance was found on
+	proto  int32    // Protocol the instance was found with
+	host   string   // Target host, without the trailing dot
+	aproto int32    // Address protocol
+	addr   string   // Host address
+	txt    [][]byte // TXT record strings
+}
+
+// resolve resolves the service instance, looking up the Cache
+// first and browsing, if not found. It returns nil, if instance
+// is not resolved within the timeout
+func (s *avahiServer) resolve(ctx context.Context,
+	fqdn, name string, aproto int32) *DnssdService {
+
+	svc := s.lookup(fqdn, name, aproto)
+	if svc == nil {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		s.daemon.Browse(ctx, fqdn)
+		cancel()
+
+		svc = s.lookup(fqdn, name, aproto)
+	}
+
+	return svc
+}
+
+// resolved returns avahiResolved for the resolved service instance.
+// Interface and protocol are taken from the instance's SRV record,
+// falling back to the requested ones, if unknown
+func (s *avahiServer) resolved(svc *DnssdService,
+	iface, proto, aproto int32) avahiResolved {
+
+	r := avahiResolved{
+		iface: iface,
+		proto: proto,
+		host:  strings.TrimSuffix(svc.Host, "."),
+		addr:  avahiAddress(svc.Addrs, aproto),
+	}
+
+	if meta, ok := s.daemon.Source(svc.Name, dns.TypeSRV); ok {
+		r.iface, r.proto = avahiSource(meta, iface, proto)
+	}
+
+	r.aproto = avahiProtoInet6
+	if strings.Contains(r.addr, ".") {
+		r.aproto = avahiProtoInet
+	}
+
+	for _, t := range svc.TXT {
+		r.txt = append(r.txt, []byte(t))
+	}
+
+	return r
+}
+
+// browserNew creates a new ServiceBrowser object
+func (s *avahiServer) browserNew(sender dbus.Sender,
+	iface, proto int32, svctype, domain string) (
+	*avahiBrowser, *dbus.Error) {
+
+	fqdn, err := avahiServiceType(svctype, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nextID++
+	b := &avahiBrowser{
+		server:  s,
+		path:    dbus.ObjectPath(fmt.Sprintf("/ServiceBrowser%d", s.nextID)),
+		owner:   string(sender),
+		iface:   iface,
+		proto:   proto,
+		svctype: fqdn,
+	}
+
+	if err := s.conn.Export(b, b.path, avahiBrowserIface); err != nil {
+		return nil, avahiError("Failure", err.Error())
+	}
+
+	s.browsers[b.path] = b
+	LogDebug("D-Bus: %s: browsing %s for %s", b.path, fqdn, sender)
+
+	return b, nil
+}
+
+// resolverNew creates a new ServiceResolver object
+func (s *avahiServer) resolverNew(sender dbus.Sender,
+	iface, proto int32, name, svctype, domain string,
+	aproto int32) (*avahiResolver, *dbus.Error) {
+
+	fqdn, err := avahiServiceType(svctype, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nextID++
+	path := fmt.Sprintf("/ServiceResolver%d", s.nextID)
+	r := &avahiResolver{
+		server:  s,
+		path:    dbus.ObjectPath(path),
+		owner:   string(sender),
+		iface:   iface,
+		proto:   proto,
+		name:    name,
+		svctype: svctype,
+		fqdn:    fqdn,
+		aproto:  aproto,
+	}
+
+	if err := s.conn.Export(r, r.path, avahiResolverIface); err != nil {
+		return nil, avahiError("Failure", err.Error())
+	}
+
+	s.resolvers[r.path] = r
+	LogDebug("D-Bus: %s: resolving %q of %s for %s",
+		r.path, name, fqdn, sender)
+
+	return r, nil
+}
+
+// lookup returns the resolved service instance from the Cache.
+// If not found, or instance has no address of the requested
+// protocol, it returns nil
+func (s *avahiServer) lookup(svctype, name string,
+	aproto int32) *DnssdService {
+
+	for _, svc := range s.daemon.Services(svctype) {
+		if svc.Instance == name && svc.Host != "" &&
+			avahiAddress(svc.Addrs, aproto) != "" {
+			return &svc
+		}
+	}
+
+	return nil
+}
+
+// nameOwnerChanged frees browsers and resolvers of disconnected clients
+func (s *avahiServer) nameOwnerChanged(sig *dbus.Signal) {
+	if sig.Name != "org.freedesktop.DBus.NameOwnerChanged" ||
+		len(sig.Body) != 3 {
+		return
+	}
+
+	name, _ := sig.Body[0].(string)
+	owner, _ := sig.Body[2].(string)
+	if owner != "" {
+		return
+	}
+
+	s.lock.Lock()
+	var gone []*avahiBrowser
+	for _, b := range s.browsers {
+		if b.owner == name {
+			gone = append(gone, b)
+		}
+	}
+
+	var goneResolvers []*avahiResolver
+	for _, r := range s.resolvers {
+		if r.owner == name {
+			goneResolvers = append(goneResolvers, r)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, b := range gone {
+		b.Free()
+	}
+
+	for _, r := range goneResolvers {
+		r.Free()
+	}
+}
+
+// Start starts the browser
+func (b *avahiBrowser) Start() *dbus.Error {
+	s := b.server
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if b.started || s.browsers[b.path] == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	b.cancel = cancel
+	b.started = true
+
+	question := []dns.Question{{
+		Name:   b.svctype,
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	}}
+
+	w := s.daemon.Watch(question)
+	done := make(chan struct{})
+
+	go func() {
+		s.daemon.Exchange(ctx, question)
+		close(done)
+	}()
+
+	go b.run(ctx, w, done)
+
+	return nil
+}
+
+// Free frees the browser
+func (b *avahiBrowser) Free() *dbus.Error {
+	s := b.server
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.browsers[b.path] == nil {
+		return nil
+	}
+
+	if b.cancel != nil {
+		b.cancel()
+	}
+
+	delete(s.browsers, b.path)
+	s.conn.Export(nil, b.path, avahiBrowserIface)
+	LogDebug("D-Bus: %s: freed", b.path)
+
+	return nil
+}
+
+// run emits browser signals until ctx is canceled
+//
+// ItemNew/ItemRemove signals are emitted for the service instances.
+// The CacheExhausted signal is emitted once already known instances
+// are reported, and the AllForNow signal, once the initial queries
+// are done
+func (b *avahiBrowser) run(ctx context.Context, w *DaemonWatcher,
+	done <-chan struct{}) {
+
+	defer b.server.daemon.Unwatch(w)
+
+	for len(w.Events) > 0 {
+		b.event(<-w.Events)
+	}
+	b.emit("CacheExhausted")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-done:
+			for len(w.Events) > 0 {
+				b.event(<-w.Events)
+			}
+			b.emit("AllForNow")
+			done = nil
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				b.emit("Failure", "Too many events")
+				return
+			}
+			b.event(ev)
+		}
+	}
+}
+
+// event emits ItemNew or ItemRemove signal for the Cache event
+func (b *avahiBrowser) event(ev CacheEvent) {
+	ptr := dnssdInstancePTR(ev.RR)
+	if ptr == nil {
+		return
+	}
+
+	signal := "ItemNew"
+	if ev.Type == CacheRemoved {
+		signal = "ItemRemove"
+	}
+
+	iface, proto := avahiSource(ev.Meta, b.iface, b.proto)
+	b.emit(signal, iface, proto,
+		dnssdInstanceName(ptr.Ptr, b.svctype),
+		strings.TrimSuffix(b.svctype, ".local."), "local",
+		uint32(avahiResultMcast))
+}
+
+// emit emits the browser signal
+func (b *avahiBrowser) emit(signal string, args ...interface{}) {
+	err := b.server.conn.Emit(b.path, avahiBrowserIface+"."+signal,
+		args...)
+	if err != nil {
+		LogDebug("D-Bus: %s: %s", b.path, err)
+	}
+}
+
+// Start starts the resolver
+func (r *avahiResolver) Start() *dbus.Error {
+	s := r.server
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r.started || s.resolvers[r.path] == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	r.cancel = cancel
+	r.started = true
+
+	go r.run(ctx)
+
+	return nil
+}
+
+// Free frees the resolver
+func (r *avahiResolver) Free() *dbus.Error {
+	s := r.server
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.resolvers[r.path] == nil {
+		return nil
+	}
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+
+	delete(s.resolvers, r.path)
+	s.conn.Export(nil, r.path, avahiResolverIface)
+	LogDebug("D-Bus: %s: freed", r.path)
+
+	return nil
+}
+
+// run resolves the service instance and emits the Found signal,
+// or the Failure signal, if instance is not resolved in time
+func (r *avahiResolver) run(ctx context.Context) {
+	s := r.server
+
+	svc := s.resolve(ctx, r.fqdn, r.name, r.aproto)
+	switch {
+	case ctx.Err() != nil:
+		return
+	case svc == nil:
+		r.emit("Failure", "Timeout reached")
+		return
+	}
+
+	res := s.resolved(svc, r.iface, r.proto, r.aproto)
+	r.emit("Found", res.iface, res.proto, r.name, r.svctype, "local",
+		res.host, res.aproto, res.addr, svc.Port, res.txt,
+		uint32(avahiResultMcast))
+}
+
+// emit emits the resolver signal
+func (r *avahiResolver) emit(signal string, args ...interface{}) {
+	err := r.server.conn.Emit(r.path, avahiResolverIface+"."+signal,
+		args...)
+	if err != nil {
+		LogDebug("D-Bus: %s: %s", r.path, err)
+	}
+}
+
+// avahiSource returns interface index and protocol where the record
+// was received from. If unknown, the requested ones are returned
+func avahiSource(meta SourceMeta, iface, proto int32) (int32, int32) {
+	if meta.IfIndex > 0 {
+		iface = int32(meta.IfIndex)
+	}
+
+	if meta.From != nil {
+		proto = avahiProtoInet6
+		if meta.From.IP.To4() != nil {
+			proto = avahiProtoInet
+		}
+	}
+
+	return iface, proto
+}
+
+// avahiServiceType returns FQDN of the service type in the domain.
+// Only the .local domain is supported
+func avahiServiceType(svctype, domain string) (string, *dbus.Error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain != "" && !strings.EqualFold(domain, "local") {
+		return "", avahiError("NotSupportedError",
+			"Only .local domain is supported")
+	}
+
+	fqdn := dns.Fqdn(strings.TrimSuffix(svctype, ".") + ".local")
+	if _, ok := dns.IsDomainName(fqdn); !ok || svctype == "" {
+		return "", avahiError("InvalidServiceTypeError",
+			"Invalid service type")
+	}
+
+	return fqdn, nil
+}
+
+// avahiAddress returns the first address of the requested protocol
+func avahiAddress(addrs []string, aproto int32) string {
+	for _, addr := range addrs {
+		v4 := strings.Contains(addr, ".")
+		switch {
+		case aproto == avahiProtoInet && v4,
+			aproto == avahiProtoInet6 && !v4,
+			aproto != avahiProtoInet && aproto != avahiProtoInet6:
+			return addr
+		}
+	}
+
+	return ""
+}
+
+// avahiError creates the Avahi D-Bus error
+func avahiError(name, message string) *dbus.Error {
+	return dbus.NewError(avahiErrorPrefix+name, []interface{}{message})
+}
@@ -0,0 +1,153 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Malformed packets forensics
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// badPacketMeta is the metadata of the saved packet, written
+// next to it as JSON
+type badPacketMeta struct {
+	Time     time.Time `json:"time"`           // Arrival time
+	From     string    `json:"from"`           // Source address
+	IfIndex  int       `json:"ifindex"`        // Receiving interface
+	Dst      string    `json:"dst,omitempty"`  // Destination address
+	Size     int       `json:"size"`           // Packet size
+	Error    string    `json:"error"`          // Unpack error
+	Category string    `json:"category"`       // Error category
+	File     string    `json:"file,omitempty"` // The packet file
+}
+
+// Malformed packets state
+var (
+	badPacketsCounts = make(map[string]int) // Counts by category
+	badPacketsSaved  int                    // Count of saved packets
+	badPacketsLock   sync.Mutex             // Access lock
+)
+
+// BadPacketsOpen creates the OptKeepBadPackets directory, if it
+// doesn't exist yet
+func BadPacketsOpen() error {
+	err := os.MkdirAll(OptKeepBadPackets, 0755)
+	if err != nil {
+		return fileError{fmt.Errorf("--keep-bad-packets: %w", err)}
+	}
+
+	return nil
+}
+
+// badPacketInput handles the packet, that dns.Msg.Unpack has
+// failed to parse. It counts the error category and saves the
+// packet into the OptKeepBadPackets directory as .bin file, with
+// source metadata in the .json file of the same name
+//
+// Errors of saving are logged, but not fatal
+func badPacketInput(pkt []byte, meta SourceMeta, err error) {
+	now := time.Now()
+	category := badPacketCategory(err)
+
+	badPacketsLock.Lock()
+	badPacketsCounts[category]++
+	badPacketsLock.Unlock()
+
+	// Names are unique and sorted by arrival time
+	addr := strings.NewReplacer(":", "_", "%", "_").
+		Replace(meta.From.IP.String())
+	name := fmt.Sprintf("%s-%s-%d",
+		now.Format("20060102-150405.000000"), addr, meta.From.Port)
+	path := filepath.Join(OptKeepBadPackets, name)
+
+	md := badPacketMeta{
+		Time:     now,
+		From:     meta.From.String(),
+		IfIndex:  meta.IfIndex,
+		Size:     len(pkt),
+		Error:    err.Error(),
+		Category: category,
+		File:     name + ".bin",
+	}
+
+	if meta.Dst != nil {
+		md.Dst = meta.Dst.String()
+	}
+
+	data, _ := json.MarshalIndent(md, "", "  ")
+	data = append(data, '\n')
+
+	err = os.WriteFile(path+".bin", pkt, 0644)
+	if err == nil {
+		err = os.WriteFile(path+".json", data, 0644)
+	}
+
+	if err != nil {
+		LogError("--keep-bad-packets: %s", err)
+		return
+	}
+
+	LogDebug("Malformed packet from %s saved to %s.bin",
+		meta.From, path)
+
+	badPacketsLock.Lock()
+	badPacketsSaved++
+	badPacketsLock.Unlock()
+}
+
+// badPacketCategory returns the category of the Unpack error,
+// e.g., "overflow unpacking uint16"
+func badPacketCategory(err error) string {
+	return strings.TrimPrefix(err.Error(), "dns: ")
+}
+
+// BadPacketsPrint prints counts of malformed packets by error
+// category and count of saved packets into io.Writer
+//
+// The returned error, if any, comes from w.Write()
+func BadPacketsPrint(w io.Writer) error {
+	badPacketsLock.Lock()
+	categories := make([]string, 0, len(badPacketsCounts))
+	counts := make(map[string]int, len(badPacketsCounts))
+	total := 0
+	for category, count := range badPacketsCounts {
+		categories = append(categories, category)
+		counts[category] = count
+		total += count
+	}
+	saved := badPacketsSaved
+	badPacketsLock.Unlock()
+
+	sort.Slice(categories, func(i, j int) bool {
+		ci, cj := categories[i], categories[j]
+		if counts[ci] != counts[cj] {
+			return counts[ci] > counts[cj]
+		}
+		return ci < cj
+	})
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, ";; MALFORMED PACKETS: %d, %d saved to %s\n",
+		total, saved, OptKeepBadPackets)
+
+	for _, category := range categories {
+		fmt.Fprintf(&buf, ";; %6d  %s\n", counts[category], category)
+	}
+
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,219 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The bench command
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// benchTimeout is how long to wait for the answer to each query.
+// Queries, not answered in time, are considered lost
+const benchTimeout = time.Second
+
+// benchBuckets are upper bounds of the latency histogram buckets
+var benchBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	benchTimeout,
+}
+
+// benchPercentiles are the reported latency percentiles
+var benchPercentiles = []int{50, 90, 95, 99}
+
+// benchBarWidth is the width of the longest histogram bar
+const benchBarWidth = 40
+
+// BenchRun sends OptTxCount queries for the host name, specified
+// by the first of OptCommandArgs, to its responder and prints the
+// latency distribution and loss to w
+//
+// Queries are sequential: the next query is sent only after the
+// answer to the previous one is received or benchTimeout expires,
+// but not faster than OptRate queries per second. The target and
+// the queries are the same as of the stress baseline (see StressRun)
+//
+// Error is returned, if the test can't be started (see StressRun)
+func BenchRun(ctx context.Context, w io.Writer) error {
+	s, conn, target, wait, err := stressStart()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, ";; Benchmarking %s at %s, %d queries, "+
+		"up to %d queries/s\n",
+		s.question.Name, target, OptTxCount, OptRate)
+
+	s.lock.Lock()
+	s.pending = make(map[uint16]time.Time)
+	s.latency = nil
+	s.lock.Unlock()
+
+	ticker := time.NewTicker(time.Second / time.Duration(OptRate))
+	defer ticker.Stop()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	sent := 0
+
+loop:
+	for sent < OptTxCount {
+		q := &dns.Msg{}
+		q.Id = uint16(rnd.Intn(65536))
+		q.Question = []dns.Question{s.question}
+		buf, _ := q.Pack()
+
+		// Drop stale signal of the late answer
+		select {
+		case <-s.answered:
+		default:
+		}
+
+		s.lock.Lock()
+		s.pending[q.Id] = time.Now()
+		s.lock.Unlock()
+
+		err := conn.WriteTo(buf, target, 0)
+		if err != nil {
+			LogError("%s: %s", target, err)
+		}
+
+		// Wait for the answer. Answers, received after
+		// timeout, are not counted
+		timer := time.NewTimer(benchTimeout)
+		select {
+		case <-ctx.Done():
+		case <-s.answered:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		s.lock.Lock()
+		delete(s.pending, q.Id)
+		s.lock.Unlock()
+
+		if ctx.Err() != nil {
+			break loop
+		}
+
+		sent++
+
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+	}
+
+	conn.Close()
+	wait.Wait()
+
+	s.lock.Lock()
+	latency := s.latency
+	s.lock.Unlock()
+
+	benchPrint(w, sent, latency)
+
+	return nil
+}
+
+// benchPrint prints the loss, latency statistics and distribution
+func benchPrint(w io.Writer, sent int, latency []time.Duration) {
+	buf := bytes.Buffer{}
+
+	lost := sent - len(latency)
+	fmt.Fprintf(&buf, ";; %d sent, %d answered, %d lost (%.1f%%)\n",
+		sent, len(latency), lost,
+		100*float64(lost)/float64(stressMax(sent, 1)))
+
+	if len(latency) == 0 {
+		buf.WriteByte('\n')
+		w.Write(buf.Bytes())
+		return
+	}
+
+	sort.Slice(latency, func(i, j int) bool {
+		return latency[i] < latency[j]
+	})
+
+	// Min, average, max and standard deviation
+	var sum time.Duration
+	for _, l := range latency {
+		sum += l
+	}
+	avg := sum / time.Duration(len(latency))
+
+	var sq float64
+	for _, l := range latency {
+		d := float64(l - avg)
+		sq += d * d
+	}
+	stddev := time.Duration(math.Sqrt(sq / float64(len(latency))))
+
+	fmt.Fprintf(&buf, ";; latency min/avg/max/stddev %s/%s/%s/%s\n",
+		benchRound(latency[0]), benchRound(avg),
+		benchRound(latency[len(latency)-1]), benchRound(stddev))
+
+	// Percentiles, by the nearest-rank method
+	var names, values []string
+	for _, p := range benchPercentiles {
+		rank := (p*len(latency) + 99) / 100
+		names = append(names, fmt.Sprintf("p%d", p))
+		values = append(values, benchRound(latency[rank-1]).String())
+	}
+
+	fmt.Fprintf(&buf, ";; latency %s %s\n",
+		strings.Join(names, "/"), strings.Join(values, "/"))
+
+	// Histogram
+	counts := make([]int, len(benchBuckets))
+	for _, l := range latency {
+		i := sort.Search(len(benchBuckets), func(i int) bool {
+			return l <= benchBuckets[i]
+		})
+		if i == len(benchBuckets) {
+			i-- // Answers at the timeout boundary
+		}
+		counts[i]++
+	}
+
+	top := 0
+	for _, count := range counts {
+		top = stressMax(top, count)
+	}
+
+	buf.WriteString(";;\n;; LATENCY DISTRIBUTION:\n")
+	for i, bound := range benchBuckets {
+		bar := strings.Repeat("#", counts[i]*benchBarWidth/top)
+		line := fmt.Sprintf(";; <= %-6s %6d %s", bound, counts[i], bar)
+		buf.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+
+	buf.WriteByte('\n')
+	w.Write(buf.Bytes())
+}
+
+// benchRound rounds latency for printing
+func benchRound(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,162 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Browsing of all services on the network
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// BrowseAllRun discovers service types, browses and resolves
+// instances of all of them concurrently over the shared sockets
+// (see Daemon) and prints the report, grouped by service type,
+// into io.Writer. With OptFormat "table", the report is printed
+// as tables (see TablePrint). With OptGroupBy "host", the report
+// is grouped by host (see GroupPrint)
+//
+// If ctx is canceled, services, discovered so far, are printed
+func BrowseAllRun(ctx context.Context, w io.Writer) {
+	d, stop := browseStart()
+
+	// Discover service types
+	question := []dns.Question{{
+		Name:   announceServicesName,
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	}}
+
+	d.Exchange(ctx, question)
+
+	var types []string
+	seen := make(map[string]bool)
+	for _, rr := range d.Records(question) {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			svctype := strings.ToLower(ptr.Ptr)
+			if !seen[svctype] {
+				seen[svctype] = true
+				types = append(types, svctype)
+			}
+		}
+	}
+
+	sort.Strings(types)
+	LogDebug("Discovered %d service types", len(types))
+
+	browseTypes(ctx, d, types)
+
+	// Collect results before sockets are closed
+	records := d.Records(nil)
+	services := make(map[string][]DnssdService)
+	for _, svctype := range types {
+		services[svctype] = d.Services(svctype)
+	}
+
+	stop()
+
+	switch {
+	case OptFormat == "table":
+		TablePrint(w, records)
+	case OptGroupBy == "host":
+		GroupPrint(w, records)
+	default:
+		browseAllPrint(w, types, services)
+	}
+}
+
+// browseStart creates the Daemon and runs it, until the returned
+// stop function is called
+func browseStart() (d *Daemon, stop func()) {
+	d, err := DaemonNew()
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+
+	return d, func() {
+		cancel()
+		<-done
+	}
+}
+
+// browseTypes browses and resolves instances of the service types
+// (FQDNs) concurrently, and returns when all types are browsed or
+// ctx is canceled. Instances are available via d.Services
+func browseTypes(ctx context.Context, d *Daemon, types []string) {
+	var wait sync.WaitGroup
+	for _, svctype := range types {
+		wait.Add(1)
+		go func(svctype string) {
+			defer wait.Done()
+			d.Browse(ctx, svctype)
+		}(svctype)
+	}
+
+	wait.Wait()
+}
+
+// browseAllPrint prints the report of services, grouped by
+// service type
+func browseAllPrint(w io.Writer, types []string,
+	services map[string][]DnssdService) error {
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; SERVICES:\n")
+
+	instances := 0
+	for _, svctype := range types {
+		svcs := services[svctype]
+		sort.Slice(svcs, func(i, j int) bool {
+			return svcs[i].Instance < svcs[j].Instance
+		})
+
+		instances += len(svcs)
+
+		fmt.Fprintf(&buf, "\n;; %s (%d)\n", svctype, len(svcs))
+		for _, svc := range svcs {
+			fmt.Fprintf(&buf, "%s\n", svc.Instance)
+
+			if svc.Host != "" {
+				fmt.Fprintf(&buf, "    host: %s port %d\n",
+					svc.Host, svc.Port)
+			} else {
+				buf.WriteString("    host: (unresolved)\n")
+			}
+
+			if svc.Model != "" {
+				fmt.Fprintf(&buf, "    model: %s\n", svc.Model)
+			}
+
+			for _, addr := range svc.Addrs {
+				fmt.Fprintf(&buf, "    addr: %s\n", addr)
+			}
+
+			for _, txt := range svc.TXT {
+				fmt.Fprintf(&buf, "    txt:  %s\n", txt)
+			}
+		}
+	}
+
+	fmt.Fprintf(&buf, "\n;; %d service types, %d instances\n\n",
+		len(types), instances)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
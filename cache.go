@@ -0,0 +1,303 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Records cache
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheFlushDelay is the time, during which records are protected
+// from being flushed by the cache-flush records of the same RRset.
+// Flushed records and goodbye records expire after the same delay
+// (RFC 6762, sections 10.1 and 10.2)
+const cacheFlushDelay = time.Second
+
+// cacheRefreshPoints are fractions of the record's TTL, when
+// record needs to be refreshed by re-query (RFC 6762, section 5.2)
+var cacheRefreshPoints = []float64{0.80, 0.85, 0.90, 0.95}
+
+// Cache event types
+const (
+	CacheAdded   = '+' // Record appeared
+	CacheRemoved = '-' // Record expired or said goodbye
+	CacheChanged = '~' // Record replaced other records of its RRset
+)
+
+// CacheEvent represents change of the Cache contents
+type CacheEvent struct {
+	Type byte       // Event type
+	RR   dns.RR     // The record
+	Meta SourceMeta // Where the record was received from
+}
+
+// Name returns the event type name: "added", "removed" or "changed"
+func (ev CacheEvent) Name() string {
+	switch ev.Type {
+	case CacheAdded:
+		return "added"
+	case CacheRemoved:
+		return "removed"
+	case CacheChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// Cache is the MDNS records cache. It honors records' TTLs,
+// goodbye records and the cache-flush bit (RFC 6762, section 10)
+//
+// Cache is not safe for concurrent use
+type Cache struct {
+	entries map[string]*cacheEntry // Entries by key
+	rnd     *rand.Rand             // Refresh points randomization
+}
+
+// cacheEntry represents a single Cache entry
+type cacheEntry struct {
+	rr       dns.RR      // The record
+	meta     SourceMeta  // Where the record was received from
+	updated  time.Time   // Last time received
+	expires  time.Time   // Expiration time
+	refresh  []time.Time // Pending refresh points
+	replaced bool        // Removed by the cache-flush record
+}
+
+// CacheNew creates a new Cache
+func CacheNew() *Cache {
+	return &Cache{
+		entries: make(map[string]*cacheEntry),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Input handles received record and returns resulting events
+//
+// The record's class may have the cache-flush bit set. The record
+// is owned by the cache after the call. The meta tells where the
+// record was received from, and is reported with its events
+//
+// Records of class ANY are meaningless in responses and ignored
+func (c *Cache) Input(rr dns.RR, meta SourceMeta,
+	now time.Time) []CacheEvent {
+
+	hdr := rr.Header()
+	flush := hdr.Class&(1<<15) != 0
+	hdr.Class &^= 1 << 15
+
+	if hdr.Class == dns.ClassANY {
+		return nil
+	}
+
+	key := dedupKey(rr)
+	ent := c.entries[key]
+
+	if hdr.Ttl == 0 {
+		// Goodbye record. It will expire in one second
+		if ent != nil && !ent.replaced {
+			ent.expires = now.Add(cacheFlushDelay)
+			ent.refresh = nil
+		}
+		return nil
+	}
+
+	var events []CacheEvent
+
+	// Handle cache-flush bit
+	replaced := false
+	if flush {
+		for _, k := range c.keys(func(ent *cacheEntry) bool {
+			h := ent.rr.Header()
+			return !ent.replaced &&
+				h.Rrtype == hdr.Rrtype && h.Class == hdr.Class &&
+				strings.EqualFold(h.Name, hdr.Name) &&
+				now.Sub(ent.updated) >= cacheFlushDelay
+		}) {
+			if k == key {
+				continue
+			}
+
+			old := c.entries[k]
+			old.expires = now.Add(cacheFlushDelay)
+			old.refresh = nil
+
+			// If record is new, it replaces the old
+			// record. Otherwise, old record disappears
+			if ent == nil || ent.replaced {
+				old.replaced = true
+				replaced = true
+			}
+		}
+	}
+
+	// Add or update the entry
+	if ent == nil || ent.replaced {
+		ent = &cacheEntry{}
+		c.entries[key] = ent
+
+		if replaced {
+			events = append(events,
+				CacheEvent{CacheChanged, rr, meta})
+		} else {
+			events = append(events,
+				CacheEvent{CacheAdded, rr, meta})
+		}
+	}
+
+	ent.rr = rr
+	ent.meta = meta
+	ent.updated = now
+	ent.expires = now.Add(time.Duration(hdr.Ttl) * time.Second)
+
+	ent.refresh = ent.refresh[:0]
+	for _, point := range cacheRefreshPoints {
+		// Add random variation of 2% of the TTL
+		point += c.rnd.Float64() * 0.02
+		at := float64(hdr.Ttl) * point * float64(time.Second)
+		ent.refresh = append(ent.refresh, now.Add(time.Duration(at)))
+	}
+
+	return events
+}
+
+// Remove immediately removes all records of the name and type
+// (of all types, if rrtype is dns.TypeANY) and returns resulting
+// events. It implements the DNS Push removal of the RRset or name
+// (RFC 8765, section 6.3.1)
+func (c *Cache) Remove(name string, rrtype uint16) []CacheEvent {
+	var events []CacheEvent
+
+	for _, k := range c.keys(func(ent *cacheEntry) bool {
+		hdr := ent.rr.Header()
+		return strings.EqualFold(hdr.Name, name) &&
+			(rrtype == dns.TypeANY || rrtype == hdr.Rrtype)
+	}) {
+		ent := c.entries[k]
+		if !ent.replaced {
+			events = append(events,
+				CacheEvent{CacheRemoved, ent.rr, ent.meta})
+		}
+		delete(c.entries, k)
+	}
+
+	return events
+}
+
+// Expire removes expired records and returns resulting events.
+// Records, replaced by cache-flush records, are removed silently
+func (c *Cache) Expire(now time.Time) []CacheEvent {
+	var events []CacheEvent
+
+	for _, k := range c.keys(func(ent *cacheEntry) bool {
+		return !now.Before(ent.expires)
+	}) {
+		ent := c.entries[k]
+		if !ent.replaced {
+			events = append(events,
+				CacheEvent{CacheRemoved, ent.rr, ent.meta})
+		}
+		delete(c.entries, k)
+	}
+
+	return events
+}
+
+// NeedRefresh tells if some records, that match the question,
+// have reached their refresh points, so re-query is needed
+func (c *Cache) NeedRefresh(question []dns.Question, now time.Time) bool {
+	need := false
+
+	for _, ent := range c.entries {
+		if len(ent.refresh) == 0 || now.Before(ent.refresh[0]) {
+			continue
+		}
+
+		for len(ent.refresh) > 0 && !now.Before(ent.refresh[0]) {
+			ent.refresh = ent.refresh[1:]
+		}
+
+		if responseMatches(ent.rr, question) {
+			need = true
+		}
+	}
+
+	return need
+}
+
+// Records returns all alive records, sorted by name, type
+// and data. TTLs are adjusted to the remaining lifetime
+func (c *Cache) Records(now time.Time) []dns.RR {
+	var out []dns.RR
+	for _, ev := range c.Contents(now) {
+		out = append(out, ev.RR)
+	}
+
+	return out
+}
+
+// Contents returns the CacheAdded events for all alive records,
+// in the same order and with the same TTL adjustment, as Records
+func (c *Cache) Contents(now time.Time) []CacheEvent {
+	var events []CacheEvent
+
+	for _, k := range c.keys(func(ent *cacheEntry) bool {
+		return !ent.replaced && now.Before(ent.expires)
+	}) {
+		ent := c.entries[k]
+		rr := dns.Copy(ent.rr)
+		rr.Header().Ttl = uint32(ent.expires.Sub(now) / time.Second)
+		events = append(events, CacheEvent{CacheAdded, rr, ent.meta})
+	}
+
+	return events
+}
+
+// Source returns where the most recently received alive record
+// of the given name and type was received from
+func (c *Cache) Source(name string, rrtype uint16,
+	now time.Time) (SourceMeta, bool) {
+
+	var found *cacheEntry
+	for _, ent := range c.entries {
+		hdr := ent.rr.Header()
+		if !ent.replaced && now.Before(ent.expires) &&
+			hdr.Rrtype == rrtype &&
+			strings.EqualFold(hdr.Name, name) &&
+			(found == nil || ent.updated.After(found.updated)) {
+			found = ent
+		}
+	}
+
+	if found == nil {
+		return SourceMeta{}, false
+	}
+
+	return found.meta, true
+}
+
+// Len returns number of records in the cache
+func (c *Cache) Len() int {
+	return len(c.entries)
+}
+
+// keys returns sorted keys of entries that match the filter
+func (c *Cache) keys(filter func(ent *cacheEntry) bool) []string {
+	var keys []string
+	for k, ent := range c.entries {
+		if filter(ent) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,289 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Records cache tests
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheTestStep is the single step of the Cache test
+type cacheTestStep struct {
+	at     time.Duration // Time since the test start
+	op     string        // "input", "expire", "remove" or "records"
+	arg    string        // Record to input or name and type to remove
+	expect []string      // Expected events or records
+}
+
+// cacheTestRun runs steps of the Cache test. Records to input are
+// in the zone file format, with the "!" prefix for the cache-flush
+// bit. Events are formatted by cacheTestString, with the event type
+// prefix
+func cacheTestRun(t *testing.T, steps []cacheTestStep) {
+	c := CacheNew()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, step := range steps {
+		now := start.Add(step.at)
+
+		var present []string
+		switch step.op {
+		case "input":
+			rsp := queryTestResponse(t, []string{step.arg}, nil)
+			events := c.Input(rsp.Answer[0], SourceMeta{}, now)
+			present = cacheTestEvents(events)
+
+		case "expire":
+			present = cacheTestEvents(c.Expire(now))
+
+		case "remove":
+			fields := strings.Fields(step.arg)
+			rrtype := dns.StringToType[fields[1]]
+			present = cacheTestEvents(c.Remove(fields[0], rrtype))
+
+		case "records":
+			for _, rr := range c.Records(now) {
+				present = append(present, cacheTestString(rr))
+			}
+
+		default:
+			t.Fatalf("step %d: unknown op %q", i, step.op)
+		}
+
+		if fmt.Sprint(present) != fmt.Sprint(step.expect) {
+			t.Errorf("step %d (%s %s at %s):\n"+
+				"expected: %q\npresent:  %q",
+				i, step.op, step.arg, step.at,
+				step.expect, present)
+		}
+	}
+}
+
+// cacheTestEvents formats events for comparison
+func cacheTestEvents(events []CacheEvent) []string {
+	var out []string
+	for _, ev := range events {
+		out = append(out, string(ev.Type)+" "+cacheTestString(ev.RR))
+	}
+	return out
+}
+
+// cacheTestString formats the record for comparison, as name,
+// type and data, without TTL and class
+func cacheTestString(rr dns.RR) string {
+	hdr := rr.Header()
+	data := strings.TrimPrefix(rr.String(), hdr.String())
+	return hdr.Name + " " + dns.TypeToString[hdr.Rrtype] + " " + data
+}
+
+// TestCacheExpire tests expiration of records by TTL
+func TestCacheExpire(t *testing.T) {
+	cacheTestRun(t, []cacheTestStep{
+		{0, "input", "a.local. 10 IN A 169.254.0.1",
+			[]string{"+ a.local. A 169.254.0.1"}},
+		{0, "input", "b.local. 20 IN A 169.254.0.2",
+			[]string{"+ b.local. A 169.254.0.2"}},
+
+		// Repeated record doesn't generate events, but
+		// extends the lifetime
+		{5 * time.Second, "input", "a.local. 10 IN A 169.254.0.1",
+			nil},
+		{10 * time.Second, "expire", "", nil},
+		{10 * time.Second, "records", "", []string{
+			"a.local. A 169.254.0.1",
+			"b.local. A 169.254.0.2",
+		}},
+
+		{15 * time.Second, "expire", "",
+			[]string{"- a.local. A 169.254.0.1"}},
+		{19 * time.Second, "expire", "", nil},
+		{20 * time.Second, "expire", "",
+			[]string{"- b.local. A 169.254.0.2"}},
+		{20 * time.Second, "records", "", nil},
+	})
+}
+
+// TestCacheFlush tests replacement of records by the cache-flush
+// records, with the one second protection of recently received
+// records (RFC 6762, section 10.2)
+func TestCacheFlush(t *testing.T) {
+	cacheTestRun(t, []cacheTestStep{
+		{0, "input", "!a.local. 120 IN A 169.254.0.1",
+			[]string{"+ a.local. A 169.254.0.1"}},
+
+		// Received within one second, so both are kept
+		{500 * time.Millisecond, "input",
+			"!a.local. 120 IN A 169.254.0.2",
+			[]string{"+ a.local. A 169.254.0.2"}},
+
+		// Both are flushed by the new record
+		{2 * time.Second, "input", "!a.local. 120 IN A 169.254.0.3",
+			[]string{"~ a.local. A 169.254.0.3"}},
+		{2 * time.Second, "records", "", []string{
+			"a.local. A 169.254.0.3",
+		}},
+
+		// Replaced records expire silently one second later
+		{2500 * time.Millisecond, "expire", "", nil},
+		{3 * time.Second, "expire", "", nil},
+
+		// Records without the cache-flush bit flush nothing
+		{3 * time.Second, "input", "a.local. 120 IN A 169.254.0.4",
+			[]string{"+ a.local. A 169.254.0.4"}},
+
+		// Record, flushed by the repeated record of the same
+		// RRset, disappears one second later
+		{5 * time.Second, "input", "!a.local. 120 IN A 169.254.0.3",
+			nil},
+		{5500 * time.Millisecond, "expire", "", nil},
+		{6 * time.Second, "expire", "",
+			[]string{"- a.local. A 169.254.0.4"}},
+		{6 * time.Second, "records", "", []string{
+			"a.local. A 169.254.0.3",
+		}},
+
+		// Records of other RRsets are not flushed
+		{6 * time.Second, "input", "!a.local. 120 IN AAAA fe80::1",
+			[]string{"+ a.local. AAAA fe80::1"}},
+		{8 * time.Second, "expire", "", nil},
+		{8 * time.Second, "records", "", []string{
+			"a.local. A 169.254.0.3",
+			"a.local. AAAA fe80::1",
+		}},
+	})
+}
+
+// TestCacheGoodbye tests goodbye records, that remove records
+// after one second (RFC 6762, section 10.1)
+func TestCacheGoodbye(t *testing.T) {
+	cacheTestRun(t, []cacheTestStep{
+		{0, "input",
+			"_http._tcp.local. 4500 IN PTR A._http._tcp.local.",
+			[]string{
+				"+ _http._tcp.local. PTR A._http._tcp.local.",
+			}},
+		{5 * time.Second, "input",
+			"_http._tcp.local. 0 IN PTR A._http._tcp.local.", nil},
+		{5500 * time.Millisecond, "expire", "", nil},
+		{6 * time.Second, "expire", "", []string{
+			"- _http._tcp.local. PTR A._http._tcp.local.",
+		}},
+
+		// Goodbye of unknown record is ignored
+		{7 * time.Second, "input",
+			"_http._tcp.local. 0 IN PTR B._http._tcp.local.", nil},
+		{7 * time.Second, "records", "", nil},
+	})
+}
+
+// TestCacheClassANY tests that records of class ANY are ignored
+// by Input, and the DNS Push removal by Remove
+func TestCacheClassANY(t *testing.T) {
+	cacheTestRun(t, []cacheTestStep{
+		{0, "input", "a.local. 120 IN A 169.254.0.1",
+			[]string{"+ a.local. A 169.254.0.1"}},
+		{0, "input", "a.local. 120 IN A 169.254.0.2",
+			[]string{"+ a.local. A 169.254.0.2"}},
+		{0, "input", "a.local. 120 IN TXT \"x\"",
+			[]string{"+ a.local. TXT \"x\""}},
+		{0, "input", "b.local. 120 IN A 169.254.0.3",
+			[]string{"+ b.local. A 169.254.0.3"}},
+
+		// Multicast records of class ANY change nothing
+		{time.Second, "input", "a.local. 0 CLASS255 A 0.0.0.0", nil},
+		{time.Second, "input", "!a.local. 120 CLASS255 A 169.254.0.3",
+			nil},
+		{time.Second, "records", "", []string{
+			"a.local. A 169.254.0.1",
+			"a.local. A 169.254.0.2",
+			"a.local. TXT \"x\"",
+			"b.local. A 169.254.0.3",
+		}},
+
+		// Removal of RRset and of all RRsets of the name
+		{2 * time.Second, "remove", "A.LOCAL. A", []string{
+			"- a.local. A 169.254.0.1",
+			"- a.local. A 169.254.0.2",
+		}},
+		{2 * time.Second, "remove", "a.local. ANY", []string{
+			"- a.local. TXT \"x\"",
+		}},
+		{2 * time.Second, "remove", "a.local. ANY", nil},
+		{2 * time.Second, "records", "", []string{
+			"b.local. A 169.254.0.3",
+		}},
+	})
+}
+
+// TestCacheRefresh tests refresh points of records near expiration
+// (RFC 6762, section 5.2)
+func TestCacheRefresh(t *testing.T) {
+	question := []dns.Question{{
+		Name:   "a.local.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}
+
+	other := []dns.Question{{
+		Name:   "b.local.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}
+
+	tests := []struct {
+		at       time.Duration  // Time since the test start
+		question []dns.Question // The question
+		expected bool           // Expected NeedRefresh result
+	}{
+		{79 * time.Second, question, false},
+
+		// Refresh points are consumed, even if records
+		// don't answer the question
+		{83 * time.Second, other, false},
+		{84 * time.Second, question, false},
+
+		{88 * time.Second, question, true},
+		{88 * time.Second, question, false},
+		{93 * time.Second, question, true},
+		{98 * time.Second, question, true},
+		{99 * time.Second, question, false},
+	}
+
+	c := CacheNew()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	rsp := queryTestResponse(t, []string{"!a.local. 100 IN A 169.254.0.1"},
+		nil)
+	c.Input(rsp.Answer[0], SourceMeta{}, start)
+
+	for _, test := range tests {
+		need := c.NeedRefresh(test.question, start.Add(test.at))
+		if need != test.expected {
+			t.Errorf("%s, %s: NeedRefresh is %v, expected %v",
+				test.at, test.question[0].Name, need,
+				test.expected)
+		}
+	}
+
+	// Goodbye cancels refresh
+	rsp = queryTestResponse(t, []string{"!a.local. 100 IN A 169.254.0.2"},
+		nil)
+	c.Input(rsp.Answer[0], SourceMeta{}, start)
+
+	rsp = queryTestResponse(t, []string{"a.local. 0 IN A 169.254.0.2"},
+		nil)
+	c.Input(rsp.Answer[0], SourceMeta{}, start.Add(time.Second))
+
+	if c.NeedRefresh(question, start.Add(99*time.Second)) {
+		t.Errorf("NeedRefresh after goodbye is true, expected false")
+	}
+}
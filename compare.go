@@ -0,0 +1,160 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Comparison of results across interfaces
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Comparison state
+var (
+	compareIfaces  []int                           // Selected ifindexes
+	compareRecords = make(map[string]dns.RR)       // Records by key
+	compareSeen    = make(map[string]map[int]bool) // Ifindexes by key
+	compareLock    sync.Mutex                      // Access lock
+)
+
+// compareSetIfaces sets interfaces, the query is sent to, so
+// interfaces without any responses are compared as well
+func compareSetIfaces(if4, if6 []net.Interface) {
+	compareLock.Lock()
+	defer compareLock.Unlock()
+
+	have := make(map[int]bool)
+	for _, iface := range append(append([]net.Interface(nil),
+		if4...), if6...) {
+		if !have[iface.Index] {
+			have[iface.Index] = true
+			compareIfaces = append(compareIfaces, iface.Index)
+		}
+	}
+}
+
+// compareInput records, which records were received via the
+// interface of the response
+func compareInput(msg *dns.Msg, meta SourceMeta) {
+	compareLock.Lock()
+	defer compareLock.Unlock()
+
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.OPT); ok {
+				continue
+			}
+
+			// Ignore the cache-flush bit
+			rr = dns.Copy(rr)
+			rr.Header().Class &^= 1 << 15
+
+			key := dedupKey(rr)
+			if compareSeen[key] == nil {
+				compareSeen[key] = make(map[int]bool)
+			}
+
+			compareRecords[key] = rr
+			compareSeen[key][meta.IfIndex] = true
+		}
+	}
+}
+
+// CompareIfacesPrint prints records, that were not received via
+// all the interfaces, marking interfaces where each of them was
+// visible (+) or not (-), into io.Writer
+//
+// Records, visible everywhere, are only counted, so filtering
+// of multicast on some segment is evident from the output
+//
+// The returned error, if any, comes from w.Write()
+func CompareIfacesPrint(w io.Writer) error {
+	compareLock.Lock()
+	defer compareLock.Unlock()
+
+	// Interfaces: selected ones and ones, responses actually
+	// came from (e.g., ifindex 0 in degraded mode)
+	ifaces := append([]int(nil), compareIfaces...)
+	have := make(map[int]bool)
+	for _, ifindex := range ifaces {
+		have[ifindex] = true
+	}
+
+	for _, seen := range compareSeen {
+		for ifindex := range seen {
+			if !have[ifindex] {
+				have[ifindex] = true
+				ifaces = append(ifaces, ifindex)
+			}
+		}
+	}
+
+	names := make([]string, len(ifaces))
+	for i, ifindex := range ifaces {
+		names[i] = compareIfName(ifindex)
+	}
+
+	// Split records into common and differing
+	var keys []string
+	common := 0
+	for key, seen := range compareSeen {
+		if len(seen) == len(ifaces) {
+			common++
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, ";; INTERFACE COMPARISON: %s\n",
+		strings.Join(names, ", "))
+	fmt.Fprintf(&buf, ";; %d records visible on all interfaces, "+
+		"%d differ\n", common, len(keys))
+
+	if len(keys) != 0 {
+		buf.WriteString(";;\n;; " + strings.Join(names, " ") + "\n")
+	}
+
+	for _, key := range keys {
+		marks := make([]string, len(ifaces))
+		for i, ifindex := range ifaces {
+			mark := "-"
+			if compareSeen[key][ifindex] {
+				mark = "+"
+			}
+
+			marks[i] = fmt.Sprintf("%-*s", len(names[i]), mark)
+		}
+
+		fmt.Fprintf(&buf, "   %s %s\n", strings.Join(marks, " "),
+			compareRecords[key])
+	}
+
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// compareIfName returns name of the interface by index
+func compareIfName(ifindex int) string {
+	if iface, err := net.InterfaceByIndex(ifindex); err == nil {
+		return iface.Name
+	}
+	if ifindex == 0 {
+		return "(unknown)"
+	}
+	return "#" + strconv.Itoa(ifindex)
+}
@@ -0,0 +1,421 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The conformance command
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// conformanceWait specifies how long to wait for responses
+// to each of test queries
+const conformanceWait = time.Second
+
+// conformanceRsp is the response, received from the target
+type conformanceRsp struct {
+	msg  *dns.Msg   // The message
+	meta SourceMeta // Message source
+}
+
+// conformance contains the conformance test state
+type conformance struct {
+	ctx     context.Context     // Test context
+	host    string              // Target host name
+	target  net.IP              // Target address, once known
+	links   []queryLink         // MDNS socket/interface pairs
+	legacy  *Conn               // Socket for legacy queries
+	rsps    chan conformanceRsp // Received messages
+	w       io.Writer           // Report goes here
+	failed  int                 // Count of failed checks
+	checked int                 // Count of all checks
+	lock    sync.Mutex          // Access lock
+}
+
+// ConformanceRun tests the responder of the host name, specified
+// by the first of OptCommandArgs, for conformance with RFC 6762,
+// and prints report to w
+//
+// It returns true, if all checks passed. Error is returned, if
+// the test can't be performed at all (e.g., no usable interfaces)
+func ConformanceRun(ctx context.Context, w io.Writer) (bool, error) {
+	host, err := QueryFqdn(OptCommandArgs[0])
+	if err != nil {
+		return false, err
+	}
+
+	c := &conformance{
+		ctx:  ctx,
+		host: host,
+		rsps: make(chan conformanceRsp, 256),
+		w:    w,
+	}
+
+	// Create sockets and start receivers
+	_, if4, if6, err := IfAddrs()
+	if err != nil {
+		return false, err
+	}
+
+	conns4, links4 := queryOpen("udp4", queryMcast4, if4)
+	conns6, links6 := queryOpen("udp6", queryMcast6, if6)
+
+	conns := append(conns4, conns6...)
+	c.links = append(links4, links6...)
+
+	if len(c.links) == 0 {
+		return false, errQueryNoInterfaces
+	}
+
+	var wait sync.WaitGroup
+
+	accept := func(meta SourceMeta) bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.target == nil || c.target.Equal(meta.From.IP)
+	}
+
+	for _, conn := range conns {
+		wait.Add(1)
+		go queryRecv(conn, accept, c.input, &wait)
+	}
+
+	// Run the tests
+	fmt.Fprintf(w, ";; Testing responder of %s\n", c.host)
+
+	qtype := dns.TypeA
+	if !Opt4 {
+		qtype = dns.TypeAAAA
+	}
+
+	if c.testResolve(qtype) {
+		network := "udp6"
+		if c.target.To4() != nil {
+			network = "udp4"
+		}
+
+		c.legacy, err = queryListen(network, QueryUnicastAddr(), "")
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			wait.Wait()
+			return false, querySocketError{err}
+		}
+
+		wait.Add(1)
+		go queryRecv(c.legacy, accept, c.input, &wait)
+
+		c.testQU(qtype)
+		c.testKnownAnswer(qtype)
+		c.testNSEC()
+		c.testLegacy(qtype)
+
+		c.legacy.Close()
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	wait.Wait()
+
+	fmt.Fprintf(w, ";; %d checks, %d passed, %d failed\n",
+		c.checked, c.checked-c.failed, c.failed)
+
+	return c.failed == 0, nil
+}
+
+// input handles received message
+func (c *conformance) input(msg *dns.Msg, meta SourceMeta) {
+	if !msg.Response {
+		return
+	}
+
+	select {
+	case c.rsps <- conformanceRsp{msg.Copy(), meta}:
+	default:
+	}
+}
+
+// check reports the check result. If failure is not empty,
+// the check is failed
+func (c *conformance) check(name, failure string) bool {
+	c.checked++
+	if failure != "" {
+		c.failed++
+		fmt.Fprintf(c.w, "FAIL  %s: %s\n", name, failure)
+		return false
+	}
+
+	fmt.Fprintf(c.w, "PASS  %s\n", name)
+	return true
+}
+
+// exchange sends the query and returns responses, received within
+// the conformanceWait. Legacy queries are sent from the ephemeral
+// port (or OptSourcePort), other queries are sent from the port 5353
+func (c *conformance) exchange(q *dns.Msg, legacy bool) []conformanceRsp {
+	// Drop stale responses
+	for len(c.rsps) > 0 {
+		<-c.rsps
+	}
+
+	buf, err := q.Pack()
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	if legacy {
+		for _, link := range c.links {
+			if link.conn.Is4() != c.legacy.Is4() {
+				continue
+			}
+
+			group := queryMcast6
+			if link.conn.Is4() {
+				group = queryMcast4
+			}
+
+			c.legacy.WriteTo(buf, group, link.iface.Index)
+		}
+	} else {
+		querySend(c.links, buf)
+	}
+
+	// Collect responses
+	var out []conformanceRsp
+
+	timer := time.NewTimer(conformanceWait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return out
+		case <-timer.C:
+			return out
+		case rsp := <-c.rsps:
+			out = append(out, rsp)
+		}
+	}
+}
+
+// query creates the query message
+func (c *conformance) query(qtype uint16, qu bool) *dns.Msg {
+	q := &dns.Msg{}
+	q.Question = []dns.Question{{Name: c.host, Qtype: qtype,
+		Qclass: dns.ClassINET}}
+
+	if qu {
+		q.Question[0].Qclass |= responderCacheFlush
+	}
+
+	return q
+}
+
+// answers returns answers from the responses that match the question
+func (c *conformance) answers(rsps []conformanceRsp,
+	qtype uint16) []dns.RR {
+
+	var out []dns.RR
+	for _, rsp := range rsps {
+		for _, rr := range rsp.msg.Answer {
+			hdr := rr.Header()
+			if hdr.Rrtype == qtype && strings.EqualFold(hdr.Name, c.host) {
+				out = append(out, rr)
+			}
+		}
+	}
+	return out
+}
+
+// answered returns responses that contain answers to the question
+func (c *conformance) answered(rsps []conformanceRsp,
+	qtype uint16) []conformanceRsp {
+
+	var out []conformanceRsp
+	for _, rsp := range rsps {
+		if len(c.answers([]conformanceRsp{rsp}, qtype)) != 0 {
+			out = append(out, rsp)
+		}
+	}
+	return out
+}
+
+// testResolve resolves the host name and checks basic response
+// properties: source port, TTL (RFC 6762, section 10) and the
+// cache-flush bit (section 10.2)
+func (c *conformance) testResolve(qtype uint16) bool {
+	rsps := c.answered(c.exchange(c.query(qtype, false), false), qtype)
+	answers := c.answers(rsps, qtype)
+
+	failure := ""
+	if len(answers) == 0 {
+		failure = "no answer"
+	}
+
+	if !c.check("host name resolves", failure) {
+		return false
+	}
+
+	c.lock.Lock()
+	c.target = rsps[0].meta.From.IP
+	c.lock.Unlock()
+
+	fmt.Fprintf(c.w, ";; Responder address: %s\n", c.target)
+
+	failure = ""
+	if port := rsps[0].meta.From.Port; port != mdnsPort {
+		failure = fmt.Sprintf("source port is %d", port)
+	}
+	c.check("response source port is 5353", failure)
+
+	failure = ""
+	if rsps[0].msg.Id != 0 {
+		failure = fmt.Sprintf("ID is %d", rsps[0].msg.Id)
+	}
+	c.check("multicast response ID is zero", failure)
+
+	failure = ""
+	if ttl := answers[0].Header().Ttl; ttl != announceHostTTL {
+		failure = fmt.Sprintf("TTL is %d, recommended is %d",
+			ttl, announceHostTTL)
+	}
+	c.check("host record TTL", failure)
+
+	failure = ""
+	if answers[0].Header().Class&responderCacheFlush == 0 {
+		failure = "cache-flush bit not set"
+	}
+	c.check("cache-flush bit on unique record", failure)
+
+	return true
+}
+
+// testQU checks that "QU" query is answered via unicast
+// (RFC 6762, section 5.4)
+func (c *conformance) testQU(qtype uint16) {
+	rsps := c.answered(c.exchange(c.query(qtype, true), false), qtype)
+
+	failure := "no answer"
+	for _, rsp := range rsps {
+		switch {
+		case rsp.meta.Dst == nil:
+			failure = "destination address unknown"
+		case rsp.meta.Dst.IsMulticast():
+			failure = "answered via multicast"
+		default:
+			failure = ""
+		}
+
+		if failure == "" {
+			break
+		}
+	}
+
+	c.check("QU query answered via unicast", failure)
+}
+
+// testKnownAnswer checks that known answers are suppressed
+// (RFC 6762, section 7.1)
+func (c *conformance) testKnownAnswer(qtype uint16) {
+	known := c.answers(c.exchange(c.query(qtype, false), false), qtype)
+	if len(known) == 0 {
+		c.check("known-answer suppression", "no answer")
+		return
+	}
+
+	q := c.query(qtype, false)
+	for _, rr := range known {
+		rr = dns.Copy(rr)
+		rr.Header().Class &^= responderCacheFlush
+		q.Answer = append(q.Answer, rr)
+	}
+
+	failure := ""
+	if len(c.answers(c.exchange(q, false), qtype)) != 0 {
+		failure = "known answer repeated"
+	}
+
+	c.check("known-answer suppression", failure)
+}
+
+// testNSEC checks that query for non-existent record type of
+// the host name is answered with NSEC record (RFC 6762, section 6.1)
+func (c *conformance) testNSEC() {
+	rsps := c.exchange(c.query(dns.TypeHINFO, false), false)
+
+	failure := "no NSEC record"
+	for _, rsp := range rsps {
+		for _, rr := range append(rsp.msg.Answer, rsp.msg.Extra...) {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok || !strings.EqualFold(nsec.Hdr.Name, c.host) {
+				continue
+			}
+
+			failure = ""
+			for _, t := range nsec.TypeBitMap {
+				if t == dns.TypeHINFO {
+					failure = "NSEC claims HINFO exists"
+				}
+			}
+		}
+	}
+
+	if len(c.answers(rsps, dns.TypeHINFO)) != 0 {
+		failure = ""
+	}
+
+	c.check("negative response (NSEC)", failure)
+}
+
+// testLegacy checks handling of legacy unicast queries
+// (RFC 6762, section 6.7)
+func (c *conformance) testLegacy(qtype uint16) {
+	q := c.query(qtype, false)
+	q.Id = dns.Id()
+
+	rsps := c.answered(c.exchange(q, true), qtype)
+	answers := c.answers(rsps, qtype)
+
+	failure := ""
+	switch {
+	case len(answers) == 0:
+		failure = "no answer"
+	case rsps[0].meta.Dst != nil && rsps[0].meta.Dst.IsMulticast():
+		failure = "answered via multicast"
+	case rsps[0].msg.Id != q.Id:
+		failure = fmt.Sprintf("ID is %d, expected %d",
+			rsps[0].msg.Id, q.Id)
+	case len(rsps[0].msg.Question) != 1:
+		failure = "question not repeated"
+	}
+
+	if !c.check("legacy query answered", failure) {
+		return
+	}
+
+	failure = ""
+	if ttl := answers[0].Header().Ttl; ttl > responderLegacyTTL {
+		failure = fmt.Sprintf("TTL is %d", ttl)
+	}
+	c.check("legacy response TTL at most 10", failure)
+
+	failure = ""
+	if answers[0].Header().Class&responderCacheFlush != 0 {
+		failure = "cache-flush bit set"
+	}
+	c.check("legacy response without cache-flush bit", failure)
+}
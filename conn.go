@@ -0,0 +1,333 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// MDNS connections
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Conn wraps UDP connection, used for MDNS, and provides
+// access to the per-family socket options and packet
+// information (pktinfo) via golang.org/x/net
+type Conn struct {
+	udp  *net.UDPConn     // Underlying UDP connection
+	p4   *ipv4.PacketConn // Non-nil for IPv4 connection
+	p6   *ipv6.PacketConn // Non-nil for IPv6 connection
+	lock sync.Mutex       // Serializes writes without pktinfo
+	ovfl bool             // SO_RXQ_OVFL enabled
+	drop uint32           // Last known count of dropped packets
+	oob  []byte           // Control messages buffer, for readMsg
+}
+
+// connDrops is the total count of packets, dropped by the kernel
+// due to the receive queue overflow of all connections
+var connDrops uint64
+
+// SourceMeta contains metadata of the received packet
+type SourceMeta struct {
+	From    *net.UDPAddr // Source address
+	IfIndex int          // Receiving interface index, 0 if unknown
+	Dst     net.IP       // Destination address, nil if unknown
+	Size    int          // Packet size, set by queryRecv
+}
+
+// Transport sends and receives MDNS datagrams with their metadata
+//
+// Conn implements it over UDP sockets. Other implementations
+// may inject synthetic traffic (e.g., for testing without real
+// multicast) or run MDNS over unusual transports, like userspace
+// network stacks (see TransportOpen)
+type Transport interface {
+	// Is4 tells if transport is IPv4
+	Is4() bool
+
+	// JoinGroup joins the multicast group on the interface
+	JoinGroup(iface *net.Interface, group *net.UDPAddr) error
+
+	// LeaveGroup leaves the multicast group on the interface
+	LeaveGroup(iface *net.Interface, group *net.UDPAddr) error
+
+	// ReadFrom receives the next datagram and its metadata.
+	// After Close, it must return error, matching net.ErrClosed
+	ReadFrom(buf []byte) (n int, meta SourceMeta, err error)
+
+	// WriteTo sends the datagram to the destination via the
+	// interface. If ifindex is 0, the interface is not specified
+	WriteTo(buf []byte, to *net.UDPAddr, ifindex int) error
+
+	// Close closes the transport
+	Close() error
+}
+
+// ConnNew wraps UDP connection into the Conn
+//
+// The RFC 6762, section 11, requires TTL (hop limit) to be set
+// to 255, so it is set here for both unicast and multicast packets.
+// Reception of the packet information is enabled as well, if
+// supported on this platform (see SockPktInfoSupported), and
+// multicast loopback is set according to OptMcastLoop
+func ConnNew(udp *net.UDPConn) (*Conn, error) {
+	c := &Conn{udp: udp}
+	var err error
+
+	if AddrIs4UDP(udp.LocalAddr().(*net.UDPAddr)) {
+		c.p4 = ipv4.NewPacketConn(udp)
+		err = c.p4.SetTTL(255)
+		if err == nil {
+			err = c.p4.SetMulticastTTL(255)
+		}
+		if err == nil && SockPktInfoSupported {
+			err = c.p4.SetControlMessage(ipv4.FlagInterface|
+				ipv4.FlagDst, true)
+		}
+		if err == nil && OptMcastLoop != "" {
+			err = c.p4.SetMulticastLoopback(OptMcastLoop == "on")
+		}
+	} else {
+		c.p6 = ipv6.NewPacketConn(udp)
+		err = c.p6.SetHopLimit(255)
+		if err == nil {
+			err = c.p6.SetMulticastHopLimit(255)
+		}
+		if err == nil && SockPktInfoSupported {
+			err = c.p6.SetControlMessage(ipv6.FlagInterface|
+				ipv6.FlagDst, true)
+		}
+		if err == nil && OptMcastLoop != "" {
+			err = c.p6.SetMulticastLoopback(OptMcastLoop == "on")
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if SockRxqOvflSupported {
+		c.ovfl = c.control(SockRxqOvfl) == nil
+		c.oob = make([]byte, 128)
+	}
+
+	selfAddConn(c.LocalAddr())
+
+	return c, nil
+}
+
+// Is4 tells if connection is IPv4
+func (c *Conn) Is4() bool {
+	return c.p4 != nil
+}
+
+// LocalAddr returns local address of the connection
+func (c *Conn) LocalAddr() *net.UDPAddr {
+	return c.udp.LocalAddr().(*net.UDPAddr)
+}
+
+// JoinGroup joins the multicast group on the specified interface
+func (c *Conn) JoinGroup(iface *net.Interface, group *net.UDPAddr) error {
+	if c.p4 != nil {
+		return c.p4.JoinGroup(iface, group)
+	}
+	return c.p6.JoinGroup(iface, group)
+}
+
+// LeaveGroup leaves the multicast group on the specified interface
+func (c *Conn) LeaveGroup(iface *net.Interface, group *net.UDPAddr) error {
+	if c.p4 != nil {
+		return c.p4.LeaveGroup(iface, group)
+	}
+	return c.p6.LeaveGroup(iface, group)
+}
+
+// ReadFrom receives the next packet. Along with the packet
+// size, it returns the packet metadata: source address, index
+// of the interface the packet was received from and destination
+// address (the two latter may be unknown)
+func (c *Conn) ReadFrom(buf []byte) (n int, meta SourceMeta, err error) {
+	if c.ovfl {
+		return c.readMsg(buf)
+	}
+
+	var src net.Addr
+
+	if c.p4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, src, err = c.p4.ReadFrom(buf)
+		if cm != nil {
+			meta.IfIndex = cm.IfIndex
+			meta.Dst = cm.Dst
+		}
+	} else {
+		var cm *ipv6.ControlMessage
+		n, cm, src, err = c.p6.ReadFrom(buf)
+		if cm != nil {
+			meta.IfIndex = cm.IfIndex
+			meta.Dst = cm.Dst
+		}
+	}
+
+	if err == nil {
+		meta.From = src.(*net.UDPAddr)
+	}
+
+	return
+}
+
+// readMsg is ReadFrom for connections with SO_RXQ_OVFL enabled.
+// Control messages are parsed here, so the count of dropped packets
+// can be taken from them (see ConnDrops)
+//
+// Receivers are serialized, so the control messages buffer is
+// reused without locking. Parsed control messages don't refer to it
+func (c *Conn) readMsg(buf []byte) (n int, meta SourceMeta, err error) {
+	n, oobn, _, src, err := c.udp.ReadMsgUDP(buf, c.oob)
+	if err != nil {
+		return
+	}
+
+	meta.From = src
+	oob := c.oob[:oobn]
+
+	if c.p4 != nil {
+		cm := &ipv4.ControlMessage{}
+		if cm.Parse(oob) == nil {
+			meta.IfIndex = cm.IfIndex
+			meta.Dst = cm.Dst
+		}
+	} else {
+		cm := &ipv6.ControlMessage{}
+		if cm.Parse(oob) == nil {
+			meta.IfIndex = cm.IfIndex
+			meta.Dst = cm.Dst
+		}
+	}
+
+	// The count is cumulative, account only the increment. The
+	// kernel counter is uint32 and wraps around, so the increment
+	// is computed in uint32 arithmetic. Receivers are serialized,
+	// so no locking is needed
+	if drop, ok := SockRxqOvflParse(oob); ok && drop != c.drop {
+		inc := drop - c.drop
+		LogDebug("%s: %d packets dropped by the kernel",
+			c.LocalAddr(), inc)
+		atomic.AddUint64(&connDrops, uint64(inc))
+		c.drop = drop
+	}
+
+	return
+}
+
+// ConnDrops returns the total count of packets, dropped by the
+// kernel due to the sockets' receive queue overflow. If the drops
+// can't be counted on this platform, ok is false
+func ConnDrops() (drops uint64, ok bool) {
+	return atomic.LoadUint64(&connDrops), SockRxqOvflSupported
+}
+
+// WriteTo sends the packet to the specified destination via
+// the specified interface. If ifindex is 0, the outgoing interface
+// is chosen by the operating system
+//
+// Without the packet information support, the interface can only be
+// chosen for multicast destinations, by setting the socket's
+// multicast interface before sending
+func (c *Conn) WriteTo(buf []byte, to *net.UDPAddr, ifindex int) error {
+	selfSend(buf)
+
+	if !SockPktInfoSupported && ifindex != 0 {
+		return c.writeToMulticastIf(buf, to, ifindex)
+	}
+
+	var err error
+
+	if c.p4 != nil {
+		var cm *ipv4.ControlMessage
+		if ifindex != 0 {
+			cm = &ipv4.ControlMessage{IfIndex: ifindex}
+		}
+		_, err = c.p4.WriteTo(buf, cm, to)
+	} else {
+		var cm *ipv6.ControlMessage
+		if ifindex != 0 {
+			cm = &ipv6.ControlMessage{IfIndex: ifindex}
+		}
+		_, err = c.p6.WriteTo(buf, cm, to)
+	}
+
+	return err
+}
+
+// writeToMulticastIf sends the packet via the specified interface,
+// using the socket's multicast interface option
+func (c *Conn) writeToMulticastIf(buf []byte, to *net.UDPAddr,
+	ifindex int) error {
+
+	if !to.IP.IsMulticast() {
+		_, err := c.udp.WriteToUDP(buf, to)
+		return err
+	}
+
+	iface, err := net.InterfaceByIndex(ifindex)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.p4 != nil {
+		err = c.p4.SetMulticastInterface(iface)
+	} else {
+		err = c.p6.SetMulticastInterface(iface)
+	}
+
+	if err == nil {
+		_, err = c.udp.WriteToUDP(buf, to)
+	}
+
+	return err
+}
+
+// RcvBuf returns the effective size of the socket receive buffer
+func (c *Conn) RcvBuf() (int, error) {
+	var size int
+	err := c.control(func(fd uintptr) (err error) {
+		size, err = SockRcvBuf(fd)
+		return
+	})
+
+	return size, err
+}
+
+// control calls the function with the socket file descriptor
+func (c *Conn) control(f func(fd uintptr) error) error {
+	rawconn, err := c.udp.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	err2 := rawconn.Control(func(fd uintptr) {
+		err = f(fd)
+	})
+
+	if err2 != nil {
+		return err2
+	}
+
+	return err
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	selfDelConn(c.LocalAddr())
+	return c.udp.Close()
+}
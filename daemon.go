@@ -0,0 +1,512 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// MDNS daemon, shared between clients
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// daemonQueueSize is the size of per-watcher events queue.
+// Watchers that don't keep up with events are dropped
+const daemonQueueSize = 1024
+
+// Daemon performs MDNS operations on behalf of multiple clients
+// (see GrpcRun), using sockets, owned by the daemon
+//
+// All received records are maintained in the Cache, shared between
+// all clients, and clients are answered from the Cache
+type Daemon struct {
+	sockets  *querySockets               // MDNS sockets
+	cache    *Cache                      // Records cache
+	watchers map[*DaemonWatcher]struct{} // Active watchers
+	sent     map[string]time.Time        // Follow-ups, by name/type
+	lock     sync.Mutex                  // Access lock
+}
+
+// DaemonWatcher receives events of records, that answer its question
+//
+// If watcher doesn't keep up with events, it is dropped and its
+// Events channel is closed
+type DaemonWatcher struct {
+	Events   <-chan CacheEvent // Events queue
+	question []dns.Question    // The question
+	events   chan CacheEvent   // Events queue, writable
+}
+
+// DaemonNew creates MDNS sockets on the selected interfaces and
+// starts receivers. Interfaces that have failed are skipped, and
+// error is returned, if none of them can be used
+func DaemonNew() (*Daemon, error) {
+	d := &Daemon{
+		cache:    CacheNew(),
+		watchers: make(map[*DaemonWatcher]struct{}),
+		sent:     make(map[string]time.Time),
+	}
+
+	_, if4, if6, err := IfAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	d.sockets = querySocketsOpen(if4, if6, d.input)
+	if d.sockets.Len() == 0 {
+		d.sockets.Close()
+		return nil, errQueryNoInterfaces
+	}
+
+	return d, nil
+}
+
+// Run maintains the Cache until ctx is canceled, then closes sockets
+//
+// Records, watched by watchers, are re-queried when they near
+// expiration. Sockets follow network configuration changes, and
+// watched records are re-queried when it changes
+func (d *Daemon) Run(ctx context.Context) {
+	go NetmonRun(ctx, func(if4, if6 []net.Interface) {
+		d.sockets.Update(if4, if6)
+
+		d.lock.Lock()
+		LogDebug("Re-querying after network configuration change")
+		d.requery()
+		d.lock.Unlock()
+	})
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case now := <-ticker.C:
+			d.tick(now)
+		}
+	}
+
+	d.sockets.Close()
+}
+
+// Exchange sends the query OptTxCount times every OptTxPeriod and
+// returns after the last period. Received answers are collected
+// in the Cache
+func (d *Daemon) Exchange(ctx context.Context,
+	question []dns.Question) error {
+	return d.ExchangeWith(ctx, question, QueryConfigDefault())
+}
+
+// ExchangeWith sends the query, like Exchange, using the
+// specified settings, so clients may query with different
+// settings concurrently
+//
+// The first query is delayed, unless cfg.NoJitter is set. With
+// cfg.Adaptive, retransmissions stop once the question is answered.
+// With cfg.QuietPeriod, ExchangeWith returns once no new answers
+// are received for that period
+//
+// Answers are collected in the shared Cache, so answers, received
+// via other interfaces (e.g., queried by other clients), are not
+// filtered out
+func (d *Daemon) ExchangeWith(ctx context.Context,
+	question []dns.Question, cfg QueryConfig) error {
+
+	rq := &dns.Msg{}
+	rq.Question = cfg.question(question)
+
+	rqBytes, err := rq.Pack()
+	if err != nil {
+		return err
+	}
+
+	// Answers are tracked only if needed
+	var events <-chan CacheEvent
+	if cfg.Adaptive || cfg.QuietPeriod != 0 {
+		w := d.Watch(question)
+		defer d.Unwatch(w)
+		events = w.Events
+	}
+
+	timer := time.NewTimer(cfg.delay())
+	defer timer.Stop()
+
+	// The quiet period timer is started by the first query
+	var quiet <-chan time.Time
+	quietTimer := time.NewTimer(cfg.QuietPeriod)
+	defer quietTimer.Stop()
+
+	answered := false
+	for count := 0; ; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case ev, ok := <-events:
+			switch {
+			case !ok:
+				events = nil
+			case ev.Type != CacheRemoved:
+				answered = cfg.Adaptive
+				if quiet != nil {
+					queryTimerReset(quietTimer,
+						cfg.QuietPeriod)
+				}
+			}
+			continue
+
+		case <-quiet:
+			LogDebug("No new records for %s, exchange completed",
+				cfg.QuietPeriod)
+			return nil
+
+		case <-timer.C:
+		}
+
+		if count == cfg.TxCount || (answered && count > 0) {
+			if quiet != nil {
+				// Wait for the quiet period
+				continue
+			}
+			return nil
+		}
+
+		sent := d.sockets.SendVia(rqBytes, cfg.Iface, cfg.Network)
+		filtered := cfg.Iface != "" || cfg.Network != ""
+		if sent == 0 && count == 0 && filtered {
+			return fmt.Errorf("no interfaces in use match "+
+				"interface %q, network %q",
+				cfg.Iface, cfg.Network)
+		}
+
+		count++
+		timer.Reset(cfg.TxPeriod)
+
+		if cfg.QuietPeriod != 0 && quiet == nil {
+			queryTimerReset(quietTimer, cfg.QuietPeriod)
+			quiet = quietTimer.C
+		}
+	}
+}
+
+// Records returns alive records, that answer the question.
+// If question is nil, all alive records are returned
+func (d *Daemon) Records(question []dns.Question) []dns.RR {
+	d.lock.Lock()
+	records := d.cache.Records(time.Now())
+	d.lock.Unlock()
+
+	if question == nil {
+		return records
+	}
+
+	var out []dns.RR
+	for _, rr := range records {
+		if responseMatches(rr, question) {
+			out = append(out, rr)
+		}
+	}
+
+	return out
+}
+
+// Services returns known instances of the service type (FQDN)
+func (d *Daemon) Services(svctype string) []DnssdService {
+	services, _ := DnssdResolve(d.Records(nil))
+
+	var out []DnssdService
+	for _, svc := range services {
+		if strings.EqualFold(svc.Type, svctype) {
+			out = append(out, svc)
+		}
+	}
+
+	return out
+}
+
+// Source returns where the most recently received record of the
+// given name and type was received from
+func (d *Daemon) Source(name string, rrtype uint16) (SourceMeta, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cache.Source(name, rrtype, time.Now())
+}
+
+// Browse discovers and resolves instances of the service type (FQDN)
+//
+// If responders don't send SRV, TXT or address records of instances
+// as additional records, these records are queried explicitly. Device
+// info of hosts (see DnssdDeviceInfoNames) is queried as well, to
+// obtain their models
+//
+// Records, already received (usually, as additional records), are
+// taken from the Cache and not queried (see exchangeMissing)
+func (d *Daemon) Browse(ctx context.Context,
+	svctype string) ([]DnssdService, error) {
+	return d.BrowseWith(ctx, svctype, QueryConfigDefault())
+}
+
+// BrowseWith discovers and resolves instances of the service type,
+// like Browse, using the specified settings for all its queries
+func (d *Daemon) BrowseWith(ctx context.Context, svctype string,
+	cfg QueryConfig) ([]DnssdService, error) {
+
+	err := d.ExchangeWith(ctx, []dns.Question{{
+		Name:   svctype,
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	}}, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	asked := make(map[string]bool)
+	for pass := 0; pass < 2; pass++ {
+		// Query missed records of instances
+		var question []dns.Question
+		add := func(name string, qtype uint16) {
+			key := daemonQuestionKey(name, qtype)
+			if !asked[key] {
+				asked[key] = true
+				question = append(question, dns.Question{
+					Name: name, Qtype: qtype,
+					Qclass: dns.ClassINET})
+			}
+		}
+
+		for _, svc := range d.Services(svctype) {
+			if svc.Model == "" {
+				for _, name := range DnssdDeviceInfoNames(svc) {
+					add(name, dns.TypeTXT)
+				}
+			}
+
+			if svc.Host == "" {
+				add(svc.Name, dns.TypeSRV)
+			} else if len(svc.Addrs) == 0 {
+				add(svc.Host, dns.TypeA)
+				add(svc.Host, dns.TypeAAAA)
+			}
+
+			if svc.TXT == nil {
+				add(svc.Name, dns.TypeTXT)
+			}
+		}
+
+		if len(question) == 0 {
+			break
+		}
+
+		err := d.exchangeMissing(ctx, question, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return d.Services(svctype), nil
+}
+
+// exchangeMissing sends follow-up questions cfg.TxCount times every
+// cfg.TxPeriod, like ExchangeWith, but each time it sends only
+// questions, not answered by the Cache yet and not sent recently by
+// other clients. It returns as soon as all questions are answered
+func (d *Daemon) exchangeMissing(ctx context.Context,
+	question []dns.Question, cfg QueryConfig) error {
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for count := 0; count <= cfg.TxCount; count++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		var missing []dns.Question
+		for _, q := range question {
+			if len(d.Records([]dns.Question{q})) == 0 {
+				missing = append(missing, q)
+			}
+		}
+
+		if len(missing) == 0 || count == cfg.TxCount {
+			break
+		}
+
+		send := d.suppress(missing, cfg.TxPeriod, time.Now())
+		LogDebug("Follow-up query: %d of %d questions unanswered, "+
+			"%d sent", len(missing), len(question), len(send))
+
+		if len(send) != 0 {
+			rq := &dns.Msg{}
+			rq.Question = cfg.question(send)
+			rqBytes, err := rq.Pack()
+			if err != nil {
+				return err
+			}
+
+			d.sockets.SendVia(rqBytes, cfg.Iface, cfg.Network)
+		}
+
+		timer.Reset(cfg.TxPeriod)
+	}
+
+	return nil
+}
+
+// suppress returns questions, not sent by other clients within
+// the half of the period, and remembers them as sent
+func (d *Daemon) suppress(question []dns.Question,
+	period time.Duration, now time.Time) []dns.Question {
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for key, t := range d.sent {
+		if now.Sub(t) >= period/2 {
+			delete(d.sent, key)
+		}
+	}
+
+	var out []dns.Question
+	for _, q := range question {
+		key := daemonQuestionKey(q.Name, q.Qtype)
+		if _, found := d.sent[key]; !found {
+			d.sent[key] = now
+			out = append(out, q)
+		}
+	}
+
+	return out
+}
+
+// daemonQuestionKey returns key of the question, by name and type
+func daemonQuestionKey(name string, qtype uint16) string {
+	return strings.ToLower(name) + "/" + dns.TypeToString[qtype]
+}
+
+// Watch creates a new watcher for the question. Already known
+// records, that answer the question, are queued to the watcher
+// as CacheAdded events
+//
+// Watch doesn't send queries. Use Exchange to send initial queries;
+// later, queries are sent automatically when records near expiration
+func (d *Daemon) Watch(question []dns.Question) *DaemonWatcher {
+	events := make(chan CacheEvent, daemonQueueSize)
+	w := &DaemonWatcher{
+		Events:   events,
+		question: question,
+		events:   events,
+	}
+
+	d.lock.Lock()
+	for _, ev := range d.cache.Contents(time.Now()) {
+		if responseMatches(ev.RR, question) &&
+			len(events) < cap(events) {
+			events <- ev
+		}
+	}
+	d.watchers[w] = struct{}{}
+	d.lock.Unlock()
+
+	return w
+}
+
+// Unwatch removes the watcher
+func (d *Daemon) Unwatch(w *DaemonWatcher) {
+	d.lock.Lock()
+	delete(d.watchers, w)
+	d.lock.Unlock()
+}
+
+// input handles received MDNS message
+func (d *Daemon) input(msg *dns.Msg, meta SourceMeta) {
+	if !msg.Response {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.OPT); !ok {
+				d.dispatch(d.cache.Input(rr, meta, now))
+			}
+		}
+	}
+}
+
+// tick expires the cached records and, if records, watched by
+// watchers, near expiration, re-queries them
+func (d *Daemon) tick(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.dispatch(d.cache.Expire(now))
+
+	question := d.question()
+	if question == nil || !d.cache.NeedRefresh(question, now) {
+		return
+	}
+
+	LogDebug("Watched records near expiration, refreshing")
+	d.requery()
+}
+
+// question returns questions of all watchers. Must be called
+// under lock
+func (d *Daemon) question() []dns.Question {
+	var question []dns.Question
+	for w := range d.watchers {
+		question = append(question, w.question...)
+	}
+	return question
+}
+
+// requery sends query with questions of all watchers, if any.
+// Must be called under lock
+func (d *Daemon) requery() {
+	question := d.question()
+	if question == nil {
+		return
+	}
+
+	rq := &dns.Msg{}
+	rq.Question = question
+	if rqBytes, err := rq.Pack(); err == nil {
+		d.sockets.Send(rqBytes)
+	}
+}
+
+// dispatch sends Cache events to the matching watchers. Watchers,
+// whose queues are full, are dropped. Must be called under lock
+func (d *Daemon) dispatch(events []CacheEvent) {
+	for _, ev := range events {
+		for w := range d.watchers {
+			if !responseMatches(ev.RR, w.question) {
+				continue
+			}
+
+			select {
+			case w.events <- ev:
+			default:
+				close(w.events)
+				delete(d.watchers, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Bounded deduplication cache
+
+package main
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DedupCache remembers recently seen records, so duplicates can
+// be detected without retaining all records forever
+//
+// Memory is bounded in two ways:
+//   - the number of entries is limited; when limit is reached,
+//     the least recently seen entry is evicted
+//   - entries expire when the record's TTL is elapsed, so records
+//     that are still alive are reported again after expiration
+//
+// DedupCache is not safe for concurrent use
+type DedupCache struct {
+	max     int                      // Max number of entries
+	ttl     bool                     // Compare records with TTL
+	lru     *list.List               // Entries, most recent first
+	entries map[string]*list.Element // Entries by key
+}
+
+// dedupEntry represents a single DedupCache entry
+type dedupEntry struct {
+	key     string    // Entry key
+	expires time.Time // Expiration time
+}
+
+// DedupCacheNew creates a new DedupCache with the specified
+// limit on number of entries. If max is 0, nothing is remembered
+//
+// If ttl is true, records that differ only in TTL are considered
+// different
+func DedupCacheNew(max int, ttl bool) *DedupCache {
+	return &DedupCache{
+		max:     max,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Seen tells if record was seen before and is not expired yet.
+// The record is remembered as seen at the specified time
+//
+// Unless created with ttl set, DedupCache ignores TTL when compares
+// records, like dns.Dedup
+func (cache *DedupCache) Seen(rr dns.RR, now time.Time) bool {
+	if cache.max == 0 {
+		return false
+	}
+
+	key := dedupKey(rr)
+	if cache.ttl {
+		key = rr.String()
+	}
+	expires := now.Add(time.Duration(rr.Header().Ttl) * time.Second)
+
+	if elem := cache.entries[key]; elem != nil {
+		ent := elem.Value.(*dedupEntry)
+		seen := now.Before(ent.expires)
+
+		ent.expires = expires
+		cache.lru.MoveToFront(elem)
+
+		return seen
+	}
+
+	for cache.lru.Len() >= cache.max {
+		elem := cache.lru.Back()
+		delete(cache.entries, elem.Value.(*dedupEntry).key)
+		cache.lru.Remove(elem)
+	}
+
+	ent := &dedupEntry{key: key, expires: expires}
+	cache.entries[key] = cache.lru.PushFront(ent)
+
+	return false
+}
+
+// Len returns number of entries in the cache
+func (cache *DedupCache) Len() int {
+	return cache.lru.Len()
+}
+
+// dedupKey returns deduplication key for the record.
+// The key ignores record's TTL
+func dedupKey(rr dns.RR) string {
+	hdr := rr.Header()
+	ttl := hdr.Ttl
+	hdr.Ttl = 0
+	key := rr.String()
+	hdr.Ttl = ttl
+	return key
+}
+
+// dedupKeyNoFlush returns deduplication key for the record, that
+// ignores the cache-flush bit as well. The record is not modified
+func dedupKeyNoFlush(rr dns.RR) string {
+	hdr := rr.Header()
+	class := hdr.Class
+	hdr.Class &^= 1 << 15
+	key := dedupKey(rr)
+	hdr.Class = class
+	return key
+}
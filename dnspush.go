@@ -0,0 +1,274 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// DNS Push notifications (RFC 8765) for wide-area watch mode
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// DNS Stateful Operations (RFC 8490) and DNS Push (RFC 8765)
+// protocol constants
+const (
+	dnsPushOpcodeDSO    = 6      // DSO opcode
+	dnsPushTLVSubscribe = 0x0040 // SUBSCRIBE TLV
+	dnsPushTLVPush      = 0x0041 // PUSH TLV
+	dnsPushTTLDelete    = 0xffffffff
+	dnsPushSrvPrefix    = "_dns-push-tls._tcp."
+)
+
+// DnsPushRun subscribes to changes of the question of the rq
+// message, using DNS Push over TLS, and handles notifications
+// until ctx is cancelled
+//
+// The push server is discovered via SOA and SRV lookups, as
+// specified by RFC 8765, section 6
+//
+// Error is returned, if the subscription fails or the connection
+// is lost before ctx is cancelled
+func DnsPushRun(ctx context.Context, rq *dns.Msg) error {
+	q := rq.Question[0]
+
+	// Discover the server
+	server, err := dnsPushDiscover(q.Name)
+	if err != nil {
+		return dnsPushError(fmt.Errorf("%s: %s", q.Name, err))
+	}
+
+	LogDebug("DNS Push server: %s", server)
+
+	// Connect to the server
+	dialer := &tls.Dialer{}
+	c, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return dnsPushError(err)
+	}
+
+	conn := c.(*tls.Conn)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Subscribe
+	id := dns.Id()
+	err = dnsPushSend(conn, id, dnsPushTLVSubscribe,
+		dnsPushQuestion(q))
+	if err != nil {
+		return dnsPushError(err)
+	}
+
+	// Handle incoming messages
+	for {
+		hdr, tlvs, err := dnsPushRecv(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return dnsPushError(err)
+		}
+
+		switch {
+		case hdr.Id == id && hdr.Response:
+			if hdr.Rcode != dns.RcodeSuccess {
+				conn.Close()
+				return dnsPushError(fmt.Errorf(
+					"subscription failed: %s",
+					dns.RcodeToString[hdr.Rcode]))
+			}
+			LogDebug("DNS Push: subscribed to %s", q.String())
+
+		case hdr.Id == 0:
+			for _, tlv := range tlvs {
+				if tlv.typ == dnsPushTLVPush {
+					dnsPushInput(tlv.data)
+				}
+			}
+
+		default:
+			LogVerbose("DNS Push: unexpected message ID=%d, "+
+				"ignored", hdr.Id)
+		}
+	}
+}
+
+// dnsPushError wraps the DNS Push error into wideAreaError
+func dnsPushError(err error) error {
+	return wideAreaError{fmt.Errorf("DNS Push: %w", err)}
+}
+
+// dnsPushTLV represents a single DSO TLV
+type dnsPushTLV struct {
+	typ  uint16 // TLV type
+	data []byte // TLV data
+}
+
+// dnsPushDiscover discovers the DNS Push server for the name.
+// It returns server address in the host:port form
+func dnsPushDiscover(name string) (string, error) {
+	// Find the zone via SOA query. The SOA record comes either
+	// in the answer section (if name is the zone apex) or in the
+	// authority section
+	soa := dns.Question{Name: name, Qtype: dns.TypeSOA,
+		Qclass: dns.ClassINET}
+	rsp, err := FallbackExchange([]dns.Question{soa})
+	if err != nil {
+		return "", err
+	}
+
+	zone := ""
+	for _, rr := range append(rsp.Answer, rsp.Ns...) {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			zone = rr.Header().Name
+			break
+		}
+	}
+
+	if zone == "" {
+		return "", errors.New("zone not found")
+	}
+
+	// Lookup the SRV record
+	srv := dns.Question{Name: dnsPushSrvPrefix + zone,
+		Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+	rsp, err = FallbackExchange([]dns.Question{srv})
+	if err != nil {
+		return "", err
+	}
+
+	for _, rr := range rsp.Answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			port := strconv.Itoa(int(srv.Port))
+			return net.JoinHostPort(srv.Target, port), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s%s: SRV record not found",
+		dnsPushSrvPrefix, zone)
+}
+
+// dnsPushQuestion encodes question as the SUBSCRIBE TLV data
+func dnsPushQuestion(q dns.Question) []byte {
+	buf := make([]byte, 256+4)
+	off, _ := dns.PackDomainName(q.Name, buf, 0, nil, false)
+	binary.BigEndian.PutUint16(buf[off:], q.Qtype)
+	binary.BigEndian.PutUint16(buf[off+2:], q.Qclass)
+	return buf[:off+4]
+}
+
+// dnsPushSend sends DSO request message with a single TLV
+func dnsPushSend(conn io.Writer, id, typ uint16, data []byte) error {
+	msg := make([]byte, 2+12+4+len(data))
+	binary.BigEndian.PutUint16(msg[0:], uint16(len(msg)-2))
+	binary.BigEndian.PutUint16(msg[2:], id)
+	msg[4] = dnsPushOpcodeDSO << 3
+	binary.BigEndian.PutUint16(msg[14:], typ)
+	binary.BigEndian.PutUint16(msg[16:], uint16(len(data)))
+	copy(msg[18:], data)
+
+	_, err := conn.Write(msg)
+	return err
+}
+
+// dnsPushRecv receives the next DSO message
+func dnsPushRecv(conn io.Reader) (hdr dns.MsgHdr, tlvs []dnsPushTLV,
+	err error) {
+
+	var lenbuf [2]byte
+	if _, err = io.ReadFull(conn, lenbuf[:]); err != nil {
+		return
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(lenbuf[:]))
+	if _, err = io.ReadFull(conn, msg); err != nil {
+		return
+	}
+
+	if len(msg) < 12 {
+		err = errors.New("message too short")
+		return
+	}
+
+	hdr.Id = binary.BigEndian.Uint16(msg[0:])
+	hdr.Response = msg[2]&0x80 != 0
+	hdr.Opcode = int(msg[2]>>3) & 0xf
+	hdr.Rcode = int(msg[3] & 0xf)
+
+	if hdr.Opcode != dnsPushOpcodeDSO {
+		err = fmt.Errorf("unexpected opcode %d", hdr.Opcode)
+		return
+	}
+
+	for data := msg[12:]; len(data) >= 4; {
+		typ := binary.BigEndian.Uint16(data[0:])
+		l := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+l {
+			err = errors.New("truncated TLV")
+			return
+		}
+
+		tlvs = append(tlvs, dnsPushTLV{typ, data[4 : 4+l]})
+		data = data[4+l:]
+	}
+
+	return
+}
+
+// dnsPushInput handles the PUSH TLV data, which consists of
+// sequence of resource records in the wire format
+//
+// Records with TTL 0xffffffff and records of class ANY
+// are removals (RFC 8765, section 6.3.1). Removals of individual
+// records are passed to ResponseInput as goodbye records (TTL 0),
+// removals of RRsets and names are made by ResponseRemove
+func dnsPushInput(data []byte) {
+	msg := &dns.Msg{}
+	msg.Response = true
+
+	for off := 0; off < len(data); {
+		rr, next, err := dns.UnpackRR(data, off)
+		if err != nil || rr == nil {
+			LogVerbose("DNS Push: invalid record: %v", err)
+			return
+		}
+		off = next
+
+		hdr := rr.Header()
+		if hdr.Ttl == dnsPushTTLDelete || hdr.Class == dns.ClassANY {
+			LogDebug("DNS Push: removed: %s %s %s",
+				hdr.Name, dns.Class(hdr.Class),
+				dns.Type(hdr.Rrtype))
+			hdr.Ttl = 0
+		}
+
+		if hdr.Class == dns.ClassANY {
+			// Records before the removal go first
+			if len(msg.Answer) != 0 {
+				ResponseInput(msg)
+				msg.Answer = nil
+			}
+
+			ResponseRemove(hdr.Name, hdr.Rrtype)
+			continue
+		}
+
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	if len(msg.Answer) != 0 {
+		ResponseInput(msg)
+	}
+}
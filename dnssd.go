@@ -0,0 +1,212 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// DNS-SD records interpretation
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dnssdDeviceInfo is the service type, used to publish the device
+// model as TXT record of the host's instance (model=...)
+const dnssdDeviceInfo = "_device-info._tcp.local."
+
+// DnssdService represents the DNS-SD service instance,
+// resolved from records
+type DnssdService struct {
+	Name     string   // Full instance name, as in the PTR record
+	Instance string   // Instance name, unescaped
+	Type     string   // Service type
+	Host     string   // Target host
+	Port     uint16   // Service port
+	Addrs    []string // Host addresses
+	TXT      []string // TXT record strings
+	Model    string   // Device model of the host, if known
+}
+
+// DnssdHost represents the host, resolved from records
+type DnssdHost struct {
+	Name  string   // Host name
+	Addrs []string // Host addresses
+}
+
+// DnssdResolve resolves service instances (PTR records of service
+// types, with SRV, TXT, A and AAAA records of instances and their
+// targets) and hosts (A and AAAA records) from records
+//
+// Services are returned in order of their PTR records, hosts are
+// sorted by name
+func DnssdResolve(records []dns.RR) ([]DnssdService, []DnssdHost) {
+	// Index records
+	srvs := make(map[string]*dns.SRV)
+	txts := make(map[string][]string)
+	addrs := make(map[string][]string)
+
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			srvs[name] = rr
+		case *dns.TXT:
+			txts[name] = append(txts[name], rr.Txt...)
+		case *dns.A:
+			addrs[name] = append(addrs[name], rr.A.String())
+		case *dns.AAAA:
+			addrs[name] = append(addrs[name], rr.AAAA.String())
+		}
+	}
+
+	// Collect services
+	var services []DnssdService
+	for _, rr := range records {
+		ptr := dnssdInstancePTR(rr)
+		if ptr == nil {
+			continue
+		}
+
+		instance := strings.ToLower(ptr.Ptr)
+		svc := DnssdService{
+			Name:     ptr.Ptr,
+			Instance: dnssdInstanceName(ptr.Ptr, ptr.Hdr.Name),
+			Type:     ptr.Hdr.Name,
+			TXT:      txts[instance],
+		}
+
+		if srv := srvs[instance]; srv != nil {
+			svc.Host = srv.Target
+			svc.Port = srv.Port
+			svc.Addrs = addrs[strings.ToLower(srv.Target)]
+		}
+
+		services = append(services, svc)
+	}
+
+	// Find models of hosts. Device info of any instance of the
+	// host applies to all its instances
+	models := make(map[string]string)
+	for _, svc := range services {
+		for _, name := range DnssdDeviceInfoNames(svc) {
+			model := dnssdModel(txts[strings.ToLower(name)])
+			if model != "" {
+				models[strings.ToLower(svc.Host)] = model
+			}
+		}
+	}
+
+	for i := range services {
+		services[i].Model = models[strings.ToLower(services[i].Host)]
+	}
+
+	// Collect hosts
+	var hosts []DnssdHost
+	for name, a := range addrs {
+		hosts = append(hosts, DnssdHost{name, a})
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Name < hosts[j].Name
+	})
+
+	return services, hosts
+}
+
+// dnssdInstancePTR returns the record as PTR, if it is PTR record
+// of the service type, that points to the service instance.
+// Otherwise, it returns nil
+func dnssdInstancePTR(rr dns.RR) *dns.PTR {
+	ptr, ok := rr.(*dns.PTR)
+	if !ok || !strings.HasPrefix(ptr.Hdr.Name, "_") ||
+		strings.EqualFold(ptr.Hdr.Name, announceServicesName) {
+		return nil
+	}
+
+	return ptr
+}
+
+// DnssdDeviceInfoNames returns names, where device info of the
+// service instance's host may be published: device info instances,
+// named after the instance and after the host. Names of unresolved
+// instances are not returned
+func DnssdDeviceInfoNames(svc DnssdService) []string {
+	if svc.Host == "" {
+		return nil
+	}
+
+	var names []string
+	for _, name := range []string{svc.Name, svc.Host} {
+		labels := dns.Split(name)
+		if len(labels) > 1 {
+			names = append(names, name[:labels[1]]+dnssdDeviceInfo)
+		}
+	}
+
+	return names
+}
+
+// dnssdModel returns the device model from TXT record strings
+// of device info, or "" if not found
+func dnssdModel(txt []string) string {
+	for _, s := range txt {
+		if len(s) > 6 && strings.EqualFold(s[:6], "model=") {
+			return s[6:]
+		}
+	}
+
+	return ""
+}
+
+// dnssdInstanceName returns the instance part of the service
+// instance name, unescaped for display
+func dnssdInstanceName(instance, svctype string) string {
+	n := len(instance) - len(svctype)
+	if n > 0 && strings.EqualFold(instance[n:], svctype) {
+		instance = strings.TrimSuffix(instance[:n], ".")
+	}
+
+	return dnssdUnescape(instance)
+}
+
+// dnssdUnescape unescapes the label in the DNS presentation format,
+// where special characters are escaped as \X and non-printable
+// as \DDD (decimal)
+func dnssdUnescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c != '\\' || i+1 == len(s):
+		case i+3 < len(s) && dnssdIsDDD(s[i+1:i+4]):
+			c = (s[i+1]-'0')*100 + (s[i+2]-'0')*10 + (s[i+3] - '0')
+			i += 3
+		default:
+			i++
+			c = s[i]
+		}
+		out = append(out, c)
+	}
+
+	return string(out)
+}
+
+// dnssdIsDDD tells if s is the \DDD escape value (3 decimal
+// digits, up to 255)
+func dnssdIsDDD(s string) bool {
+	for i := 0; i < 3; i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s <= "255"
+}
@@ -0,0 +1,71 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// DNSSEC records rendering
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnssecUDPSize is the EDNS UDP payload size, advertised with
+// the DO bit
+const dnssecUDPSize = 1232
+
+// dnssecComment returns comment with decoded metadata of DNSSEC
+// records (RRSIG, DNSKEY, DS), like dig prints, or "" for other
+// records
+func dnssecComment(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.RRSIG:
+		validity := "valid"
+		switch now := time.Now(); {
+		case rr.ValidityPeriod(now):
+		case now.Unix() < int64(rr.Inception):
+			validity = "not yet valid"
+		default:
+			validity = "expired"
+		}
+
+		return fmt.Sprintf("covers %s, alg = %s, key id = %d, %s",
+			dns.TypeToString[rr.TypeCovered],
+			dnssecAlgorithm(rr.Algorithm), rr.KeyTag, validity)
+
+	case *dns.DNSKEY:
+		kind := "ZSK"
+		if rr.Flags&dns.SEP != 0 {
+			kind = "KSK"
+		}
+		if rr.Flags&dns.REVOKE != 0 {
+			kind += " (revoked)"
+		}
+
+		return fmt.Sprintf("%s, alg = %s, key id = %d", kind,
+			dnssecAlgorithm(rr.Algorithm), rr.KeyTag())
+
+	case *dns.DS:
+		digest := dns.HashToString[rr.DigestType]
+		if digest == "" {
+			digest = fmt.Sprint(rr.DigestType)
+		}
+
+		return fmt.Sprintf("key id = %d, alg = %s, digest = %s",
+			rr.KeyTag, dnssecAlgorithm(rr.Algorithm), digest)
+	}
+
+	return ""
+}
+
+// dnssecAlgorithm returns name of the DNSSEC algorithm
+func dnssecAlgorithm(alg uint8) string {
+	if name, ok := dns.AlgorithmToString[alg]; ok {
+		return name
+	}
+	return fmt.Sprint(alg)
+}
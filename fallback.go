@@ -0,0 +1,100 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Fallback to the unicast DNS
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// FallbackNeeded tells if unicast DNS fallback is needed for
+// the query. It is needed when enabled by OptFallbackDNS,
+// the queried name is not within the .local domain, and
+// no matching answers were received via MDNS
+func FallbackNeeded(rq *dns.Msg) bool {
+	if !OptFallbackDNS || ResponseHasAnswer() {
+		return false
+	}
+
+	for _, q := range rq.Question {
+		if !dns.IsSubDomain("local.", q.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FallbackRun sends question of the rq message to the unicast DNS
+// resolvers, configured in OptResolvConf, and merges the response
+// with results of the MDNS query
+func FallbackRun(rq *dns.Msg) {
+	rsp, server, err := fallbackExchange(rq.Question)
+	if err != nil {
+		LogError("fallback DNS: %s", err)
+		return
+	}
+
+	if RcodeInput(rsp, server) {
+		ResponseInput(rsp)
+	}
+}
+
+// FallbackExchange sends question to the unicast DNS resolvers,
+// configured in OptResolvConf, and returns the response. With
+// OptDnssec, the DO bit is set, so DNSSEC records are returned
+//
+// Each resolver is given OptDNSTimeout to reply. The first resolver
+// that replies wins
+func FallbackExchange(question []dns.Question) (*dns.Msg, error) {
+	rsp, _, err := fallbackExchange(question)
+	return rsp, err
+}
+
+// fallbackExchange does the work of FallbackExchange and
+// also returns address of the resolver that has replied
+func fallbackExchange(question []dns.Question) (*dns.Msg,
+	string, error) {
+
+	conf, err := dns.ClientConfigFromFile(OptResolvConf)
+	if err != nil {
+		return nil, "", err
+	}
+
+	msg := &dns.Msg{}
+	msg.Id = dns.Id()
+	msg.RecursionDesired = true
+	msg.Question = question
+
+	if OptDnssec {
+		msg.SetEdns0(dnssecUDPSize, true)
+	}
+
+	clnt := &dns.Client{Timeout: OptDNSTimeout}
+	for _, server := range conf.Servers {
+		addr := net.JoinHostPort(server, conf.Port)
+		LogDebug("Using unicast DNS server %s", addr)
+
+		rsp, _, err := clnt.Exchange(msg, addr)
+		if err == nil && rsp.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: clnt.Timeout}
+			rsp, _, err = tcp.Exchange(msg, addr)
+		}
+
+		if err != nil {
+			LogDebug("%s: %s", addr, err)
+			continue
+		}
+
+		return rsp, addr, nil
+	}
+
+	return nil, "", errors.New("no response from servers")
+}
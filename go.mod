@@ -1,5 +1,18 @@
 module github.com/alexpevzner/mcdig
 
-go 1.11
+go 1.21
 
-require github.com/miekg/dns v1.1.55
+require (
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/miekg/dns v1.1.55
+	golang.org/x/net v0.9.0
+	golang.org/x/sys v0.7.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+)
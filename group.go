@@ -0,0 +1,115 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Grouped views of records
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// GroupPrint prints services and hosts, resolved from records (see
+// DnssdResolve), grouped according to OptGroupBy, into io.Writer:
+//   - "type": service type, its instances and their details
+//   - "host": host, its addresses and services
+//
+// The returned error, if any, comes from w.Write()
+func GroupPrint(w io.Writer, records []dns.RR) error {
+	services, hosts := DnssdResolve(records)
+
+	if OptGroupBy == "type" {
+		var types []string
+		bytype := make(map[string][]DnssdService)
+		for _, svc := range services {
+			key := strings.ToLower(svc.Type)
+			if bytype[key] == nil {
+				types = append(types, key)
+			}
+			bytype[key] = append(bytype[key], svc)
+		}
+
+		sort.Strings(types)
+		return browseAllPrint(w, types, bytype)
+	}
+
+	return groupPrintHosts(w, services, hosts)
+}
+
+// groupPrintHosts prints hosts with their addresses and services.
+// Services of unresolved instances are printed separately
+func groupPrintHosts(w io.Writer, services []DnssdService,
+	hosts []DnssdHost) error {
+
+	addrs := make(map[string][]string)
+	var names []string
+	for _, host := range hosts {
+		names = append(names, host.Name)
+		addrs[host.Name] = host.Addrs
+	}
+
+	byhost := make(map[string][]DnssdService)
+	var unresolved []DnssdService
+	for _, svc := range services {
+		key := strings.ToLower(svc.Host)
+		switch {
+		case key == "":
+			unresolved = append(unresolved, svc)
+			continue
+		case byhost[key] == nil && addrs[key] == nil:
+			names = append(names, key)
+		}
+		byhost[key] = append(byhost[key], svc)
+	}
+
+	sort.Strings(names)
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; HOSTS:\n")
+
+	for _, name := range names {
+		svcs := byhost[name]
+		sort.Slice(svcs, func(i, j int) bool {
+			if svcs[i].Type != svcs[j].Type {
+				return svcs[i].Type < svcs[j].Type
+			}
+			return svcs[i].Instance < svcs[j].Instance
+		})
+
+		fmt.Fprintf(&buf, "\n%s\n", name)
+		if len(svcs) != 0 && svcs[0].Model != "" {
+			fmt.Fprintf(&buf, "    model: %s\n", svcs[0].Model)
+		}
+
+		for _, addr := range addrs[name] {
+			fmt.Fprintf(&buf, "    addr: %s\n", addr)
+		}
+
+		for _, svc := range svcs {
+			fmt.Fprintf(&buf, "    service: %s (%s) port %d\n",
+				svc.Instance, svc.Type, svc.Port)
+		}
+	}
+
+	if len(unresolved) != 0 {
+		buf.WriteString("\n;; (unresolved)\n")
+		for _, svc := range unresolved {
+			fmt.Fprintf(&buf, "    service: %s (%s)\n",
+				svc.Instance, svc.Type)
+		}
+	}
+
+	fmt.Fprintf(&buf, "\n;; %d hosts, %d services\n\n", len(names),
+		len(services))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
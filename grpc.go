@@ -0,0 +1,375 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The grpc command
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexpevzner/mcdig/api"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcDefaultAddr is the default address of the gRPC server
+const grpcDefaultAddr = "127.0.0.1:5380"
+
+// grpcServer implements the api.McdigServer on top of the Daemon
+type grpcServer struct {
+	api.UnimplementedMcdigServer
+	daemon *Daemon // The daemon
+}
+
+// GrpcRun runs the gRPC server on the address, specified by
+// OptCommandArgs (or grpcDefaultAddr), that performs MDNS operations
+// on the selected interfaces on behalf of clients, until ctx is
+// cancelled
+//
+// With systemd socket activation, the passed socket is used instead
+// of the specified address
+func GrpcRun(ctx context.Context) {
+	addr := grpcDefaultAddr
+	if len(OptCommandArgs) > 0 {
+		addr = OptCommandArgs[0]
+	}
+
+	daemon, err := DaemonNew()
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	s := &grpcServer{daemon: daemon}
+
+	if OptAvahi {
+		AvahiRun(ctx, s.daemon)
+	}
+
+	// Start gRPC server. With systemd socket activation, the passed
+	// socket is used instead of the specified address
+	var l net.Listener
+	if listeners, _ := SystemdListeners(); len(listeners) != 0 {
+		l = listeners[0]
+	} else {
+		var err error
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			LogFatal("%s", err)
+		}
+	}
+
+	srv := grpc.NewServer()
+	api.RegisterMcdigServer(srv, s)
+
+	go srv.Serve(l)
+
+	LogDebug("gRPC server listening on %s", l.Addr())
+	SystemdNotify("READY=1")
+
+	// Run the daemon until termination
+	s.daemon.Run(ctx)
+	SystemdNotify("STOPPING=1")
+	srv.Stop()
+}
+
+// Query performs MDNS query and returns answers
+func (s *grpcServer) Query(ctx context.Context,
+	rq *api.QueryRequest) (*api.QueryResponse, error) {
+
+	question, err := grpcQuestion(rq)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := grpcConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.daemon.ExchangeWith(ctx, question, cfg)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	records := s.daemon.Records(question)
+
+	rsp := &api.QueryResponse{}
+	for _, rr := range records {
+		rsp.Answer = append(rsp.Answer, grpcRecord(rr))
+	}
+
+	for _, rr := range grpcAdditional(s.daemon.Records(nil), records) {
+		rsp.Additional = append(rsp.Additional, grpcRecord(rr))
+	}
+
+	return rsp, nil
+}
+
+// Browse discovers and resolves instances of the DNS-SD service type
+func (s *grpcServer) Browse(ctx context.Context,
+	rq *api.BrowseRequest) (*api.BrowseResponse, error) {
+
+	svctype := strings.TrimSuffix(rq.Type, ".")
+	svctype = dns.Fqdn(strings.TrimSuffix(svctype, ".local") + ".local")
+	if _, ok := dns.IsDomainName(svctype); !ok || rq.Type == "" {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid service type: %q", rq.Type)
+	}
+
+	cfg, err := grpcConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := s.daemon.BrowseWith(ctx, svctype, cfg)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	rsp := &api.BrowseResponse{}
+	for _, svc := range services {
+		rsp.Services = append(rsp.Services, &api.Service{
+			Instance:  svc.Instance,
+			Type:      svc.Type,
+			Host:      svc.Host,
+			Port:      uint32(svc.Port),
+			Addresses: svc.Addrs,
+			Txt:       svc.TXT,
+		})
+	}
+
+	return rsp, nil
+}
+
+// Watch streams events of records, that answer the question
+func (s *grpcServer) Watch(rq *api.QueryRequest,
+	stream api.Mcdig_WatchServer) error {
+
+	question, err := grpcQuestion(rq)
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+
+	cfg, err := grpcConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := s.daemon.Watch(question)
+	defer s.daemon.Unwatch(w)
+
+	exchanged := make(chan error, 1)
+	go func() {
+		exchanged <- s.daemon.ExchangeWith(ctx, question, cfg)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-exchanged:
+			if err != nil && ctx.Err() == nil {
+				return grpcError(err)
+			}
+			exchanged = nil
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted,
+					"client too slow")
+			}
+
+			err := stream.Send(grpcEvent(ev, time.Now()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcError converts error to the gRPC status error
+func grpcError(err error) error {
+	if s := status.FromContextError(err); s.Code() != codes.Unknown {
+		return s.Err()
+	}
+	return status.Errorf(codes.InvalidArgument, "%s", err)
+}
+
+// grpcQuestion creates the question from the request
+func grpcQuestion(rq *api.QueryRequest) ([]dns.Question, error) {
+	q := dns.Question{
+		Name:   rq.Name,
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	labels, ok := dns.IsDomainName(q.Name)
+	if !ok || q.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid name: %q", rq.Name)
+	}
+
+	if labels < 2 {
+		q.Name += ".local."
+	}
+	q.Name = dns.Fqdn(q.Name)
+
+	if rq.Type != "" {
+		q.Qtype, ok = dns.StringToType[strings.ToUpper(rq.Type)]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid type: %q", rq.Type)
+		}
+	}
+
+	if rq.Class != "" {
+		q.Qclass, ok = dns.StringToClass[strings.ToUpper(rq.Class)]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid class: %q", rq.Class)
+		}
+	}
+
+	return []dns.Question{q}, nil
+}
+
+// grpcConfig returns query settings: command line settings,
+// overridden by per-query parameters, passed by the client
+// as the request metadata (see api.Option)
+func grpcConfig(ctx context.Context) (QueryConfig, error) {
+	cfg := QueryConfigDefault()
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	get := func(key string) string {
+		if v := md.Get(key); len(v) != 0 {
+			return v[len(v)-1]
+		}
+		return ""
+	}
+
+	cfg.Iface = get(api.MetadataInterface)
+
+	cfg.Network = get(api.MetadataNetwork)
+	switch cfg.Network {
+	case "", "udp4", "udp6":
+	default:
+		return cfg, status.Errorf(codes.InvalidArgument,
+			"invalid %s: %q", api.MetadataNetwork, cfg.Network)
+	}
+
+	if v := get(api.MetadataTxCount); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, status.Errorf(codes.InvalidArgument,
+				"invalid %s: %q", api.MetadataTxCount, v)
+		}
+		cfg.TxCount = n
+	}
+
+	if v := get(api.MetadataTxPeriod); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, status.Errorf(codes.InvalidArgument,
+				"invalid %s: %q", api.MetadataTxPeriod, v)
+		}
+		cfg.TxPeriod = d
+	}
+
+	if v := get(api.MetadataQU); v != "" {
+		qu, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, status.Errorf(codes.InvalidArgument,
+				"invalid %s: %q", api.MetadataQU, v)
+		}
+		cfg.QU = qu
+	}
+
+	return cfg, nil
+}
+
+// grpcAdditional returns records, related to answers: records of
+// names, answers point to (PTR, SRV and CNAME targets), and address
+// records of targets of these records
+func grpcAdditional(records, answer []dns.RR) []dns.RR {
+	seen := make(map[string]bool)
+	for _, rr := range answer {
+		seen[dedupKey(rr)] = true
+	}
+
+	var out []dns.RR
+	related := answer
+
+	for round := 0; round < 2; round++ {
+		names := make(map[string]bool)
+		for _, rr := range related {
+			switch rr := rr.(type) {
+			case *dns.PTR:
+				names[strings.ToLower(rr.Ptr)] = true
+			case *dns.SRV:
+				names[strings.ToLower(rr.Target)] = true
+			case *dns.CNAME:
+				names[strings.ToLower(rr.Target)] = true
+			}
+		}
+
+		related = nil
+		for _, rr := range records {
+			key := dedupKey(rr)
+			if names[strings.ToLower(rr.Header().Name)] && !seen[key] {
+				seen[key] = true
+				related = append(related, rr)
+			}
+		}
+
+		out = append(out, related...)
+	}
+
+	return out
+}
+
+// grpcRecord converts record to its API representation
+func grpcRecord(rr dns.RR) *api.Record {
+	rec := snapshotRecordNew(rr)
+	return &api.Record{
+		Name:  rec.Name,
+		Type:  rec.Type,
+		Class: rec.Class,
+		Ttl:   rec.TTL,
+		Data:  rec.Data,
+	}
+}
+
+// grpcEvent converts Cache event to its API representation
+func grpcEvent(ev CacheEvent, now time.Time) *api.Event {
+	event := &api.Event{
+		Event:        ev.Name(),
+		Record:       grpcRecord(ev.RR),
+		TimeUnixNano: now.UnixNano(),
+	}
+
+	if ev.Meta.From != nil {
+		event.Source = ev.Meta.From.String()
+	}
+
+	if ev.Meta.IfIndex > 0 {
+		iface, err := net.InterfaceByIndex(ev.Meta.IfIndex)
+		if err == nil {
+			event.Interface = iface.Name
+		}
+	}
+
+	return event
+}
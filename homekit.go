@@ -0,0 +1,98 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// HomeKit accessories discovery preset
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// presetHomekit browses HomeKit accessories
+var presetHomekit = &preset{
+	title:  "HOMEKIT ACCESSORIES",
+	types:  []string{"_hap._tcp.local.", "_hap._udp.local."},
+	decode: homekitDecode,
+}
+
+// homekitCategories are accessory categories (the ci key)
+var homekitCategories = map[string]string{
+	"1":  "other",
+	"2":  "bridge",
+	"3":  "fan",
+	"4":  "garage door opener",
+	"5":  "lightbulb",
+	"6":  "door lock",
+	"7":  "outlet",
+	"8":  "switch",
+	"9":  "thermostat",
+	"10": "sensor",
+	"11": "security system",
+	"12": "door",
+	"13": "window",
+	"14": "window covering",
+	"15": "programmable switch",
+	"16": "range extender",
+	"17": "IP camera",
+	"18": "video doorbell",
+	"19": "air purifier",
+	"20": "heater",
+	"21": "air conditioner",
+	"22": "humidifier",
+	"23": "dehumidifier",
+	"28": "sprinkler",
+	"29": "faucet",
+	"30": "shower system",
+	"31": "television",
+	"32": "remote",
+}
+
+// Status flags (the sf key)
+const (
+	homekitNotPaired     = 1 << 0 // Not paired, pairing is possible
+	homekitNotConfigured = 1 << 1 // Wi-Fi is not configured
+	homekitProblem       = 1 << 2 // Problem detected
+)
+
+// homekitDecode decodes pairing status, category, model and
+// configuration number of the HomeKit accessory
+func homekitDecode(svc DnssdService, txt map[string]string) []presetField {
+	category := homekitCategories[txt["ci"]]
+	if category == "" {
+		category = txt["ci"]
+	}
+
+	return []presetField{
+		{"status", homekitStatus(txt["sf"])},
+		{"category", category},
+		{"model", txt["md"]},
+		{"id", txt["id"]},
+		{"config", txt["c#"]},
+		{"protocol", txt["pv"]},
+	}
+}
+
+// homekitStatus decodes the sf (status flags) key
+func homekitStatus(v string) string {
+	sf, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return v
+	}
+
+	status := []string{"paired"}
+	if sf&homekitNotPaired != 0 {
+		status[0] = "unpaired (pairing mode)"
+	}
+	if sf&homekitNotConfigured != 0 {
+		status = append(status, "Wi-Fi not configured")
+	}
+	if sf&homekitProblem != 0 {
+		status = append(status, "problem detected")
+	}
+
+	return strings.Join(status, ", ")
+}
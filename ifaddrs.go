@@ -7,13 +7,23 @@
 
 package main
 
-import "net"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sync"
+)
 
 // IfAddrs returns a slice of local (source) addresses for MDNS
 // queries
 //
 // It honors the following options:
 //   - OptIface
+//   - OptExcludeIfaces
+//   - OptAllIfaces
 //   - Opt4
 //   - Opt6
 //
@@ -21,27 +31,113 @@ import "net"
 // and two lists of network interfaces: one for IPv4 and one for
 // IPv6. Note, interfaces are only included into the list if they
 // are really in use, after address filtering
-func IfAddrs() (addrs []*net.UDPAddr, if4, if6 []net.Interface) {
+//
+// If network interfaces or their addresses can't be obtained
+// (e.g., on Android or in some containers), and OptIface is not set,
+// IfAddrs falls back to the degraded mode: it returns no addresses
+// and the single pseudo-interface (see ifaceDefault) per address
+// family, so the operating system chooses interfaces for sending
+// and joining multicast groups
+//
+// Interfaces, whose addresses can't be obtained, are skipped. It
+// returns error, if OptIface can't be used, or no usable local IP
+// addresses are found
+func IfAddrs() (addrs []*net.UDPAddr, if4, if6 []net.Interface,
+	err error) {
+
+	addrs, if4, if6, err = ifAddrsGet(false)
+	switch {
+	case err != nil && OptIface == "":
+		LogError("%s; using default interface (degraded mode)", err)
+		addrs, if4, if6 = ifAddrsDegraded()
+		return addrs, if4, if6, nil
+
+	case err != nil:
+		return nil, nil, nil, ifAddrsError{err}
+	}
+
+	// List must be non-empty
+	if len(addrs) == 0 {
+		err = errors.New("No local IP addresses found")
+		return nil, nil, nil, ifAddrsError{err}
+	}
+
+	return addrs, if4, if6, nil
+}
+
+// ifAddrsError is returned by IfAddrs, so it can be told apart
+// from other errors (see mainExitStatus)
+type ifAddrsError struct {
+	err error // The underlying error
+}
+
+// Error returns the error message
+func (e ifAddrsError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e ifAddrsError) Unwrap() error {
+	return e.err
+}
+
+// ifaceDefault is the pseudo-interface, used in degraded mode.
+// Its zero index lets the operating system choose the interface
+var ifaceDefault = net.Interface{
+	Index: 0,
+	Name:  "default",
+	Flags: net.FlagUp | net.FlagMulticast,
+}
+
+// ifAddrsDegraded returns IfAddrs result for the degraded mode
+func ifAddrsDegraded() (addrs []*net.UDPAddr, if4, if6 []net.Interface) {
+	if Opt4 {
+		if4 = []net.Interface{ifaceDefault}
+	}
+	if Opt6 {
+		if6 = []net.Interface{ifaceDefault}
+	}
+	return []*net.UDPAddr{}, if4, if6
+}
+
+// ifAddrsGet does the work of IfAddrs. If poll is true, it is
+// used for periodic polling of the network configuration, and
+// nothing is logged, and missed OptIface is not an error
+func ifAddrsGet(poll bool) (addrs []*net.UDPAddr,
+	if4, if6 []net.Interface, err error) {
+
 	// Obtain list of network interfaces
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		LogFatal("Can't get list of network interfaces: %s", err)
+		err = fmt.Errorf("Can't get list of network interfaces: %s",
+			err)
+		return
 	}
 
-	// Apply OptIface option, if set
-	if OptIface != "" {
-		for len(interfaces) != 0 {
-			if interfaces[0].Name == OptIface {
-				interfaces = interfaces[:1]
-				break
-			} else {
-				interfaces = interfaces[1:]
-			}
+	// Apply OptIface and OptExcludeIfaces options
+	selected := []net.Interface{}
+	matched := false
+	for _, iface := range interfaces {
+		if !ifaceSelected(iface.Name) {
+			continue
 		}
 
-		if len(interfaces) == 0 {
-			LogFatal("Unknown network interface: %q", OptIface)
+		matched = true
+		if skip := ifaceSkipReason(iface); skip != "" {
+			if !poll {
+				LogDebug("Skipping interface %s: %s",
+					iface.Name, skip)
+			}
+			continue
 		}
+
+		selected = append(selected, iface)
+	}
+
+	interfaces = selected
+	if OptIface != "" && !matched && !poll {
+		err = fmt.Errorf("Unknown network interface: %q", OptIface)
+		return
 	}
 
 	// Build list of addresses and interfaces
@@ -49,40 +145,26 @@ func IfAddrs() (addrs []*net.UDPAddr, if4, if6 []net.Interface) {
 	if4seen := make(map[int]bool)
 	if6seen := make(map[int]bool)
 
+	// Interfaces, whose addresses can't be obtained, are skipped.
+	// If it happens with all interfaces, it is an error
+	var failed error
+
 	for _, iface := range interfaces {
-		ifaddrs, err := iface.Addrs()
-		if err != nil {
-			LogFatal("%s: can't get interface addresses: %s", iface.Name, err)
+		ifaddrs, err2 := iface.Addrs()
+		if err2 != nil {
+			failed = fmt.Errorf("%s: can't get interface "+
+				"addresses: %s", iface.Name, err2)
+			if !poll {
+				LogDebug("Skipping interface %s: %s",
+					iface.Name, err2)
+			}
+			continue
 		}
 
 		for _, ifaddr := range ifaddrs {
-			ip := ifaddr.(*net.IPNet).IP
+			ip, _ := ifaddrUsable(ifaddr.(*net.IPNet).IP)
 			ip4 := ip.To4()
 
-			switch {
-			case ip.IsLoopback():
-				// Loopback addresses cannot be used for MDNS
-				ip = nil
-
-			case ip4 != nil:
-				// All IPv4 addresses are OK
-				ip = ip4
-
-			case !ip.IsLinkLocalUnicast():
-				// Only link-local IPv6 addresses are OK
-				ip = nil
-			}
-
-			// Honor IPv4/IPv6 options
-			if ip != nil {
-				if ip4 != nil && !Opt4 {
-					ip = nil
-				} else if ip4 == nil && !Opt6 {
-					ip = nil
-				}
-
-			}
-
 			// Add address and interface to the list
 			if ip != nil {
 				addr := &net.UDPAddr{
@@ -108,10 +190,274 @@ func IfAddrs() (addrs []*net.UDPAddr, if4, if6 []net.Interface) {
 		}
 	}
 
-	// List must be non-empty
-	if len(addrs) == 0 {
-		LogFatal("No local IP addresses found")
+	if len(addrs) == 0 && failed != nil {
+		err = failed
 	}
 
-	return addrs, if4, if6
+	return
+}
+
+// ifaddrUsable checks if interface address can be used as MDNS
+// source address. If it can, the address is returned, converted
+// to the appropriate form (4-byte for IPv4). Otherwise, nil is
+// returned and the reason explains, why address is not usable
+//
+// It honors the Opt4 and Opt6 options
+func ifaddrUsable(ip net.IP) (usable net.IP, reason string) {
+	ip4 := ip.To4()
+
+	switch {
+	case ip.IsLoopback():
+		// Loopback addresses cannot be used for MDNS
+		return nil, "loopback address"
+
+	case ip4 != nil && !Opt4:
+		return nil, "IPv4 not enabled"
+
+	case ip4 != nil:
+		// All IPv4 addresses are OK
+		return ip4, ""
+
+	case !ip.IsLinkLocalUnicast():
+		// Only link-local IPv6 addresses are OK
+		return nil, "not link-local"
+
+	case !Opt6:
+		return nil, "IPv6 not enabled"
+	}
+
+	return ip, ""
+}
+
+// ifaceVirtualPatterns contains name patterns of interfaces, known
+// to be virtual (container, VM and bridge plumbing), which are
+// useless for MDNS queries in most cases
+var ifaceVirtualPatterns = []string{
+	"veth*",
+	"vnet*",
+	"flannel*",
+	"cali*",
+}
+
+// ifaceBridgePatterns contains name patterns of bridges, created
+// for container and VM networks (Docker, libvirt, CNI, Podman).
+// They are virtual too, but used with OptBridges, so services,
+// published inside containers and VMs, can be discovered
+var ifaceBridgePatterns = []string{
+	"docker*",
+	"br-*",
+	"virbr*",
+	"cni*",
+	"podman*",
+}
+
+// ifaceTunnelPatterns contains name patterns of macOS tunnel
+// interfaces (VPN, iCloud Private Relay and so on). MDNS is not
+// used over them
+var ifaceTunnelPatterns = []string{
+	"utun*",
+	"ipsec*",
+}
+
+// ifaceAWDLPatterns contains name patterns of macOS peer-to-peer
+// interfaces: Apple Wireless Direct Link (AirDrop) and its low
+// latency companion. They are only used with OptAWDL
+var ifaceAWDLPatterns = []string{
+	"awdl*",
+	"llw*",
+}
+
+// ifaceSkipReason tells why interface should be skipped by default.
+// If interface is usable, it returns empty string
+//
+// It honors the OptAllIfaces, OptBridges and OptAWDL options.
+// Interfaces, explicitly selected by name (not by pattern) or by
+// their VRF, are never considered virtual, tunnel or AWDL
+func ifaceSkipReason(iface net.Interface) string {
+	if OptAllIfaces {
+		return ""
+	}
+
+	switch {
+	case iface.Flags&net.FlagUp == 0:
+		return "interface is down"
+
+	case iface.Flags&net.FlagLoopback != 0:
+		return "loopback interface"
+
+	case iface.Flags&net.FlagMulticast == 0:
+		return "interface is not multicast-capable"
+	}
+
+	if OptIface != iface.Name && IfaceVrf() == "" {
+		switch {
+		case ifaceMatches(iface.Name, ifaceVirtualPatterns):
+			return "virtual interface"
+
+		case !OptBridges &&
+			ifaceMatches(iface.Name, ifaceBridgePatterns):
+			return "virtual bridge interface (use --bridges)"
+
+		case ifaceMatches(iface.Name, ifaceTunnelPatterns):
+			return "tunnel interface"
+
+		case !OptAWDL && IfaceIsAWDL(iface.Name):
+			return "AWDL interface (use --awdl)"
+		}
+	}
+
+	return ""
+}
+
+// IfaceIsAWDL tells if interface is the macOS peer-to-peer (AWDL)
+// interface
+func IfaceIsAWDL(name string) bool {
+	return ifaceMatches(name, ifaceAWDLPatterns)
+}
+
+// ifaceMatches tells if interface name matches one of patterns
+func ifaceMatches(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IfaceVrf returns name of the VRF device, if OptIface specifies
+// one, or empty string otherwise
+//
+// The VRF device selects interfaces, enslaved to it, and sockets
+// are bound to it (see querySockControl)
+func IfaceVrf() string {
+	ifaceVrfOnce.Do(func() {
+		if OptIface != "" && VrfIs(OptIface) {
+			ifaceVrf = OptIface
+			LogDebug("Using VRF %s", ifaceVrf)
+		}
+	})
+
+	return ifaceVrf
+}
+
+// ifaceVrf is the IfaceVrf result, computed once, as network
+// namespace may change after options are parsed (see NetnsEnter)
+var (
+	ifaceVrf     string
+	ifaceVrfOnce sync.Once
+)
+
+// ifaceSelected tells if interface with the given name is selected
+// by the OptIface and OptExcludeIfaces options. If OptIface is the
+// VRF device, interfaces, enslaved to it, are selected
+//
+// Patterns are validated by optParse, so errors are ignored here
+func ifaceSelected(name string) bool {
+	if vrf := IfaceVrf(); vrf != "" {
+		if VrfMaster(name) != vrf {
+			return false
+		}
+	} else if OptIface != "" {
+		if match, _ := path.Match(OptIface, name); !match {
+			return false
+		}
+	}
+
+	for _, pattern := range OptExcludeIfaces {
+		if match, _ := path.Match(pattern, name); match {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IfAddrsPrint prints all network interfaces with their addresses,
+// explaining which of them will be used for MDNS queries and why
+//
+// It honors the same options as IfAddrs. Interfaces that don't
+// match OptIface and OptExcludeIfaces are not printed at all
+//
+// The returned error, if any, comes from w.Write() or from
+// obtaining the list of network interfaces
+func IfAddrsPrint(w io.Writer) error {
+	// Obtain list of network interfaces
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("Can't get list of network interfaces: %s",
+			err)
+	}
+
+	buf := bytes.Buffer{}
+
+	for _, iface := range interfaces {
+		if !ifaceSelected(iface.Name) {
+			continue
+		}
+
+		// Interface header
+		multicast := "no multicast"
+		if iface.Flags&net.FlagMulticast != 0 {
+			multicast = "multicast"
+		}
+
+		status := "down"
+		if iface.Flags&net.FlagUp != 0 {
+			status = "up"
+		}
+
+		fmt.Fprintf(&buf, "%s (index %d): %s, %s\n",
+			iface.Name, iface.Index, status, multicast)
+
+		skip := ifaceSkipReason(iface)
+		if skip != "" {
+			fmt.Fprintf(&buf, "    skipped: %s\n", skip)
+		}
+
+		// Interface addresses
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			fmt.Fprintf(&buf, "    can't get addresses: %s\n", err)
+			buf.WriteByte('\n')
+			continue
+		}
+
+		use4, use6 := false, false
+		for _, ifaddr := range ifaddrs {
+			ip := ifaddr.(*net.IPNet).IP
+			usable, reason := ifaddrUsable(ip)
+
+			if usable == nil {
+				fmt.Fprintf(&buf, "    %-28s skipped: %s\n",
+					ip, reason)
+				continue
+			}
+
+			fmt.Fprintf(&buf, "    %-28s usable\n", ip)
+			if skip == "" {
+				if usable.To4() != nil {
+					use4 = true
+				} else {
+					use6 = true
+				}
+			}
+		}
+
+		fmt.Fprintf(&buf, "    IPv4: %s\n", ifaddrsYesNo(use4))
+		fmt.Fprintf(&buf, "    IPv6: %s\n", ifaddrsYesNo(use6))
+		buf.WriteByte('\n')
+	}
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// ifaddrsYesNo formats boolean "will be used" flag for IfAddrsPrint
+func ifaddrsYesNo(v bool) string {
+	if v {
+		return "will be used"
+	}
+	return "will not be used"
 }
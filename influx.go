@@ -0,0 +1,112 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// InfluxDB line protocol output
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// influxOut is the line protocol output. It is non-nil if
+// the line protocol output is enabled. Protected by rspLock
+var influxOut io.Writer
+
+// ResponseInflux enables output in the InfluxDB line protocol.
+// In this mode, discovery events (or just received records,
+// outside of watch mode) are printed as the mcdig_record points,
+// and latencies of answers to our question, since the last query,
+// are printed as the mcdig_latency points
+func ResponseInflux(w io.Writer) {
+	rspLock.Lock()
+	influxOut = w
+	rspLock.Unlock()
+}
+
+// InfluxPrintRecords prints records as the mcdig_record points
+// of the "seen" event
+//
+// The returned error, if any, comes from w.Write()
+func InfluxPrintRecords(w io.Writer, rrs []dns.RR) error {
+	buf := &bytes.Buffer{}
+	now := JournalNow()
+
+	for _, rr := range rrs {
+		influxRecord(buf, "seen", rr, now)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// influxEventsPrint prints Cache events. Must be called under rspLock
+func influxEventsPrint(events []CacheEvent) {
+	buf := &bytes.Buffer{}
+	now := JournalNow()
+	for _, ev := range events {
+		influxRecord(buf, ev.Name(), ev.RR, now)
+	}
+	influxOut.Write(buf.Bytes())
+}
+
+// influxLatencyPrint prints latency of the response, if it answers
+// our question
+func influxLatencyPrint(msg *dns.Msg, meta SourceMeta) {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+
+	answered := false
+	for _, rr := range msg.Answer {
+		if responseMatches(rr, rspQuestion) {
+			answered = true
+		}
+	}
+
+	now := JournalNow()
+	latency, ok := metricsLatencySince(now)
+	if !answered || !ok {
+		return
+	}
+
+	fmt.Fprintf(influxOut, "mcdig_latency,responder=%s seconds=%g %d\n",
+		influxTag(meta.From.IP.String()), latency.Seconds(),
+		now.UnixNano())
+}
+
+// influxRecord formats the record as the mcdig_record point
+func influxRecord(buf *bytes.Buffer, event string, rr dns.RR,
+	now time.Time) {
+
+	hdr := rr.Header()
+	data := strings.TrimPrefix(rr.String(), hdr.String())
+
+	fmt.Fprintf(buf,
+		"mcdig_record,event=%s,name=%s,type=%s,class=%s "+
+			"ttl=%di,data=%s %d\n",
+		event,
+		influxTag(hdr.Name),
+		influxTag(dns.Type(hdr.Rrtype).String()),
+		influxTag(dns.Class(hdr.Class&^(1<<15)).String()),
+		hdr.Ttl,
+		influxString(data),
+		now.UnixNano())
+}
+
+// influxTag escapes the tag value
+func influxTag(s string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+// influxString formats the string field value
+func influxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
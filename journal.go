@@ -0,0 +1,333 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Session journal record and replay
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// journalMagic is the signature of the journal file
+const journalMagic = "MCDIG-JOURNAL-1\n"
+
+// Directions of journal events
+const (
+	journalTx = 'T' // Sent packet
+	journalRx = 'R' // Received packet
+)
+
+// journalEvent is the journal event: the sent or received packet
+//
+// In the file, event is encoded as follows (integers are in
+// network byte order):
+//
+//	direction  1 byte ('T' or 'R')
+//	time       8 bytes, Unix time in nanoseconds
+//	interface  1 byte of length, then interface name
+//	address    1 byte of length (0, 4 or 16), then IP address
+//	port       2 bytes
+//	packet     4 bytes of length, then packet bytes
+//
+// The address is the destination of sent packets and the source
+// of received ones
+type journalEvent struct {
+	dir    byte         // journalTx or journalRx
+	time   time.Time    // Event time
+	ifname string       // Interface name, "" if unknown
+	addr   *net.UDPAddr // Peer address
+	pkt    []byte       // Packet bytes
+}
+
+// Journal state
+var (
+	journalFile    *os.File       // Non-nil when recording
+	journalIfnames map[int]string // Interface names, by ifindex
+	journalTime    time.Time      // Replayed event time, if replaying
+	journalLock    sync.Mutex     // Access lock
+)
+
+// JournalOpen creates the OptJournal file and starts recording
+// of packet events
+func JournalOpen() error {
+	file, err := os.Create(OptJournal)
+	if err == nil {
+		_, err = file.Write([]byte(journalMagic))
+		if err != nil {
+			file.Close()
+		}
+	}
+
+	if err != nil {
+		return fileError{fmt.Errorf("--journal: %w", err)}
+	}
+
+	journalLock.Lock()
+	journalFile = file
+	journalIfnames = make(map[int]string)
+	journalLock.Unlock()
+
+	return nil
+}
+
+// JournalClose stops recording and closes the OptJournal file
+func JournalClose() error {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	if journalFile == nil {
+		return nil
+	}
+
+	err := journalFile.Close()
+	journalFile = nil
+
+	if err != nil {
+		err = fmt.Errorf("--journal: %s", err)
+	}
+
+	return err
+}
+
+// journalPacket records the packet event, if recording. The addr
+// is the destination of sent packet or source of the received one
+//
+// Errors are logged, and recording is stopped
+func journalPacket(dir byte, pkt []byte, addr *net.UDPAddr,
+	ifindex int) {
+
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	if journalFile == nil {
+		return
+	}
+
+	ifname, ok := journalIfnames[ifindex]
+	if !ok && ifindex != 0 {
+		if iface, err := net.InterfaceByIndex(ifindex); err == nil {
+			ifname = iface.Name
+		}
+		journalIfnames[ifindex] = ifname
+	}
+
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteByte(dir)
+	binary.Write(&buf, binary.BigEndian, time.Now().UnixNano())
+	buf.WriteByte(byte(len(ifname)))
+	buf.WriteString(ifname)
+	buf.WriteByte(byte(len(ip)))
+	buf.Write(ip)
+	binary.Write(&buf, binary.BigEndian, uint16(addr.Port))
+	binary.Write(&buf, binary.BigEndian, uint32(len(pkt)))
+	buf.Write(pkt)
+
+	_, err := journalFile.Write(buf.Bytes())
+	if err != nil {
+		LogError("--journal: %s; recording stopped", err)
+		journalFile.Close()
+		journalFile = nil
+	}
+}
+
+// JournalNow returns the current time. During and after journal
+// replay, it is the time of the last replayed event, so results
+// are rendered with the recorded timing and arrival times
+func JournalNow() time.Time {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	if !journalTime.IsZero() {
+		return journalTime
+	}
+
+	return time.Now()
+}
+
+// JournalQuestion returns the query message, recorded in the
+// journal file: the first sent packet
+func JournalQuestion(path string) (*dns.Msg, error) {
+	var rq *dns.Msg
+
+	err := journalRead(path, func(ev *journalEvent) error {
+		if ev.dir != journalTx {
+			return nil
+		}
+
+		rq = &dns.Msg{}
+		if err := rq.Unpack(ev.pkt); err != nil {
+			err = fmt.Errorf("%s: invalid query: %s", path, err)
+			return fileError{err}
+		}
+
+		return io.EOF
+	})
+
+	switch {
+	case err != nil:
+		return nil, err
+	case rq == nil:
+		err = fmt.Errorf("%s: no query recorded", path)
+		return nil, fileError{err}
+	}
+
+	// Clear the unicast-response bit, for printing
+	for i := range rq.Question {
+		rq.Question[i].Qclass &^= 1 << 15
+	}
+
+	return rq, nil
+}
+
+// JournalReplay replays packets, recorded in the journal file,
+// at their recorded times (see JournalNow), so collected records
+// are printed as usual, according to options. Sent packets are
+// only accounted, so latencies are computed as when recorded
+//
+// Packets, received via interfaces that don't exist on this host,
+// are replayed with unknown interface
+func JournalReplay(path string, rq *dns.Msg) error {
+	ResponseSetQuestion(rq.Question)
+	queryDupSetQuestion(rq.Question)
+
+	err := journalRead(path, func(ev *journalEvent) error {
+		journalLock.Lock()
+		journalTime = ev.time
+		journalLock.Unlock()
+
+		if ev.dir == journalTx {
+			metricsSent()
+			return nil
+		}
+
+		meta := SourceMeta{From: ev.addr}
+		if iface, err := net.InterfaceByName(ev.ifname); err == nil {
+			meta.IfIndex = iface.Index
+		}
+
+		queryUnpack(ev.pkt, meta, queryPacketInput)
+		return nil
+	})
+
+	queryMultiPkt.Flush()
+	return err
+}
+
+// journalRead reads the journal file and calls the callback for
+// each event. If callback returns io.EOF, reading is stopped
+// without error. Other errors are returned. Errors of reading
+// are returned as fileError
+func journalRead(path string, callback func(*journalEvent) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fileError{err}
+	}
+
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	magic := make([]byte, len(journalMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != journalMagic {
+		return fileError{fmt.Errorf("%s: not a journal file", path)}
+	}
+
+	for {
+		ev, err := journalReadEvent(r)
+		switch {
+		case err == io.EOF:
+			return nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			// Recording was interrupted
+			LogError("%s: truncated event ignored", path)
+			return nil
+		case err != nil:
+			return fileError{fmt.Errorf("%s: %s", path, err)}
+		}
+
+		err = callback(ev)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// journalReadEvent reads the next event. At the end of file,
+// it returns io.EOF
+func journalReadEvent(r *bufio.Reader) (*journalEvent, error) {
+	dir, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// The rest of event must be complete
+	read := func(data interface{}) {
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, data)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+	}
+
+	var t int64
+	var ifnameLen, ipLen uint8
+	var port uint16
+	var pktLen uint32
+
+	read(&t)
+	read(&ifnameLen)
+	ifname := make([]byte, ifnameLen)
+	read(ifname)
+	read(&ipLen)
+	ip := make([]byte, ipLen)
+	read(ip)
+	read(&port)
+	read(&pktLen)
+	if err == nil && pktLen > 65535 {
+		err = fmt.Errorf("invalid packet size %d", pktLen)
+		pktLen = 0
+	}
+	pkt := make([]byte, pktLen)
+	read(pkt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if dir != journalTx && dir != journalRx {
+		return nil, fmt.Errorf("invalid event direction %q", dir)
+	}
+
+	ev := &journalEvent{
+		dir:    dir,
+		time:   time.Unix(0, t),
+		ifname: string(ifname),
+		addr:   &net.UDPAddr{IP: net.IP(ip), Port: int(port)},
+		pkt:    pkt,
+	}
+
+	return ev, nil
+}
@@ -8,27 +8,44 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"os"
+	"strconv"
+	"sync"
 )
 
+// LevelVerbose is the log level of verbose debug messages
+const LevelVerbose = slog.LevelDebug - 4
+
+// logJournalSocket is the journald native protocol socket
+const logJournalSocket = "/run/systemd/journal/socket"
+
+// logLogger is the logger, used by the Log functions
+var logLogger = slog.New(&logHandler{sink: &logWriterSink{w: os.Stderr}})
+
+// logSink writes formatted log messages to their destination
+type logSink interface {
+	write(level slog.Level, msg []byte) error
+}
+
 // LogVerbose writes a verbose debug message
 func LogVerbose(format string, args ...interface{}) {
-	if OptVerbose {
-		fmt.Printf(format+"\n", args...)
-	}
+	logWrite(LevelVerbose, format, args...)
 }
 
 // LogDebug writes a debug message
 func LogDebug(format string, args ...interface{}) {
-	if OptDebug || OptVerbose {
-		fmt.Printf(format+"\n", args...)
-	}
+	logWrite(slog.LevelDebug, format, args...)
 }
 
 // LogError writes an error message
 func LogError(format string, args ...interface{}) {
-	fmt.Printf(format+"\n", args...)
+	logWrite(slog.LevelError, format, args...)
 }
 
 // LogFatal writes an error message and terminates the program
@@ -36,3 +53,204 @@ func LogFatal(format string, args ...interface{}) {
 	LogError(format, args...)
 	os.Exit(1)
 }
+
+// Logger returns the slog.Logger, used by the Log functions
+func Logger() *slog.Logger {
+	return logLogger
+}
+
+// LogInit configures logging according to OptLogFormat and
+// OptLogOutput. It doesn't return in a case of errors
+func LogInit() {
+	var sink logSink
+
+	// With OptLogToFile, OptLogOutput is always the file name
+	output := OptLogOutput
+	if OptLogToFile {
+		output = ""
+	}
+
+	switch output {
+	case "stdout":
+		sink = &logWriterSink{w: os.Stdout}
+
+	case "stderr":
+		sink = &logWriterSink{w: os.Stderr}
+
+	case "syslog":
+		var err error
+		sink, err = logSyslogOpen()
+		if err != nil {
+			LogFatal("syslog: %s", err)
+		}
+
+	case "journald":
+		conn, err := net.DialUnix("unixgram", nil,
+			&net.UnixAddr{Name: logJournalSocket, Net: "unixgram"})
+		if err != nil {
+			LogFatal("journald: %s", err)
+		}
+		sink = &logJournalSink{conn: conn}
+
+	default:
+		file, err := os.OpenFile(OptLogOutput,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			LogFatal("%s", err)
+		}
+		sink = &logWriterSink{w: file}
+	}
+
+	logLogger = slog.New(&logHandler{sink: sink})
+}
+
+// logWrite writes the message at the specified level
+func logWrite(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if logLogger.Enabled(ctx, level) {
+		logLogger.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+// logHandler is the slog.Handler, that formats records according
+// to OptLogFormat and writes them to the sink
+//
+// The "plain" format contains only the message (and attributes,
+// if any), the "text" and "json" formats are formats of the
+// slog.TextHandler and slog.JSONHandler
+type logHandler struct {
+	sink  logSink     // Destination
+	attrs []slog.Attr // Attributes, added by WithAttrs
+	group string      // Group, set by WithGroup
+}
+
+// Enabled tells if records of the level are logged. The level
+// depends on OptDebug and OptVerbose
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	switch {
+	case OptVerbose:
+		return level >= LevelVerbose
+	case OptDebug:
+		return level >= slog.LevelDebug
+	}
+	return level >= slog.LevelInfo
+}
+
+// Handle formats and writes the record
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	buf := &bytes.Buffer{}
+
+	opts := &slog.HandlerOptions{
+		Level:       LevelVerbose,
+		ReplaceAttr: logReplaceAttr,
+	}
+
+	var fmtr slog.Handler
+	switch OptLogFormat {
+	case "text":
+		fmtr = slog.NewTextHandler(buf, opts)
+	case "json":
+		fmtr = slog.NewJSONHandler(buf, opts)
+	default:
+		buf.WriteString(r.Message)
+		r.Attrs(func(a slog.Attr) bool {
+			fmt.Fprintf(buf, " %s", a)
+			return true
+		})
+		for _, a := range h.attrs {
+			fmt.Fprintf(buf, " %s", a)
+		}
+		buf.WriteByte('\n')
+		return h.sink.write(r.Level, buf.Bytes())
+	}
+
+	if h.attrs != nil {
+		fmtr = fmtr.WithAttrs(h.attrs)
+	}
+	if h.group != "" {
+		fmtr = fmtr.WithGroup(h.group)
+	}
+
+	err := fmtr.Handle(ctx, r)
+	if err == nil {
+		err = h.sink.write(r.Level, buf.Bytes())
+	}
+
+	return err
+}
+
+// WithAttrs returns a new handler with added attributes
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &h2
+}
+
+// WithGroup returns a new handler with the group
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.group = name
+	return &h2
+}
+
+// logReplaceAttr names the LevelVerbose level
+func logReplaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok &&
+			level == LevelVerbose {
+			a.Value = slog.StringValue("VERBOSE")
+		}
+	}
+	return a
+}
+
+// logWriterSink writes messages to io.Writer
+type logWriterSink struct {
+	w    io.Writer  // Destination
+	lock sync.Mutex // Serializes writes
+}
+
+// write writes the message
+func (s *logWriterSink) write(level slog.Level, msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.w.Write(msg)
+	return err
+}
+
+// logJournalSink writes messages to journald, using its native
+// protocol (see systemd.journal-fields(7))
+type logJournalSink struct {
+	conn *net.UnixConn // Journal socket
+}
+
+// write writes the message
+func (s *logJournalSink) write(level slog.Level, msg []byte) error {
+	priority := 7 // LOG_DEBUG
+	switch {
+	case level >= slog.LevelError:
+		priority = 3 // LOG_ERR
+	case level >= slog.LevelWarn:
+		priority = 4 // LOG_WARNING
+	case level >= slog.LevelInfo:
+		priority = 6 // LOG_INFO
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("PRIORITY=" + strconv.Itoa(priority) + "\n")
+	buf.WriteString("SYSLOG_IDENTIFIER=mcdig\n")
+
+	// MESSAGE may contain newlines, so it is written in the
+	// binary form: name, newline, 64-bit LE length, data, newline
+	text := bytes.TrimSuffix(msg, []byte("\n"))
+	buf.WriteString("MESSAGE\n")
+	size := uint64(len(text))
+	for i := uint(0); i < 8; i++ {
+		buf.WriteByte(byte(size >> (8 * i)))
+	}
+	buf.Write(text)
+	buf.WriteByte('\n')
+
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
@@ -8,29 +8,295 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// Sections, selected by OptSections
+const (
+	OptSectionQuestion = 1 << iota
+	OptSectionAnswer
+	OptSectionAuthority
+	OptSectionAdditional
+
+	OptSectionAll = OptSectionQuestion | OptSectionAnswer |
+		OptSectionAuthority | OptSectionAdditional
+)
+
 // Program options are global, but located and initialized here
 var (
+	// OptCommand specifies subcommand to execute. Empty string
+	// means the normal MDNS query
+	OptCommand = ""
+
+	// OptCommandArgs contains arguments of the subcommand
+	OptCommandArgs []string
+
+	// OptServices specifies services to be published by the
+	// announce command, as "instance,type,port[,key=value...]"
+	OptServices []string
+
+	// OptReflectServices specifies service types (e.g.,
+	// "_ipp._tcp.local."), reflected by the reflect command.
+	// If empty, all messages are reflected
+	OptReflectServices []string
+
+	// OptZone specifies the zone file for the respond command
+	OptZone = ""
+
+	// OptProtocol specifies name resolution protocol:
+	// "mdns" (the default) or "nbns" (NetBIOS name service)
+	OptProtocol = "mdns"
+
 	// optDomain specifies queried domain name
 	OptDomain = ""
 
-	// optQType specifies query type
-	OptQType = dns.TypeA
+	// OptQTypes specifies query types. Each type is queried
+	// by its own question in the same query
+	OptQTypes = []uint16{dns.TypeA}
+
+	// OptQService enables DNS-SD semantics of the domain, set
+	// by the "service" q-type: it is the service type, e.g.,
+	// "http" or "_http._tcp", queried for PTR records
+	OptQService = false
+
+	// OptQResolve enables resolve mode, set by the "resolve"
+	// q-type: the domain is the service instance name, which
+	// is resolved into SRV, TXT and address records
+	OptQResolve = false
 
 	// optQClass specifies query class
 	OptQClass uint16 = dns.ClassINET
 
-	// optIface specifies query interface
+	// optIface specifies query interface. It may be
+	// a shell-style pattern (e.g., "en*")
 	OptIface = ""
 
+	// OptNetns specifies the network namespace to run in
+	// (see NetnsEnter). If empty, the current one is used
+	OptNetns = ""
+
+	// OptServer, if not nil, specifies address of the responder
+	// to be queried directly via unicast
+	OptServer *net.UDPAddr
+
+	// OptWideArea enables wide-area (unicast DNS) queries
+	// instead of MDNS
+	OptWideArea = false
+
+	// OptPush enables DNS Push (RFC 8765) subscription in
+	// the wide-area watch mode
+	OptPush = false
+
+	// OptFallbackDNS enables fallback to the unicast DNS
+	// for names outside of the .local domain
+	OptFallbackDNS = false
+
+	// OptResolvConf specifies the resolver configuration file,
+	// where unicast DNS servers and search domains come from
+	OptResolvConf = "/etc/resolv.conf"
+
+	// OptDNSTimeout specifies the timeout of unicast DNS queries
+	OptDNSTimeout = 2 * time.Second
+
+	// OptExcludeIfaces specifies shell-style patterns of
+	// interfaces to be excluded
+	OptExcludeIfaces []string
+
+	// OptAllIfaces disables skipping of interfaces that are
+	// down, not multicast-capable or known to be virtual
+	OptAllIfaces = false
+
+	// OptBindDevice enables binding of sockets to their network
+	// interfaces (SO_BINDTODEVICE, Linux only)
+	OptBindDevice = false
+
+	// OptBridges enables use of bridges of container and VM
+	// networks (docker0, virbr0...), which are skipped by default
+	OptBridges = false
+
+	// OptAWDL enables use of the macOS peer-to-peer (AirDrop)
+	// interfaces, awdl0 and llw0, which are skipped by default
+	OptAWDL = false
+
+	// OptRcvBuf specifies socket receive buffer size (SO_RCVBUF).
+	// 0 means system default
+	OptRcvBuf = 0
+
+	// OptMcastLoop controls IP_MULTICAST_LOOP of MDNS sockets:
+	// "on", "off" or "" for the system default. "on" implies
+	// OptIncludeSelf
+	OptMcastLoop = ""
+
+	// OptIncludeSelf enables reception of messages from other
+	// programs on this host (see SelfIsLocal)
+	OptIncludeSelf = false
+
+	// OptStrictOnlink enables dropping of responses from
+	// off-link sources (see OnlinkInput)
+	OptStrictOnlink = false
+
+	// OptSourcePort specifies local port of unicast sockets
+	// (see QueryUnicastAddr). 0 means ephemeral port
+	OptSourcePort = 0
+
+	// OptWatch enables watch mode: queries are repeated forever
+	// with increasing intervals, records are printed as events
+	// when they appear, disappear or change. It implies OptStream
+	OptWatch = false
+
+	// OptStream enables printing of records as they arrive
+	OptStream = false
+
+	// OptForget disables deduplication of records in
+	// streaming mode
+	OptForget = false
+
+	// OptDedup specifies how received records are deduplicated:
+	//   - "name": records that differ only in TTL are duplicates
+	//   - "full": records are duplicates only if TTLs are equal
+	//   - "none": every received copy is kept
+	OptDedup = "name"
+
+	// OptQuietPeriod, if not 0, terminates the query once no new
+	// records have been received for this period
+	OptQuietPeriod time.Duration
+
+	// OptSnapshotInterval specifies how often the snapshot
+	// of known records is written to OptOutput in watch mode.
+	// 0 disables snapshots
+	OptSnapshotInterval time.Duration
+
+	// OptOutput specifies the output file. With OptSnapshotInterval,
+	// it is the snapshot file
+	OptOutput = ""
+
+	// OptAppend appends results to OptOutput instead of replacing it
+	OptAppend = false
+
+	// OptGroupBy, if not "", selects grouped view of collected
+	// records: "type" or "host" (see GroupPrint)
+	OptGroupBy = ""
+
+	// OptFormat specifies the output format: "text", "influx"
+	// (InfluxDB line protocol), "table" or "json"
+	OptFormat = "text"
+
+	// OptWebhook specifies the URL to POST notifications
+	// about appeared and disappeared services in watch mode
+	OptWebhook = ""
+
+	// OptServe specifies the address of the HTTP server, that
+	// serves the browse page and streams events of watch mode.
+	// If empty, server is disabled
+	OptServe = ""
+
+	// OptMetrics specifies the address to serve Prometheus
+	// metrics at, in watch mode. If empty, metrics are disabled
+	OptMetrics = ""
+
+	// OptPprof specifies the address to serve net/http/pprof
+	// profiles at, in long-running modes. If empty, profiles
+	// are not served
+	OptPprof = ""
+
+	// OptCacheFile specifies the persistent cache file.
+	// If empty, persistent cache is not used
+	OptCacheFile = ""
+
+	// OptCached enables answering from the persistent
+	// cache, without querying the network
+	OptCached = false
+
+	// OptAvahi enables the Avahi-compatible D-Bus interface
+	// of the grpc command
+	OptAvahi = false
+
+	// OptSections selects sections, printed by ResponsePrint,
+	// by the +[no]question, +[no]answer, +[no]authority,
+	// +[no]additional and +[no]all flags
+	OptSections = OptSectionAll
+
+	// OptTimestamps enables printing of records' arrival times
+	OptTimestamps = false
+
+	// OptDnssec enables the DO bit in unicast DNS queries,
+	// by the +[no]dnssec flag
+	OptDnssec = false
+
+	// OptRRHex enables printing of records' rdata as hex, by
+	// the +[no]rrhex flag
+	OptRRHex = false
+
+	// OptKeepBadPackets specifies directory, where malformed
+	// packets are saved
+	OptKeepBadPackets = ""
+
+	// OptSave specifies file, where records of the session
+	// are saved
+	OptSave = ""
+
+	// OptDiff specifies file with the saved session, changes
+	// since which are printed
+	OptDiff = ""
+
+	// OptJournal specifies file, where sent and received packets
+	// are recorded (see JournalOpen)
+	OptJournal = ""
+
+	// OptRounds enables the report of answers, elicited by
+	// each transmission round
+	OptRounds = false
+
+	// OptSizes enables the report of response sizes
+	OptSizes = false
+
+	// OptCompareIfaces enables comparison of records, received
+	// via each interface
+	OptCompareIfaces = false
+
+	// OptSummary enables the per-interface summary of responses
+	OptSummary = false
+
+	// OptTui enables the terminal UI browser
+	OptTui = false
+
+	// OptLogFormat specifies the log format: "plain" (message
+	// only), "text" or "json"
+	OptLogFormat = "plain"
+
+	// OptLogOutput specifies the log destination: "stdout",
+	// "stderr", "syslog", "journald" or the file name
+	OptLogOutput = "stderr"
+
+	// OptLogToFile means OptLogOutput is the file name, even if
+	// it matches other destinations (set by --log-file)
+	OptLogToFile = false
+
+	// OptRate specifies the rate of the stress and bench
+	// commands queries, per second
+	OptRate = 20
+
+	// OptMaxRate specifies the maximum count of records, printed
+	// per second in streaming mode. 0 means unlimited
+	OptMaxRate = 0
+
+	// OptDedupSize specifies the size of deduplication cache
+	// in streaming mode, in records
+	OptDedupSize = 4096
+
 	// opt4/opt6 specifies IPv4/IPv6 transport. If none is
 	// set, the default is used
 	Opt4 = false
@@ -46,6 +312,13 @@ var (
 	// OptQueryTime specifies the whole query wait time
 	OptQueryTime = 2500 * time.Millisecond
 
+	// OptAdaptive stops retransmissions once matching
+	// answer is received
+	OptAdaptive = false
+
+	// OptNoJitter disables random delay before the first query
+	OptNoJitter = false
+
 	// OptDebug enables debugging
 	OptDebug = false
 
@@ -54,38 +327,530 @@ var (
 	OptVerbose = false
 )
 
+// optWithArg lists options that require argument
+var optWithArg = map[string]bool{
+	"-p":                  true,
+	"-c":                  true,
+	"--exclude-iface":     true,
+	"--rcvbuf":            true,
+	"--source-port":       true,
+	"--mcast-loop":        true,
+	"--dedup-size":        true,
+	"--max-rate":          true,
+	"--dedup":             true,
+	"--protocol":          true,
+	"--service":           true,
+	"--zone":              true,
+	"--reflect-service":   true,
+	"--rate":              true,
+	"--snapshot-interval": true,
+	"--quiet-period":      true,
+	"--resolv-conf":       true,
+	"--dns-timeout":       true,
+	"-o":                  true,
+	"--output":            true,
+	"--cache-file":        true,
+	"--metrics":           true,
+	"--pprof":             true,
+	"--format":            true,
+	"--group-by":          true,
+	"--webhook":           true,
+	"--serve":             true,
+	"--log-format":        true,
+	"--log-output":        true,
+	"--log-file":          true,
+	"--interface":         true,
+	"--netns":             true,
+	"--save":              true,
+	"--diff":              true,
+	"--keep-bad-packets":  true,
+	"--journal":           true,
+}
+
+// Ranges of duration options
+const (
+	optMinTxPeriod         = 10 * time.Millisecond
+	optMaxTxPeriod         = time.Hour
+	optMinQuietPeriod      = 10 * time.Millisecond
+	optMaxQuietPeriod      = time.Hour
+	optMinSnapshotInterval = time.Second
+	optMaxSnapshotInterval = 24 * time.Hour
+	optMinDNSTimeout       = 10 * time.Millisecond
+	optMaxDNSTimeout       = time.Minute
+)
+
+// optLongNames maps GNU-style long names of options to their
+// short forms
+var optLongNames = map[string]string{
+	"--ipv4":    "-4",
+	"--ipv6":    "-6",
+	"--debug":   "-d",
+	"--verbose": "-v",
+	"--period":  "-p",
+	"--count":   "-c",
+}
+
+// optCommand describes a subcommand
+type optCommand struct {
+	minArgs, maxArgs int    // Min/max count of arguments; -1 is unlimited
+	missed           string // Description of missed argument
+}
+
+// optCommands lists subcommands
+var optCommands = map[string]optCommand{
+	"interfaces":  {0, 0, ""},
+	"domains":     {0, 0, ""},
+	"browse-all":  {0, 0, ""},
+	"printers":    {0, 0, ""},
+	"media":       {0, 0, ""},
+	"matter":      {0, 0, ""},
+	"homekit":     {0, 0, ""},
+	"shares":      {0, 0, ""},
+	"announce":    {1, -1, "host name"},
+	"respond":     {0, 0, ""},
+	"reflect":     {0, 0, ""},
+	"proxy":       {0, 1, ""},
+	"grpc":        {0, 1, ""},
+	"probe":       {1, -1, "host name"},
+	"conformance": {1, 1, "host name"},
+	"stress":      {1, 1, "host name"},
+	"bench":       {1, 1, "host name"},
+	"diff":        {2, 2, "session file"},
+	"render":      {1, 1, "journal file"},
+}
+
 // usage prints detailed usage and exits
 func usage() {
 	const help = "" +
 		"Usage:\n" +
 		"    mcdig [@interface] [options] domain [q-type] [q-class]\n" +
+		"    mcdig @address [options] domain [q-type] [q-class]\n" +
+		"    mcdig [@interface] [options] interfaces\n" +
+		"    mcdig [options] domains\n" +
+		"    mcdig [@interface] [options] browse-all\n" +
+		"    mcdig [@interface] [options] printers\n" +
+		"    mcdig [@interface] [options] media\n" +
+		"    mcdig [@interface] [options] matter\n" +
+		"    mcdig [@interface] [options] homekit\n" +
+		"    mcdig [@interface] [options] shares\n" +
+		"    mcdig [@interface] [options] announce name [address...]\n" +
+		"    mcdig [@interface] [options] probe name [address...]\n" +
+		"    mcdig [@interface] [options] conformance name\n" +
+		"    mcdig [@interface|@address] [options] stress name\n" +
+		"    mcdig [@interface|@address] [options] bench name\n" +
+		"    mcdig [@interface] [options] respond --zone file\n" +
+		"    mcdig [@interface] [options] reflect\n" +
+		"    mcdig [@interface] [options] proxy [address[:port]]\n" +
+		"    mcdig [@interface] [options] grpc [address:port]\n" +
+		"    mcdig [options] diff old.json new.json\n" +
+		"    mcdig [options] render journal\n" +
+		"\n" +
+		"The interfaces command lists network interfaces and their\n" +
+		"addresses and explains, which of them will be used for\n" +
+		"MDNS queries\n" +
+		"\n" +
+		"The domains command discovers wide-area DNS-SD browse\n" +
+		"domains in the host's search domains, via unicast DNS\n" +
+		"\n" +
+		"The browse-all command discovers all DNS-SD service types,\n" +
+		"browses and resolves their instances and prints report,\n" +
+		"grouped by service type\n" +
+		"\n" +
+		"The printers command discovers printers (IPP, IPPS and raw\n" +
+		"port printing) and prints their capabilities, decoded from\n" +
+		"TXT records (queue, formats, color, duplex, AirPrint)\n" +
+		"\n" +
+		"The media command discovers streaming devices (Chromecast,\n" +
+		"AirPlay) with their names and models, decoded the same way\n" +
+		"\n" +
+		"The matter command discovers Matter nodes, commissionable\n" +
+		"devices (discriminator, vendor and product IDs, commissioning\n" +
+		"mode) and Thread border routers\n" +
+		"\n" +
+		"The homekit command discovers HomeKit accessories with their\n" +
+		"pairing status (accessories in pairing mode are unpaired),\n" +
+		"category and configuration number\n" +
+		"\n" +
+		"The shares command discovers file servers (SMB, AFP, NFS,\n" +
+		"SFTP) and checks, if they are reachable via TCP\n" +
+		"\n" +
+		"The announce command publishes the host name with its addresses\n" +
+		"(if none given, addresses of the used interfaces) and services\n" +
+		"(see --service), until terminated. Records are probed for\n" +
+		"uniqueness and announced, as required by RFC 6762\n" +
+		"\n" +
+		"The probe command only probes the host name and services, the\n" +
+		"same way, and reports if they are already in use by other host\n" +
+		"(exit status is 2 in this case)\n" +
+		"\n" +
+		"The conformance command tests the responder of the host name\n" +
+		"for RFC 6762 conformance (QU and legacy queries, known-answer\n" +
+		"suppression, NSEC, TTLs, cache-flush bit) and prints report\n" +
+		"(exit status is 2 if some checks failed)\n" +
+		"\n" +
+		"The stress command sends bursts of valid and edge-case queries\n" +
+		"for the host name to its responder (resolved via MDNS, unless\n" +
+		"@address given), count queries of each kind at the specified\n" +
+		"rate, and measures answer rate and latency\n" +
+		"\n" +
+		"The bench command sends count sequential queries for the host\n" +
+		"name to its responder, the same way, each after the answer to\n" +
+		"the previous one (or 1s timeout), at up to the specified rate,\n" +
+		"and prints latency distribution and loss\n" +
+		"\n" +
+		"The respond command publishes records, loaded from the zone\n" +
+		"file (relative names are relative to .local), the same way\n" +
+		"\n" +
+		"The reflect command relays MDNS messages between the selected\n" +
+		"interfaces (at least two), e.g., between the IoT VLAN and LAN\n" +
+		"\n" +
+		"The proxy command runs unicast DNS server (UDP and TCP) on the\n" +
+		"specified address (default is %s), that answers queries\n" +
+		"for names in the .local domain by performing MDNS lookups\n" +
+		"\n" +
+		"The grpc command runs gRPC server on the specified address\n" +
+		"(default is %s), that performs MDNS queries, DNS-SD\n" +
+		"browsing and watching on behalf of clients (see api/mcdig.proto)\n" +
+		"\n" +
+		"The diff command compares two sessions, saved by --save\n" +
+		"(or snapshots), and prints added (+), removed (-) and changed\n" +
+		"(~) records (exit status is 2 if sessions differ)\n" +
+		"\n" +
+		"The render command replays packets, recorded by --journal,\n" +
+		"and prints results as if the query was run now, so the same\n" +
+		"capture may be printed with different options (e.g., --format)\n" +
+		"\n" +
+		"The proxy and grpc commands support systemd socket activation\n" +
+		"(passed sockets are used instead of the address), and these\n" +
+		"and other long-running commands notify systemd of readiness\n" +
+		"(Type=notify services)\n" +
+		"\n" +
+		"To query a domain which name matches a command name,\n" +
+		"use the full name (e.g., interfaces.local) instead\n" +
 		"\n" +
 		"Options may be intermixed with other parameters.\n" +
+		"Long options take argument as --name value or --name=value.\n" +
+		"Short options may be combined (e.g., -46d or -dc5).\n" +
 		"Use -- to terminate options list.\n" +
 		"\n" +
-		"The @interface specifies network interface (by name)\n" +
-		"If missed, all active interfaces are used\n" +
+		"Default options may be set by the MCDIG_OPTS environment\n" +
+		"variable (e.g., MCDIG_OPTS=\"-4 @eth0 +noall +answer\").\n" +
+		"They are parsed before the command line options, so command\n" +
+		"line options override them.\n" +
+		"\n" +
+		"The @interface specifies network interface (by name\n" +
+		"or shell-style pattern, e.g., @en*)\n" +
+		"If missed, all active interfaces are used. On Linux, it may\n" +
+		"be the VRF device (e.g., @vrf-blue): interfaces of this VRF\n" +
+		"are used then, and sockets are bound to the VRF\n" +
+		"\n" +
+		"The @address (e.g., @192.168.1.40 or @fe80::1%%eth0) specifies\n" +
+		"IP address of the responder to be queried directly via unicast\n" +
+		"\n" +
+		"The q-type is the record type (default is A) or alias: addr\n" +
+		"(A and AAAA) or service (PTR for the service type, e.g., http\n" +
+		"or _http._tcp, in the DNS-SD sense) or resolve (SRV and TXT\n" +
+		"of the service instance and addresses of its target host;\n" +
+		"the query completes as soon as all of them are received, and\n" +
+		"retransmissions ask only for missing records). Types and\n" +
+		"aliases may be combined with '+' (e.g., srv+txt)\n" +
+		"\n" +
+		"Responses to the query with non-zero RCODE (e.g., REFUSED or\n" +
+		"NOTIMP, but not NXDOMAIN, which is the negative answer) are\n" +
+		"not merged with results, but reported after them by source\n" +
+		"(exit status is 3 in this case, so \"responder has refused\"\n" +
+		"differs from \"no responders\", which is not an error)\n" +
+		"\n" +
+		"NSEC records, that assert absence of the queried type of the\n" +
+		"queried name, are reported after results as NXRRSET verdicts,\n" +
+		"unless the type is received from other responders by the end\n" +
+		"of the query (if no question is answered at all, exit status\n" +
+		"is 4, so \"the type does not exist\" differs from silence)\n" +
+		"\n" +
+		"Errors are reported with exit status 1, except when no network\n" +
+		"interfaces or addresses can be used (exit status is 5),\n" +
+		"sockets can't be created, e.g., due to missing permissions or\n" +
+		"the port in use (exit status is 6), the unicast DNS or DNS Push\n" +
+		"query can't be performed (exit status is 7) or files, given by\n" +
+		"options or arguments, can't be read or written (exit status is 8)\n" +
 		"\n" +
 		"Options are:\n" +
-		"    -4         use IPv4 (the default, may be combined with -6)\n" +
-		"    -6         use IPv6 (may be combined with -4)\n" +
-		"    -d         enable debugging\n" +
-		"    -v         enable verbose debugging\n" +
-		"    -p period  MDNS query period, milliseconds (default is %d)\n" +
-		"    -c count   MDNS query count, before exit (default is %d)\n" +
-		"    -h         print help screen and exit\n" +
+		"    -4, --ipv4 use IPv4 (the default, may be combined with -6)\n" +
+		"    -6, --ipv6 use IPv6 (may be combined with -4)\n" +
+		"    -d, --debug\n" +
+		"               enable debugging\n" +
+		"    -v, --verbose\n" +
+		"               enable verbose debugging\n" +
+		"    -p period, --period period\n" +
+		"               MDNS query period, as duration (e.g., 250ms\n" +
+		"               or 2s) or milliseconds (default is %s)\n" +
+		"    -c count, --count count\n" +
+		"               MDNS query count, before exit (default is %d)\n" +
+		"    --interface interface|address\n" +
+		"               the same as @interface or @address\n" +
+		"    --netns name|path\n" +
+		"               run in the network namespace, specified by\n" +
+		"               name (see ip-netns(8)) or path (e.g.,\n" +
+		"               /proc/PID/ns/net), e.g., to probe container\n" +
+		"               networks from the host (Linux only)\n" +
+		"    --all-ifaces\n" +
+		"               don't skip interfaces that are down, not\n" +
+		"               multicast-capable, virtual (veth, docker...)\n" +
+		"               or tunnels (macOS utun, ipsec)\n" +
+		"    --bridges  use bridges of container and VM networks\n" +
+		"               (docker0, br-*, virbr0, cni0, podman0), skipped\n" +
+		"               by default as virtual, to discover services\n" +
+		"               published inside containers and VMs\n" +
+		"    --awdl     use macOS peer-to-peer (AirDrop) interfaces\n" +
+		"               awdl0 and llw0, skipped by default\n" +
+		"    --bind-device\n" +
+		"               bind sockets to their interfaces (Linux only)\n" +
+		"    --exclude-iface pattern\n" +
+		"               exclude interfaces that match the shell-style\n" +
+		"               pattern (may be used multiple times)\n" +
+		"    --protocol mdns|nbns\n" +
+		"               name resolution protocol (default is mdns).\n" +
+		"               With nbns, NetBIOS name is queried via\n" +
+		"               IPv4 broadcast; q-type and q-class are ignored\n" +
+		"    --wide-area\n" +
+		"               query via unicast DNS instead of MDNS\n" +
+		"               (for wide-area DNS-SD browsing)\n" +
+		"    --push     with --wide-area and --watch, subscribe to\n" +
+		"               changes using DNS Push over TLS (RFC 8765)\n" +
+		"    --fallback-dns\n" +
+		"               if MDNS gives no answer for non-.local name,\n" +
+		"               query system's unicast DNS servers\n" +
+		"    --resolv-conf file\n" +
+		"               with --wide-area and --fallback-dns, take\n" +
+		"               unicast DNS servers and search domains from\n" +
+		"               the file (default is %s)\n" +
+		"    --dns-timeout period\n" +
+		"               with --wide-area and --fallback-dns, timeout\n" +
+		"               of unicast DNS queries (default is %s)\n" +
+		"    --adaptive stop retransmissions once answer is received\n" +
+		"    --keep-bad-packets dir\n" +
+		"               save packets, that can't be parsed, into the\n" +
+		"               dir (.bin files with .json source metadata)\n" +
+		"               and print counts of parse errors by category\n" +
+		"               at the end of the run\n" +
+		"    --no-jitter\n" +
+		"               don't delay the first query by random 20-120 ms\n" +
+		"    --quiet-period period\n" +
+		"               terminate the query once no new records have\n" +
+		"               arrived for the period (e.g., 500ms), instead\n" +
+		"               of after -c queries and the period after them\n" +
+		"    --rounds   at the end of the run, print count of new\n" +
+		"               responders and answers, elicited by each\n" +
+		"               transmission round, to help tuning -c and -p\n" +
+		"    --sizes    at the end of the run, print wire size of each\n" +
+		"               response, savings by name compression and\n" +
+		"               whether it approaches the safe size (1472\n" +
+		"               bytes for IPv4, 1232 for IPv6)\n" +
+		"    --compare-ifaces\n" +
+		"               at the end of the run, print which records were\n" +
+		"               received via which interfaces (+ visible, - not)\n" +
+		"               e.g., to find segments that filter multicast\n" +
+		"    --summary  at the end of the run, print count of responses\n" +
+		"               and unique records, received via each interface\n" +
+		"               and count of packets, dropped by the kernel due\n" +
+		"               to socket receive queue overflow (Linux only)\n" +
+		"    --timestamps\n" +
+		"               print arrival time of each record (first and\n" +
+		"               last seen, if records are printed at the end)\n" +
+		"    --tui      run interactive terminal browser of DNS-SD\n" +
+		"               services. The domain, if specified, is the\n" +
+		"               service type to browse (e.g., http)\n" +
+		"    --watch    run forever, repeating queries with increasing\n" +
+		"               intervals (up to an hour); implies --stream.\n" +
+		"               Records are printed as events: + (appeared),\n" +
+		"               - (expired or goodbye) and ~ (changed).\n" +
+		"               SIGUSR1 prints snapshot of all alive records.\n" +
+		"               Interfaces that appear or disappear while\n" +
+		"               running are picked up automatically, and\n" +
+		"               queries are re-sent when network changes\n" +
+		"    --snapshot-interval interval\n" +
+		"               with --watch, periodically write all alive\n" +
+		"               records to the --output file, as JSON\n" +
+		"               (interval is like 60s or 5m)\n" +
+		"    -o file, --output file\n" +
+		"               write results to file instead of stdout. The\n" +
+		"               file is replaced atomically, unless results are\n" +
+		"               streamed. With --snapshot-interval, this is the\n" +
+		"               snapshot file\n" +
+		"    --append   append results to the --output file\n" +
+		"    --format text|influx|table|json\n" +
+		"               output format (default is text). With influx,\n" +
+		"               records (events, with --watch) and answer\n" +
+		"               latencies are printed in InfluxDB line protocol.\n" +
+		"               With table, service instances are printed as\n" +
+		"               table (instance, host, port, addresses, key TXT\n" +
+		"               fields), e.g., for service, resolve or browse-all.\n" +
+		"               With json, records are printed as JSON, in the\n" +
+		"               same format as --save files\n" +
+		"    --group-by type|host\n" +
+		"               print services and hosts, resolved from\n" +
+		"               records, grouped by service type (type, its\n" +
+		"               instances and their details) or by host (host,\n" +
+		"               its addresses and services)\n" +
+		"    --webhook url\n" +
+		"               with --watch, POST JSON notification to the\n" +
+		"               http(s) url when service appears or disappears\n" +
+		"    --serve addr\n" +
+		"               with --watch, serve the browse page at\n" +
+		"               http://addr/ and stream events as JSON via\n" +
+		"               Server-Sent Events at http://addr/events\n" +
+		"    --metrics addr\n" +
+		"               with --watch, serve Prometheus metrics at\n" +
+		"               http://addr/metrics (e.g., :9353)\n" +
+		"    --pprof addr\n" +
+		"               with --watch, --tui and long-running commands\n" +
+		"               (announce, respond, reflect, proxy, grpc),\n" +
+		"               serve Go runtime profiles (memory, goroutines\n" +
+		"               and so on) at http://addr/debug/pprof/\n" +
+		"    --cache-file file\n" +
+		"               remember discovered records in the file across\n" +
+		"               runs, and print changes since the previous run\n" +
+		"               (+ new record, - record not seen anymore)\n" +
+		"    --save file\n" +
+		"               save discovered records into the file (JSON)\n" +
+		"    --diff file\n" +
+		"               print changes of records since the session,\n" +
+		"               saved in the file by --save\n" +
+		"    --journal file\n" +
+		"               record sent and received packets into the\n" +
+		"               file, to be printed later by render\n" +
+		"    --cached   with --cache-file, print records from the file,\n" +
+		"               with their last seen times, without querying\n" +
+		"    --stream   print records as they arrive\n" +
+		"    --forget   with --stream, don't remember printed records\n" +
+		"               (duplicates will be printed)\n" +
+		"    --no-dedup show every received copy of records (e.g., to\n" +
+		"               see retransmissions and announcement rates)\n" +
+		"    --dedup name|full\n" +
+		"               with name, records that differ only in TTL are\n" +
+		"               duplicates (the default). With full, records\n" +
+		"               with different TTLs are shown separately\n" +
+		"    --dedup-size count\n" +
+		"               with --stream, remember up to count recently\n" +
+		"               printed records, for deduplication (default is %d)\n" +
+		"    --max-rate count\n" +
+		"               with --stream, print up to count records per\n" +
+		"               second. Other records are aggregated: once per\n" +
+		"               second, identical records are printed once,\n" +
+		"               with count of copies (e.g., on noisy networks)\n" +
+		"    --service instance,type,port[,key=value...]\n" +
+		"               with announce or probe, DNS-SD service (e.g.,\n" +
+		"               \"My Web,_http._tcp,80,path=/\"); may be used\n" +
+		"               multiple times\n" +
+		"    --zone file\n" +
+		"               with respond, the zone file to load records from\n" +
+		"    --reflect-service type\n" +
+		"               with reflect, only relay messages related to\n" +
+		"               the service type (e.g., _ipp._tcp); may be\n" +
+		"               used multiple times\n" +
+		"    --avahi    with grpc, also register on the D-Bus system\n" +
+		"               bus as org.freedesktop.Avahi and serve the\n" +
+		"               subset of Avahi API (service browsing and\n" +
+		"               resolving), for Avahi clients\n" +
+		"    --rate rate\n" +
+		"               with stress and bench, queries per second,\n" +
+		"               1 to 1000000000 (default is %d)\n" +
+		"    --log-format plain|text|json\n" +
+		"               format of log messages (default is plain,\n" +
+		"               the message only)\n" +
+		"    --log-output stdout|stderr|syslog|journald|file\n" +
+		"               destination of log messages (default is stderr)\n" +
+		"    --log-file file\n" +
+		"               write log messages to file (like --log-output,\n" +
+		"               but the argument is always the file name)\n" +
+		"    --rcvbuf size\n" +
+		"               socket receive buffer size, bytes\n" +
+		"    --include-self\n" +
+		"               accept messages from other programs on this\n" +
+		"               host, so local responders (e.g., Avahi) can be\n" +
+		"               queried. Our own messages are always ignored\n" +
+		"    --strict-onlink\n" +
+		"               drop responses from sources, that are not on\n" +
+		"               local subnets (RFC 6762, section 11). Without\n" +
+		"               this option, they are accepted with warning\n" +
+		"    --mcast-loop on|off\n" +
+		"               with on, multicast loopback is enabled and\n" +
+		"               implies --include-self. With off, our queries\n" +
+		"               are not looped back (and not seen by local\n" +
+		"               responders). By default, loopback is system\n" +
+		"               default\n" +
+		"    --source-port port\n" +
+		"               local port of unicast queries (to @address,\n" +
+		"               and of stress, bench, conformance and nbns);\n" +
+		"               0 (the default) means ephemeral port. With\n" +
+		"               5353, queries are not legacy (RFC 6762,\n" +
+		"               section 6.7)\n" +
+		"    -h, --help print help screen and exit\n" +
+		"\n" +
+		"Output flags (dig-style) are:\n" +
+		"    +[no]question    print the QUESTION PSEUDOSECTION\n" +
+		"    +[no]answer      print the ANSWER SECTION\n" +
+		"    +[no]authority   print the AUTHORITY SECTION\n" +
+		"    +[no]additional  print the ADDITIONAL SECTION\n" +
+		"    +[no]all         set or clear all the above flags\n" +
+		"    +[no]dnssec      request DNSSEC records (RRSIG...) in\n" +
+		"                     unicast DNS queries (the DO bit)\n" +
+		"    +[no]rrhex       print rdata of records as hex (e.g., to\n" +
+		"                     inspect binary TXT values)\n" +
+		"Flags are applied in order, e.g., +noall +answer prints\n" +
+		"only the ANSWER SECTION\n" +
 		""
 
-	fmt.Printf(help, OptTxPeriod/time.Millisecond, OptTxCount)
+	fmt.Printf(help, proxyDefaultAddr, grpcDefaultAddr,
+		OptTxPeriod,
+		OptTxCount, OptResolvConf, OptDNSTimeout,
+		OptDedupSize, OptRate)
 	os.Exit(0)
 }
 
 // usageError prints usage error and exits
 func usageError(format string, args ...interface{}) {
-	fmt.Printf(format+"\n"+"Try mcdig -h for more information\n", args...)
+	fmt.Fprintf(os.Stderr, format+"\n"+"Try mcdig -h for more information\n", args...)
 	os.Exit(1)
 }
 
+// Exit statuses of errors, by kind (see mainExitStatus)
+const (
+	mainExitError      = 1 // Other errors
+	mainExitInterfaces = 5 // No usable interfaces or addresses
+	mainExitSocket     = 6 // Socket can't be created
+	mainExitWideArea   = 7 // Unicast DNS or DNS Push failed
+	mainExitFile       = 8 // File can't be read or written
+)
+
+// mainExitStatus returns exit status for the error, by its kind
+func mainExitStatus(err error) int {
+	var ifErr ifAddrsError
+	var sockErr querySocketError
+	var wideErr wideAreaError
+	var fileErr fileError
+
+	switch {
+	case errors.Is(err, errQueryNoInterfaces), errors.As(err, &ifErr):
+		return mainExitInterfaces
+	case errors.As(err, &sockErr):
+		return mainExitSocket
+	case errors.As(err, &wideErr):
+		return mainExitWideArea
+	case errors.As(err, &fileErr):
+		return mainExitFile
+	}
+
+	return mainExitError
+}
+
+// mainFatal reports the error and exits with the exit status
+// of its kind (see mainExitStatus)
+func mainFatal(err error) {
+	LogError("%s", err)
+	os.Exit(mainExitStatus(err))
+}
+
 // optParse parses command-line options.
 // This function doesn't return in a case of errors
 func optParse() {
@@ -94,42 +859,83 @@ func optParse() {
 		usage()
 	}
 
-	// Split command line into position arguments and options
-	type option struct{ Name, Val string }
+	// Split command line into position arguments and options.
+	// Options from the MCDIG_OPTS environment variable come first,
+	// so command line options override them
+	type option struct {
+		Name, Val string
+		env       bool // Option comes from MCDIG_OPTS
+	}
 
 	args := []string{}
 	opts := []option{}
 	endOfOptions := false
 
-	for i := 1; i < len(os.Args); i++ {
-		arg := os.Args[i]
+	envArgv := optExpand(strings.Fields(os.Getenv("MCDIG_OPTS")))
+	argv := append(envArgv, optExpand(os.Args[1:])...)
+
+	for i := 0; i < len(argv); i++ {
+		arg := argv[i]
+		env := i < len(envArgv)
 
 		switch {
 		case endOfOptions:
 			args = append(args, arg)
 
+		case env && (arg == "--" || !optIsOption(arg)):
+			usageError("MCDIG_OPTS: invalid option: %q", arg)
+
 		case arg == "--":
 			endOfOptions = true
 
-		case arg == "-h":
+		case arg == "-h" || arg == "--help":
 			usage()
 
-		case arg == "-p" || arg == "-c":
-			if i+1 == len(os.Args) {
+		case strings.HasPrefix(arg, "--") && strings.Contains(arg, "="):
+			// --name=value
+			i := strings.IndexByte(arg, '=')
+			name, val := optLongName(arg[:i]), arg[i+1:]
+			if !optWithArg[name] {
+				usageError("option %s doesn't take argument",
+					arg[:i])
+			}
+			opts = append(opts, option{Name: name, Val: val, env: env})
+
+		case optWithArg[optLongName(arg)]:
+			if i+1 == len(argv) || env && i+1 == len(envArgv) {
 				usageError("option %s requires argument", arg)
 			}
-			opts = append(opts,
-				option{Name: arg, Val: os.Args[i+1]})
+			opts = append(opts, option{Name: optLongName(arg),
+				Val: argv[i+1], env: env})
 			i++
 
-		case strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "@"):
-			opts = append(opts, option{Name: arg})
+		case optIsOption(arg):
+			opts = append(opts,
+				option{Name: optLongName(arg), env: env})
 
 		default:
 			args = append(args, arg)
 		}
 	}
 
+	// Handle subcommands
+	if len(args) > 0 {
+		if cmd, ok := optCommands[args[0]]; ok {
+			OptCommand = args[0]
+			OptCommandArgs = args[1:]
+			args = nil
+
+			switch {
+			case len(OptCommandArgs) < cmd.minArgs:
+				usageError("missed %s", cmd.missed)
+			case cmd.maxArgs >= 0 &&
+				len(OptCommandArgs) > cmd.maxArgs:
+				usageError("invalid argument: %q",
+					OptCommandArgs[cmd.maxArgs])
+			}
+		}
+	}
+
 	// Handle positional arguments
 	switch len(args) {
 	default:
@@ -144,21 +950,17 @@ func optParse() {
 		fallthrough
 
 	case 2:
-		if v, ok := dns.StringToType[strings.ToUpper(args[1])]; ok {
-			OptQType = v
-		} else {
-			usageError("invalid type: %q", args[1])
-		}
+		OptQTypes, OptQService, OptQResolve = optParseQType(args[1])
 		fallthrough
 
 	case 1:
 		OptDomain = args[0]
 
 	case 0:
-		usageError("missed domain")
 	}
 
 	// Handle options
+	ifaceFromEnv := false
 	for _, opt := range opts {
 		switch {
 		case opt.Name == "-4":
@@ -170,10 +972,19 @@ func optParse() {
 		case opt.Name == "-d":
 			OptDebug = true
 
+		case strings.HasPrefix(opt.Name, "+"):
+			optParseFlag(opt.Name)
+
 		case opt.Name == "-v":
 			OptVerbose = true
 
-		case opt.Name == "-p" || opt.Name == "-c":
+		case opt.Name == "-p":
+			OptTxPeriod = optParseDuration(opt.Name, opt.Val,
+				optMinTxPeriod, optMaxTxPeriod)
+
+		case opt.Name == "-c" ||
+			opt.Name == "--rcvbuf" || opt.Name == "--dedup-size" ||
+			opt.Name == "--rate" || opt.Name == "--max-rate":
 			val, err := strconv.ParseUint(opt.Val, 0, 31)
 			if err != nil {
 				usageError("invalid argument: %s %s",
@@ -181,37 +992,951 @@ func optParse() {
 			}
 
 			switch opt.Name {
-			case "-p":
-				OptTxPeriod = time.Duration(val) *
-					time.Millisecond
 			case "-c":
 				OptTxCount = int(val)
+			case "--rcvbuf":
+				OptRcvBuf = int(val)
+			case "--dedup-size":
+				OptDedupSize = int(val)
+			case "--max-rate":
+				OptMaxRate = int(val)
+			case "--rate":
+				// Rate up to 1e9 keeps the period between
+				// queries at least 1ns
+				if val == 0 || val > 1e9 {
+					usageError("invalid argument: %s %s",
+						opt.Name, opt.Val)
+				}
+				OptRate = int(val)
 
 			default:
 				panic("internal error")
 			}
 
-		case strings.HasPrefix(opt.Name, "@"):
-			if OptIface == "" {
-				OptIface = opt.Name[1:]
-			} else {
+		case opt.Name == "--mcast-loop":
+			switch opt.Val {
+			case "on", "off":
+				OptMcastLoop = opt.Val
+			default:
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+
+		case opt.Name == "--source-port":
+			val, err := strconv.ParseUint(opt.Val, 10, 16)
+			if err != nil {
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+			OptSourcePort = int(val)
+
+		case opt.Name == "--quiet-period":
+			OptQuietPeriod = optParseDuration(opt.Name, opt.Val,
+				optMinQuietPeriod, optMaxQuietPeriod)
+
+		case opt.Name == "--dns-timeout":
+			OptDNSTimeout = optParseDuration(opt.Name, opt.Val,
+				optMinDNSTimeout, optMaxDNSTimeout)
+
+		case opt.Name == "--resolv-conf":
+			OptResolvConf = opt.Val
+
+		case opt.Name == "--snapshot-interval":
+			OptSnapshotInterval = optParseDuration(opt.Name, opt.Val,
+				optMinSnapshotInterval, optMaxSnapshotInterval)
+
+		case opt.Name == "-o", opt.Name == "--output":
+			OptOutput = opt.Val
+
+		case opt.Name == "--append":
+			OptAppend = true
+
+		case opt.Name == "--format":
+			switch opt.Val {
+			case "text", "influx", "table", "json":
+				OptFormat = opt.Val
+			default:
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+
+		case opt.Name == "--group-by":
+			switch opt.Val {
+			case "type", "host":
+				OptGroupBy = opt.Val
+			default:
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+
+		case opt.Name == "--webhook":
+			u, err := url.Parse(opt.Val)
+			if err != nil || u.Host == "" ||
+				(u.Scheme != "http" && u.Scheme != "https") {
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+			OptWebhook = opt.Val
+
+		case opt.Name == "--serve":
+			OptServe = opt.Val
+
+		case opt.Name == "--metrics":
+			OptMetrics = opt.Val
+
+		case opt.Name == "--pprof":
+			OptPprof = opt.Val
+
+		case opt.Name == "--cache-file":
+			OptCacheFile = opt.Val
+
+		case opt.Name == "--log-format":
+			switch opt.Val {
+			case "plain", "text", "json":
+				OptLogFormat = opt.Val
+			default:
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+
+		case opt.Name == "--log-output", opt.Name == "--log-file":
+			OptLogOutput = opt.Val
+			OptLogToFile = opt.Name == "--log-file"
+
+		case opt.Name == "--avahi":
+			OptAvahi = true
+
+		case opt.Name == "--save":
+			OptSave = opt.Val
+
+		case opt.Name == "--diff":
+			OptDiff = opt.Val
+
+		case opt.Name == "--journal":
+			OptJournal = opt.Val
+
+		case opt.Name == "--keep-bad-packets":
+			OptKeepBadPackets = opt.Val
+
+		case opt.Name == "--summary":
+			OptSummary = true
+
+		case opt.Name == "--compare-ifaces":
+			OptCompareIfaces = true
+
+		case opt.Name == "--sizes":
+			OptSizes = true
+
+		case opt.Name == "--rounds":
+			OptRounds = true
+
+		case opt.Name == "--timestamps":
+			OptTimestamps = true
+
+		case opt.Name == "--tui":
+			OptTui = true
+
+		case opt.Name == "--cached":
+			OptCached = true
+
+		case opt.Name == "--no-jitter":
+			OptNoJitter = true
+
+		case opt.Name == "--protocol":
+			switch opt.Val {
+			case "mdns", "nbns":
+				OptProtocol = opt.Val
+			default:
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+
+		case opt.Name == "--wide-area":
+			OptWideArea = true
+
+		case opt.Name == "--push":
+			OptPush = true
+
+		case opt.Name == "--fallback-dns":
+			OptFallbackDNS = true
+
+		case opt.Name == "--adaptive":
+			OptAdaptive = true
+
+		case opt.Name == "--watch":
+			OptWatch = true
+			OptStream = true
+
+		case opt.Name == "--stream":
+			OptStream = true
+
+		case opt.Name == "--forget":
+			OptForget = true
+
+		case opt.Name == "--no-dedup":
+			OptDedup = "none"
+
+		case opt.Name == "--dedup":
+			switch opt.Val {
+			case "name", "full":
+				OptDedup = opt.Val
+			default:
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+
+		case opt.Name == "--all-ifaces":
+			OptAllIfaces = true
+
+		case opt.Name == "--include-self":
+			OptIncludeSelf = true
+
+		case opt.Name == "--strict-onlink":
+			OptStrictOnlink = true
+
+		case opt.Name == "--bridges":
+			OptBridges = true
+
+		case opt.Name == "--awdl":
+			OptAWDL = true
+
+		case opt.Name == "--bind-device":
+			if !SockBindToDeviceSupported {
+				usageError("%s: not supported on this platform",
+					opt.Name)
+			}
+			OptBindDevice = true
+
+		case opt.Name == "--service":
+			OptServices = append(OptServices, opt.Val)
+
+		case opt.Name == "--zone":
+			OptZone = opt.Val
+
+		case opt.Name == "--reflect-service":
+			svc := strings.TrimSuffix(opt.Val, ".")
+			svc = dns.Fqdn(strings.TrimSuffix(svc, ".local") + ".local")
+			if _, ok := dns.IsDomainName(svc); !ok {
+				usageError("invalid argument: %s %s",
+					opt.Name, opt.Val)
+			}
+
+			OptReflectServices = append(OptReflectServices, svc)
+
+		case opt.Name == "--exclude-iface":
+			if _, err := path.Match(opt.Val, ""); err != nil {
+				usageError("invalid pattern: %s %s",
+					opt.Name, opt.Val)
+			}
+
+			OptExcludeIfaces = append(OptExcludeIfaces, opt.Val)
+
+		case opt.Name == "--netns":
+			OptNetns = opt.Val
+
+		case strings.HasPrefix(opt.Name, "@"), opt.Name == "--interface":
+			if (OptIface != "" || OptServer != nil) && !ifaceFromEnv {
 				usageError("Duplicated @interface")
 			}
 
+			OptIface, OptServer = "", nil
+			ifaceFromEnv = opt.env
+
+			iface := strings.TrimPrefix(opt.Name, "@")
+			if opt.Name == "--interface" {
+				iface = opt.Val
+			}
+
+			if addr := optParseAddr(iface); addr != nil {
+				OptServer = addr
+				break
+			}
+
+			OptIface = iface
+			if _, err := path.Match(OptIface, ""); err != nil {
+				usageError("invalid interface pattern: %q",
+					opt.Name)
+			}
+
 		default:
 			usageError("invalid option: %q", opt)
 		}
 	}
 
 	// Fixup options
+	if OptDomain == "" && OptCommand == "" && !OptTui {
+		usageError("missed domain")
+	}
+
+	// The render command prints results of the recorded query,
+	// so options of results apply to it, as to queries
+	command := OptCommand
+	if command == "render" {
+		command = ""
+	}
+
+	if (OptSave != "" || OptDiff != "") &&
+		(command != "" || OptStream && !OptWatch || OptCached) {
+		usageError("--save and --diff can't be used with commands, " +
+			"--stream or --cached")
+	}
+
+	if OptSummary && (command != "" || OptProtocol == "nbns") {
+		usageError("--summary can't be used with commands " +
+			"or --protocol nbns")
+	}
+
+	if OptCompareIfaces && (command != "" || OptProtocol == "nbns" ||
+		OptServer != nil || OptWideArea || OptWatch || OptCached) {
+		usageError("--compare-ifaces can't be used with commands, " +
+			"@address, --protocol nbns, --wide-area, --watch " +
+			"or --cached")
+	}
+
+	if OptTimestamps && (command != "" || OptCached ||
+		OptFormat != "text") {
+		usageError("--timestamps can't be used with commands, " +
+			"--cached or --format")
+	}
+
+	if OptRounds && (command != "" || OptProtocol == "nbns" ||
+		OptWatch || OptWideArea) {
+		usageError("--rounds can't be used with commands, " +
+			"--protocol nbns, --watch or --wide-area")
+	}
+
+	if OptKeepBadPackets != "" && command != "" {
+		usageError("--keep-bad-packets can't be used with commands")
+	}
+
+	if OptJournal != "" && (command != "" ||
+		OptProtocol == "nbns" || OptWideArea || OptCached) {
+		usageError("--journal can't be used with commands, " +
+			"--protocol nbns, --wide-area or --cached")
+	}
+
+	// Packets are replayed without sending queries, so options
+	// of queries don't apply to render
+	if OptCommand == "render" && (OptWatch || OptTui || OptRounds ||
+		OptJournal != "" || OptQuietPeriod != 0 || OptCached ||
+		OptProtocol == "nbns" || OptWideArea || OptFallbackDNS) {
+		usageError("render can't be used with --watch, --tui, " +
+			"--rounds, --journal, --quiet-period, --cached, " +
+			"--protocol nbns, --wide-area or --fallback-dns")
+	}
+
+	if OptSizes && (command != "" || OptProtocol == "nbns" ||
+		OptWatch || OptWideArea) {
+		usageError("--sizes can't be used with commands, " +
+			"--protocol nbns, --watch or --wide-area")
+	}
+
+	if OptTui && (command != "" || OptStream || OptCached) {
+		usageError("--tui can't be used with commands, " +
+			"--stream, --watch or --cached")
+	}
+
 	if !Opt4 && !Opt6 {
 		Opt4 = true // The default if none set
 	}
+
+	if OptForget && !OptStream {
+		usageError("--forget requires --stream")
+	}
+
+	if OptMaxRate != 0 && (!OptStream || OptWatch ||
+		OptFormat != "text") {
+		usageError("--max-rate requires --stream and can't be " +
+			"used with --watch or --format")
+	}
+
+	if OptDedup != "name" && (OptWatch || command != "") {
+		usageError("--no-dedup and --dedup can't be used with " +
+			"--watch or commands")
+	}
+
+	if OptPush && !(OptWideArea && OptWatch) {
+		usageError("--push requires --wide-area and --watch")
+	}
+
+	if OptQuietPeriod != 0 && (OptWatch || command != "") {
+		usageError("--quiet-period can't be used with --watch " +
+			"or commands")
+	}
+
+	if OptSourcePort == mdnsPort && OptCommand == "conformance" {
+		usageError("--source-port %d can't be used with conformance,"+
+			" as it tests legacy queries", mdnsPort)
+	}
+
+	if OptSnapshotInterval != 0 && OptOutput == "" {
+		usageError("--snapshot-interval requires --output")
+	}
+
+	if OptAppend && (OptOutput == "" || OptSnapshotInterval != 0) {
+		usageError("--append requires --output " +
+			"without --snapshot-interval")
+	}
+
+	if OptSnapshotInterval != 0 && !OptWatch {
+		usageError("--snapshot-interval requires --watch")
+	}
+
+	if OptFormat != "text" && command != "" &&
+		!(OptFormat == "table" && OptCommand == "browse-all") {
+		usageError("--format %s can't be used with %s",
+			OptFormat, OptCommand)
+	}
+
+	if OptGroupBy != "" && (OptStream || OptFormat != "text" ||
+		command != "" && command != "browse-all") {
+		usageError("--group-by can't be used with --stream, " +
+			"--watch, --format or commands other than browse-all")
+	}
+
+	if (OptFormat == "table" || OptFormat == "json") &&
+		(OptStream || OptProtocol == "nbns") {
+		usageError("--format %s can't be used with --stream, "+
+			"--watch or --protocol nbns", OptFormat)
+	}
+
+	if OptFormat != "text" && OptCached {
+		usageError("--format can't be used with --cached")
+	}
+
+	if OptWebhook != "" && !OptWatch {
+		usageError("--webhook requires --watch")
+	}
+
+	if OptServe != "" && !OptWatch {
+		usageError("--serve requires --watch")
+	}
+
+	if OptMetrics != "" && !OptWatch {
+		usageError("--metrics requires --watch")
+	}
+
+	if OptPprof != "" && !OptWatch && !OptTui {
+		switch OptCommand {
+		case "announce", "respond", "reflect", "proxy", "grpc":
+		default:
+			usageError("--pprof requires --watch, --tui or " +
+				"announce, respond, reflect, proxy or grpc")
+		}
+	}
+
+	if OptCacheFile != "" && command != "" {
+		usageError("--cache-file can't be used with %s", OptCommand)
+	}
+
+	if OptCached && OptCacheFile == "" {
+		usageError("--cached requires --cache-file")
+	}
+
+	if OptCached && OptStream {
+		usageError("--cached can't be used with --stream or --watch")
+	}
+
+	if OptAvahi && OptCommand != "grpc" {
+		usageError("--avahi requires grpc")
+	}
+
+	if OptServices != nil && OptCommand != "announce" &&
+		OptCommand != "probe" {
+		usageError("--service requires announce or probe")
+	}
+
+	if (OptZone != "") != (OptCommand == "respond") {
+		usageError("respond requires --zone, and vice versa")
+	}
+
+	if OptReflectServices != nil && OptCommand != "reflect" {
+		usageError("--reflect-service requires reflect")
+	}
+
+	LogInit()
+}
+
+// optExpand expands clusters of short options: -46dv becomes
+// -4 -6 -d -v. The option that requires argument takes the rest
+// of the cluster as its argument, if any (i.e., -dp100 becomes
+// -d -p 100), or the next argument otherwise
+//
+// Arguments of options and arguments after the -- are not expanded
+func optExpand(argv []string) []string {
+	out := make([]string, 0, len(argv))
+	needArg := false
+
+	for i, arg := range argv {
+		switch {
+		case needArg:
+			out = append(out, arg)
+			needArg = false
+			continue
+
+		case arg == "--":
+			return append(out, argv[i:]...)
+
+		case len(arg) <= 2 || arg[0] != '-' || arg[1] == '-':
+			out = append(out, arg)
+			needArg = optWithArg[optLongName(arg)]
+			continue
+		}
+
+		for j := 1; j < len(arg); j++ {
+			opt := "-" + arg[j:j+1]
+			out = append(out, opt)
+			needArg = optWithArg[opt]
+			if needArg && j+1 < len(arg) {
+				out = append(out, arg[j+1:])
+				needArg = false
+				break
+			}
+		}
+	}
+
+	return out
+}
+
+// optParseQType parses the q-type argument: the record type,
+// alias (addr for A+AAAA, service for PTR with DNS-SD semantics,
+// resolve for SRV+TXT of the service instance and addresses of
+// its target) or combination of them, joined by '+' (e.g., srv+txt).
+// This function doesn't return in a case of errors
+func optParseQType(arg string) (qtypes []uint16, service, resolve bool) {
+	seen := make(map[uint16]bool)
+	add := func(qtype uint16) {
+		if !seen[qtype] {
+			seen[qtype] = true
+			qtypes = append(qtypes, qtype)
+		}
+	}
+
+	for _, name := range strings.Split(arg, "+") {
+		switch strings.ToLower(name) {
+		case "addr":
+			add(dns.TypeA)
+			add(dns.TypeAAAA)
+
+		case "service":
+			add(dns.TypePTR)
+			service = true
+
+		case "resolve":
+			add(dns.TypeSRV)
+			add(dns.TypeTXT)
+			resolve = true
+
+		default:
+			qtype, ok := dns.StringToType[strings.ToUpper(name)]
+			if !ok {
+				usageError("invalid type: %q", arg)
+			}
+			add(qtype)
+		}
+	}
+
+	return
+}
+
+// optParseDuration parses duration option value, which may be
+// Go duration string (e.g., 250ms or 5s) or integer number of
+// milliseconds, and checks that it is within the [min...max] range.
+// This function doesn't return in a case of errors
+func optParseDuration(name, val string, min, max time.Duration) time.Duration {
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		var ms uint64
+		ms, err = strconv.ParseUint(val, 10, 31)
+		d = time.Duration(ms) * time.Millisecond
+	}
+
+	switch {
+	case err != nil:
+		usageError("invalid argument: %s %s", name, val)
+	case d < min || d > max:
+		usageError("%s %s: must be between %s and %s",
+			name, val, min, max)
+	}
+
+	return d
+}
+
+// optIsOption tells if command line argument is option
+// (-option, --option, +flag or @interface)
+func optIsOption(arg string) bool {
+	return strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "@") ||
+		strings.HasPrefix(arg, "+")
+}
+
+// optLongName returns the short form of the option, if it is
+// the long alias, or the option itself
+func optLongName(name string) string {
+	if short, ok := optLongNames[name]; ok {
+		return short
+	}
+	return name
+}
+
+// optParseFlag parses the dig-style +[no]flag.
+// This function doesn't return in a case of errors
+func optParseFlag(flag string) {
+	name := strings.TrimPrefix(flag, "+")
+	on := true
+	if strings.HasPrefix(name, "no") {
+		name, on = name[2:], false
+	}
+
+	var sections int
+	switch name {
+	case "rrhex":
+		OptRRHex = on
+		return
+	case "dnssec":
+		OptDnssec = on
+		return
+	case "question":
+		sections = OptSectionQuestion
+	case "answer":
+		sections = OptSectionAnswer
+	case "authority":
+		sections = OptSectionAuthority
+	case "additional":
+		sections = OptSectionAdditional
+	case "all":
+		sections = OptSectionAll
+	default:
+		usageError("invalid flag: %q", flag)
+	}
+
+	if on {
+		OptSections |= sections
+	} else {
+		OptSections &^= sections
+	}
+}
+
+// optParseAddr parses IP address with optional zone (e.g.,
+// fe80::1%eth0) and returns it as UDP address of the MDNS
+// responder. If s is not an IP address, nil is returned
+func optParseAddr(s string) *net.UDPAddr {
+	zone := ""
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s, zone = s[:i], s[i+1:]
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return &net.UDPAddr{IP: ip, Port: 5353, Zone: zone}
 }
 
 // The main function
 func main() {
 	optParse()
-	q := QueryRun()
-	ResponseGetAndPrint(os.Stdout, q)
+
+	if OptNetns != "" {
+		if err := NetnsEnter(OptNetns); err != nil {
+			LogFatal("--netns %s: %s", OptNetns, err)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	out, err := OutputOpen()
+	if err != nil {
+		mainFatal(err)
+	}
+
+	if OptPprof != "" {
+		PprofRun(ctx)
+	}
+
+	switch OptCommand {
+	case "interfaces":
+		if err := IfAddrsPrint(out); err != nil {
+			mainFatal(err)
+		}
+
+	case "domains":
+		if err := WideAreaDomains(out); err != nil {
+			mainFatal(err)
+		}
+
+	case "browse-all":
+		BrowseAllRun(ctx, out)
+
+	case "printers":
+		PrintersRun(ctx, out)
+
+	case "media", "matter", "homekit", "shares":
+		PresetRun(ctx, out, presets[OptCommand])
+
+	case "announce":
+		if err := AnnounceRun(ctx, out); err != nil {
+			mainFatal(err)
+		}
+
+	case "respond":
+		if err := RespondRun(ctx, out); err != nil {
+			mainFatal(err)
+		}
+
+	case "reflect":
+		ReflectRun(ctx)
+
+	case "proxy":
+		ProxyRun(ctx)
+
+	case "grpc":
+		GrpcRun(ctx)
+
+	case "probe":
+		free, err := ProbeRun(ctx, out)
+		if err != nil {
+			mainFatal(err)
+		}
+
+		if !free {
+			OutputClose()
+			os.Exit(2)
+		}
+
+	case "conformance":
+		passed, err := ConformanceRun(ctx, out)
+		if err != nil {
+			mainFatal(err)
+		}
+
+		if !passed {
+			OutputClose()
+			os.Exit(2)
+		}
+
+	case "stress":
+		if err := StressRun(ctx, out); err != nil {
+			mainFatal(err)
+		}
+
+	case "bench":
+		if err := BenchRun(ctx, out); err != nil {
+			mainFatal(err)
+		}
+
+	case "diff":
+		same, err := DiffRun(out)
+		if err != nil {
+			mainFatal(err)
+		}
+
+		if !same {
+			OutputClose()
+			os.Exit(2)
+		}
+
+	case "":
+		if OptTui {
+			TuiRun(ctx)
+			break
+		}
+
+		fallthrough
+
+	default:
+		var rq *dns.Msg
+		var err error
+		switch {
+		case OptCommand == "render":
+			rq, err = JournalQuestion(OptCommandArgs[0])
+		case OptProtocol == "nbns":
+			rq = NbnsNewRequest()
+		default:
+			rq, err = QueryNewRequest()
+		}
+
+		if err != nil {
+			mainFatal(err)
+		}
+
+		if OptCacheFile != "" {
+			if err := PersistLoad(); err != nil {
+				mainFatal(err)
+			}
+		}
+
+		if OptCached {
+			PersistPrintCached(out, rq.Question)
+			break
+		}
+
+		if OptFormat == "influx" {
+			ResponseInflux(out)
+		} else if OptStream {
+			ResponsePrint(out, rq.Question, nil, nil, nil)
+		}
+
+		switch {
+		case OptWatch:
+			ResponseWatch(out)
+		case OptStream:
+			ResponseStream(out)
+		}
+
+		// SIGUSR1 prints snapshot of everything known so far,
+		// without terminating. It always goes to stdout, as
+		// buffered output is not safe for concurrent use
+		usr1 := make(chan os.Signal, 1)
+		SignalNotifySnapshot(usr1)
+		go func() {
+			for range usr1 {
+				ResponseSnapshot(os.Stdout)
+			}
+		}()
+
+		if OptSnapshotInterval != 0 {
+			go SnapshotRun(ctx, rq.Question)
+		}
+
+		if OptMetrics != "" {
+			MetricsRun(ctx)
+		}
+
+		if OptWebhook != "" {
+			WebhookRun(ctx)
+		}
+
+		if OptServe != "" {
+			ServeRun(ctx)
+		}
+
+		if OptKeepBadPackets != "" {
+			if err := BadPacketsOpen(); err != nil {
+				mainFatal(err)
+			}
+		}
+
+		if OptJournal != "" {
+			if err := JournalOpen(); err != nil {
+				mainFatal(err)
+			}
+		}
+
+		if OptCommand == "render" {
+			err = JournalReplay(OptCommandArgs[0], rq)
+		} else {
+			err = QueryRun(ctx, rq, QueryConfigDefault())
+		}
+		cancel()
+
+		if err == nil {
+			err = JournalClose()
+		}
+
+		if err != nil {
+			mainFatal(err)
+		}
+
+		if drops, _ := ConnDrops(); drops != 0 {
+			LogError("Warning: %d packets dropped by the kernel, "+
+				"results may be incomplete (see --rcvbuf)", drops)
+		}
+
+		if FallbackNeeded(rq) {
+			FallbackRun(rq)
+		}
+
+		switch {
+		case OptStream:
+			ResponseRateFlush()
+		case OptFormat == "influx":
+			ans, auth, add := ResponseGet()
+			InfluxPrintRecords(out,
+				append(append(ans, auth...), add...))
+		case OptFormat == "table":
+			ans, auth, add := ResponseGet()
+			TablePrint(out, append(append(ans, auth...), add...))
+		case OptFormat == "json":
+			SnapshotPrint(out, rq.Question, SessionRecords())
+		case OptGroupBy != "":
+			ans, auth, add := ResponseGet()
+			GroupPrint(out, append(append(ans, auth...), add...))
+		default:
+			ResponseGetAndPrint(out, rq.Question)
+		}
+
+		if !OutputParseable() {
+			OnlinkPrint(out)
+		}
+
+		RcodePrint(out)
+		NxrrsetPrint(out)
+
+		if OptSummary {
+			SummaryPrint(out)
+		}
+
+		if OptCompareIfaces {
+			CompareIfacesPrint(out)
+		}
+
+		if OptRounds {
+			RoundsPrint(out)
+		}
+
+		if OptSizes {
+			SizesPrint(out)
+		}
+
+		if OptKeepBadPackets != "" {
+			BadPacketsPrint(out)
+		}
+
+		if OptDiff != "" || OptSave != "" {
+			records := SessionRecords()
+
+			if OptDiff != "" {
+				err := SessionPrintDiff(out, OptDiff, records)
+				if err != nil {
+					LogError("%s", err)
+				}
+			}
+
+			if OptSave != "" {
+				err := SessionSave(OptSave, rq.Question, records)
+				if err != nil {
+					LogError("%s", err)
+				}
+			}
+		}
+
+		if OptCacheFile != "" {
+			if !OptStream && OptFormat == "text" {
+				PersistPrintChanges(out, rq.Question)
+			}
+
+			if err := PersistSave(); err != nil {
+				LogError("%s", err)
+			}
+		}
+
+		if RcodeSeen() {
+			OutputClose()
+			os.Exit(3)
+		}
+
+		if NxrrsetSeen() && !ResponseHasAnswer() {
+			OutputClose()
+			os.Exit(4)
+		}
+	}
+
+	OutputClose()
 }
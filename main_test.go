@@ -0,0 +1,143 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Command line parsing tests
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestOptExpand tests expansion of clusters of short options
+func TestOptExpand(t *testing.T) {
+	tests := []struct {
+		argv     string // Arguments, space-separated
+		expected string // Expanded arguments, space-separated
+	}{
+		// Clusters of flags
+		{"-46dv a.local", "-4 -6 -d -v a.local"},
+		{"-4 -d a.local", "-4 -d a.local"},
+
+		// Option with argument takes the rest of the cluster,
+		// or the next argument
+		{"-dp100ms a.local", "-d -p 100ms a.local"},
+		{"-dp 100ms a.local", "-d -p 100ms a.local"},
+		{"-c3p 100ms", "-c 3p 100ms"},
+
+		// Arguments of options are not expanded
+		{"-c -46", "-c -46"},
+		{"--count -46", "--count -46"},
+
+		// Long options, --name=value and positional arguments
+		// are not expanded
+		{"--ipv4 --count=3 -46", "--ipv4 --count=3 -4 -6"},
+		{"--count=3 a.local", "--count=3 a.local"},
+		{"--rcvbuf=1000 -dv", "--rcvbuf=1000 -d -v"},
+		{"@eth0 +noall a.local", "@eth0 +noall a.local"},
+
+		// Nothing is expanded after --
+		{"-dv -- -46", "-d -v -- -46"},
+	}
+
+	for _, test := range tests {
+		out := optExpand(strings.Fields(test.argv))
+		if present := strings.Join(out, " "); present != test.expected {
+			t.Errorf("%q:\nexpected: %q\npresent:  %q",
+				test.argv, test.expected, present)
+		}
+	}
+}
+
+// TestOptParseEnv tests that options from the MCDIG_OPTS environment
+// variable are used as defaults, overridden by the command line
+func TestOptParseEnv(t *testing.T) {
+	tests := []struct {
+		env      string // MCDIG_OPTS
+		argv     string // Command line, space-separated
+		expected string // Expected options, formatted as below
+	}{
+		{
+			env:      "",
+			argv:     "a.local",
+			expected: "-4=true -6=false -c=10 -p=250ms @",
+		},
+		{
+			env:      "-c 5 -p 300ms",
+			argv:     "a.local",
+			expected: "-4=true -6=false -c=5 -p=300ms @",
+		},
+		{
+			env:      "-c 5 -p 300ms",
+			argv:     "-c 2 a.local",
+			expected: "-4=true -6=false -c=2 -p=300ms @",
+		},
+		{
+			env:      "--count=5",
+			argv:     "--count=2 a.local",
+			expected: "-4=true -6=false -c=2 -p=250ms @",
+		},
+		{
+			env:      "-6c5",
+			argv:     "a.local -p 1s",
+			expected: "-4=false -6=true -c=5 -p=1s @",
+		},
+		{
+			env:      "-6",
+			argv:     "-4 a.local",
+			expected: "-4=true -6=true -c=10 -p=250ms @",
+		},
+		{
+			env:      "@eth0",
+			argv:     "a.local",
+			expected: "-4=true -6=false -c=10 -p=250ms @eth0",
+		},
+		{
+			env:      "@eth0",
+			argv:     "@eth1 a.local",
+			expected: "-4=true -6=false -c=10 -p=250ms @eth1",
+		},
+	}
+
+	// Options, modified by optParse, are restored after the test
+	saved4, saved6 := Opt4, Opt6
+	savedCount, savedPeriod := OptTxCount, OptTxPeriod
+	savedIface, savedDomain := OptIface, OptDomain
+	savedArgs := os.Args
+
+	restore := func() {
+		Opt4, Opt6 = saved4, saved6
+		OptTxCount, OptTxPeriod = savedCount, savedPeriod
+		OptIface, OptDomain = savedIface, savedDomain
+		os.Args = savedArgs
+	}
+	defer restore()
+
+	for _, test := range tests {
+		restore()
+		t.Setenv("MCDIG_OPTS", test.env)
+		os.Args = append([]string{"mcdig"},
+			strings.Fields(test.argv)...)
+
+		optParse()
+
+		present := fmt.Sprintf("-4=%v -6=%v -c=%d -p=%s @%s",
+			Opt4, Opt6, OptTxCount, OptTxPeriod, OptIface)
+
+		if present != test.expected {
+			t.Errorf("MCDIG_OPTS=%q, argv %q:\n"+
+				"expected: %s\npresent:  %s",
+				test.env, test.argv, test.expected, present)
+		}
+
+		if OptDomain != "a.local" {
+			t.Errorf("MCDIG_OPTS=%q, argv %q: domain is %q",
+				test.env, test.argv, OptDomain)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Matter and Thread discovery preset
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// presetMatter browses Matter nodes, commissionable devices
+// and Thread border routers
+var presetMatter = &preset{
+	title: "MATTER AND THREAD",
+	types: []string{
+		"_matter._tcp.local.",
+		"_matterc._udp.local.",
+		"_meshcop._udp.local.",
+	},
+	decode: matterDecode,
+}
+
+// matterCommissioningModes are values of the CM key
+var matterCommissioningModes = map[string]string{
+	"0": "not commissionable",
+	"1": "basic (pairing window open)",
+	"2": "enhanced (opened by administrator)",
+	"3": "dynamic passcode",
+}
+
+// matterThreadStates are values of the Thread interface status
+// bits of the meshcop state bitmap
+var matterThreadStates = []string{
+	"not initialized", "initialized", "active", "unknown",
+}
+
+// matterDecode decodes Matter operational instances (fabric and node
+// IDs), commissionable devices (discriminator, vendor and product IDs,
+// commissioning mode) and Thread border routers (MeshCoP)
+func matterDecode(svc DnssdService, txt map[string]string) []presetField {
+	switch strings.ToLower(svc.Type) {
+	case "_matter._tcp.local.":
+		// Instance name is <compressed fabric ID>-<node ID>
+		fabric, node := svc.Instance, ""
+		if i := strings.IndexByte(fabric, '-'); i >= 0 {
+			fabric, node = fabric[:i], fabric[i+1:]
+		}
+
+		return []presetField{
+			{"fabric", fabric},
+			{"node", node},
+			{"intervals", matterIntervals(txt)},
+		}
+
+	case "_matterc._udp.local.":
+		return []presetField{
+			{"name", txt["dn"]},
+			{"discriminator", matterDiscriminator(txt["d"])},
+			{"vendor", matterVendorProduct(txt["vp"], 0)},
+			{"product", matterVendorProduct(txt["vp"], 1)},
+			{"device type", matterHex(txt["dt"])},
+			{"commissioning", matterMode(txt["cm"])},
+			{"pairing hint", txt["ph"]},
+			{"intervals", matterIntervals(txt)},
+		}
+
+	case "_meshcop._udp.local.":
+		return []presetField{
+			{"network", txt["nn"]},
+			{"ext PAN ID", matterBinary(txt["xp"])},
+			{"vendor", txt["vn"]},
+			{"model", txt["mn"]},
+			{"thread", txt["tv"]},
+			{"state", matterThreadState(txt["sb"])},
+		}
+	}
+
+	return nil
+}
+
+// matterDiscriminator decodes the D key: 12-bit discriminator,
+// with the 4-bit short discriminator used for manual pairing codes
+func matterDiscriminator(v string) string {
+	d, err := strconv.ParseUint(v, 10, 12)
+	if err != nil {
+		return v
+	}
+	return fmt.Sprintf("%d (short %d)", d, d>>8)
+}
+
+// matterVendorProduct decodes the VP key (vendor+product, decimal)
+// and returns vendor (part 0) or product (part 1) ID as hex
+func matterVendorProduct(v string, part int) string {
+	parts := strings.SplitN(v, "+", 2)
+	if part >= len(parts) {
+		return ""
+	}
+	return matterHex(parts[part])
+}
+
+// matterHex formats decimal ID as hex and decimal
+func matterHex(v string) string {
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return v
+	}
+	return fmt.Sprintf("0x%04X (%d)", n, n)
+}
+
+// matterMode decodes the CM (commissioning mode) key
+func matterMode(v string) string {
+	if mode, ok := matterCommissioningModes[v]; ok {
+		return mode
+	}
+	return v
+}
+
+// matterIntervals formats the SII, SAI (retransmission intervals,
+// ms) and SAT (active threshold, ms) keys
+func matterIntervals(txt map[string]string) string {
+	var out []string
+	for _, key := range []string{"sii", "sai", "sat"} {
+		if v := txt[key]; v != "" {
+			out = append(out, strings.ToUpper(key)+"="+v+"ms")
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// matterBinary formats binary TXT value as hex
+func matterBinary(v string) string {
+	if v == "" {
+		return ""
+	}
+	return hex.EncodeToString([]byte(dnssdUnescape(v)))
+}
+
+// matterThreadState decodes the Thread interface status from the
+// sb (state bitmap, 32-bit big endian) key of MeshCoP
+func matterThreadState(v string) string {
+	sb := []byte(dnssdUnescape(v))
+	if len(sb) != 4 {
+		return matterBinary(v)
+	}
+	return matterThreadStates[(sb[3]>>3)&3]
+}
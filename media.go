@@ -0,0 +1,62 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Media devices (Chromecast, AirPlay) discovery preset
+
+package main
+
+import (
+	"strings"
+)
+
+// presetMedia browses streaming endpoints
+var presetMedia = &preset{
+	title: "MEDIA DEVICES",
+	types: []string{
+		"_googlecast._tcp.local.",
+		"_airplay._tcp.local.",
+		"_raop._tcp.local.",
+	},
+	decode: mediaDecode,
+}
+
+// mediaDecode decodes friendly names, models and IDs of
+// Chromecast, AirPlay and RAOP (AirTunes) instances
+func mediaDecode(svc DnssdService, txt map[string]string) []presetField {
+	switch strings.ToLower(svc.Type) {
+	case "_googlecast._tcp.local.":
+		return []presetField{
+			{"name", txt["fn"]},
+			{"model", txt["md"]},
+			{"id", txt["id"]},
+			{"status", txt["rs"]},
+		}
+
+	case "_airplay._tcp.local.":
+		return []presetField{
+			{"name", svc.Instance},
+			{"model", txt["model"]},
+			{"id", txt["deviceid"]},
+			{"version", txt["srcvers"]},
+		}
+
+	case "_raop._tcp.local.":
+		// Instance name is MAC@Name
+		name := svc.Instance
+		id := ""
+		if i := strings.IndexByte(name, '@'); i >= 0 {
+			id, name = name[:i], name[i+1:]
+		}
+
+		return []presetField{
+			{"name", name},
+			{"model", txt["am"]},
+			{"id", id},
+			{"version", txt["vs"]},
+		}
+	}
+
+	return nil
+}
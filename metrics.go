@@ -0,0 +1,268 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Prometheus metrics
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// metricsLatencyBuckets are upper bounds of the response latency
+// histogram buckets, in seconds
+var metricsLatencyBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5,
+}
+
+// Packet counters. They are updated atomically
+var (
+	metricsPacketsSent     uint64 // Packets sent
+	metricsPacketsReceived uint64 // Packets received
+	metricsParseErrors     uint64 // Packets failed to parse
+)
+
+// Metrics state, protected by metricsLock
+var (
+	metricsLastSent   time.Time                       // Last query time
+	metricsResponders map[string]map[string]time.Time // Records by responder
+	metricsLatency    []uint64                        // Latency buckets
+	metricsLatencySum float64                         // Sum of latencies
+	metricsLatencyCnt uint64                          // Count of latencies
+	metricsLock       sync.Mutex                      // Access lock
+)
+
+// MetricsRun serves Prometheus metrics at the /metrics path of
+// the OptMetrics address, until ctx is canceled. It doesn't
+// return in a case of errors
+func MetricsRun(ctx context.Context) {
+	metricsLock.Lock()
+	metricsResponders = make(map[string]map[string]time.Time)
+	metricsLatency = make([]uint64, len(metricsLatencyBuckets))
+	metricsLock.Unlock()
+
+	l, err := net.Listen("tcp", OptMetrics)
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsServe)
+
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	LogDebug("Serving metrics at http://%s/metrics", l.Addr())
+
+	go srv.Serve(l)
+}
+
+// metricsSent counts sent query
+func metricsSent() {
+	atomic.AddUint64(&metricsPacketsSent, 1)
+
+	now := JournalNow()
+	metricsLock.Lock()
+	metricsLastSent = now
+	metricsLock.Unlock()
+}
+
+// metricsLatencySince returns time, elapsed since the last query.
+// If no queries were sent yet, it returns false
+func metricsLatencySince(now time.Time) (time.Duration, bool) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if metricsLastSent.IsZero() {
+		return 0, false
+	}
+
+	return now.Sub(metricsLastSent), true
+}
+
+// metricsReceived counts received packet
+func metricsReceived() {
+	atomic.AddUint64(&metricsPacketsReceived, 1)
+}
+
+// metricsParseError counts packet that failed to parse
+func metricsParseError() {
+	atomic.AddUint64(&metricsParseErrors, 1)
+}
+
+// metricsResponse accounts received response: records by responder
+// and, if response answers our question, the response latency since
+// the last query
+func metricsResponse(msg *dns.Msg, meta SourceMeta,
+	question []dns.Question) {
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if metricsResponders == nil {
+		return
+	}
+
+	now := JournalNow()
+	responder := meta.From.IP.String()
+
+	records := metricsResponders[responder]
+	if records == nil {
+		records = make(map[string]time.Time)
+		metricsResponders[responder] = records
+	}
+
+	answered := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if _, ok := rr.(*dns.OPT); ok {
+				continue
+			}
+
+			hdr := rr.Header()
+			key := dedupKeyNoFlush(rr)
+
+			if hdr.Ttl == 0 {
+				delete(records, key)
+				continue
+			}
+
+			ttl := time.Duration(hdr.Ttl) * time.Second
+			records[key] = now.Add(ttl)
+
+			if responseMatches(rr, question) {
+				answered = true
+			}
+		}
+	}
+
+	if answered && !metricsLastSent.IsZero() {
+		latency := now.Sub(metricsLastSent).Seconds()
+		for i, bound := range metricsLatencyBuckets {
+			if latency <= bound {
+				metricsLatency[i]++
+			}
+		}
+		metricsLatencySum += latency
+		metricsLatencyCnt++
+	}
+}
+
+// metricsServe handles HTTP requests for metrics
+func metricsServe(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	now := time.Now()
+
+	// Packet counters
+	metricsWrite(buf, "mcdig_packets_sent_total", "counter",
+		"MDNS queries sent")
+	fmt.Fprintf(buf, "mcdig_packets_sent_total %d\n",
+		atomic.LoadUint64(&metricsPacketsSent))
+
+	metricsWrite(buf, "mcdig_packets_received_total", "counter",
+		"MDNS packets received")
+	fmt.Fprintf(buf, "mcdig_packets_received_total %d\n",
+		atomic.LoadUint64(&metricsPacketsReceived))
+
+	metricsWrite(buf, "mcdig_parse_errors_total", "counter",
+		"MDNS packets that failed to parse")
+	fmt.Fprintf(buf, "mcdig_parse_errors_total %d\n",
+		atomic.LoadUint64(&metricsParseErrors))
+
+	if drops, ok := ConnDrops(); ok {
+		metricsWrite(buf, "mcdig_packets_dropped_total", "counter",
+			"MDNS packets dropped by the kernel (queue overflow)")
+		fmt.Fprintf(buf, "mcdig_packets_dropped_total %d\n", drops)
+	}
+
+	// Discovered services by type
+	services := make(map[string]int)
+	for _, rr := range ResponseRecords() {
+		if ptr := dnssdInstancePTR(rr); ptr != nil {
+			services[ptr.Hdr.Name]++
+		}
+	}
+
+	metricsWrite(buf, "mcdig_services", "gauge",
+		"Discovered service instances by type")
+	for _, name := range metricsKeys(services) {
+		fmt.Fprintf(buf, "mcdig_services{type=%q} %d\n",
+			strings.TrimSuffix(name, "."), services[name])
+	}
+
+	metricsLock.Lock()
+
+	// Records by responder
+	metricsWrite(buf, "mcdig_records", "gauge",
+		"Alive records by responder")
+
+	responders := make(map[string]int)
+	for responder, records := range metricsResponders {
+		for key, expires := range records {
+			if now.Before(expires) {
+				responders[responder]++
+			} else {
+				delete(records, key)
+			}
+		}
+	}
+
+	for _, responder := range metricsKeys(responders) {
+		fmt.Fprintf(buf, "mcdig_records{responder=%q} %d\n",
+			responder, responders[responder])
+	}
+
+	// Response latency histogram
+	metricsWrite(buf, "mcdig_response_latency_seconds", "histogram",
+		"Latency of answers since the last query")
+	for i, bound := range metricsLatencyBuckets {
+		fmt.Fprintf(buf,
+			"mcdig_response_latency_seconds_bucket{le=\"%g\"} %d\n",
+			bound, metricsLatency[i])
+	}
+	fmt.Fprintf(buf,
+		"mcdig_response_latency_seconds_bucket{le=\"+Inf\"} %d\n",
+		metricsLatencyCnt)
+	fmt.Fprintf(buf, "mcdig_response_latency_seconds_sum %g\n",
+		metricsLatencySum)
+	fmt.Fprintf(buf, "mcdig_response_latency_seconds_count %d\n",
+		metricsLatencyCnt)
+
+	metricsLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// metricsWrite writes HELP and TYPE lines of the metric
+func metricsWrite(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+}
+
+// metricsKeys returns sorted keys of the map
+func metricsKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
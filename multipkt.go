@@ -0,0 +1,140 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Multi-packet messages aggregation
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MultiPktTimeout specifies how long to wait for the continuation
+// packet. RFC 6762, section 7.2, says that responder receiving
+// a packet with the TC bit set should wait 400-500 ms for the
+// continuation, so we use the same timeout
+const MultiPktTimeout = 500 * time.Millisecond
+
+// MultiPkt aggregates messages, split across multiple packets
+// with the TC bit set (RFC 6762, section 7.2), into the single
+// logical message
+//
+// The message with the TC bit set starts aggregation. Subsequent
+// messages of the same kind (query or response) from the same
+// source are appended to it, until message without the TC bit
+// is received or MultiPktTimeout expires. Then the aggregated
+// message is delivered to the callback
+type MultiPkt struct {
+	deliver func(*dns.Msg, SourceMeta)  // Delivery callback
+	pending map[string]*multiPktPending // Pending messages
+	lock    sync.Mutex                  // Access lock
+}
+
+// multiPktPending represents a pending aggregated message
+type multiPktPending struct {
+	msg   *dns.Msg    // Message being aggregated
+	meta  SourceMeta  // Message source
+	count int         // Count of packets
+	timer *time.Timer // Timeout timer
+}
+
+// MultiPktNew creates a new MultiPkt. Complete messages will be
+// delivered to the deliver callback. Note, the callback may be
+// called from different goroutines, but calls are serialized
+func MultiPktNew(deliver func(*dns.Msg, SourceMeta)) *MultiPkt {
+	return &MultiPkt{
+		deliver: deliver,
+		pending: make(map[string]*multiPktPending),
+	}
+}
+
+// Input handles the received message
+//
+// The message is not retained after return (but its RRs may be),
+// so caller may reuse it
+func (mp *MultiPkt) Input(msg *dns.Msg, meta SourceMeta) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	key := meta.From.String()
+	pend := mp.pending[key]
+
+	// Message that doesn't continue anything is delivered as is,
+	// unless it starts aggregation. Query with question is never
+	// a continuation
+	if pend == nil || pend.msg.Response != msg.Response ||
+		(!msg.Response && len(msg.Question) != 0) {
+		if pend != nil {
+			mp.flush(key, pend)
+		}
+
+		if !msg.Truncated {
+			mp.deliver(msg, meta)
+			return
+		}
+
+		pend = &multiPktPending{
+			msg: &dns.Msg{
+				MsgHdr:   msg.MsgHdr,
+				Question: append([]dns.Question(nil), msg.Question...),
+			},
+			meta: meta,
+		}
+
+		pend.timer = time.AfterFunc(MultiPktTimeout, func() {
+			mp.timeout(key, pend)
+		})
+
+		mp.pending[key] = pend
+	}
+
+	// Append message to the pending one
+	pend.msg.Answer = append(pend.msg.Answer, msg.Answer...)
+	pend.msg.Ns = append(pend.msg.Ns, msg.Ns...)
+	pend.msg.Extra = append(pend.msg.Extra, msg.Extra...)
+	pend.count++
+
+	if msg.Truncated {
+		pend.timer.Reset(MultiPktTimeout)
+	} else {
+		mp.flush(key, pend)
+	}
+}
+
+// timeout handles expiration of the pending message timer
+func (mp *MultiPkt) timeout(key string, pend *multiPktPending) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	if mp.pending[key] == pend {
+		LogVerbose("%s: continuation of multi-packet message "+
+			"not received", pend.meta.From)
+		mp.flush(key, pend)
+	}
+}
+
+// flush delivers the pending message and removes it from the table
+func (mp *MultiPkt) flush(key string, pend *multiPktPending) {
+	pend.timer.Stop()
+	delete(mp.pending, key)
+
+	LogVerbose("%s: %d packets aggregated", pend.meta.From, pend.count)
+
+	pend.msg.Truncated = false
+	mp.deliver(pend.msg, pend.meta)
+}
+
+// Flush delivers all pending messages
+func (mp *MultiPkt) Flush() {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	for key, pend := range mp.pending {
+		mp.flush(key, pend)
+	}
+}
@@ -0,0 +1,252 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// NetBIOS name service (NBNS) queries
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// NBNS protocol constants (RFC 1002)
+const (
+	nbnsPort    = 137  // NBNS UDP port
+	nbnsTypeNB  = 0x20 // NetBIOS general Name Service Resource Record
+	nbnsMaxName = 15   // Max length of NetBIOS name
+)
+
+// NbnsNewRequest creates a new request message for the NBNS query
+//
+// NBNS uses encoded names and its own record types, so the
+// returned message is not sent to the wire as is. Instead, its
+// question is formatted in terms of DNS (the NetBIOS name and
+// type A), which is useful for response formatting. NBNS responses
+// are converted into A records accordingly
+func NbnsNewRequest() *dns.Msg {
+	name := strings.ToUpper(OptDomain)
+	if name == "" || len(name) > nbnsMaxName ||
+		strings.ContainsAny(name, ". ") {
+		LogFatal("%q: invalid NetBIOS name", OptDomain)
+	}
+
+	rq := &dns.Msg{}
+	rq.Question = []dns.Question{
+		{
+			Name:   name + ".",
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		},
+	}
+
+	return rq
+}
+
+// NbnsRun runs the NBNS query with the specified settings
+//
+// The rq is the query message, created by NbnsNewRequest.
+// The query is broadcast on all selected IPv4 interfaces. Error
+// is returned, if the query can't be performed at all
+func NbnsRun(ctx context.Context, rq *dns.Msg, cfg QueryConfig) error {
+	// Create the wire request.
+	//
+	// Note, the NBNS B (broadcast) flag occupies the same bit,
+	// as the DNS CD flag
+	name := strings.TrimSuffix(rq.Question[0].Name, ".")
+
+	wire := &dns.Msg{}
+	wire.Id = dns.Id()
+	wire.RecursionDesired = true
+	wire.CheckingDisabled = true
+	wire.Question = []dns.Question{
+		{
+			Name:   nbnsEncode(name, 0x00) + ".",
+			Qtype:  nbnsTypeNB,
+			Qclass: dns.ClassINET,
+		},
+	}
+
+	wireBytes, err := wire.Pack()
+	if err != nil {
+		return fmt.Errorf("%s: %s", OptDomain, err)
+	}
+
+	// Obtain broadcast addresses
+	_, if4, _, err := IfAddrs()
+	if err != nil {
+		return err
+	}
+	if4, _ = cfg.ifaces(if4, nil)
+	bcasts := nbnsBroadcasts(if4)
+	if len(bcasts) == 0 {
+		return fmt.Errorf("%w: no IPv4 broadcast addresses",
+			errQueryNoInterfaces)
+	}
+
+	for _, bcast := range bcasts {
+		LogDebug("Using broadcast address: %s", bcast)
+	}
+
+	// Create socket and start receiver
+	conn, err := queryListen("udp4", QueryUnicastAddr(), "")
+	if err != nil {
+		return querySocketError{err}
+	}
+
+	var wait sync.WaitGroup
+
+	accept := func(meta SourceMeta) bool {
+		return !SelfIsLocal(meta.From)
+	}
+
+	wait.Add(1)
+	go queryRecv(conn, accept, queryMultiPkt.Input, &wait)
+
+	// Run the send loop
+	queryLoop(ctx, rq, cfg, 0, nil, func(retransmit bool) bool {
+		for _, bcast := range bcasts {
+			err := conn.WriteTo(wireBytes, bcast, 0)
+			if err != nil {
+				LogDebug("%s: %s", bcast, err)
+			}
+		}
+		return true
+	})
+
+	// Close connection and wait for receiver termination
+	conn.Close()
+	wait.Wait()
+	queryMultiPkt.Flush()
+
+	return nil
+}
+
+// NbnsConvert converts the NBNS response into the DNS response,
+// replacing NB records with A records of the decoded NetBIOS names
+func NbnsConvert(rsp *dns.Msg) *dns.Msg {
+	out := &dns.Msg{MsgHdr: rsp.MsgHdr}
+	out.Answer = nbnsConvertRRs(rsp.Answer)
+	out.Ns = nbnsConvertRRs(rsp.Ns)
+	out.Extra = nbnsConvertRRs(rsp.Extra)
+	return out
+}
+
+// nbnsConvertRRs converts NB records into A records.
+// Other records are dropped
+func nbnsConvertRRs(rrs []dns.RR) []dns.RR {
+	var out []dns.RR
+
+	for _, rr := range rrs {
+		// NB type code coincides with the DNS NIMLOC type, so
+		// miekg/dns unpacks NB records as *dns.NIMLOC, with
+		// hex-encoded RDATA
+		hdr := rr.Header()
+		nb, ok := rr.(*dns.NIMLOC)
+		if !ok {
+			continue
+		}
+
+		name, ok := nbnsDecode(strings.TrimSuffix(hdr.Name, "."))
+		if !ok {
+			continue
+		}
+
+		// RDATA consists of 6-byte entries: 2 bytes of NB_FLAGS,
+		// followed by the IPv4 address
+		rdata, err := hex.DecodeString(nb.Locator)
+		if err != nil {
+			continue
+		}
+
+		for ; len(rdata) >= 6; rdata = rdata[6:] {
+			a := &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   name + ".",
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    hdr.Ttl,
+				},
+				A: net.IP(append([]byte(nil), rdata[2:6]...)),
+			}
+
+			out = append(out, a)
+		}
+	}
+
+	return out
+}
+
+// nbnsEncode performs the first-level encoding of the NetBIOS name
+// (RFC 1001, section 14.1). The name is padded with spaces to 15
+// bytes and suffix is appended as the 16th byte
+func nbnsEncode(name string, suffix byte) string {
+	raw := []byte(name + strings.Repeat(" ", nbnsMaxName-len(name)))
+	raw = append(raw, suffix)
+
+	encoded := make([]byte, 0, 2*len(raw))
+	for _, c := range raw {
+		encoded = append(encoded, 'A'+(c>>4), 'A'+(c&0xf))
+	}
+
+	return string(encoded)
+}
+
+// nbnsDecode decodes the first-level encoded NetBIOS name.
+// The suffix byte and padding are removed
+func nbnsDecode(label string) (string, bool) {
+	if len(label) != 2*(nbnsMaxName+1) {
+		return "", false
+	}
+
+	label = strings.ToUpper(label)
+	raw := make([]byte, 0, nbnsMaxName+1)
+	for i := 0; i < len(label); i += 2 {
+		hi, lo := label[i]-'A', label[i+1]-'A'
+		if hi > 0xf || lo > 0xf {
+			return "", false
+		}
+		raw = append(raw, hi<<4|lo)
+	}
+
+	return strings.TrimRight(string(raw[:nbnsMaxName]), " "), true
+}
+
+// nbnsBroadcasts returns IPv4 broadcast addresses of the interfaces
+func nbnsBroadcasts(ifaces []net.Interface) []*net.UDPAddr {
+	var bcasts []*net.UDPAddr
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || ipnet.IP.IsLoopback() {
+				continue
+			}
+
+			ip := ipnet.IP.To4()
+			mask := ipnet.Mask[len(ipnet.Mask)-4:]
+			bcast := make(net.IP, 4)
+			for i := range bcast {
+				bcast[i] = ip[i] | ^mask[i]
+			}
+
+			bcasts = append(bcasts,
+				&net.UDPAddr{IP: bcast, Port: nbnsPort})
+		}
+	}
+
+	return bcasts
+}
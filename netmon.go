@@ -0,0 +1,81 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Network configuration monitoring
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// netmonInterval is how often the network configuration is polled
+const netmonInterval = 2 * time.Second
+
+// NetmonRun polls the network configuration (interfaces and their
+// addresses, selected the same way as by IfAddrs) every
+// netmonInterval, until ctx is canceled. When configuration
+// changes, the change callback is called with the new lists
+// of IPv4 and IPv6 interfaces
+//
+// Polling is used instead of platform-specific notifications
+// (e.g., netlink), so it works everywhere
+func NetmonRun(ctx context.Context, change func(if4, if6 []net.Interface)) {
+	ticker := time.NewTicker(netmonInterval)
+	defer ticker.Stop()
+
+	prev, _, _, err := netmonPoll()
+	if err != nil {
+		prev = ""
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		state, if4, if6, err := netmonPoll()
+		if err != nil || state == prev {
+			continue
+		}
+
+		LogDebug("Network configuration changed")
+		prev = state
+		AddrCacheFlush()
+		change(if4, if6)
+	}
+}
+
+// netmonPoll obtains the network configuration and returns it
+// as string, suitable for comparison, and lists of interfaces
+func netmonPoll() (state string, if4, if6 []net.Interface, err error) {
+	addrs, if4, if6, err := ifAddrsGet(true)
+	if err != nil {
+		return
+	}
+
+	var lines []string
+	for _, addr := range addrs {
+		lines = append(lines, addr.String())
+	}
+	for _, iface := range if4 {
+		lines = append(lines, fmt.Sprintf("4 %d %s", iface.Index, iface.Name))
+	}
+	for _, iface := range if6 {
+		lines = append(lines, fmt.Sprintf("6 %d %s", iface.Index, iface.Name))
+	}
+
+	sort.Strings(lines)
+	state = strings.Join(lines, "\n")
+
+	return
+}
@@ -0,0 +1,75 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Network namespaces, Linux version
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsDir is where named network namespaces are mounted
+// by the ip-netns(8) utility
+const netnsDir = "/var/run/netns"
+
+// NetnsEnter makes the program run in the network namespace,
+// specified by name (see ip-netns(8)) or path (e.g.,
+// /proc/PID/ns/net). It returns only if the program is already
+// running in this namespace, or in a case of errors
+//
+// The namespace is per-thread, and threads of the Go runtime
+// can't be reliably switched all together. So the calling thread
+// enters the namespace and re-executes the program, which then
+// inherits the namespace in all its threads
+func NetnsEnter(ns string) error {
+	path := ns
+	if !strings.Contains(ns, "/") {
+		path = filepath.Join(netnsDir, ns)
+	}
+
+	var target, current unix.Stat_t
+	if err := unix.Stat(path, &target); err != nil {
+		return err
+	}
+
+	if err := unix.Stat("/proc/self/ns/net", &current); err != nil {
+		return err
+	}
+
+	if target.Dev == current.Dev && target.Ino == current.Ino {
+		LogDebug("Running in network namespace %s", path)
+		return nil
+	}
+
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	runtime.LockOSThread()
+
+	err = unix.Setns(fd, unix.CLONE_NEWNET)
+	unix.Close(fd)
+
+	if err == nil {
+		var exe string
+		exe, err = os.Executable()
+		if err == nil {
+			err = syscall.Exec(exe, os.Args, os.Environ())
+		}
+	}
+
+	return err
+}
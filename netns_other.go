@@ -0,0 +1,21 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Network namespaces, version for platforms other than Linux
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// NetnsEnter makes the program run in the network namespace.
+// Not supported on this platform
+func NetnsEnter(ns string) error {
+	return errors.New("network namespaces not supported")
+}
@@ -0,0 +1,160 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Negative answers (NSEC) and the NXRRSET verdict
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// nxrrsetKey identifies the RRset, asserted to be absent
+type nxrrsetKey struct {
+	name  string // Record name, lowercase
+	qtype uint16 // Record type
+}
+
+// nxrrsetVerdict is the NXRRSET verdict for the RRset
+type nxrrsetVerdict struct {
+	nxrrsetKey
+	sources []string // Asserting sources, sorted
+}
+
+// Negative answers state
+var (
+	nxrrsetSources = make(map[nxrrsetKey]map[string]bool)
+	nxrrsetLock    sync.Mutex
+)
+
+// nxrrsetInput records negative answers of the response: NSEC
+// records of the queried names, that don't list the queried type
+// (RFC 6762, section 6.1)
+func nxrrsetInput(msg *dns.Msg, meta SourceMeta) {
+	question := ResponseQuestion()
+
+	nxrrsetLock.Lock()
+	defer nxrrsetLock.Unlock()
+
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range rrs {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok || nsec.Hdr.Ttl == 0 {
+				continue
+			}
+
+			for _, q := range question {
+				switch {
+				case q.Qtype == dns.TypeANY:
+				case !strings.EqualFold(q.Name, nsec.Hdr.Name):
+				case nxrrsetHasType(nsec, q.Qtype):
+				default:
+					key := nxrrsetKey{
+						strings.ToLower(q.Name),
+						q.Qtype,
+					}
+
+					if nxrrsetSources[key] == nil {
+						nxrrsetSources[key] =
+							make(map[string]bool)
+					}
+
+					from := meta.From.IP.String()
+					nxrrsetSources[key][from] = true
+				}
+			}
+		}
+	}
+}
+
+// nxrrsetHasType tells if type is listed in the NSEC type bitmap
+func nxrrsetHasType(nsec *dns.NSEC, qtype uint16) bool {
+	for _, t := range nsec.TypeBitMap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// nxrrsetVerdicts returns definitive NXRRSET verdicts: RRsets,
+// asserted to be absent, that were not received from any other
+// responder by the end of the query
+func nxrrsetVerdicts() []nxrrsetVerdict {
+	nxrrsetLock.Lock()
+	defer nxrrsetLock.Unlock()
+
+	var verdicts []nxrrsetVerdict
+	for key, sources := range nxrrsetSources {
+		q := dns.Question{Name: key.name, Qtype: key.qtype}
+		if queryAnswered(q) {
+			continue
+		}
+
+		v := nxrrsetVerdict{nxrrsetKey: key}
+		for from := range sources {
+			v.sources = append(v.sources, from)
+		}
+		sort.Strings(v.sources)
+
+		verdicts = append(verdicts, v)
+	}
+
+	sort.Slice(verdicts, func(i, j int) bool {
+		if verdicts[i].name != verdicts[j].name {
+			return verdicts[i].name < verdicts[j].name
+		}
+		return verdicts[i].qtype < verdicts[j].qtype
+	})
+
+	return verdicts
+}
+
+// NxrrsetSeen tells if there are NXRRSET verdicts
+func NxrrsetSeen() bool {
+	return len(nxrrsetVerdicts()) != 0
+}
+
+// NxrrsetPrint prints NXRRSET verdicts, if any, into io.Writer.
+// It must be called after the query is completed, so the whole
+// retransmission schedule had a chance to elicit the records from
+// other responders. With influx and json formats, verdicts are
+// logged instead, to keep the output parseable
+//
+// The returned error, if any, comes from w.Write()
+func NxrrsetPrint(w io.Writer) error {
+	verdicts := nxrrsetVerdicts()
+	if len(verdicts) == 0 {
+		return nil
+	}
+
+	buf := bytes.Buffer{}
+	for _, v := range verdicts {
+		line := fmt.Sprintf("NXRRSET for %s %s, asserted by %s",
+			dns.Type(v.qtype), strings.TrimSuffix(v.name, "."),
+			strings.Join(v.sources, ", "))
+
+		if OutputParseable() {
+			LogError("%s", line)
+		} else {
+			buf.WriteString(";; " + line + "\n")
+		}
+	}
+
+	if OutputParseable() {
+		return nil
+	}
+
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,124 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Off-link sources detection
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+// onlinkKey identifies the off-link source
+type onlinkKey struct {
+	from    string // Source address
+	ifindex int    // Receiving interface index
+}
+
+// Off-link sources state
+var (
+	onlinkCounts = make(map[onlinkKey]int) // Counts of responses
+	onlinkLock   sync.Mutex                // Access lock
+)
+
+// OnlinkInput checks, that the source of the response is on-link
+// (RFC 6762, section 11). Responses from other sources may come
+// from reflection, routing leak or spoofing. The first response
+// from each such source is warned about, and all of them are
+// counted for OnlinkPrint
+//
+// It returns false, if the response must be dropped, as requested
+// by OptStrictOnlink. Responses to direct unicast queries (see
+// OptServer) and responses, replayed from the journal (possibly
+// recorded on another network), are not checked
+func OnlinkInput(meta SourceMeta) bool {
+	switch {
+	case OptServer != nil, OptCommand == "render":
+		return true
+	case AddrIsOnLink(meta.From.IP, meta.IfIndex):
+		return true
+	}
+
+	key := onlinkKey{meta.From.String(), meta.IfIndex}
+
+	onlinkLock.Lock()
+	onlinkCounts[key]++
+	first := onlinkCounts[key] == 1
+	onlinkLock.Unlock()
+
+	action := "accepted"
+	if OptStrictOnlink {
+		action = "dropped"
+	}
+
+	if first {
+		LogError("Warning: response from off-link source %s "+
+			"via %s, %s",
+			key.from, onlinkIfName(key.ifindex), action)
+	} else {
+		LogVerbose("Response from off-link source %s, %s",
+			key.from, action)
+	}
+
+	return !OptStrictOnlink
+}
+
+// OnlinkPrint prints off-link sources of responses, if any, with
+// counts of their responses, into io.Writer
+//
+// The returned error, if any, comes from w.Write()
+func OnlinkPrint(w io.Writer) error {
+	onlinkLock.Lock()
+	counts := make(map[onlinkKey]int, len(onlinkCounts))
+	keys := make([]onlinkKey, 0, len(onlinkCounts))
+	for key, count := range onlinkCounts {
+		counts[key] = count
+		keys = append(keys, key)
+	}
+	onlinkLock.Unlock()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].from != keys[j].from {
+			return keys[i].from < keys[j].from
+		}
+		return keys[i].ifindex < keys[j].ifindex
+	})
+
+	action := "accepted"
+	if OptStrictOnlink {
+		action = "dropped"
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; WARNING: RESPONSES FROM OFF-LINK SOURCES:\n")
+
+	for _, key := range keys {
+		fmt.Fprintf(&buf, ";; %s via %s: %d responses, %s\n",
+			key.from, onlinkIfName(key.ifindex),
+			counts[key], action)
+	}
+
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// onlinkIfName returns name of the interface by index
+func onlinkIfName(ifindex int) string {
+	if iface, err := net.InterfaceByIndex(ifindex); err == nil {
+		return iface.Name
+	}
+	return fmt.Sprintf("ifindex %d", ifindex)
+}
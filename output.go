@@ -0,0 +1,108 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Results output
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Output state
+var (
+	outputFile *os.File      // Output file, written directly
+	outputBuf  *bytes.Buffer // Buffered output, written by OutputClose
+)
+
+// OutputOpen returns io.Writer, where results are printed. This
+// is os.Stdout, unless OptOutput is set (and is not the snapshot
+// file of --snapshot-interval)
+//
+// Results of a one-shot run are buffered and written by OutputClose:
+// appended to the file with OptAppend, or atomically replacing the
+// file otherwise, so file readers never see partial results. Results
+// of streaming and long-running commands are written to the file
+// as they are printed
+//
+// Error is returned, if the OptOutput file can't be opened
+func OutputOpen() (io.Writer, error) {
+	if OptOutput == "" || OptSnapshotInterval != 0 {
+		return os.Stdout, nil
+	}
+
+	if !OptStream && OptCommand != "announce" && OptCommand != "respond" {
+		outputBuf = &bytes.Buffer{}
+		return outputBuf, nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if OptAppend {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(OptOutput, flags, 0644)
+	if err != nil {
+		return nil, fileError{err}
+	}
+
+	outputFile = file
+	return outputFile, nil
+}
+
+// fileError is returned, when the file, given by options or
+// arguments, can't be read or written, so it can be told apart
+// from other errors (see mainExitStatus)
+type fileError struct {
+	err error // The underlying error
+}
+
+// Error returns the error message
+func (e fileError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e fileError) Unwrap() error {
+	return e.err
+}
+
+// OutputParseable tells if the output format is machine-parseable
+// (influx or json), so diagnostics, printed after results in text
+// formats, must be logged instead
+func OutputParseable() bool {
+	return OptFormat == "influx" || OptFormat == "json"
+}
+
+// OutputClose completes the output, started by OutputOpen.
+// Errors are logged
+func OutputClose() {
+	var err error
+
+	switch {
+	case outputFile != nil:
+		err = outputFile.Close()
+
+	case outputBuf != nil && OptAppend:
+		var file *os.File
+		file, err = os.OpenFile(OptOutput,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			_, err = file.Write(outputBuf.Bytes())
+			if err2 := file.Close(); err == nil {
+				err = err2
+			}
+		}
+
+	case outputBuf != nil:
+		err = snapshotWriteFile(OptOutput, outputBuf.Bytes())
+	}
+
+	if err != nil {
+		LogError("%s", err)
+	}
+}
@@ -0,0 +1,223 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Persistent records cache
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// persistMaxAge specifies how long records, not seen anymore,
+// are kept in the persistent cache
+const persistMaxAge = 30 * 24 * time.Hour
+
+// Persistent cache state. It is protected by rspLock
+var (
+	persistPrev    map[string]*persistEntry // As loaded from file
+	persistEntries map[string]*persistEntry // Updated during this run
+)
+
+// persistFile is the JSON representation of the persistent cache
+type persistFile struct {
+	Entries []*persistEntry `json:"entries"`
+}
+
+// persistEntry represents a single record of the persistent cache
+type persistEntry struct {
+	Record    string    `json:"record"`     // Record, in zone file format
+	FirstSeen time.Time `json:"first_seen"` // When first seen
+	LastSeen  time.Time `json:"last_seen"`  // When last seen
+
+	rr dns.RR // Parsed record
+}
+
+// PersistLoad loads the persistent cache from the OptCacheFile.
+// Missed file is treated as empty cache. Error is returned,
+// if the file can't be read or parsed
+func PersistLoad() error {
+	prev := make(map[string]*persistEntry)
+	entries := make(map[string]*persistEntry)
+
+	data, err := os.ReadFile(OptCacheFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fileError{err}
+	}
+
+	if err == nil {
+		var file persistFile
+		err = json.Unmarshal(data, &file)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", OptCacheFile, err)
+			return fileError{err}
+		}
+
+		for _, ent := range file.Entries {
+			ent.rr, err = dns.NewRR(ent.Record)
+			if err != nil || ent.rr == nil {
+				LogDebug("%s: bad record %q", OptCacheFile,
+					ent.Record)
+				continue
+			}
+
+			key := dedupKey(ent.rr)
+			prev[key] = ent
+
+			cp := *ent
+			entries[key] = &cp
+		}
+	}
+
+	rspLock.Lock()
+	persistPrev = prev
+	persistEntries = entries
+	rspLock.Unlock()
+
+	return nil
+}
+
+// PersistSave saves the persistent cache into the OptCacheFile.
+// Records, not seen for the persistMaxAge, are dropped
+func PersistSave() error {
+	rspLock.Lock()
+	var file persistFile
+	now := time.Now()
+	for _, ent := range persistEntries {
+		if now.Sub(ent.LastSeen) < persistMaxAge {
+			file.Entries = append(file.Entries, ent)
+		}
+	}
+	rspLock.Unlock()
+
+	sort.Slice(file.Entries, func(i, j int) bool {
+		return file.Entries[i].Record < file.Entries[j].Record
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	err = os.MkdirAll(filepath.Dir(OptCacheFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return snapshotWriteFile(OptCacheFile, data)
+}
+
+// PersistPrintCached prints records from the persistent cache, that
+// answer the question, with their last seen times
+//
+// The returned error, if any, comes from w.Write()
+func PersistPrintCached(w io.Writer, question []dns.Question) error {
+	rspLock.Lock()
+	var found []*persistEntry
+	for _, ent := range persistPrev {
+		if responseMatches(ent.rr, question) {
+			found = append(found, ent)
+		}
+	}
+	rspLock.Unlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Record < found[j].Record
+	})
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; CACHED SECTION:\n")
+	for _, ent := range found {
+		fmt.Fprintf(&buf, "%s\t; last seen %s\n", ent.rr,
+			ent.LastSeen.Format(time.RFC3339))
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// PersistPrintChanges prints changes of records, that answer the
+// question, since the previous run: + (new record) and - (record
+// not seen during this run, with its last seen time)
+//
+// The returned error, if any, comes from w.Write()
+func PersistPrintChanges(w io.Writer, question []dns.Question) error {
+	var lines []string
+
+	rspLock.Lock()
+	for key, ent := range persistEntries {
+		if responseMatches(ent.rr, question) && persistPrev[key] == nil {
+			lines = append(lines, fmt.Sprintf("+ %s", ent.rr))
+		}
+	}
+
+	for key, ent := range persistPrev {
+		if !responseMatches(ent.rr, question) {
+			continue
+		}
+
+		if persistEntries[key].LastSeen.Equal(ent.LastSeen) {
+			lines = append(lines, fmt.Sprintf("- %s\t; last seen %s",
+				ent.rr, ent.LastSeen.Format(time.RFC3339)))
+		}
+	}
+	rspLock.Unlock()
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	sort.Strings(lines)
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; CHANGES SINCE PREVIOUS RUN:\n")
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// persistInput handles received records. Must be called under rspLock
+//
+// Records are copied before they are retained (see ResponseInput)
+func persistInput(rrs []dns.RR, now time.Time) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if _, ok := rr.(*dns.OPT); ok || hdr.Ttl == 0 ||
+			hdr.Class == dns.ClassANY {
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		rr.Header().Class &^= 1 << 15
+
+		key := dedupKey(rr)
+		ent := persistEntries[key]
+		if ent == nil {
+			ent = &persistEntry{FirstSeen: now}
+			persistEntries[key] = ent
+		}
+
+		ent.Record = rr.String()
+		ent.LastSeen = now
+		ent.rr = rr
+	}
+}
@@ -0,0 +1,46 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Profiling and debug endpoint
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// PprofRun serves net/http/pprof profiles at the /debug/pprof/
+// path of the OptPprof address, until ctx is canceled. It doesn't
+// return in a case of errors
+//
+// Handlers are registered on the own mux, so profiles are not
+// exposed by other HTTP servers (see ServeRun and MetricsRun)
+func PprofRun(ctx context.Context) {
+	l, err := net.Listen("tcp", OptPprof)
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	LogDebug("Serving profiles at http://%s/debug/pprof/", l.Addr())
+
+	go srv.Serve(l)
+}
@@ -0,0 +1,103 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Discovery presets
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// preset describes the discovery preset: service types to browse
+// and how to decode TXT records of their instances
+type preset struct {
+	title  string   // Report title, e.g. "MEDIA DEVICES"
+	types  []string // Service types (FQDNs) to browse
+	decode func(svc DnssdService, txt map[string]string) []presetField
+}
+
+// presetField is the decoded field of the service instance
+type presetField struct {
+	name, value string // Field name and value; empty value is omitted
+}
+
+// presets contains discovery presets, by command name
+var presets = map[string]*preset{
+	"media":   presetMedia,
+	"matter":  presetMatter,
+	"homekit": presetHomekit,
+	"shares":  presetShares,
+}
+
+// PresetRun browses service types of the preset (see presets),
+// resolves instances and prints them with fields, decoded from
+// their TXT records, into io.Writer
+func PresetRun(ctx context.Context, w io.Writer, p *preset) {
+	d, stop := browseStart()
+	browseTypes(ctx, d, p.types)
+
+	var services []DnssdService
+	for _, svctype := range p.types {
+		services = append(services, d.Services(svctype)...)
+	}
+
+	stop()
+
+	sort.SliceStable(services, func(i, j int) bool {
+		return services[i].Instance < services[j].Instance
+	})
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, ";; %s:\n", p.title)
+
+	for _, svc := range services {
+		proto := strings.SplitN(svc.Type, ".", 2)[0]
+		fmt.Fprintf(&buf, "\n%s (%s)\n", svc.Instance,
+			strings.TrimPrefix(proto, "_"))
+
+		host := "(unresolved)"
+		if svc.Host != "" {
+			host = fmt.Sprintf("%s port %d", svc.Host, svc.Port)
+		}
+		if len(svc.Addrs) != 0 {
+			host += " (" + strings.Join(svc.Addrs, ", ") + ")"
+		}
+
+		fields := []presetField{{"host", host}}
+		fields = append(fields, p.decode(svc, presetTXT(svc.TXT))...)
+		fields = append(fields, presetField{"device", svc.Model})
+
+		for _, f := range fields {
+			if f.value != "" {
+				fmt.Fprintf(&buf, "    %-15s %s\n", f.name+":",
+					f.value)
+			}
+		}
+	}
+
+	fmt.Fprintf(&buf, "\n;; %d instances\n\n", len(services))
+
+	w.Write(buf.Bytes())
+}
+
+// presetTXT returns TXT record strings as map of values by
+// lowercase keys. If key is repeated, the first value is used
+func presetTXT(txt []string) map[string]string {
+	m := make(map[string]string)
+	for _, s := range txt {
+		kv := strings.SplitN(s, "=", 2)
+		key := strings.ToLower(kv[0])
+		if _, found := m[key]; !found && len(kv) == 2 {
+			m[key] = kv[1]
+		}
+	}
+	return m
+}
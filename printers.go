@@ -0,0 +1,217 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Printers (AirPrint, IPP) discovery
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// printersTypes are service types of printers
+var printersTypes = []string{
+	"_ipp._tcp.local.",
+	"_ipps._tcp.local.",
+	"_pdl-datastream._tcp.local.",
+}
+
+// printersPDL maps MIME types of the pdl key to format names
+var printersPDL = map[string]string{
+	"application/pdf":          "PDF",
+	"application/postscript":   "PostScript",
+	"application/vnd.hp-pcl":   "PCL",
+	"application/vnd.hp-pclxl": "PCL XL",
+	"application/octet-stream": "raw",
+	"image/pwg-raster":         "PWG Raster",
+	"image/urf":                "Apple Raster",
+	"image/jpeg":               "JPEG",
+	"image/png":                "PNG",
+	"image/tiff":               "TIFF",
+}
+
+// printer represents the printer, that may be available via
+// several protocols (service types)
+type printer struct {
+	name      string            // Instance name
+	host      string            // Target host
+	addrs     []string          // Host addresses
+	model     string            // Device model, if known
+	protocols []string          // Protocols with ports, e.g. "ipp:631"
+	txt       map[string]string // TXT keys, lowercase, of all instances
+}
+
+// PrintersRun browses printers (IPP, IPPS and raw port printing),
+// resolves them and prints their capabilities, decoded from TXT
+// records (rp, pdl, URF, Color, Duplex...), into io.Writer
+//
+// Instances of the same printer with different protocols are
+// printed together
+func PrintersRun(ctx context.Context, w io.Writer) {
+	d, stop := browseStart()
+	browseTypes(ctx, d, printersTypes)
+
+	var services []DnssdService
+	for _, svctype := range printersTypes {
+		services = append(services, d.Services(svctype)...)
+	}
+
+	stop()
+
+	printersPrint(w, printersCollect(services))
+}
+
+// printersCollect groups instances by printer (instance name and host)
+func printersCollect(services []DnssdService) []*printer {
+	var printers []*printer
+	byname := make(map[string]*printer)
+
+	for _, svc := range services {
+		key := strings.ToLower(svc.Instance + "@" + svc.Host)
+		p := byname[key]
+		if p == nil {
+			p = &printer{
+				name:  svc.Instance,
+				host:  svc.Host,
+				addrs: svc.Addrs,
+				model: svc.Model,
+				txt:   make(map[string]string),
+			}
+			byname[key] = p
+			printers = append(printers, p)
+		}
+
+		proto := strings.SplitN(svc.Type, ".", 2)[0]
+		proto = strings.TrimPrefix(proto, "_")
+		if svc.Host != "" {
+			proto += fmt.Sprintf(":%d", svc.Port)
+		}
+		p.protocols = append(p.protocols, proto)
+
+		for _, s := range svc.TXT {
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) == 2 && p.txt[strings.ToLower(kv[0])] == "" {
+				p.txt[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+	}
+
+	sort.Slice(printers, func(i, j int) bool {
+		return printers[i].name < printers[j].name
+	})
+
+	return printers
+}
+
+// printersPrint prints the printers report
+func printersPrint(w io.Writer, printers []*printer) error {
+	buf := bytes.Buffer{}
+	buf.WriteString(";; PRINTERS:\n")
+
+	for _, p := range printers {
+		fmt.Fprintf(&buf, "\n%s\n", p.name)
+
+		line := func(name, value string) {
+			if value != "" {
+				fmt.Fprintf(&buf, "    %-10s %s\n",
+					name+":", value)
+			}
+		}
+
+		host := p.host
+		if host == "" {
+			host = "(unresolved)"
+		}
+		if len(p.addrs) != 0 {
+			host += " (" + strings.Join(p.addrs, ", ") + ")"
+		}
+
+		model := p.txt["ty"]
+		if model == "" {
+			model = p.model
+		}
+
+		line("host", host)
+		line("model", model)
+		line("protocols", strings.Join(p.protocols, ", "))
+		line("queue", p.txt["rp"])
+		line("formats", printersFormats(p.txt["pdl"]))
+		line("color", printersBool(p.txt["color"]))
+		line("duplex", printersBool(p.txt["duplex"]))
+		line("airprint", printersURF(p.txt["urf"]))
+		line("location", p.txt["note"])
+		line("admin", p.txt["adminurl"])
+	}
+
+	fmt.Fprintf(&buf, "\n;; %d printers\n\n", len(printers))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// printersFormats decodes the pdl key (comma-separated MIME types)
+func printersFormats(pdl string) string {
+	if pdl == "" {
+		return ""
+	}
+
+	var formats []string
+	for _, mime := range strings.Split(pdl, ",") {
+		mime = strings.TrimSpace(mime)
+		if name, ok := printersPDL[strings.ToLower(mime)]; ok {
+			formats = append(formats, name)
+		} else if mime != "" {
+			formats = append(formats, mime)
+		}
+	}
+
+	return strings.Join(formats, ", ")
+}
+
+// printersBool decodes boolean TXT values (T or F)
+func printersBool(v string) string {
+	switch strings.ToUpper(v) {
+	case "T":
+		return "yes"
+	case "F":
+		return "no"
+	}
+	return v
+}
+
+// printersURF decodes the URF key (Apple Raster capabilities),
+// e.g. "W8,SRGB24,RS300-600,DM1,V1.4". Unknown tokens are ignored
+func printersURF(urf string) string {
+	if urf == "" || strings.EqualFold(urf, "none") {
+		return ""
+	}
+
+	var caps []string
+	for _, tok := range strings.Split(urf, ",") {
+		tok = strings.TrimSpace(tok)
+		switch {
+		case tok == "W8":
+			caps = append(caps, "grayscale")
+		case tok == "SRGB24":
+			caps = append(caps, "sRGB color")
+		case tok == "ADOBERGB24":
+			caps = append(caps, "AdobeRGB color")
+		case strings.HasPrefix(tok, "RS"):
+			caps = append(caps, strings.Replace(tok[2:], "-",
+				"/", -1)+" dpi")
+		case strings.HasPrefix(tok, "DM"):
+			caps = append(caps, "duplex")
+		case strings.HasPrefix(tok, "V"):
+			caps = append(caps, "version "+tok[1:])
+		}
+	}
+
+	return strings.Join(caps, ", ")
+}
@@ -0,0 +1,53 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The probe command
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// ProbeRun performs probing (RFC 6762, section 8.1) of the host
+// name and services, specified the same way as for AnnounceRun,
+// without announcing them, and prints result to w
+//
+// It returns true, if names are not in use and false, if some
+// name is defended by an existing host. Error is returned, if
+// the Responder can't be created or probing is interrupted
+func ProbeRun(ctx context.Context, w io.Writer) (bool, error) {
+	records := announceRecords()
+
+	r, err := ResponderNew(records)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.Probe(ctx)
+	r.Close()
+
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	if err != nil {
+		fmt.Fprintf(w, ";; IN USE: %s\n", err)
+		return false, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		name := rec.RR.Header().Name
+		if rec.Unique && !seen[name] {
+			seen[name] = true
+			fmt.Fprintf(w, ";; NOT IN USE: %s\n", name)
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,277 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The proxy command
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// proxyDefaultAddr is the default address of the proxy
+const proxyDefaultAddr = "127.0.0.1:5300"
+
+// Proxy state
+var (
+	proxyLinks   []queryLink                   // Socket/interface pairs
+	proxyPending = make(map[*proxyLookup]bool) // Pending lookups
+	proxyLock    sync.Mutex                    // Access lock
+)
+
+// proxyLookup represents a pending MDNS lookup
+type proxyLookup struct {
+	question dns.Question  // The question
+	answer   []dns.RR      // Answer records
+	extra    []dns.RR      // Additional records
+	done     chan struct{} // Closed when answered
+}
+
+// ProxyRun runs the unicast DNS server on the address, specified
+// by OptCommandArgs (or proxyDefaultAddr), that answers queries
+// for names within the .local domain by performing MDNS lookups
+// on the selected interfaces, until ctx is cancelled
+//
+// Queries for other names are refused.
+//
+// With systemd socket activation, passed sockets are used instead
+// of the specified address
+func ProxyRun(ctx context.Context) {
+	addr := proxyDefaultAddr
+	if len(OptCommandArgs) > 0 {
+		addr = OptCommandArgs[0]
+	}
+
+	// Create MDNS sockets and start receivers
+	_, if4, if6, err := IfAddrs()
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	conns4, links4 := queryOpen("udp4", queryMcast4, if4)
+	conns6, links6 := queryOpen("udp6", queryMcast6, if6)
+
+	conns := append(conns4, conns6...)
+	proxyLinks = append(links4, links6...)
+
+	if len(proxyLinks) == 0 {
+		LogFatal("No usable interfaces found")
+	}
+
+	var wait sync.WaitGroup
+
+	for _, conn := range conns {
+		accept := func(meta SourceMeta) bool {
+			return !AddrIsLocalUDP(meta.From)
+		}
+
+		wait.Add(1)
+		go queryRecv(conn, accept, proxyInput, &wait)
+	}
+
+	// Start DNS servers
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, rq *dns.Msg) {
+		proxyServe(ctx, w, rq)
+	})
+
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: handler},
+		{Addr: addr, Net: "tcp", Handler: handler},
+	}
+
+	// With systemd socket activation, use passed sockets instead
+	listeners, packetConns := SystemdListeners()
+	if listeners != nil || packetConns != nil {
+		servers = nil
+		for _, pc := range packetConns {
+			servers = append(servers, &dns.Server{
+				Addr: pc.LocalAddr().String(), Net: "udp",
+				PacketConn: pc, Handler: handler})
+		}
+		for _, l := range listeners {
+			servers = append(servers, &dns.Server{
+				Addr: l.Addr().String(), Net: "tcp",
+				Listener: l, Handler: handler})
+		}
+	}
+
+	for _, srv := range servers {
+		srv := srv
+		started := make(chan error, 1)
+		srv.NotifyStartedFunc = func() { started <- nil }
+
+		go func() {
+			if srv.PacketConn != nil || srv.Listener != nil {
+				started <- srv.ActivateAndServe()
+			} else {
+				started <- srv.ListenAndServe()
+			}
+		}()
+
+		if err := <-started; err != nil {
+			LogFatal("%s/%s: %s", srv.Addr, srv.Net, err)
+		}
+
+		LogDebug("Proxy listening on %s/%s", srv.Addr, srv.Net)
+	}
+
+	SystemdNotify("READY=1")
+
+	// Wait for termination
+	<-ctx.Done()
+	SystemdNotify("STOPPING=1")
+
+	for _, srv := range servers {
+		srv.Shutdown()
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	wait.Wait()
+}
+
+// proxyServe handles the unicast DNS query
+func proxyServe(ctx context.Context, w dns.ResponseWriter, rq *dns.Msg) {
+	rsp := &dns.Msg{}
+	rsp.SetReply(rq)
+
+	switch {
+	case rq.Opcode != dns.OpcodeQuery:
+		rsp.Rcode = dns.RcodeNotImplemented
+
+	case len(rq.Question) != 1:
+		rsp.Rcode = dns.RcodeFormatError
+
+	case !dns.IsSubDomain("local.", rq.Question[0].Name):
+		rsp.Rcode = dns.RcodeRefused
+
+	default:
+		q := rq.Question[0]
+		rsp.Authoritative = true
+		rsp.Answer, rsp.Extra = proxyLookupRun(ctx, q)
+
+		// No answer doesn't mean the name doesn't exist: it may
+		// have other records, or the responder may be just slow,
+		// so we reply NODATA (NOERROR with empty answer), not
+		// NXDOMAIN, that resolvers cache for the whole name
+
+		LogDebug("%s: %s: %d answers", w.RemoteAddr(), q.String(),
+			len(rsp.Answer))
+	}
+
+	// Truncate UDP response, if needed
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := dns.MinMsgSize
+		if opt := rq.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		rsp.Truncate(size)
+	}
+
+	w.WriteMsg(rsp)
+}
+
+// proxyLookupRun performs MDNS lookup for the question
+//
+// The query is retransmitted OptTxCount times every OptTxPeriod
+// until the first answer is received. Records TTLs are limited,
+// as for the legacy unicast queries (RFC 6762, section 6.7)
+func proxyLookupRun(ctx context.Context,
+	q dns.Question) (answer, extra []dns.RR) {
+
+	rq := &dns.Msg{}
+	rq.Question = []dns.Question{q}
+	rqBytes, err := rq.Pack()
+	if err != nil {
+		return
+	}
+
+	lookup := &proxyLookup{
+		question: q,
+		done:     make(chan struct{}),
+	}
+
+	proxyLock.Lock()
+	proxyPending[lookup] = true
+	proxyLock.Unlock()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+loop:
+	for count := 0; ; count++ {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-lookup.done:
+			break loop
+		case <-timer.C:
+			if count == OptTxCount {
+				break loop
+			}
+
+			proxyLock.Lock()
+			proxyLinks = querySend(proxyLinks, rqBytes)
+			proxyLock.Unlock()
+
+			timer.Reset(OptTxPeriod)
+		}
+	}
+
+	proxyLock.Lock()
+	delete(proxyPending, lookup)
+	answer, extra = lookup.answer, lookup.extra
+	proxyLock.Unlock()
+
+	for _, rrs := range [][]dns.RR{answer, extra} {
+		for _, rr := range rrs {
+			if rr.Header().Ttl > responderLegacyTTL {
+				rr.Header().Ttl = responderLegacyTTL
+			}
+		}
+	}
+
+	return
+}
+
+// proxyInput handles received MDNS message
+func proxyInput(msg *dns.Msg, meta SourceMeta) {
+	if !msg.Response {
+		return
+	}
+
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+
+	for lookup := range proxyPending {
+		question := []dns.Question{lookup.question}
+
+		var answer []dns.RR
+		for _, rr := range msg.Answer {
+			if responseMatches(rr, question) {
+				answer = append(answer, dns.Copy(rr))
+			}
+		}
+
+		if len(answer) == 0 || lookup.answer != nil {
+			continue
+		}
+
+		lookup.answer = responseAppend(nil, answer)
+		for _, rr := range msg.Extra {
+			lookup.extra = append(lookup.extra, dns.Copy(rr))
+		}
+		lookup.extra = responseAppend(nil, lookup.extra)
+
+		close(lookup.done)
+	}
+}
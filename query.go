@@ -10,7 +10,10 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -18,13 +21,177 @@ import (
 	"github.com/miekg/dns"
 )
 
-// QueryRun runs MDNS query
+// MDNS multicast group addresses
+var (
+	queryMcast4 = &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+	queryMcast6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// errQueryNoInterfaces is returned, when MDNS sockets can't be
+// used on any interface
+var errQueryNoInterfaces = errors.New("No usable interfaces found")
+
+// querySocketError is returned, when the socket can't be created,
+// so it can be told apart from other errors (see mainExitStatus).
+// Its message includes the remediation hint, if available (see
+// SockErrorHint)
+type querySocketError struct {
+	err error // The underlying error
+}
+
+// Error returns the error message
+func (e querySocketError) Error() string {
+	return sockErrorf(e.err, nil, "%s", e.err)
+}
+
+// Unwrap returns the underlying error
+func (e querySocketError) Unwrap() error {
+	return e.err
+}
+
+// queryMaxInterval is the max interval between queries in the
+// steady state of watch mode
+const queryMaxInterval = time.Hour
+
+// QueryConfig contains settings of the query core (see QueryRun
+// and Daemon.ExchangeWith). Command line settings are returned
+// by QueryConfigDefault
+//
+// Daemon.ExchangeWith takes settings per call, so daemon clients
+// may query with different settings concurrently. QueryRun is not
+// reentrant: its state (received answers, known answers, duplicate
+// question suppression) is global, and watch mode, unicast, NBNS
+// and wide-area queries are still selected by command line options,
+// so only one QueryRun may run at a time
+type QueryConfig struct {
+	Iface       string        // Send only via this interface, if set
+	Network     string        // Send only via "udp4" or "udp6", if set
+	TxCount     int           // Count of transmissions
+	TxPeriod    time.Duration // Period between transmissions
+	QuietPeriod time.Duration // Stop, if no new records, 0 if not
+	Adaptive    bool          // Stop retransmissions, once answered
+	NoJitter    bool          // Don't delay the first query
+	QU          bool          // Request unicast responses
+}
+
+// QueryConfigDefault returns QueryConfig with command line settings
 //
-// It returns question section of the query message, which is
-// useful for response formatting
-func QueryRun() []dns.Question {
+// Interfaces and address families, selected by the command line,
+// are already applied by IfAddrs, so Iface and Network are not set
+func QueryConfigDefault() QueryConfig {
+	return QueryConfig{
+		TxCount:     OptTxCount,
+		TxPeriod:    OptTxPeriod,
+		QuietPeriod: OptQuietPeriod,
+		Adaptive:    OptAdaptive,
+		NoJitter:    OptNoJitter,
+	}
+}
+
+// ifaces returns interfaces, selected by Iface and Network
+func (cfg QueryConfig) ifaces(if4, if6 []net.Interface) (
+	[]net.Interface, []net.Interface) {
+
+	filter := func(ifaces []net.Interface) []net.Interface {
+		var out []net.Interface
+		for _, iface := range ifaces {
+			if cfg.Iface == "" || iface.Name == cfg.Iface {
+				out = append(out, iface)
+			}
+		}
+		return out
+	}
+
+	switch cfg.Network {
+	case "udp4":
+		if6 = nil
+	case "udp6":
+		if4 = nil
+	}
+
+	return filter(if4), filter(if6)
+}
+
+// question returns the question to send, with the QU bit set
+// in the question class, if QU is requested (RFC 6762, section 5.4)
+func (cfg QueryConfig) question(question []dns.Question) []dns.Question {
+	question = append([]dns.Question(nil), question...)
+	if cfg.QU {
+		for i := range question {
+			question[i].Qclass |= 1 << 15
+		}
+	}
+
+	return question
+}
+
+// delay returns the delay of the first query
+//
+// RFC 6762, section 5.2, recommends to delay the first query
+// by a random interval in the range 20-120 ms, to avoid
+// synchronized bursts when many clients start together
+func (cfg QueryConfig) delay() time.Duration {
+	if cfg.NoJitter {
+		return 0
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	delay := 20*time.Millisecond +
+		time.Duration(rnd.Int63n(int64(100*time.Millisecond)))
+
+	LogDebug("Initial query delay: %s", delay)
+	return delay
+}
+
+// QueryRun runs MDNS query with the specified settings
+//
+// The rq is the query message, created by QueryNewRequest.
+// In watch mode (OptWatch), QueryRun only returns when ctx
+// is cancelled
+//
+// If OptServer is set, the query is sent via unicast to that
+// server. If OptProtocol is "nbns", the NetBIOS name query is
+// performed. If OptWideArea is set, the query is sent via unicast
+// DNS (or, with OptPush, the DNS Push subscription is used).
+// Otherwise, the normal multicast query is performed
+//
+// Interfaces that have failed are skipped. Error is returned, if
+// the query can't be performed at all (e.g., no usable interfaces)
+func QueryRun(ctx context.Context, rq *dns.Msg, cfg QueryConfig) error {
+	switch {
+	case OptServer != nil:
+		return queryRunUnicast(ctx, rq, cfg)
+
+	case OptProtocol == "nbns":
+		return NbnsRun(ctx, rq, cfg)
+
+	case OptWideArea && OptPush:
+		return DnsPushRun(ctx, rq)
+
+	case OptWideArea:
+		return WideAreaRun(rq)
+	}
+
+	// Pack DNS query message. With cfg.QU, the QU bit is set
+	// in the sent question only, so answers are matched as usual
+	q := rq
+	if cfg.QU {
+		q = rq.Copy()
+		q.Question = cfg.question(rq.Question)
+	}
+
+	rqBytes, err := q.Pack()
+	if err != nil {
+		return fmt.Errorf("%s: %s", OptDomain, err)
+	}
+
 	// Obtain local addresses and relevant interfaces
-	addrs, if4, if6 := IfAddrs()
+	addrs, if4, if6, err := IfAddrs()
+	if err != nil {
+		return err
+	}
+
+	if4, if6 = cfg.ifaces(if4, if6)
 
 	for _, addr := range addrs {
 		LogDebug("Using local IP address: %s@%s", addr.IP, addr.Zone)
@@ -38,185 +205,1081 @@ func QueryRun() []dns.Question {
 		LogDebug("Using IPv6 interface: %s", iface.Name)
 	}
 
-	// Create unicast sockets, one socket per local address
-	conns := []*net.UDPConn{}
-
-	conf := &net.ListenConfig{
-		Control: func(network, address string, c syscall.RawConn) error {
-			var err error
-			c.Control(func(fd uintptr) {
-				// SO_REUSEADDR is needed for coexistence
-				// with Avahi daemon
-				err = syscall.SetsockoptInt(int(fd),
-					syscall.SOL_SOCKET,
-					syscall.SO_REUSEADDR, 1)
-
-				// RFC 6762, section 11, requires TTL
-				// to be set to 255
-				if err == nil {
-					err = syscall.SetsockoptInt(int(fd),
-						syscall.IPPROTO_IP,
-						syscall.IP_TTL, 255)
-				}
+	return queryRunLinks(ctx, rq, rqBytes, cfg, if4, if6)
+}
 
-				if err == nil {
-					err = syscall.SetsockoptInt(int(fd),
-						syscall.IPPROTO_IP,
-						syscall.IP_MULTICAST_TTL, 255)
-				}
-			})
-			return err
-		},
+// queryRunLinks runs multicast query via the specified IPv4 and
+// IPv6 interfaces. The rqBytes is the packed rq, as sent initially
+func queryRunLinks(ctx context.Context, rq *dns.Msg, rqBytes []byte,
+	cfg QueryConfig, if4, if6 []net.Interface) error {
+
+	if OptCompareIfaces {
+		compareSetIfaces(if4, if6)
 	}
 
-	for _, addr := range addrs {
-		conn, err := conf.ListenPacket(context.Background(),
-			"udp", addr.String())
+	// Create sockets, join multicast groups and start receivers.
+	// In watch mode, follow network configuration changes and
+	// re-query when it changes
+	sockets := querySocketsOpen(if4, if6, queryPacketInput)
+	if sockets.Len() == 0 && !OptWatch {
+		sockets.Close()
+		return errQueryNoInterfaces
+	}
 
-		if err != nil {
-			LogFatal("%s", err)
+	var netchange chan struct{}
+	if OptWatch {
+		netchange = make(chan struct{}, 1)
+		go NetmonRun(ctx, func(if4, if6 []net.Interface) {
+			sockets.Update(cfg.ifaces(if4, if6))
+			select {
+			case netchange <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	queryDupSetQuestion(rq.Question)
+
+	// Run the send loop
+	delay := cfg.delay()
+	queryLoop(ctx, rq, cfg, delay, netchange, func(retransmit bool) bool {
+		var left int
+		if retransmit {
+			left = sockets.Retransmit(rq)
+		} else {
+			left = sockets.Send(queryResolveBytes(rq, rqBytes))
 		}
 
-		conns = append(conns, conn.(*net.UDPConn))
+		switch {
+		case left != 0:
+		case OptWatch:
+			// Wait for interfaces to appear
+			LogDebug("No usable interfaces, waiting")
+		default:
+			LogError("No usable interfaces left")
+			return false
+		}
+		return true
+	})
+
+	// Close all connections and wait for receivers termination
+	sockets.Close()
+	queryMultiPkt.Flush()
+
+	return nil
+}
+
+// queryRunUnicast runs unicast query to the OptServer
+//
+// The query is sent from the ephemeral port (or OptSourcePort), so
+// responder will reply via unicast (RFC 6762, section 6.7)
+func queryRunUnicast(ctx context.Context, rq *dns.Msg,
+	cfg QueryConfig) error {
+
+	network := "udp6"
+	if AddrIs4UDP(OptServer) {
+		network = "udp4"
 	}
 
-	// Create multicast sockets, one socket per interface
-	mcast4 := &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
-	mcast6 := &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+	LogDebug("Using unicast server: %s", OptServer)
 
-	mconns := []*net.UDPConn{}
-	for _, iface := range if4 {
-		conn, err := net.ListenMulticastUDP("udp4", &iface, mcast4)
+	// Pack DNS query message
+	rqBytes, err := rq.Pack()
+	if err != nil {
+		return fmt.Errorf("%s: %s", OptDomain, err)
+	}
+
+	conn, err := queryListen(network, QueryUnicastAddr(), "")
+	if err != nil {
+		return querySocketError{err}
+	}
+
+	// Start receiver
+	var wait sync.WaitGroup
+
+	accept := func(meta SourceMeta) bool {
+		from := meta.From
+		if !from.IP.Equal(OptServer.IP) || from.Port != OptServer.Port {
+			LogVerbose("Packet from %s: unexpected source, dropped",
+				from)
+			return false
+		}
+		return true
+	}
+
+	wait.Add(1)
+	go queryRecv(conn, accept, queryPacketInput, &wait)
+
+	// Run the send loop
+	queryLoop(ctx, rq, cfg, 0, nil, func(retransmit bool) bool {
+		buf := queryResolveBytes(rq, rqBytes)
+		if retransmit {
+			question := queryUnanswered(queryQuestion(rq), -1)
+			if len(question) == 0 {
+				return true
+			}
+			buf = queryPack(rq, question,
+				queryKnownAnswers(question, -1))
+		}
+
+		err := conn.WriteTo(buf, OptServer, 0)
 		if err != nil {
-			LogFatal("%s", err)
+			LogError("%s: %s", OptServer, err)
+			return false
 		}
+		metricsSent()
+		journalPacket(journalTx, buf, OptServer, 0)
+		return true
+	})
+
+	// Close connection and wait for receiver termination
+	conn.Close()
+	wait.Wait()
+	queryMultiPkt.Flush()
+
+	return nil
+}
 
-		mconns = append(mconns, conn)
+// queryLoop runs the send loop. The first query is sent after
+// the specified delay. The send callback sends the query; if it
+// returns false, the loop is terminated. The retransmit parameter
+// of the callback is true for the 2nd and following queries of
+// the initial cfg.TxCount queries, which may be limited to questions,
+// not answered yet (see queryRetransmit)
+//
+// Initially, cfg.TxCount queries are sent every cfg.TxPeriod.
+// In adaptive mode, retransmissions are stopped once matching
+// answer is received.
+//
+// Then, in watch mode, we continue in the steady state. RFC 6762,
+// section 5.2, requires interval between queries to be at least
+// one second, increasing by at least a factor of two, up to
+// an hour.
+//
+// Duplicate question suppression (RFC 6762, section 7.3)
+// is performed in the steady state: if other host has sent
+// the same question since our last query, our query is
+// treated as sent.
+//
+// Additionally, in watch mode, query is sent when answers
+// near expiration (see ResponseRefreshChan).
+//
+// When netchange is signaled, the network configuration has
+// changed, and query is sent immediately. In the steady state,
+// the interval between queries restarts from one second, so
+// records, re-announced on the new network, are learned quickly.
+// The netchange may be nil.
+//
+// In resolve mode, only missing parts of the service instance
+// are queried, and the loop terminates (except in watch mode)
+// once resolution is complete.
+//
+// If cfg.QuietPeriod is set, the loop terminates once no new
+// records have been received for this period since the first
+// query, instead of after the last of cfg.TxCount periods.
+func queryLoop(ctx context.Context, rq *dns.Msg, cfg QueryConfig,
+	delay time.Duration, netchange <-chan struct{},
+	send func(retransmit bool) bool) {
+
+	ResponseSetQuestion(rq.Question)
+
+	var answered <-chan struct{}
+	if cfg.Adaptive {
+		answered = ResponseAnsweredChan()
 	}
 
-	for _, iface := range if6 {
-		conn, err := net.ListenMulticastUDP("udp6", &iface, mcast6)
-		if err != nil {
-			LogFatal("%s", err)
+	refresh := ResponseRefreshChan()
+	resolved := ResponseResolveChan()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	// The quiet period timer is started by the first query
+	var newRecords <-chan struct{}
+	var quiet <-chan time.Time
+	quietTimer := time.NewTimer(cfg.QuietPeriod)
+	defer quietTimer.Stop()
+
+	if cfg.QuietPeriod != 0 {
+		newRecords = ResponseNewChan()
+	}
+
+	count := 0
+	suppress := false
+	steady := false
+	interval := time.Second
+	last := time.Now()
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			LogDebug("Query terminated: %s", ctx.Err())
+			break loop
+
+		case <-answered:
+			answered = nil
+			suppress = true
+
+		case <-resolved:
+			resolved = nil
+			if !OptWatch {
+				break loop
+			}
+
+		case <-newRecords:
+			if quiet != nil {
+				queryTimerReset(quietTimer, cfg.QuietPeriod)
+			}
+
+		case <-quiet:
+			LogDebug("No new records for %s, query terminated",
+				cfg.QuietPeriod)
+			break loop
+
+		case <-refresh:
+			LogDebug("Answers near expiration, refreshing")
+			if !send(false) {
+				break loop
+			}
+
+		case <-netchange:
+			LogDebug("Re-querying after network configuration change")
+			if !send(false) {
+				break loop
+			}
+
+			if steady {
+				last = time.Now()
+				interval = time.Second
+				queryTimerReset(timer, interval)
+			}
+
+		case <-timer.C:
+			switch {
+			case !steady && count < cfg.TxCount && !suppress:
+				if OptRounds {
+					roundsNext()
+				}
+
+				if !send(count > 0) {
+					break loop
+				}
+				count++
+				timer.Reset(cfg.TxPeriod)
+
+				if newRecords != nil && quiet == nil {
+					queryTimerReset(quietTimer, cfg.QuietPeriod)
+					quiet = quietTimer.C
+				}
+
+			case !steady:
+				if suppress && count < cfg.TxCount {
+					LogDebug("Answer received, %d "+
+						"retransmissions suppressed",
+						cfg.TxCount-count)
+				}
+
+				if !OptWatch && quiet != nil {
+					// Wait for the quiet period
+					steady = true
+					continue
+				}
+
+				if !OptWatch {
+					break loop
+				}
+
+				steady = true
+				last = time.Now()
+				timer.Reset(interval)
+
+			default:
+				if queryDupSeenSince(last) {
+					LogDebug("Duplicate question seen, " +
+						"query suppressed")
+				} else if !send(false) {
+					break loop
+				}
+
+				last = time.Now()
+				interval *= 2
+				if interval > queryMaxInterval {
+					interval = queryMaxInterval
+				}
+
+				LogDebug("Next query in %s", interval)
+				timer.Reset(interval)
+			}
 		}
+	}
+
+}
 
-		mconns = append(mconns, conn)
+// queryResolveBytes returns the query message to send. In resolve
+// mode, it asks only for the missing parts of the service instance
+// (see ResponseResolveMissing). Otherwise, rqBytes is returned
+func queryResolveBytes(rq *dns.Msg, rqBytes []byte) []byte {
+	missing := ResponseResolveMissing()
+	if missing == nil {
+		return rqBytes
 	}
 
-	// Start receivers
-	var wait sync.WaitGroup
+	return queryPack(rq, missing, nil)
+}
 
-	for _, conn := range conns {
-		wait.Add(1)
-		go queryRecv(conn, &wait)
+// queryQuestion returns the question, being asked: missing parts
+// of the service instance in resolve mode, or the question of rq
+func queryQuestion(rq *dns.Msg) []dns.Question {
+	if missing := ResponseResolveMissing(); missing != nil {
+		return missing
 	}
+	return rq.Question
+}
+
+// queryPack packs rq with the question replaced and known answers
+// added (RFC 6762, section 7.1). Known answers that don't fit into
+// the safe packet size (see sizes.go) are omitted, so responders
+// just send them again
+//
+// Questions come from rq, or from received records, so packing
+// is not expected to fail. If it fails, the whole rq is packed
+func queryPack(rq *dns.Msg, question []dns.Question,
+	known []dns.RR) []byte {
 
-	for _, conn := range mconns {
-		wait.Add(1)
-		go queryRecv(conn, &wait)
+	q := rq.Copy()
+	q.Question = question
+	for _, rr := range known {
+		q.Answer = append(q.Answer, rr)
+		if q.Len() > sizesLimit6 {
+			q.Answer = q.Answer[:len(q.Answer)-1]
+			break
+		}
 	}
 
-	// Create DNS query message
-	rq := queryNewRequest()
-	rqBytes, err := rq.Pack()
+	buf, err := q.Pack()
 	if err != nil {
-		LogFatal("%s: %s", OptDomain, err)
+		LogError("%s: %s; sending the full query", OptDomain, err)
+		buf, _ = rq.Pack()
 	}
 
-	// Begin sending queries until time is expired
-	tmCount := OptTxCount
+	return buf
+}
+
+// queryRetransmit retransmits the query via links, asking on each
+// link only questions, not answered via its interface yet. Links,
+// where all questions are answered, are skipped
+//
+// Questions for shared records (e.g., PTR records of service
+// instances) are never answered, as more responders may follow,
+// so they are retransmitted with known answers, received via the
+// link's interface
+//
+// Links that have failed are removed from the list. The updated
+// list is returned
+func queryRetransmit(links []queryLink, rq *dns.Msg) []queryLink {
+	question := queryQuestion(rq)
+	alive := links[:0]
 
-	for tmCount > 0 {
-		for _, conn := range conns {
-			if AddrIs4(conn.LocalAddr().(*net.UDPAddr).IP) {
-				conn.WriteToUDP(rqBytes, mcast4)
-			} else {
-				conn.WriteToUDP(rqBytes, mcast6)
+	for _, link := range links {
+		// In degraded mode (see IfAddrs), interface is unknown
+		ifindex := link.iface.Index
+		if ifindex == 0 {
+			ifindex = -1
+		}
+
+		unanswered := queryUnanswered(question, ifindex)
+
+		switch {
+		case len(unanswered) == 0:
+			LogVerbose("%s: all questions answered, "+
+				"retransmission skipped", link.iface.Name)
+			alive = append(alive, link)
+
+		default:
+			if len(unanswered) != len(question) {
+				LogVerbose("%s: retransmitting %d of %d "+
+					"questions", link.iface.Name,
+					len(unanswered), len(question))
 			}
+
+			known := queryKnownAnswers(unanswered, ifindex)
+			buf := queryPack(rq, unanswered, known)
+			alive = append(alive, querySend([]queryLink{link}, buf)...)
 		}
+	}
+
+	return alive
+}
+
+// Answers tracking state, for retransmission of unanswered questions
+var (
+	// Names and types of received records, per ifindex. True
+	// for unique records (with the cache-flush bit)
+	queryAnswers = make(map[int]map[string]bool)
+
+	// Received shared records, per ifindex, by dedupKey
+	queryKnown = make(map[int]map[string]*queryKnownAnswer)
+
+	queryAnswersLock sync.Mutex // Access lock
+)
+
+// queryKnownAnswer is the received shared record, to be sent
+// in the Known-Answer Section of retransmissions
+type queryKnownAnswer struct {
+	rr       dns.RR    // The record
+	received time.Time // When received
+}
 
-		tmCount--
-		time.Sleep(OptTxPeriod)
+// queryAnswerInput records names and types of the received records
+// per interface, for queryUnanswered, and shared records, for
+// queryKnownAnswers
+func queryAnswerInput(msg *dns.Msg, meta SourceMeta) {
+	queryAnswersLock.Lock()
+	defer queryAnswersLock.Unlock()
+
+	answers := queryAnswers[meta.IfIndex]
+	known := queryKnown[meta.IfIndex]
+	if answers == nil {
+		answers = make(map[string]bool)
+		known = make(map[string]*queryKnownAnswer)
+		queryAnswers[meta.IfIndex] = answers
+		queryKnown[meta.IfIndex] = known
 	}
 
-	// Close all connections and wait for receivers termination
-	for _, conn := range conns {
-		conn.Close()
+	now := time.Now()
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.OPT); ok {
+				continue
+			}
+
+			hdr := rr.Header()
+			unique := hdr.Class&(1<<15) != 0
+			types := []uint16{hdr.Rrtype, dns.TypeANY}
+			for _, qtype := range types {
+				key := queryAnswerKey(hdr.Name, qtype)
+				answers[key] = answers[key] || unique
+			}
+
+			key := dedupKey(rr)
+			switch {
+			case unique:
+			case hdr.Ttl == 0:
+				delete(known, key)
+			default:
+				known[key] = &queryKnownAnswer{dns.Copy(rr), now}
+			}
+		}
+	}
+}
+
+// queryUnanswered returns questions, not answered via the
+// interface with the specified index. If ifindex is -1, questions
+// not answered via any interface are returned
+//
+// Only unique records answer the question: shared records may
+// come from many responders, so more of them may follow
+func queryUnanswered(question []dns.Question, ifindex int) []dns.Question {
+	queryAnswersLock.Lock()
+	defer queryAnswersLock.Unlock()
+
+	var out []dns.Question
+	for _, q := range question {
+		key := queryAnswerKey(q.Name, q.Qtype)
+		answered := false
+
+		for idx, answers := range queryAnswers {
+			if (ifindex == -1 || idx == ifindex) && answers[key] {
+				answered = true
+			}
+		}
+
+		if !answered {
+			out = append(out, q)
+		}
 	}
 
-	for _, conn := range mconns {
-		conn.Close()
+	return out
+}
+
+// queryAnswered tells if any records (unique or shared) of the
+// question's name and type were received via any interface
+func queryAnswered(q dns.Question) bool {
+	queryAnswersLock.Lock()
+	defer queryAnswersLock.Unlock()
+
+	key := queryAnswerKey(q.Name, q.Qtype)
+	for _, answers := range queryAnswers {
+		if _, found := answers[key]; found {
+			return true
+		}
 	}
 
-	wait.Wait()
+	return false
+}
 
-	return rq.Question
+// queryKnownAnswers returns shared records, that answer the
+// question and were received via the interface with the specified
+// index (or via any interface, if ifindex is -1), for the
+// Known-Answer Section of the query
+//
+// Only records with more than half of TTL remaining are returned,
+// with TTL adjusted (RFC 6762, section 7.1)
+func queryKnownAnswers(question []dns.Question, ifindex int) []dns.RR {
+	queryAnswersLock.Lock()
+	defer queryAnswersLock.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+
+	var out []dns.RR
+	for idx, known := range queryKnown {
+		if ifindex != -1 && idx != ifindex {
+			continue
+		}
+
+		for key, ka := range known {
+			hdr := ka.rr.Header()
+			elapsed := uint32(now.Sub(ka.received) / time.Second)
+			switch {
+			case seen[key]:
+			case elapsed >= hdr.Ttl, hdr.Ttl-elapsed <= hdr.Ttl/2:
+			case responseMatches(ka.rr, question):
+				seen[key] = true
+				rr := dns.Copy(ka.rr)
+				rr.Header().Ttl -= elapsed
+				out = append(out, rr)
+			}
+		}
+	}
+
+	return out
 }
 
-// queryNewQuestion creates q new request message
-func queryNewRequest() *dns.Msg {
+// queryAnswerKey returns the key of name and type for the
+// answers tracking
+func queryAnswerKey(name string, rrtype uint16) string {
+	return strings.ToLower(name) + " " + dns.TypeToString[rrtype]
+}
+
+// queryTimerReset stops the timer, drains its channel, if timer
+// has fired, and resets it to the new duration
+func queryTimerReset(timer *time.Timer, d time.Duration) {
+	timer.Stop()
+	select {
+	case <-timer.C:
+	default:
+	}
+	timer.Reset(d)
+}
+
+// Duplicate question suppression state
+var (
+	queryDupQuestion []dns.Question // Our question
+	queryDupLast     time.Time      // Last time duplicate seen
+	queryDupLock     sync.Mutex     // Access lock
+)
+
+// queryDupSetQuestion sets our question for duplicate question
+// suppression
+func queryDupSetQuestion(question []dns.Question) {
+	queryDupLock.Lock()
+	queryDupQuestion = question
+	queryDupLock.Unlock()
+}
+
+// queryDupInput handles query, received from other host
+//
+// If query contains the same question as ours, as a "QM" question,
+// and its Known-Answer Section doesn't contain records, that we
+// would not list in our own Known-Answer Section (see
+// queryKnownAnswers), the query is considered a duplicate of our
+// own (RFC 6762, section 7.3). Otherwise, responders would
+// suppress answers, that we don't know yet
+func queryDupInput(q *dns.Msg, meta SourceMeta) {
+	queryDupLock.Lock()
+	question := queryDupQuestion
+	queryDupLock.Unlock()
+
+	var dup []dns.Question
+	for _, q1 := range q.Question {
+		for _, q2 := range question {
+			// Note, "QU" questions have the top bit of
+			// class set, so they never match here
+			if q1.Qtype == q2.Qtype &&
+				q1.Qclass == q2.Qclass &&
+				strings.EqualFold(q1.Name, q2.Name) {
+				dup = append(dup, q2)
+			}
+		}
+	}
+
+	if len(dup) == 0 {
+		return
+	}
+
+	// In degraded mode (see IfAddrs), interface is unknown
+	ifindex := meta.IfIndex
+	if ifindex == 0 {
+		ifindex = -1
+	}
+
+	known := make(map[string]bool)
+	for _, rr := range queryKnownAnswers(dup, ifindex) {
+		known[dedupKeyNoFlush(rr)] = true
+	}
+
+	for _, rr := range q.Answer {
+		if responseMatches(rr, dup) && !known[dedupKeyNoFlush(rr)] {
+			LogVerbose("Question from %s has unknown known "+
+				"answers, not a duplicate", meta.From)
+			return
+		}
+	}
+
+	LogVerbose("Duplicate question from %s", meta.From)
+
+	queryDupLock.Lock()
+	queryDupLast = time.Now()
+	queryDupLock.Unlock()
+}
+
+// queryDupSeenSince tells if duplicate question was seen
+// since the specified time
+func queryDupSeenSince(t time.Time) bool {
+	queryDupLock.Lock()
+	defer queryDupLock.Unlock()
+	return queryDupLast.After(t)
+}
+
+// querySend sends the query message to the multicast group
+// via all links
+//
+// Links that have failed due to interface going away or down are
+// removed from the list. The updated list is returned
+func querySend(links []queryLink, rqBytes []byte) []queryLink {
+	alive := links[:0]
+
+	for _, link := range links {
+		group := queryMcast6
+		if link.conn.Is4() {
+			group = queryMcast4
+		}
+
+		err := link.conn.WriteTo(rqBytes, group, link.iface.Index)
+		switch {
+		case err == nil:
+			metricsSent()
+			journalPacket(journalTx, rqBytes, group,
+				link.iface.Index)
+		case errors.Is(err, syscall.ENODEV),
+			errors.Is(err, syscall.ENXIO),
+			errors.Is(err, syscall.ENETDOWN),
+			errors.Is(err, syscall.EADDRNOTAVAIL):
+			LogError("%s: %s; interface disabled",
+				link.iface.Name, err)
+			continue
+
+		default:
+			LogDebug("%s: %s", link.iface.Name, err)
+		}
+
+		alive = append(alive, link)
+	}
+
+	return alive
+}
+
+// querySockControl returns net.ListenConfig.Control function
+// for the MDNS sockets. If ifname is not empty, socket is bound
+// to that network interface, otherwise to the VRF device, if
+// OptIface specifies one (see IfaceVrf)
+func querySockControl(ifname string) func(network, address string,
+	c syscall.RawConn) error {
+
+	// In VRF, sockets are bound to the VRF device, unless
+	// bound to the interface
+	if ifname == "" {
+		ifname = IfaceVrf()
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			// SO_REUSEADDR is needed for coexistence
+			// with Avahi daemon
+			err = SockReuseAddr(fd)
+
+			// SO_REUSEPORT is needed for coexistence with
+			// responders that use it instead of SO_REUSEADDR
+			// (e.g., mDNSResponder). Not all systems support
+			// it, so errors are ignored here
+			if err == nil {
+				SockReusePort(fd)
+			}
+
+			// Bind to device, if requested
+			if err == nil && ifname != "" {
+				err = SockBindToDevice(fd, ifname)
+			}
+
+			// Receive via AWDL interfaces, if requested
+			if err == nil && OptAWDL {
+				err = SockRecvAnyIf(fd)
+			}
+		})
+		return err
+	}
+}
+
+// queryLink represents a pair of socket and network interface,
+// used to send and receive MDNS messages
+type queryLink struct {
+	conn  Transport     // The socket
+	iface net.Interface // The interface
+}
+
+// queryOpen creates sockets for the specified address family and
+// joins the multicast group on all the specified interfaces
+//
+// Normally, a single socket is shared between all interfaces of
+// the same address family. If OptBindDevice is set, a separate
+// socket, bound to its device, is created per interface
+//
+// Errors are logged with remediation hints (see SockErrorHint), and
+// interfaces that have failed are skipped, so the caller continues
+// with the remaining interfaces
+func queryOpen(network string, group *net.UDPAddr,
+	ifaces []net.Interface) (conns []Transport, links []queryLink) {
+
+	var conn Transport
+	for _, iface := range ifaces {
+		iface := iface
+		created := false
+
+		if conn == nil || OptBindDevice {
+			ifname := ""
+			if OptBindDevice {
+				ifname = iface.Name
+			}
+
+			laddr := &net.UDPAddr{Port: group.Port}
+			c, err := TransportOpen(network, laddr, ifname)
+			if err != nil {
+				LogError("%s", sockErrorf(err, nil, "%s: %s",
+					iface.Name, err))
+				if !OptBindDevice {
+					// Shared socket fails for all
+					return
+				}
+				continue
+			}
+
+			conn = c
+			created = true
+			conns = append(conns, conn)
+		}
+
+		err := conn.JoinGroup(&iface, group)
+		if err != nil {
+			LogError("%s", sockErrorf(err, &iface,
+				"%s: joining %s: %s; interface skipped",
+				iface.Name, group.IP, err))
+
+			if created && OptBindDevice {
+				conn.Close()
+				conns = conns[:len(conns)-1]
+			}
+			continue
+		}
+
+		links = append(links, queryLink{conn, iface})
+	}
+
+	return
+}
+
+// QueryUnicastAddr returns local address for unicast sockets:
+// wildcard address with the OptSourcePort port
+func QueryUnicastAddr() *net.UDPAddr {
+	return &net.UDPAddr{Port: OptSourcePort}
+}
+
+// TransportOpen opens the MDNS transport of the address family
+// ("udp4" or "udp6"), bound to the address and, if ifname is not
+// empty, to the network interface. Transports are used for MDNS
+// multicast links (see queryOpen and querySockets)
+//
+// By default, it creates UDP sockets (see Conn). Embedders and
+// tests may replace it before MDNS operations are started
+var TransportOpen = func(network string, addr *net.UDPAddr,
+	ifname string) (Transport, error) {
+
+	conn, err := queryListen(network, addr, ifname)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// queryListen creates a new MDNS socket, bound to the specified
+// address. If ifname is not empty, socket is bound to that
+// network interface
+func queryListen(network string, addr *net.UDPAddr,
+	ifname string) (*Conn, error) {
+
+	conf := &net.ListenConfig{Control: querySockControl(ifname)}
+	udp, err := conf.ListenPacket(context.Background(),
+		network, addr.String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if OptRcvBuf != 0 {
+		err = udp.(*net.UDPConn).SetReadBuffer(OptRcvBuf)
+		if err != nil {
+			udp.Close()
+			return nil, fmt.Errorf("%s: SO_RCVBUF: %s", addr, err)
+		}
+	}
+
+	conn, err := ConnNew(udp.(*net.UDPConn))
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+
+	if size, err := conn.RcvBuf(); err == nil {
+		LogDebug("Socket %s %s: receive buffer size is %d bytes",
+			network, addr, size)
+	}
+
+	return conn, nil
+}
+
+// QueryNewRequest creates a new request message
+//
+// Its question section is useful for response formatting.
+// It returns error if OptDomain is invalid
+func QueryNewRequest() (*dns.Msg, error) {
 	rq := &dns.Msg{}
 
-	// Make sure domain is FQDN
-	labels, ok := dns.IsDomainName(OptDomain)
-	if !ok {
-		LogFatal("%q: invalid domain name", OptDomain)
+	var fqdn string
+	var err error
+	if OptQService {
+		fqdn, err = QueryServiceFqdn(OptDomain)
+	} else {
+		fqdn, err = QueryFqdn(OptDomain)
 	}
 
-	fqdn := OptDomain
-	if labels < 2 {
-		fqdn += ".local."
+	if err != nil {
+		return nil, err
 	}
 
-	fqdn = dns.Fqdn(fqdn)
+	if OptQResolve {
+		ResponseResolve(fqdn)
+	}
 
-	// Set question
+	// Set question, one per query type
 	rq.Id = dns.Id()
 	rq.RecursionDesired = false
-	rq.Question = make([]dns.Question, 1)
-	rq.Question[0] = dns.Question{
-		Name:   fqdn,
-		Qtype:  OptQType,
-		Qclass: OptQClass,
+	for _, qtype := range OptQTypes {
+		rq.Question = append(rq.Question, dns.Question{
+			Name:   fqdn,
+			Qtype:  qtype,
+			Qclass: OptQClass,
+		})
 	}
 
-	return rq
+	return rq, nil
 }
 
-// queryRecv runs on its own goroutine and receives and handles
-// all UDP datagrams, received from connection
-func queryRecv(conn *net.UDPConn, wait *sync.WaitGroup) {
-	defer wait.Done()
+// QueryServiceFqdn makes DNS-SD service type FQDN from the
+// service type name, e.g., "http" or "_http._tcp" becomes
+// "_http._tcp.local." (the domain is not appended in wide-area
+// mode). It returns error if name is invalid
+func QueryServiceFqdn(name string) (string, error) {
+	if !strings.HasPrefix(name, "_") {
+		name = "_" + name + "._tcp"
+	}
+
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", fmt.Errorf("%q: invalid service type", name)
+	}
+
+	fqdn := dns.Fqdn(name)
+	if !OptWideArea && !dns.IsSubDomain("local.", fqdn) {
+		fqdn += "local."
+	}
+
+	return fqdn, nil
+}
+
+// QueryFqdn makes sure domain name is FQDN. Single-label names
+// are considered to be in the .local domain (except in wide-area
+// mode). It returns error if name is invalid
+func QueryFqdn(name string) (string, error) {
+	labels, ok := dns.IsDomainName(name)
+	if !ok {
+		return "", fmt.Errorf("%q: invalid domain name", name)
+	}
+
+	fqdn := name
+	if labels < 2 && !OptWideArea {
+		fqdn += ".local."
+	}
+
+	return dns.Fqdn(fqdn), nil
+}
+
+// queryMultiPkt aggregates multi-packet messages
+var queryMultiPkt = MultiPktNew(queryInput)
+
+// queryPacketInput handles received packets, before multi-packet
+// messages are aggregated by queryMultiPkt
+func queryPacketInput(msg *dns.Msg, meta SourceMeta) {
+	if OptSizes && msg.Response {
+		sizesInput(msg, meta)
+	}
+
+	queryMultiPkt.Input(msg, meta)
+}
+
+// queryInput handles received message, after multi-packet
+// aggregation. Queries from other hosts are used for duplicate
+// question suppression
+func queryInput(msg *dns.Msg, meta SourceMeta) {
+	switch {
+	case msg.Response && !OnlinkInput(meta):
+	case msg.Response && !RcodeInput(msg, meta.From.String()):
+
+	case OptProtocol == "nbns":
+		if msg.Response {
+			ResponseInput(NbnsConvert(msg))
+		}
+
+	case msg.Response:
+		queryAnswerInput(msg, meta)
+		if !OptWatch {
+			nxrrsetInput(msg, meta)
+		}
+		if OptSummary {
+			summaryInput(msg, meta)
+		}
+		if OptCompareIfaces {
+			compareInput(msg, meta)
+		}
+		if OptRounds {
+			roundsInput(msg, meta)
+		}
+		if OptMetrics != "" {
+			metricsResponse(msg, meta, ResponseQuestion())
+		}
+		if OptFormat == "influx" {
+			influxLatencyPrint(msg, meta)
+		}
+		ResponseInput(msg)
+
+	default:
+		queryDupInput(msg, meta)
+	}
+}
+
+// Pools of receive buffers and messages, shared between
+// all receivers
+var (
+	queryBufPool = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, 65536)
+			return &buf
+		},
+	}
+
+	queryMsgPool = sync.Pool{
+		New: func() interface{} {
+			return &dns.Msg{}
+		},
+	}
+)
 
-	buf := make([]byte, 65536)
+// queryRecv runs on its own goroutine and receives all UDP
+// datagrams, received from connection. Received messages are
+// passed to the input callback (normally, MultiPkt.Input)
+//
+// Our own datagrams (see SelfIs) and datagrams, not accepted by
+// the accept callback, are dropped.
+// The message is not valid after input returns, but its RRs are
+func queryRecv(conn Transport, accept func(meta SourceMeta) bool,
+	input func(*dns.Msg, SourceMeta), wait *sync.WaitGroup) {
+
+	defer wait.Done()
 
 	for {
 		// Receive the message
-		n, from, err := conn.ReadFromUDP(buf)
+		buf := queryBufPool.Get().(*[]byte)
+		n, meta, err := conn.ReadFrom(*buf)
 		if err != nil {
+			queryBufPool.Put(buf)
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
 			continue
 		}
 
-		// Skip our own messages
-		if AddrIsLocalUDP(from) {
+		if SelfIs((*buf)[:n], meta.From) {
+			LogVerbose("Own packet from %s, dropped", meta.From)
+			queryBufPool.Put(buf)
 			continue
 		}
 
-		LogVerbose("%d bytes received from %s", n, from)
-
-		// Parse response
-		rsp := &dns.Msg{}
-		err = rsp.Unpack(buf[:n])
-		if err != nil {
-			LogVerbose("Invalid message received from %s: %s",
-				from, err)
+		if !accept(meta) {
+			queryBufPool.Put(buf)
 			continue
 		}
 
-		// Process receiver response
-		ResponseInput(rsp)
+		LogVerbose("%d bytes received from %s (ifindex %d)",
+			n, meta.From, meta.IfIndex)
+		metricsReceived()
+		journalPacket(journalRx, (*buf)[:n], meta.From, meta.IfIndex)
+
+		queryUnpack((*buf)[:n], meta, input)
+		queryBufPool.Put(buf)
 	}
 }
+
+// queryUnpack parses the received packet and passes the message
+// to the input callback. Malformed packets are counted and dropped
+//
+// The packet is not retained after return
+func queryUnpack(pkt []byte, meta SourceMeta,
+	input func(*dns.Msg, SourceMeta)) {
+
+	meta.Size = len(pkt)
+
+	rsp := queryMsgPool.Get().(*dns.Msg)
+	err := rsp.Unpack(pkt)
+	if err != nil {
+		if OptKeepBadPackets != "" {
+			badPacketInput(pkt, meta, err)
+		}
+
+		LogVerbose("Invalid message received from %s: %s",
+			meta.From, err)
+		metricsParseError()
+		*rsp = dns.Msg{}
+		queryMsgPool.Put(rsp)
+		return
+	}
+
+	// Process received message
+	input(rsp, meta)
+
+	// Return message to the pool. Unpack allocates new
+	// RRs each time, so RRs, retained by ResponseInput
+	// or MultiPkt, are not affected by the message reuse
+	*rsp = dns.Msg{}
+	queryMsgPool.Put(rsp)
+}
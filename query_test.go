@@ -0,0 +1,454 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// MDNS queries tests
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryTestIfaces are the interfaces, queries are sent via
+var queryTestIfaces = []net.Interface{
+	{Index: 1, Name: "test1", Flags: net.FlagUp | net.FlagMulticast},
+	{Index: 2, Name: "test2", Flags: net.FlagUp | net.FlagMulticast},
+}
+
+// queryTestTransport is the Transport, that passes sent queries
+// to the responder callback and receives its responses, instead
+// of using the network
+type queryTestTransport struct {
+	respond func(q *dns.Msg, ifindex int) []*dns.Msg // The responder
+	sent    map[int][]*dns.Msg                       // Queries by ifindex
+	rx      chan queryTestPacket                     // Received packets
+	done    chan struct{}                            // Closed by Close
+	close   sync.Once                                // Closes done
+	lock    sync.Mutex                               // Access lock
+}
+
+// queryTestPacket is the packet, received by queryTestTransport
+type queryTestPacket struct {
+	buf  []byte     // Packet data
+	meta SourceMeta // Packet metadata
+}
+
+// Is4 tells if transport is IPv4
+func (t *queryTestTransport) Is4() bool {
+	return true
+}
+
+// JoinGroup joins the multicast group on the interface
+func (t *queryTestTransport) JoinGroup(iface *net.Interface,
+	group *net.UDPAddr) error {
+	return nil
+}
+
+// LeaveGroup leaves the multicast group on the interface
+func (t *queryTestTransport) LeaveGroup(iface *net.Interface,
+	group *net.UDPAddr) error {
+	return nil
+}
+
+// ReadFrom receives the next response of the responder
+func (t *queryTestTransport) ReadFrom(buf []byte) (int, SourceMeta,
+	error) {
+
+	select {
+	case pkt := <-t.rx:
+		return copy(buf, pkt.buf), pkt.meta, nil
+	case <-t.done:
+		return 0, SourceMeta{}, net.ErrClosed
+	}
+}
+
+// WriteTo remembers the query and passes it to the responder.
+// Responses come from the link-local address, that corresponds
+// to the interface, so they are on-link (see OnlinkInput)
+func (t *queryTestTransport) WriteTo(buf []byte, to *net.UDPAddr,
+	ifindex int) error {
+
+	q := &dns.Msg{}
+	if err := q.Unpack(buf); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	t.sent[ifindex] = append(t.sent[ifindex], q)
+	t.lock.Unlock()
+
+	from := &net.UDPAddr{
+		IP:   net.IPv4(169, 254, 0, byte(ifindex)),
+		Port: mdnsPort,
+	}
+
+	for _, rsp := range t.respond(q, ifindex) {
+		pkt, err := rsp.Pack()
+		if err != nil {
+			return err
+		}
+
+		t.rx <- queryTestPacket{pkt, SourceMeta{From: from,
+			IfIndex: ifindex}}
+	}
+
+	return nil
+}
+
+// Close closes the transport
+func (t *queryTestTransport) Close() error {
+	t.close.Do(func() { close(t.done) })
+	return nil
+}
+
+// queryTestRun runs the query for the question via queryTestIfaces,
+// using queryTestTransport with the responder callback, and returns
+// the transport, so sent queries can be examined
+//
+// Queries are sent 3 times, so retransmissions can be examined
+func queryTestRun(t *testing.T, question dns.Question,
+	respond func(q *dns.Msg, ifindex int) []*dns.Msg) *queryTestTransport {
+
+	tr := &queryTestTransport{
+		respond: respond,
+		sent:    make(map[int][]*dns.Msg),
+		rx:      make(chan queryTestPacket, 64),
+		done:    make(chan struct{}),
+	}
+
+	saved := TransportOpen
+	TransportOpen = func(network string, addr *net.UDPAddr,
+		ifname string) (Transport, error) {
+		return tr, nil
+	}
+	defer func() { TransportOpen = saved }()
+
+	// Reset results of previous tests
+	rspLock.Lock()
+	rspAnswer, rspAuthority, rspAdditional = nil, nil, nil
+	rspLock.Unlock()
+
+	rspUniqueLock.Lock()
+	rspUnique = make(map[string]bool)
+	rspUniqueLock.Unlock()
+
+	queryAnswersLock.Lock()
+	queryAnswers = make(map[int]map[string]bool)
+	queryKnown = make(map[int]map[string]*queryKnownAnswer)
+	queryAnswersLock.Unlock()
+
+	// Run the query
+	rq := &dns.Msg{}
+	rq.Question = []dns.Question{question}
+	rqBytes, err := rq.Pack()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	cfg := QueryConfig{
+		TxCount:  3,
+		TxPeriod: 50 * time.Millisecond,
+		NoJitter: true,
+	}
+
+	err = queryRunLinks(context.Background(), rq, rqBytes, cfg,
+		queryTestIfaces, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return tr
+}
+
+// queryTestResponse creates response with answers and additional
+// records, in the zone file format. Records with the "!" prefix
+// have the cache-flush bit set
+func queryTestResponse(t *testing.T, answers, additional []string) *dns.Msg {
+	parse := func(records []string) []dns.RR {
+		var rrs []dns.RR
+		for _, s := range records {
+			flush := s[0] == '!'
+			if flush {
+				s = s[1:]
+			}
+
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("%q: %s", s, err)
+			}
+
+			if flush {
+				rr.Header().Class |= 1 << 15
+			}
+
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+
+	rsp := &dns.Msg{}
+	rsp.Response = true
+	rsp.Authoritative = true
+	rsp.Answer = parse(answers)
+	rsp.Extra = parse(additional)
+
+	return rsp
+}
+
+// queryTestStrings returns records in the zone file format, sorted,
+// with TTLs and the cache-flush bits dropped
+func queryTestStrings(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rr.Header().Class &^= 1 << 15
+		out = append(out, rr.String())
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// TestQueryMerge tests merging of responses of different responders,
+// received via different interfaces and repeated on retransmissions
+func TestQueryMerge(t *testing.T) {
+	question := dns.Question{
+		Name:   "_http._tcp.local.",
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	}
+
+	queryTestRun(t, question, func(q *dns.Msg, ifindex int) []*dns.Msg {
+		if ifindex == 1 {
+			return []*dns.Msg{queryTestResponse(t,
+				[]string{"_http._tcp.local. 4500 IN PTR " +
+					"A._http._tcp.local."},
+				[]string{"!a.local. 120 IN A 169.254.0.1"})}
+		}
+
+		return []*dns.Msg{
+			queryTestResponse(t,
+				[]string{"_http._tcp.local. 4500 IN PTR " +
+					"A._http._tcp.local."},
+				[]string{"!a.local. 120 IN A 169.254.0.1"}),
+			queryTestResponse(t,
+				[]string{"_http._tcp.local. 4500 IN PTR " +
+					"B._http._tcp.local."},
+				[]string{"!b.local. 120 IN A 169.254.0.2"}),
+		}
+	})
+
+	ans, auth, add := ResponseGet()
+
+	expect := func(section string, rrs []dns.RR, want []string) {
+		got := queryTestStrings(rrs)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s section:\nexpected: %q\npresent:  %q",
+				section, want, got)
+		}
+	}
+
+	expect("answer", ans, []string{
+		"_http._tcp.local.\t0\tIN\tPTR\tA._http._tcp.local.",
+		"_http._tcp.local.\t0\tIN\tPTR\tB._http._tcp.local.",
+	})
+	expect("authority", auth, nil)
+	expect("additional", add, []string{
+		"a.local.\t0\tIN\tA\t169.254.0.1",
+		"b.local.\t0\tIN\tA\t169.254.0.2",
+	})
+}
+
+// TestQueryRetransmitUnanswered tests that retransmissions are
+// skipped on interfaces, where the question is answered by the
+// unique record, and continue on other interfaces
+func TestQueryRetransmitUnanswered(t *testing.T) {
+	question := dns.Question{
+		Name:   "a.local.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	tr := queryTestRun(t, question, func(q *dns.Msg,
+		ifindex int) []*dns.Msg {
+
+		if ifindex != 1 {
+			return nil
+		}
+
+		return []*dns.Msg{queryTestResponse(t,
+			[]string{"!a.local. 120 IN A 169.254.0.1"}, nil)}
+	})
+
+	if n := len(tr.sent[1]); n != 1 {
+		t.Errorf("answered interface: %d queries sent, "+
+			"expected 1", n)
+	}
+
+	if n := len(tr.sent[2]); n != 3 {
+		t.Errorf("unanswered interface: %d queries sent, "+
+			"expected 3", n)
+	}
+
+	for _, q := range tr.sent[2] {
+		if len(q.Question) != 1 || q.Question[0] != question {
+			t.Errorf("unanswered interface: bad question: %v",
+				q.Question)
+		}
+	}
+}
+
+// TestQueryRetransmitKnownAnswers tests that questions, answered
+// by shared records, are retransmitted with these records in the
+// Known-Answer Section, but only on the interface they were
+// received via (RFC 6762, section 7.1)
+func TestQueryRetransmitKnownAnswers(t *testing.T) {
+	question := dns.Question{
+		Name:   "_http._tcp.local.",
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	}
+
+	tr := queryTestRun(t, question, func(q *dns.Msg,
+		ifindex int) []*dns.Msg {
+
+		if ifindex != 1 || len(q.Answer) != 0 {
+			return nil
+		}
+
+		return []*dns.Msg{queryTestResponse(t,
+			[]string{"_http._tcp.local. 4500 IN PTR " +
+				"A._http._tcp.local."}, nil)}
+	})
+
+	sent := tr.sent[1]
+	if len(sent) != 3 {
+		t.Fatalf("answered interface: %d queries sent, "+
+			"expected 3", len(sent))
+	}
+
+	if n := len(sent[0].Answer); n != 0 {
+		t.Errorf("initial query: %d known answers, expected 0", n)
+	}
+
+	for i, q := range sent[1:] {
+		if len(q.Answer) != 1 {
+			t.Errorf("retransmission %d: %d known answers, "+
+				"expected 1", i+1, len(q.Answer))
+			continue
+		}
+
+		ptr, ok := q.Answer[0].(*dns.PTR)
+		switch {
+		case !ok || ptr.Ptr != "A._http._tcp.local.":
+			t.Errorf("retransmission %d: bad known answer: %s",
+				i+1, q.Answer[0])
+		case ptr.Hdr.Ttl <= 4500/2 || ptr.Hdr.Ttl > 4500:
+			t.Errorf("retransmission %d: bad known answer "+
+				"TTL: %d", i+1, ptr.Hdr.Ttl)
+		}
+	}
+
+	for i, q := range tr.sent[2] {
+		if n := len(q.Answer); n != 0 {
+			t.Errorf("other interface, query %d: %d known "+
+				"answers, expected 0", i, n)
+		}
+	}
+}
+
+// TestQueryDupKnownAnswers tests that the query of other host is
+// considered a duplicate of our own only if its Known-Answer Section
+// doesn't contain records, unknown to us (RFC 6762, section 7.3)
+func TestQueryDupKnownAnswers(t *testing.T) {
+	question := dns.Question{
+		Name:   "_http._tcp.local.",
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	}
+
+	tests := []struct {
+		name     string   // Test name
+		qclass   uint16   // Question class
+		known    []string // Known-Answer Section
+		expected bool     // Expected to be duplicate
+	}{
+		{
+			name:     "no known answers",
+			qclass:   dns.ClassINET,
+			expected: true,
+		},
+		{
+			name:   "known answers, known to us",
+			qclass: dns.ClassINET,
+			known: []string{"_http._tcp.local. 4500 IN PTR " +
+				"A._http._tcp.local."},
+			expected: true,
+		},
+		{
+			name:   "known answers, unknown to us",
+			qclass: dns.ClassINET,
+			known: []string{"_http._tcp.local. 4500 IN PTR " +
+				"B._http._tcp.local."},
+			expected: false,
+		},
+		{
+			name:   "known answers to other question",
+			qclass: dns.ClassINET,
+			known: []string{"_ipp._tcp.local. 4500 IN PTR " +
+				"B._ipp._tcp.local."},
+			expected: true,
+		},
+		{
+			name:     "QU question",
+			qclass:   dns.ClassINET | 1<<15,
+			expected: false,
+		},
+	}
+
+	// Our known answers, received via interface 1
+	queryAnswersLock.Lock()
+	queryKnown = map[int]map[string]*queryKnownAnswer{1: {}}
+	for _, rr := range queryTestResponse(t, []string{
+		"_http._tcp.local. 4500 IN PTR A._http._tcp.local."},
+		nil).Answer {
+		queryKnown[1][dedupKey(rr)] = &queryKnownAnswer{rr, time.Now()}
+	}
+	queryAnswersLock.Unlock()
+
+	queryDupSetQuestion([]dns.Question{question})
+	defer queryDupSetQuestion(nil)
+
+	for _, test := range tests {
+		q := queryTestResponse(t, test.known, nil)
+		q.Response = false
+		q.Question = []dns.Question{question}
+		q.Question[0].Qclass = test.qclass
+
+		queryDupLock.Lock()
+		queryDupLast = time.Time{}
+		queryDupLock.Unlock()
+
+		queryDupInput(q, SourceMeta{
+			From:    &net.UDPAddr{IP: net.IPv4(169, 254, 0, 2)},
+			IfIndex: 1,
+		})
+
+		dup := queryDupSeenSince(time.Time{})
+		if dup != test.expected {
+			t.Errorf("%s: duplicate is %v, expected %v",
+				test.name, dup, test.expected)
+		}
+	}
+}
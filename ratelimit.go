@@ -0,0 +1,124 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Output rate limiting in streaming mode
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rateHeld contains the record, held back by the rate limit
+type rateHeld struct {
+	rr    dns.RR // The record (the last received copy)
+	count int    // Count of received copies
+}
+
+// Rate limit state. It is protected by rspLock
+var (
+	ratePrinted int                  // Records printed in this second
+	rateHeldTot int                  // Records held in this second
+	rateHeldRRs map[string]*rateHeld // Held records, by dedupKey
+)
+
+// rateLimitStart starts the rate limiter. Once per second, records,
+// held back by rateLimit, are printed to rspStream as summary.
+// Must be called under rspLock
+func rateLimitStart() {
+	rateHeldRRs = make(map[string]*rateHeld)
+
+	go func() {
+		for range time.Tick(time.Second) {
+			rspLock.Lock()
+			rateFlush()
+			rspLock.Unlock()
+		}
+	}()
+}
+
+// rateLimit passes records of the section, while count of records,
+// printed in this second, is below OptMaxRate, and holds back the
+// rest, counting identical records. Must be called under rspLock
+func rateLimit(section []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range section {
+		if ratePrinted < OptMaxRate {
+			ratePrinted++
+			out = append(out, rr)
+			continue
+		}
+
+		key := dedupKey(rr)
+		held := rateHeldRRs[key]
+		if held == nil {
+			held = &rateHeld{}
+			rateHeldRRs[key] = held
+		}
+
+		held.rr = rr
+		held.count++
+		rateHeldTot++
+	}
+
+	return out
+}
+
+// ResponseRateFlush prints summary of records, held back by the
+// rate limit (see OptMaxRate), which were not printed yet
+func ResponseRateFlush() {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+
+	if rateHeldRRs != nil {
+		rateFlush()
+	}
+}
+
+// rateFlush prints summary of held records, most frequent first,
+// and starts the next second. Must be called under rspLock
+func rateFlush() {
+	ratePrinted = 0
+	if rateHeldTot == 0 {
+		return
+	}
+
+	held := make([]*rateHeld, 0, len(rateHeldRRs))
+	for _, h := range rateHeldRRs {
+		held = append(held, h)
+	}
+
+	sort.Slice(held, func(i, j int) bool {
+		if held[i].count != held[j].count {
+			return held[i].count > held[j].count
+		}
+		return held[i].rr.String() < held[j].rr.String()
+	})
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, ";; RATE LIMITED: %d records (%d unique) "+
+		"not printed:\n", rateHeldTot, len(held))
+
+	for i, h := range held {
+		if i == OptMaxRate {
+			fmt.Fprintf(&buf, ";; ... and %d more unique records\n",
+				len(held)-i)
+			break
+		}
+
+		fmt.Fprintf(&buf, ";; %6d x %s\n", h.count, h.rr.String())
+	}
+
+	buf.WriteByte('\n')
+	rspStream.Write(buf.Bytes())
+
+	rateHeldTot = 0
+	rateHeldRRs = make(map[string]*rateHeld)
+}
@@ -0,0 +1,159 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Responses with non-zero RCODE
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	rcodeCounts = make(map[rcodeKey]int) // Counts of responses
+	rcodeLock   sync.Mutex               // Access lock
+)
+
+// rcodeKey identifies the source of responses and their RCODE
+type rcodeKey struct {
+	from  string // Responder or unicast DNS server address
+	rcode int    // The RCODE
+}
+
+// RcodeInput checks RCODE of the response, received from the
+// source (responder or unicast DNS server address). If RCODE is
+// not zero, false is returned, so the response is not merged with
+// results, and, if the response relates to our question, it is
+// recorded to be reported by RcodePrint
+//
+// Multicast DNS receivers must ignore such responses (RFC 6762,
+// section 18.11), but silent ignoring hides the difference between
+// "no responders" and responders, that have refused the query.
+// Unrelated responses are ignored silently
+//
+// NXDOMAIN (from the unicast DNS server) is the negative answer,
+// not an error, so such responses are merged as usual
+func RcodeInput(rsp *dns.Msg, from string) bool {
+	switch {
+	case rsp.Rcode == dns.RcodeSuccess:
+		return true
+
+	case rsp.Rcode == dns.RcodeNameError:
+		LogDebug("Response from %s: %s, negative answer", from,
+			rcodeString(rsp.Rcode))
+		return true
+
+	case !rcodeMatches(rsp, ResponseQuestion()):
+		LogDebug("Response from %s: %s, unrelated, ignored", from,
+			rcodeString(rsp.Rcode))
+		return false
+	}
+
+	LogDebug("Response from %s: %s, not merged", from,
+		rcodeString(rsp.Rcode))
+
+	rcodeLock.Lock()
+	rcodeCounts[rcodeKey{from, rsp.Rcode}]++
+	rcodeLock.Unlock()
+
+	return false
+}
+
+// rcodeMatches tells if the response relates to the question:
+// its question section asks for the same records, or, if it has
+// no question section (as usual for MDNS), it contains answers
+// to the question
+func rcodeMatches(rsp *dns.Msg, question []dns.Question) bool {
+	for _, rq := range rsp.Question {
+		for _, q := range question {
+			switch {
+			case !strings.EqualFold(rq.Name, q.Name):
+			case rq.Qtype == q.Qtype,
+				rq.Qtype == dns.TypeANY,
+				q.Qtype == dns.TypeANY:
+				return true
+			}
+		}
+	}
+
+	for _, rr := range rsp.Answer {
+		if responseMatches(rr, question) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RcodeSeen tells if responses with non-zero RCODE were received
+func RcodeSeen() bool {
+	rcodeLock.Lock()
+	defer rcodeLock.Unlock()
+	return len(rcodeCounts) != 0
+}
+
+// RcodePrint prints responses with non-zero RCODE, if any, by
+// source and RCODE, into io.Writer. With influx and json formats,
+// they are logged as errors instead, to keep the output parseable
+//
+// The returned error, if any, comes from w.Write()
+func RcodePrint(w io.Writer) error {
+	rcodeLock.Lock()
+	counts := make(map[rcodeKey]int, len(rcodeCounts))
+	keys := make([]rcodeKey, 0, len(rcodeCounts))
+	for key, count := range rcodeCounts {
+		counts[key] = count
+		keys = append(keys, key)
+	}
+	rcodeLock.Unlock()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].from != keys[j].from {
+			return keys[i].from < keys[j].from
+		}
+		return keys[i].rcode < keys[j].rcode
+	})
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; ERROR RESPONSES:\n")
+
+	for _, key := range keys {
+		line := fmt.Sprintf("%s: %s (%d responses)",
+			key.from, rcodeString(key.rcode), counts[key])
+
+		if OutputParseable() {
+			LogError("%s", line)
+		} else {
+			buf.WriteString(";; " + line + "\n")
+		}
+	}
+
+	if OutputParseable() {
+		return nil
+	}
+
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// rcodeString returns the RCODE name, e.g. "REFUSED"
+func rcodeString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
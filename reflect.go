@@ -0,0 +1,210 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The reflect command
+
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// reflectLoopWindow specifies how long reflected messages are
+// remembered for loop prevention. Identical message, received
+// again within this window, is not reflected
+const reflectLoopWindow = 100 * time.Millisecond
+
+// Reflector state
+var (
+	reflectLinks []queryLink          // Socket/interface pairs
+	reflectSeen  map[uint64]time.Time // Recently reflected messages
+	reflectLock  sync.Mutex           // Access lock
+)
+
+// ReflectRun relays MDNS messages between all selected interfaces,
+// until ctx is cancelled
+//
+// Messages, received on some interface, are multicast via all
+// other interfaces of the same address family. If OptReflectServices
+// is set, only messages that refer to the specified service types
+// are reflected
+func ReflectRun(ctx context.Context) {
+	_, if4, if6, err := IfAddrs()
+	if err != nil {
+		LogFatal("%s", err)
+	}
+	if len(if4) < 2 && len(if6) < 2 {
+		LogFatal("At least two interfaces required")
+	}
+
+	conns4, links4 := queryOpen("udp4", queryMcast4, if4)
+	conns6, links6 := queryOpen("udp6", queryMcast6, if6)
+
+	conns := append(conns4, conns6...)
+	reflectLinks = append(links4, links6...)
+	reflectSeen = make(map[uint64]time.Time)
+
+	if len(reflectLinks) == 0 {
+		LogFatal("No usable interfaces found")
+	}
+
+	for _, link := range reflectLinks {
+		LogDebug("Reflecting via %s", link.iface.Name)
+	}
+
+	// Start receivers. Our own messages are skipped, which
+	// prevents trivial reflection loops
+	var wait sync.WaitGroup
+
+	for _, conn := range conns {
+		accept := func(meta SourceMeta) bool {
+			return meta.IfIndex != 0 && !AddrIsLocalUDP(meta.From)
+		}
+
+		wait.Add(1)
+		go queryRecv(conn, accept, reflectInput, &wait)
+	}
+
+	SystemdNotify("READY=1")
+	<-ctx.Done()
+	SystemdNotify("STOPPING=1")
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	wait.Wait()
+}
+
+// reflectInput handles received message
+func reflectInput(msg *dns.Msg, meta SourceMeta) {
+	// Responses to legacy unicast queries will not come back
+	// to the querier, so such queries are not reflected
+	if !msg.Response && meta.From.Port != mdnsPort {
+		LogVerbose("%s: legacy query, not reflected", meta.From)
+		return
+	}
+
+	if !reflectFilter(msg) {
+		LogVerbose("%s: filtered out", meta.From)
+		return
+	}
+
+	// Responses to "QU" questions would be sent to us
+	// via unicast, so "QU" bit is cleared
+	for i := range msg.Question {
+		msg.Question[i].Qclass &^= responderCacheFlush
+	}
+
+	msg.Compress = true
+	buf, err := msg.Pack()
+	if err != nil {
+		LogVerbose("%s: %s", meta.From, err)
+		return
+	}
+
+	// Skip messages we've just reflected, that came back
+	// via other reflector
+	if reflectLoop(buf) {
+		LogVerbose("%s: reflection loop, dropped", meta.From)
+		return
+	}
+
+	is4 := AddrIs4UDP(meta.From)
+	for _, link := range reflectLinks {
+		if link.iface.Index == meta.IfIndex || link.conn.Is4() != is4 {
+			continue
+		}
+
+		group := queryMcast6
+		if is4 {
+			group = queryMcast4
+		}
+
+		LogVerbose("%s: %d bytes reflected to %s",
+			meta.From, len(buf), link.iface.Name)
+
+		err := link.conn.WriteTo(buf, group, link.iface.Index)
+		if err != nil {
+			LogDebug("%s: %s", link.iface.Name, err)
+		}
+	}
+}
+
+// reflectLoop tells if the message was reflected within
+// the reflectLoopWindow, and remembers it
+func reflectLoop(buf []byte) bool {
+	h := fnv.New64a()
+	h.Write(buf)
+	sum := h.Sum64()
+
+	now := time.Now()
+
+	reflectLock.Lock()
+	defer reflectLock.Unlock()
+
+	for k, t := range reflectSeen {
+		if now.Sub(t) > reflectLoopWindow {
+			delete(reflectSeen, k)
+		}
+	}
+
+	if _, found := reflectSeen[sum]; found {
+		return true
+	}
+
+	reflectSeen[sum] = now
+	return false
+}
+
+// reflectFilter tells if message needs to be reflected, according
+// to OptReflectServices. Message is reflected if any of its question
+// names, record names or PTR targets is within any of service types
+// (or it is the DNS-SD service type enumeration)
+func reflectFilter(msg *dns.Msg) bool {
+	if len(OptReflectServices) == 0 {
+		return true
+	}
+
+	match := func(name string) bool {
+		if strings.EqualFold(name, announceServicesName) {
+			return true
+		}
+
+		for _, svc := range OptReflectServices {
+			if dns.IsSubDomain(svc, name) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, q := range msg.Question {
+		if match(q.Name) {
+			return true
+		}
+	}
+
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if match(rr.Header().Name) {
+				return true
+			}
+
+			if ptr, ok := rr.(*dns.PTR); ok && match(ptr.Ptr) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,154 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Service instance resolution
+
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// resolveState tracks parts of the service instance, received
+// so far in resolve mode. It is protected by rspLock
+type resolveState struct {
+	instance string          // Instance name
+	target   string          // SRV target, "" if SRV not received
+	txt      bool            // TXT received
+	addr     bool            // Address of the target received
+	addrs    map[string]bool // Names with known addresses
+	complete chan struct{}   // Closed when all parts are received
+}
+
+// rspResolve is the resolve mode state, nil outside of resolve mode
+var rspResolve *resolveState
+
+// ResponseResolve enables resolve mode for the service instance.
+// In this mode, SRV and TXT records of the instance and A/AAAA
+// records of its target host are tracked, and the resolution
+// is complete when all of them are received
+func ResponseResolve(instance string) {
+	rspLock.Lock()
+	rspResolve = &resolveState{
+		instance: instance,
+		addrs:    make(map[string]bool),
+		complete: make(chan struct{}),
+	}
+	rspLock.Unlock()
+}
+
+// ResponseResolveChan returns channel, which is closed when the
+// resolution is complete. Outside of resolve mode, it returns nil
+func ResponseResolveChan() <-chan struct{} {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+
+	if rspResolve == nil {
+		return nil
+	}
+
+	return rspResolve.complete
+}
+
+// ResponseResolveMissing returns questions for the parts of the
+// service instance, not received so far. Outside of resolve mode,
+// or if resolution is complete, it returns nil
+func ResponseResolveMissing() []dns.Question {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+
+	r := rspResolve
+	if r == nil {
+		return nil
+	}
+
+	var question []dns.Question
+	add := func(name string, qtype uint16) {
+		question = append(question, dns.Question{
+			Name:   name,
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		})
+	}
+
+	if r.closed() {
+		return nil
+	}
+
+	if r.target == "" {
+		add(r.instance, dns.TypeSRV)
+	}
+
+	if !r.txt {
+		add(r.instance, dns.TypeTXT)
+	}
+
+	if r.target != "" && !r.addr {
+		if Opt4 {
+			add(r.target, dns.TypeA)
+		}
+		if Opt6 {
+			add(r.target, dns.TypeAAAA)
+		}
+	}
+
+	return question
+}
+
+// resolveInput handles received records. Must be called under rspLock
+//
+// Records are not retained (see ResponseInput)
+func resolveInput(rrs []dns.RR) {
+	r := rspResolve
+	if r.closed() {
+		return
+	}
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			if strings.EqualFold(name, r.instance) && hdr.Ttl != 0 {
+				r.target = strings.ToLower(rr.Target)
+			}
+
+		case *dns.TXT:
+			if strings.EqualFold(name, r.instance) && hdr.Ttl != 0 {
+				r.txt = true
+			}
+
+		case *dns.A, *dns.AAAA:
+			if hdr.Ttl != 0 {
+				r.addrs[name] = true
+			}
+		}
+	}
+
+	r.addr = r.target != "" && r.addrs[r.target]
+
+	if r.isComplete() {
+		LogDebug("%s: resolved", r.instance)
+		close(r.complete)
+	}
+}
+
+// isComplete tells if all parts of the instance are received
+func (r *resolveState) isComplete() bool {
+	return r.target != "" && r.txt && r.addr
+}
+
+// closed tells if the complete channel is closed
+func (r *resolveState) closed() bool {
+	select {
+	case <-r.complete:
+		return true
+	default:
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The respond command
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// RespondRun loads records from the zone file, specified by OptZone,
+// and publishes them until ctx is cancelled
+//
+// Relative names in the zone file are relative to the .local domain,
+// and default TTL is 120 seconds. PTR records are published as
+// shared, all other records as unique
+//
+// Records are published by ResponderRun, and its error is returned
+func RespondRun(ctx context.Context, w io.Writer) error {
+	records, err := respondLoad(OptZone)
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		LogFatal("%s: no records", OptZone)
+	}
+
+	return ResponderRun(ctx, w, records)
+}
+
+// respondLoad loads records from the zone file. Errors are
+// returned as fileError
+func respondLoad(file string) ([]ResponderRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fileError{err}
+	}
+	defer f.Close()
+
+	zp := dns.NewZoneParser(f, "local.", file)
+	zp.SetDefaultTTL(announceHostTTL)
+
+	var records []ResponderRecord
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Class &^= responderCacheFlush
+		records = append(records, ResponderRecord{
+			RR:     rr,
+			Unique: rr.Header().Rrtype != dns.TypePTR,
+		})
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, fileError{err}
+	}
+
+	return records, nil
+}
@@ -0,0 +1,709 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// MDNS responder
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MDNS responder constants (RFC 6762)
+const (
+	responderCacheFlush    = 1 << 15                // Cache-flush bit
+	responderProbeCount    = 3                      // Count of probes
+	responderProbeInterval = 250 * time.Millisecond // Between probes
+	responderAnnounceCount = 2                      // Announcements
+	responderLegacyTTL     = 10                     // Max legacy TTL
+	mdnsPort               = 5353                   // MDNS UDP port
+)
+
+// ResponderRecord is the resource record, published by the Responder
+//
+// Unique records (host addresses, SRV and TXT records) are probed
+// for uniqueness before announcing and sent with the cache-flush
+// bit set. Shared records (e.g., PTR records of DNS-SD service
+// browsing) may be published by many hosts simultaneously
+type ResponderRecord struct {
+	RR     dns.RR // The record. Class must not have cache-flush bit
+	Unique bool   // The record is unique
+}
+
+// Responder answers MDNS queries for the set of published records
+// on all selected interfaces
+type Responder struct {
+	records   []ResponderRecord // Published records
+	conns     []Transport       // All sockets
+	links     []queryLink       // Socket/interface pairs
+	mp        *MultiPkt         // Multi-packet messages aggregation
+	wait      sync.WaitGroup    // Wait for receivers
+	conflict  chan error        // Conflicts reported here
+	rnd       *rand.Rand        // Random delays
+	announced bool              // Records are announced
+	lock      sync.Mutex        // Access lock
+}
+
+// ResponderNew creates a new Responder for the set of records.
+// It opens MDNS sockets on all selected interfaces and starts
+// receiving. Error is returned, if no interfaces can be used
+//
+// Records are not answered until announced.
+func ResponderNew(records []ResponderRecord) (*Responder, error) {
+	r := &Responder{
+		records:  records,
+		conflict: make(chan error, 1),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	r.mp = MultiPktNew(r.input)
+
+	// Create sockets and join multicast groups
+	_, if4, if6, err := IfAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	conns4, links4 := queryOpen("udp4", queryMcast4, if4)
+	conns6, links6 := queryOpen("udp6", queryMcast6, if6)
+
+	r.conns = append(conns4, conns6...)
+	r.links = append(links4, links6...)
+
+	if len(r.links) == 0 {
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+		return nil, errQueryNoInterfaces
+	}
+
+	for _, link := range r.links {
+		family := "IPv6"
+		if link.conn.Is4() {
+			family = "IPv4"
+		}
+		LogDebug("Responding on %s (%s)", link.iface.Name, family)
+	}
+
+	// Start receivers. Note, unlike queries, messages from
+	// local addresses are accepted, so local clients may
+	// query our records
+	for _, conn := range r.conns {
+		ifindexes := make(map[int]bool)
+		for _, link := range r.links {
+			if link.conn == conn {
+				ifindexes[link.iface.Index] = true
+			}
+		}
+
+		// In degraded mode (see IfAddrs), the interface is
+		// unknown, and messages from all interfaces are accepted
+		accept := func(meta SourceMeta) bool {
+			return meta.IfIndex == 0 || ifindexes[meta.IfIndex] ||
+				ifindexes[0]
+		}
+
+		r.wait.Add(1)
+		go queryRecv(conn, accept, r.mp.Input, &r.wait)
+	}
+
+	return r, nil
+}
+
+// ResponderRun publishes the records: they are probed and
+// announced, printed to w, and then answered until ctx is
+// cancelled. Error is returned, if the Responder can't be
+// created or conflict is detected
+func ResponderRun(ctx context.Context, w io.Writer,
+	records []ResponderRecord) error {
+
+	r, err := ResponderNew(records)
+	if err != nil {
+		return err
+	}
+
+	err = r.Probe(ctx)
+	if err == nil && ctx.Err() == nil {
+		r.Announce(ctx)
+
+		rrs := []dns.RR{}
+		for _, rec := range records {
+			rrs = append(rrs, rec.RR)
+		}
+		ResponsePrint(w, nil, rrs, nil, nil)
+		SystemdNotify("READY=1")
+
+		err = r.Serve(ctx)
+		SystemdNotify("STOPPING=1")
+	}
+
+	r.Close()
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+// Serve answers queries for the published records, until ctx
+// is cancelled or conflict is detected. Records must be probed
+// and announced before
+//
+// RFC 6762, section 9, requires conflicting records to be renamed
+// and re-probed. We don't choose names for the user, so conflict
+// is reported as error
+func (r *Responder) Serve(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-r.conflict:
+		return err
+	}
+}
+
+// Probe performs probing (RFC 6762, section 8.1) of the unique
+// records. If any of names is already in use, error is returned
+func (r *Responder) Probe(ctx context.Context) error {
+	// Build the probe message: "ANY" question with the "QU" bit
+	// per name, proposed records in the Authority Section
+	probe := &dns.Msg{}
+	seen := make(map[string]bool)
+
+	for _, rec := range r.records {
+		if !rec.Unique {
+			continue
+		}
+
+		name := strings.ToLower(rec.RR.Header().Name)
+		if !seen[name] {
+			seen[name] = true
+			probe.Question = append(probe.Question, dns.Question{
+				Name:   rec.RR.Header().Name,
+				Qtype:  dns.TypeANY,
+				Qclass: dns.ClassINET | responderCacheFlush,
+			})
+		}
+
+		probe.Ns = append(probe.Ns, rec.RR)
+	}
+
+	if len(probe.Question) == 0 {
+		return nil
+	}
+
+	// The first probe is delayed by random 0-250 ms
+	r.lock.Lock()
+	delay := time.Duration(r.rnd.Int63n(int64(responderProbeInterval)))
+	r.lock.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for i := 0; i <= responderProbeCount; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-r.conflict:
+			return err
+		case <-timer.C:
+		}
+
+		if i < responderProbeCount {
+			LogDebug("Sending probe %d of %d", i+1,
+				responderProbeCount)
+			r.send(probe, nil)
+			timer.Reset(responderProbeInterval)
+		}
+	}
+
+	return nil
+}
+
+// Announce announces (RFC 6762, section 8.3) all the records and
+// enables answering of queries
+func (r *Responder) Announce(ctx context.Context) {
+	r.lock.Lock()
+	r.announced = true
+	r.lock.Unlock()
+
+	msg := r.response(r.records, nil, false)
+
+	for i := 0; i < responderAnnounceCount; i++ {
+		if i != 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+
+		LogDebug("Sending announcement %d of %d", i+1,
+			responderAnnounceCount)
+		r.send(msg, nil)
+	}
+}
+
+// Close stops the responder. If records were announced, goodbye
+// packets (RFC 6762, section 10.1) are sent before closing sockets
+func (r *Responder) Close() {
+	r.lock.Lock()
+	announced := r.announced
+	r.announced = false
+	r.lock.Unlock()
+
+	if announced {
+		msg := r.response(r.records, nil, false)
+		for _, rr := range msg.Answer {
+			rr.Header().Ttl = 0
+		}
+
+		LogDebug("Sending goodbye")
+		r.send(msg, nil)
+	}
+
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+
+	r.wait.Wait()
+}
+
+// input handles received message, after multi-packet aggregation
+func (r *Responder) input(msg *dns.Msg, meta SourceMeta) {
+	if msg.Opcode != dns.OpcodeQuery || msg.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	if msg.Response {
+		r.inputResponse(msg, meta)
+	} else {
+		r.inputQuery(msg, meta)
+	}
+}
+
+// inputResponse handles received response. Responses are only
+// used for conflicts detection (RFC 6762, section 9)
+func (r *Responder) inputResponse(msg *dns.Msg, meta SourceMeta) {
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Ttl != 0 && r.conflicts(rr) {
+				r.reportConflict(fmt.Errorf("%s: conflicting "+
+					"record from %s: %s",
+					rr.Header().Name, meta.From, rr))
+				return
+			}
+		}
+	}
+}
+
+// inputQuery handles received query
+func (r *Responder) inputQuery(msg *dns.Msg, meta SourceMeta) {
+	r.lock.Lock()
+	announced := r.announced
+	r.lock.Unlock()
+
+	if !announced {
+		r.inputProbe(msg, meta)
+		return
+	}
+
+	// Collect answers
+	var answers []ResponderRecord
+	unicast := true
+
+	for _, q := range msg.Question {
+		if q.Qclass&responderCacheFlush == 0 {
+			unicast = false
+		}
+
+		for _, rec := range r.lookup(q) {
+			if !r.knownAnswer(rec, msg.Answer) {
+				answers = responderAppend(answers, rec)
+			}
+		}
+	}
+
+	if len(answers) == 0 {
+		return
+	}
+
+	// Collect additional records
+	var extra []ResponderRecord
+	for _, rec := range answers {
+		for _, add := range r.additional(rec.RR) {
+			if !responderContains(answers, add) {
+				extra = responderAppend(extra, add)
+			}
+		}
+	}
+
+	// Legacy unicast queries (RFC 6762, section 6.7) come from
+	// the port other that 5353
+	legacy := meta.From.Port != mdnsPort
+	rsp := r.response(answers, extra, legacy)
+
+	if legacy {
+		rsp.Id = msg.Id
+		rsp.Question = msg.Question
+		LogDebug("Legacy query from %s, answered", meta.From)
+		r.send(rsp, &meta)
+		return
+	}
+
+	// AWDL peers are not reachable via unicast, so QU queries,
+	// received via AWDL, are answered via multicast
+	if unicast && responderViaAWDL(meta) {
+		LogDebug("QU query from %s via AWDL, answered via multicast",
+			meta.From)
+		unicast = false
+	}
+
+	if unicast {
+		LogDebug("QU query from %s, answered", meta.From)
+		r.send(rsp, &meta)
+		return
+	}
+
+	// Multicast response. If it contains shared records,
+	// it must be delayed by 20-120 ms (RFC 6762, section 6)
+	delay := time.Duration(0)
+	for _, rec := range answers {
+		if !rec.Unique {
+			r.lock.Lock()
+			delay = 20*time.Millisecond + time.Duration(
+				r.rnd.Int63n(int64(100*time.Millisecond)))
+			r.lock.Unlock()
+			break
+		}
+	}
+
+	LogDebug("Query from %s, answered in %s", meta.From, delay)
+
+	mcast := SourceMeta{From: queryMcast6, IfIndex: meta.IfIndex}
+	if AddrIs4UDP(meta.From) {
+		mcast.From = queryMcast4
+	}
+
+	time.AfterFunc(delay, func() { r.send(rsp, &mcast) })
+}
+
+// inputProbe handles query, received while we are probing
+//
+// If it is a probe from another host for the same name
+// (simultaneous probe tie-breaking, RFC 6762, section 8.2),
+// proposed records are compared, and if ours are
+// lexicographically earlier, we lose
+func (r *Responder) inputProbe(msg *dns.Msg, meta SourceMeta) {
+	for _, q := range msg.Question {
+		if q.Qtype != dns.TypeANY {
+			continue
+		}
+
+		var ours, theirs []dns.RR
+		for _, rec := range r.records {
+			if rec.Unique &&
+				strings.EqualFold(rec.RR.Header().Name, q.Name) {
+				ours = append(ours, rec.RR)
+			}
+		}
+
+		for _, rr := range msg.Ns {
+			if strings.EqualFold(rr.Header().Name, q.Name) {
+				theirs = append(theirs, rr)
+			}
+		}
+
+		if len(ours) == 0 || len(theirs) == 0 {
+			continue
+		}
+
+		if responderCompare(ours, theirs) < 0 {
+			r.reportConflict(fmt.Errorf("%s: simultaneous "+
+				"probe from %s, lost", q.Name, meta.From))
+			return
+		}
+	}
+}
+
+// reportConflict reports detected conflict
+func (r *Responder) reportConflict(err error) {
+	select {
+	case r.conflict <- err:
+	default:
+	}
+}
+
+// conflicts tells if the record, received from other host,
+// conflicts with our unique records: it has the same name,
+// type and class, but different data
+func (r *Responder) conflicts(rr dns.RR) bool {
+	hdr := rr.Header()
+	found := false
+
+	for _, rec := range r.records {
+		our := rec.RR.Header()
+		if !rec.Unique || our.Rrtype != hdr.Rrtype ||
+			our.Class != hdr.Class&^responderCacheFlush ||
+			!strings.EqualFold(our.Name, hdr.Name) {
+			continue
+		}
+
+		if bytes.Equal(responderRdata(rec.RR), responderRdata(rr)) {
+			return false
+		}
+
+		found = true
+	}
+
+	return found
+}
+
+// lookup returns our records that answer the question
+func (r *Responder) lookup(q dns.Question) []ResponderRecord {
+	var out []ResponderRecord
+
+	class := q.Qclass &^ responderCacheFlush
+	for _, rec := range r.records {
+		hdr := rec.RR.Header()
+		if (class == hdr.Class || class == dns.ClassANY) &&
+			(q.Qtype == hdr.Rrtype || q.Qtype == dns.TypeANY) &&
+			strings.EqualFold(q.Name, hdr.Name) {
+			out = append(out, rec)
+		}
+	}
+
+	return out
+}
+
+// additional returns additional records for the answer record
+// (RFC 6763, section 12)
+func (r *Responder) additional(rr dns.RR) []ResponderRecord {
+	var out []ResponderRecord
+
+	add := func(name string, types ...uint16) {
+		for _, t := range types {
+			q := dns.Question{Name: name, Qtype: t,
+				Qclass: dns.ClassINET}
+			out = append(out, r.lookup(q)...)
+		}
+	}
+
+	switch rr := rr.(type) {
+	case *dns.PTR:
+		add(rr.Ptr, dns.TypeSRV, dns.TypeTXT)
+		for _, rec := range out {
+			if srv, ok := rec.RR.(*dns.SRV); ok {
+				add(srv.Target, dns.TypeA, dns.TypeAAAA)
+			}
+		}
+
+	case *dns.SRV:
+		add(rr.Target, dns.TypeA, dns.TypeAAAA)
+	}
+
+	return out
+}
+
+// knownAnswer tells if the record is contained in the Known-Answer
+// Section of the query with at least half of its TTL remaining
+// (RFC 6762, section 7.1)
+func (r *Responder) knownAnswer(rec ResponderRecord, known []dns.RR) bool {
+	for _, rr := range known {
+		if rr.Header().Ttl >= rec.RR.Header().Ttl/2 &&
+			dns.IsDuplicate(rr, rec.RR) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// response creates the response message for the answers and
+// additional records. For legacy unicast queries, TTLs are
+// limited and the cache-flush bit is not used
+func (r *Responder) response(answers, extra []ResponderRecord,
+	legacy bool) *dns.Msg {
+
+	rsp := &dns.Msg{}
+	rsp.Response = true
+	rsp.Authoritative = true
+
+	convert := func(recs []ResponderRecord) []dns.RR {
+		var out []dns.RR
+		for _, rec := range recs {
+			rr := dns.Copy(rec.RR)
+			hdr := rr.Header()
+			switch {
+			case legacy:
+				if hdr.Ttl > responderLegacyTTL {
+					hdr.Ttl = responderLegacyTTL
+				}
+			case rec.Unique:
+				hdr.Class |= responderCacheFlush
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+
+	rsp.Answer = convert(answers)
+	rsp.Extra = convert(extra)
+
+	return rsp
+}
+
+// send sends the message. If dest is nil, message is multicast via
+// all links. Otherwise, it is sent to dest.From. If dest.IfIndex
+// is not 0, message is sent via that interface
+func (r *Responder) send(msg *dns.Msg, dest *SourceMeta) {
+	buf, err := msg.Pack()
+	if err != nil {
+		LogError("%s", err)
+		return
+	}
+
+	for _, link := range r.links {
+		group := queryMcast6
+		if link.conn.Is4() {
+			group = queryMcast4
+		}
+
+		to := group
+		if dest != nil {
+			if dest.IfIndex != 0 && link.iface.Index != 0 &&
+				dest.IfIndex != link.iface.Index ||
+				link.conn.Is4() != AddrIs4UDP(dest.From) {
+				continue
+			}
+			to = dest.From
+		}
+
+		err := link.conn.WriteTo(buf, to, link.iface.Index)
+		if err != nil {
+			LogDebug("%s: %s", link.iface.Name, err)
+		}
+
+		// Unicast is sent only once
+		if !to.IP.IsMulticast() {
+			return
+		}
+	}
+}
+
+// responderAppend appends record to the list, if not there yet
+func responderAppend(recs []ResponderRecord,
+	rec ResponderRecord) []ResponderRecord {
+
+	if responderContains(recs, rec) {
+		return recs
+	}
+	return append(recs, rec)
+}
+
+// responderContains tells if list contains the record
+func responderContains(recs []ResponderRecord, rec ResponderRecord) bool {
+	for _, rec2 := range recs {
+		if rec2.RR == rec.RR {
+			return true
+		}
+	}
+	return false
+}
+
+// responderViaAWDL tells if message was received via the AWDL
+// interface. AWDL interfaces are only used with OptAWDL
+func responderViaAWDL(meta SourceMeta) bool {
+	if !OptAWDL || meta.IfIndex == 0 {
+		return false
+	}
+
+	iface, err := net.InterfaceByIndex(meta.IfIndex)
+	return err == nil && IfaceIsAWDL(iface.Name)
+}
+
+// responderCompare lexicographically compares two sets of records
+// for simultaneous probe tie-breaking (RFC 6762, section 8.2.1)
+//
+// Records are sorted by class, type and rdata, and then compared
+// pairwise. If one set is a prefix of other, the longer one wins.
+// It returns -1, 0 or 1, if a is less, equal or greater than b
+func responderCompare(a, b []dns.RR) int {
+	sorted := func(rrs []dns.RR) []dns.RR {
+		rrs = append([]dns.RR(nil), rrs...)
+		sort.Slice(rrs, func(i, j int) bool {
+			return responderCompareRR(rrs[i], rrs[j]) < 0
+		})
+		return rrs
+	}
+
+	a, b = sorted(a), sorted(b)
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := responderCompareRR(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+
+	return 0
+}
+
+// responderCompareRR compares two records by class, type and rdata
+func responderCompareRR(a, b dns.RR) int {
+	ha, hb := a.Header(), b.Header()
+	ca, cb := ha.Class&^responderCacheFlush, hb.Class&^responderCacheFlush
+
+	switch {
+	case ca != cb:
+		if ca < cb {
+			return -1
+		}
+		return 1
+
+	case ha.Rrtype != hb.Rrtype:
+		if ha.Rrtype < hb.Rrtype {
+			return -1
+		}
+		return 1
+	}
+
+	return bytes.Compare(responderRdata(a), responderRdata(b))
+}
+
+// responderRdata returns record's rdata in the wire format,
+// without name compression
+func responderRdata(rr dns.RR) []byte {
+	buf := make([]byte, dns.Len(rr)+256)
+
+	end, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+
+	hdr, err := dns.PackDomainName(rr.Header().Name, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+
+	// Skip type, class, TTL and rdlength
+	return buf[hdr+10 : end]
+}
@@ -9,8 +9,11 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -19,24 +22,287 @@ var (
 	rspAnswer     []dns.RR   // Collected answer section
 	rspAuthority  []dns.RR   // Collected authority section
 	rspAdditional []dns.RR   // Collected additional section
+	rspStream     io.Writer  // Non-nil in streaming mode
 	rspLock       sync.Mutex // Access lock
+
+	// Dedup caches for streaming mode, per section
+	rspStreamDedup [3]*DedupCache
+
+	rspQuestion []dns.Question // Question being answered
+	rspAnswered chan struct{}  // Closed when matching answer received
+	rspHasAnswr bool           // Matching answer received
+	rspNew      chan struct{}  // Signaled when new records received
+
+	// Arrival times of records, collected with OptTimestamps,
+	// by responseTimesKey. They are tracked only when records are
+	// collected, so they are printed at the end of the query
+	rspTimes     = make(map[string]*responseTimes)
+	rspTimesLock sync.Mutex
+
+	// Keys of unique RRsets, received with the cache-flush bit,
+	// by responseSetKey (see ResponseIsUnique)
+	rspUnique     = make(map[string]bool)
+	rspUniqueLock sync.Mutex
 )
 
+// responseTimeFormat is the format of records' arrival times
+const responseTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// responseTimes contains arrival times of the record
+type responseTimes struct {
+	first, last time.Time // First and last seen
+}
+
+// ResponseSetQuestion sets the question, responses are
+// expected to answer. It is used to detect matching answers
+func ResponseSetQuestion(question []dns.Question) {
+	rspLock.Lock()
+	rspQuestion = question
+	rspAnswered = make(chan struct{})
+	rspHasAnswr = false
+	rspNew = make(chan struct{}, 1)
+	rspLock.Unlock()
+}
+
+// ResponseNewChan returns channel, which is signaled when new
+// unique records are received. It is not signaled in watch mode
+func ResponseNewChan() <-chan struct{} {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+	return rspNew
+}
+
+// responseNew signals the ResponseNewChan. Must be called
+// under rspLock
+func responseNew() {
+	select {
+	case rspNew <- struct{}{}:
+	default:
+	}
+}
+
+// ResponseQuestion returns the question, set by ResponseSetQuestion
+func ResponseQuestion() []dns.Question {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+	return rspQuestion
+}
+
+// ResponseHasAnswer tells if at least one answer, matching
+// the question, set by ResponseSetQuestion, has been received
+func ResponseHasAnswer() bool {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+	return rspHasAnswr
+}
+
+// ResponseAnsweredChan returns channel, which is closed when at
+// least one answer, matching the question, set by
+// ResponseSetQuestion, has been received
+func ResponseAnsweredChan() <-chan struct{} {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+	return rspAnswered
+}
+
+// ResponseStream enables streaming mode. In this mode, newly
+// received records are printed to w as they arrive
+//
+// Records are not retained in this mode, so memory consumption
+// remains bounded. Instead, duplicates are detected using the
+// DedupCache of OptDedupSize entries (0 if OptForget is set or
+// deduplication is disabled by OptDedup). With OptMaxRate,
+// printing is rate-limited (see rateLimit)
+func ResponseStream(w io.Writer) {
+	size := OptDedupSize
+	if OptForget || OptDedup == "none" {
+		size = 0
+	}
+
+	ttl := OptDedup == "full"
+
+	rspLock.Lock()
+	rspStream = w
+	rspStreamDedup = [3]*DedupCache{
+		DedupCacheNew(size, ttl),
+		DedupCacheNew(size, ttl),
+		DedupCacheNew(size, ttl),
+	}
+	if OptMaxRate != 0 {
+		rateLimitStart()
+	}
+	rspLock.Unlock()
+}
+
 // ResponseInput handles received messages
+//
+// The message is not retained after return, but RRs are: the
+// caller passes ownership of RRs to ResponseInput and must not use
+// them after the call. RRs are owned by exactly one consumer, that
+// may modify them in place (e.g., clear the cache-flush bit): the
+// watch mode Cache, streaming mode or collected sections. Other
+// consumers run first and copy RRs they retain
 func ResponseInput(rsp *dns.Msg) {
+	responseUniqueInput(rsp)
+
 	// We can be called from different goroutines, so
 	// locking is necessary
 	rspLock.Lock()
 	defer rspLock.Unlock()
 
+	// Check for matching answers
+	for _, rr := range rsp.Answer {
+		if !rspHasAnswr && responseMatches(rr, rspQuestion) {
+			close(rspAnswered)
+			rspHasAnswr = true
+			break
+		}
+	}
+
+	now := JournalNow()
+
+	// Track parts of the service instance in resolve mode
+	if rspResolve != nil {
+		resolveInput(rsp.Answer)
+		resolveInput(rsp.Ns)
+		resolveInput(rsp.Extra)
+	}
+
+	// Update persistent cache
+	if persistEntries != nil {
+		persistInput(rsp.Answer, now)
+		persistInput(rsp.Ns, now)
+		persistInput(rsp.Extra, now)
+	}
+
+	// RRs are still unmodified here. Below, they are passed
+	// to their owner, depending on the mode
+
+	// In watch mode, print events
+	if watchOut != nil {
+		watchInput(rsp.Answer, now)
+		watchInput(rsp.Ns, now)
+		watchInput(rsp.Extra, now)
+		return
+	}
+
+	// In streaming mode, just print new records
+	if rspStream != nil {
+		ans := responseStreamNew(0, rsp.Answer, now)
+		auth := responseStreamNew(1, rsp.Ns, now)
+		add := responseStreamNew(2, rsp.Extra, now)
+
+		if ans != nil || auth != nil || add != nil {
+			responseNew()
+		}
+
+		if OptMaxRate != 0 {
+			ans = rateLimit(ans)
+			auth = rateLimit(auth)
+			add = rateLimit(add)
+		}
+
+		if influxOut != nil {
+			InfluxPrintRecords(influxOut,
+				append(append(ans, auth...), add...))
+		} else {
+			ResponsePrint(rspStream, nil, ans, auth, add)
+		}
+		return
+	}
+
 	// Save RRs, deduplicate
+	count := len(rspAnswer) + len(rspAuthority) + len(rspAdditional)
+
 	rspAnswer = responseAppend(rspAnswer, rsp.Answer)
-	rspAuthority = responseAppend(rspAnswer, rsp.Ns)
+	rspAuthority = responseAppend(rspAuthority, rsp.Ns)
 	rspAdditional = responseAppend(rspAdditional, rsp.Extra)
+
+	if OptTimestamps {
+		responseTimesInput(rsp.Answer, now)
+		responseTimesInput(rsp.Ns, now)
+		responseTimesInput(rsp.Extra, now)
+	}
+
+	if len(rspAnswer)+len(rspAuthority)+len(rspAdditional) != count {
+		responseNew()
+	}
+}
+
+// responseUniqueInput remembers unique RRsets of the response:
+// RRsets of records with the cache-flush bit (RFC 6762, section 10.2)
+func responseUniqueInput(rsp *dns.Msg) {
+	rspUniqueLock.Lock()
+	defer rspUniqueLock.Unlock()
+
+	for _, rrs := range [][]dns.RR{rsp.Answer, rsp.Ns, rsp.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Class&(1<<15) != 0 {
+				rspUnique[responseSetKey(rr)] = true
+			}
+		}
+	}
+}
+
+// ResponseIsUnique tells if the record belongs to the unique RRset,
+// i.e., the RRset was received with the cache-flush bit
+func ResponseIsUnique(rr dns.RR) bool {
+	rspUniqueLock.Lock()
+	defer rspUniqueLock.Unlock()
+	return rspUnique[responseSetKey(rr)]
+}
+
+// responseSetKey returns key of the record's RRset (name, type
+// and class, without the cache-flush bit)
+func responseSetKey(rr dns.RR) string {
+	hdr := rr.Header()
+	return fmt.Sprintf("%s %d %d", strings.ToLower(hdr.Name),
+		hdr.Rrtype, hdr.Class&^(1<<15))
+}
+
+// responseMatches tells if RR answers one of the questions.
+// RRSIG answers the question, if it covers the queried type
+func responseMatches(rr dns.RR, question []dns.Question) bool {
+	hdr := rr.Header()
+	class := hdr.Class &^ (1 << 15)
+
+	covered := hdr.Rrtype
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		covered = sig.TypeCovered
+	}
+
+	for _, q := range question {
+		switch {
+		case !strings.EqualFold(hdr.Name, q.Name):
+		case q.Qclass != dns.ClassANY && q.Qclass != class:
+		case q.Qtype == dns.TypeANY,
+			q.Qtype == hdr.Rrtype,
+			q.Qtype == covered,
+			hdr.Rrtype == dns.TypeCNAME:
+			return true
+		}
+	}
+
+	return false
+}
+
+// responseStreamNew returns records from data, not seen before
+// in the specified section (0 - answer, 1 - authority, 2 - additional)
+// in streaming mode. If there are no new records, it returns nil,
+// so section will be omitted by ResponsePrint
+func responseStreamNew(section int, data []dns.RR, now time.Time) []dns.RR {
+	var out []dns.RR
+	for _, rr := range responseAppend(nil, data) {
+		if !rspStreamDedup[section].Seen(rr, now) {
+			out = append(out, rr)
+		}
+	}
+	return out
 }
 
 // responseAppend appends newly received response data to the
-// section, removes duplicates and returns updated section
+// section, removes duplicates according to OptDedup and returns
+// updated section
 func responseAppend(section, data []dns.RR) []dns.RR {
 	for _, rr := range data {
 		// Skip OPT PSEUDOSECTION records
@@ -66,11 +332,36 @@ func responseAppend(section, data []dns.RR) []dns.RR {
 		// mDNS reuses upper bit of RR class as "unicast response"
 		// flag - so we must clear it before data is saved into
 		// our records
-		rr2 := dns.Copy(rr)
-		rr2.Header().Class &^= 1 << 15
+		//
+		// Records are owned by us (see ResponseInput), so there
+		// is no need to copy them
+		rr.Header().Class &^= 1 << 15
+
+		section = append(section, rr)
+	}
+	return responseDedup(section)
+}
+
+// responseDedup removes duplicates from the section according
+// to OptDedup and returns updated section
+func responseDedup(section []dns.RR) []dns.RR {
+	switch OptDedup {
+	case "none":
+		return section
 
-		section = append(section, rr2)
+	case "full":
+		seen := make(map[string]bool, len(section))
+		out := section[:0]
+		for _, rr := range section {
+			key := rr.String()
+			if !seen[key] {
+				seen[key] = true
+				out = append(out, rr)
+			}
+		}
+		return out
 	}
+
 	return dns.Dedup(section, nil)
 }
 
@@ -98,13 +389,14 @@ func ResponseGet() (ans, auth, add []dns.RR) {
 // and used to format QUESTION PSEUDOSECTION (normally
 // missed in the MDNS queries
 //
-// The returned error, if any, comes from w.Write()
+// Sections, not selected by OptSections, are omitted. The returned
+// error, if any, comes from w.Write()
 func ResponsePrint(w io.Writer, question []dns.Question,
 	ans, auth, add []dns.RR) error {
 	buf := bytes.Buffer{}
 
 	// QUESTION PSEUDOSECTION
-	if question != nil {
+	if question != nil && OptSections&OptSectionQuestion != 0 {
 		buf.WriteString(";; QUESTION PSEUDOSECTION:\n")
 		for _, q := range question {
 			buf.WriteString(q.String())
@@ -115,10 +407,10 @@ func ResponsePrint(w io.Writer, question []dns.Question,
 	}
 
 	// ANSWER SECTION
-	if ans != nil {
+	if ans != nil && OptSections&OptSectionAnswer != 0 {
 		buf.WriteString(";; ANSWER SECTION:\n")
 		for _, rr := range ans {
-			buf.WriteString(rr.String())
+			buf.WriteString(ResponseRRString(rr))
 			buf.WriteByte('\n')
 		}
 
@@ -126,10 +418,10 @@ func ResponsePrint(w io.Writer, question []dns.Question,
 	}
 
 	// AUTHORITY SECTION
-	if auth != nil {
+	if auth != nil && OptSections&OptSectionAuthority != 0 {
 		buf.WriteString(";; AUTHORITY SECTION:\n")
 		for _, rr := range auth {
-			buf.WriteString(rr.String())
+			buf.WriteString(ResponseRRString(rr))
 			buf.WriteByte('\n')
 		}
 
@@ -137,10 +429,10 @@ func ResponsePrint(w io.Writer, question []dns.Question,
 	}
 
 	// ADDITIONAL SECTION
-	if add != nil {
+	if add != nil && OptSections&OptSectionAdditional != 0 {
 		buf.WriteString(";; ADDITIONAL SECTION:\n")
 		for _, rr := range add {
-			buf.WriteString(rr.String())
+			buf.WriteString(ResponseRRString(rr))
 			buf.WriteByte('\n')
 		}
 
@@ -151,6 +443,114 @@ func ResponsePrint(w io.Writer, question []dns.Question,
 	return err
 }
 
+// ResponseRRString formats the record for printing. Metadata
+// of DNSSEC records is appended as comment (see dnssecComment).
+// With OptTimestamps, the record's arrival time is appended as
+// comment. With OptRRHex, the record's rdata is appended as hex
+// on the next line
+func ResponseRRString(rr dns.RR) string {
+	s := rr.String()
+	if comment := dnssecComment(rr); comment != "" {
+		s += "\t; " + comment
+	}
+
+	if OptTimestamps {
+		s += "\t; " + responseTimestamp(rr)
+	}
+
+	if !OptRRHex {
+		return s
+	}
+
+	raw := &dns.RFC3597{}
+	if err := raw.ToRFC3597(rr); err != nil {
+		return s + "\n; rdata: " + err.Error()
+	}
+
+	return fmt.Sprintf("%s\n; rdata (%d bytes): %s", s,
+		raw.Hdr.Rdlength, raw.Rdata)
+}
+
+// responseTimesInput updates arrival times of the received records.
+// Records must have the cache-flush bit cleared
+func responseTimesInput(rrs []dns.RR, now time.Time) {
+	rspTimesLock.Lock()
+	defer rspTimesLock.Unlock()
+
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.OPT); ok {
+			continue
+		}
+
+		key := responseTimesKey(rr)
+		if t := rspTimes[key]; t != nil {
+			t.last = now
+		} else {
+			rspTimes[key] = &responseTimes{now, now}
+		}
+	}
+}
+
+// responseTimestamp returns arrival time of the record for printing:
+// first and last seen times of collected records. Other records are
+// printed as they arrive (in streaming and watch modes), so the
+// current time is used
+func responseTimestamp(rr dns.RR) string {
+	rspTimesLock.Lock()
+	t := rspTimes[responseTimesKey(rr)]
+	rspTimesLock.Unlock()
+
+	if t == nil {
+		return "received " + JournalNow().Format(responseTimeFormat)
+	}
+
+	return fmt.Sprintf("first seen %s, last seen %s",
+		t.first.Format(responseTimeFormat),
+		t.last.Format(responseTimeFormat))
+}
+
+// responseTimesKey returns key of the record in rspTimes. Records,
+// considered duplicates according to OptDedup, share the key
+func responseTimesKey(rr dns.RR) string {
+	if OptDedup == "full" {
+		return rr.String()
+	}
+	return dedupKey(rr)
+}
+
+// ResponseSnapshot prints everything known so far into io.Writer:
+// alive records of the Cache in watch mode, or records collected
+// so far otherwise. In streaming mode records are not retained,
+// so there is nothing to print except the note
+//
+// The returned error, if any, comes from w.Write()
+func ResponseSnapshot(w io.Writer) error {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+
+	now := time.Now()
+	_, err := fmt.Fprintf(w, ";; SNAPSHOT at %s\n\n", now.Format(time.RFC3339))
+
+	switch {
+	case err != nil:
+	case watchCache != nil:
+		err = ResponsePrint(w, nil,
+			append([]dns.RR{}, watchCache.Records(now)...), nil, nil)
+	case rspStream != nil:
+		_, err = fmt.Fprintf(w, ";; Records are not retained "+
+			"in streaming mode\n\n")
+	default:
+		err = ResponsePrint(w, nil, rspAnswer, rspAuthority,
+			rspAdditional)
+	}
+
+	if err == nil {
+		_, err = fmt.Fprintf(w, ";; END OF SNAPSHOT\n\n")
+	}
+
+	return err
+}
+
 // ResponseGetAndPrint is the convenience wrapper for
 // ResponseGet + ResponsePrint
 func ResponseGetAndPrint(w io.Writer, question []dns.Question) error {
@@ -0,0 +1,124 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Retransmission effectiveness report
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// roundsStat contains what was first received in the
+// transmission round
+type roundsStat struct {
+	responders int // Count of new responders
+	records    int // Count of new answer records
+}
+
+// Rounds state. Round 0 means before the first query
+var (
+	roundsCurrent    int                     // Current round
+	roundsStats      = []roundsStat{{}}      // Stats, by round
+	roundsResponders = make(map[string]bool) // Seen responders, by IP
+	roundsRecords    = make(map[string]bool) // Seen records, by dedupKey
+	roundsLock       sync.Mutex              // Access lock
+)
+
+// roundsNext starts the next transmission round. It is called,
+// when the query is sent by the initial -c transmissions
+func roundsNext() {
+	roundsLock.Lock()
+	roundsCurrent++
+	roundsStats = append(roundsStats, roundsStat{})
+	roundsLock.Unlock()
+}
+
+// roundsInput accounts new responders and answer records of the
+// received response to the current round
+func roundsInput(msg *dns.Msg, meta SourceMeta) {
+	roundsLock.Lock()
+	defer roundsLock.Unlock()
+
+	stat := &roundsStats[roundsCurrent]
+
+	responder := meta.From.IP.String()
+	if !roundsResponders[responder] {
+		roundsResponders[responder] = true
+		stat.responders++
+	}
+
+	for _, rr := range msg.Answer {
+		key := dedupKeyNoFlush(rr)
+		if !roundsRecords[key] {
+			roundsRecords[key] = true
+			stat.records++
+		}
+	}
+}
+
+// RoundsPrint prints, which transmission round elicited which new
+// responders and answers, into io.Writer. Consecutive rounds
+// without new answers are printed as a range, e.g.:
+//
+//	;; round 1: 4 responders, 9 records
+//	;; round 2: +1 responders, +2 records
+//	;; rounds 3-10: 0
+//
+// The returned error, if any, comes from w.Write()
+func RoundsPrint(w io.Writer) error {
+	roundsLock.Lock()
+	stats := append([]roundsStat(nil), roundsStats...)
+	roundsLock.Unlock()
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; TRANSMISSION ROUNDS:\n")
+
+	if s := stats[0]; s.responders != 0 || s.records != 0 {
+		fmt.Fprintf(&buf, ";; before query: %d responders, %d records\n",
+			s.responders, s.records)
+	}
+
+	for i := 1; i < len(stats); i++ {
+		s := stats[i]
+
+		if s.responders == 0 && s.records == 0 {
+			end := i
+			for end+1 < len(stats) && stats[end+1] == s {
+				end++
+			}
+
+			if end == i {
+				fmt.Fprintf(&buf, ";; round %d: 0\n", i)
+			} else {
+				fmt.Fprintf(&buf, ";; rounds %d-%d: 0\n", i, end)
+			}
+
+			i = end
+			continue
+		}
+
+		plus := "+"
+		if i == 1 {
+			plus = ""
+		}
+
+		fmt.Fprintf(&buf, ";; round %d: %s%d responders, %s%d records\n",
+			i, plus, s.responders, plus, s.records)
+	}
+
+	if len(stats) == 1 {
+		buf.WriteString(";; no queries sent\n")
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,106 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Recognition of our own packets
+
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// selfSentTTL is how long sent packets are remembered. Looped back
+// packets are received almost immediately
+const selfSentTTL = 5 * time.Second
+
+// Own packets recognition state
+var (
+	selfPorts  = make(map[int]int)          // Ports of our sockets
+	selfSent   = make(map[uint64]time.Time) // Sent packets by hash
+	selfPruned time.Time                    // Last pruning of selfSent
+	selfLock   sync.Mutex                   // Access lock
+)
+
+// SelfIs tells if the received packet is our own packet, looped
+// back by the operating system
+//
+// The packet is our own, if it comes from the local address and
+// port of one of our sockets. Port 5353 is shared with other MDNS
+// programs on this host, so for this port, the packet must also
+// be the same as recently sent
+func SelfIs(buf []byte, from *net.UDPAddr) bool {
+	if !AddrIsLocalUDP(from) {
+		return false
+	}
+
+	selfLock.Lock()
+	defer selfLock.Unlock()
+
+	if selfPorts[from.Port] == 0 {
+		return false
+	}
+
+	if from.Port != mdnsPort {
+		return true
+	}
+
+	_, found := selfSent[selfHash(buf)]
+	return found
+}
+
+// SelfIsLocal tells if the message from the local address must be
+// dropped, as it is not our own (see SelfIs), but comes from other
+// program on this host. It honors OptIncludeSelf and OptMcastLoop
+func SelfIsLocal(from *net.UDPAddr) bool {
+	return !OptIncludeSelf && OptMcastLoop != "on" &&
+		AddrIsLocalUDP(from)
+}
+
+// selfAddConn remembers the port of our socket
+func selfAddConn(laddr *net.UDPAddr) {
+	selfLock.Lock()
+	selfPorts[laddr.Port]++
+	selfLock.Unlock()
+}
+
+// selfDelConn forgets the port of our socket
+func selfDelConn(laddr *net.UDPAddr) {
+	selfLock.Lock()
+	selfPorts[laddr.Port]--
+	if selfPorts[laddr.Port] <= 0 {
+		delete(selfPorts, laddr.Port)
+	}
+	selfLock.Unlock()
+}
+
+// selfSend remembers the sent packet
+func selfSend(buf []byte) {
+	now := time.Now()
+
+	selfLock.Lock()
+	defer selfLock.Unlock()
+
+	// Forget old packets, once per second
+	if now.Sub(selfPruned) >= time.Second {
+		for hash, t := range selfSent {
+			if now.Sub(t) > selfSentTTL {
+				delete(selfSent, hash)
+			}
+		}
+		selfPruned = now
+	}
+
+	selfSent[selfHash(buf)] = now
+}
+
+// selfHash returns hash of the packet
+func selfHash(buf []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(buf)
+	return h.Sum64()
+}
@@ -0,0 +1,150 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// HTTP server for live events
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveQueueSize is the size of per-client events queue. Clients
+// that don't keep up with events are disconnected
+const serveQueueSize = 1024
+
+// serveClients contains queues of connected clients. It is
+// non-nil when the server is running. Protected by rspLock
+var serveClients map[chan *serveEvent]struct{}
+
+// serveEvent is the JSON representation of the event
+type serveEvent struct {
+	Event string    `json:"event"` // "added", "removed" or "changed"
+	Time  time.Time `json:"time"`  // Event time
+	snapshotRecord
+}
+
+// ServeRun runs HTTP server at the OptServe address, until ctx
+// is canceled. It doesn't return in a case of errors
+//
+// Discovery events of watch mode are streamed at the /events
+// path as Server-Sent Events, with JSON data. Upon connection,
+// all currently known records are sent as "added" events
+//
+// The root path serves the browse page (see webuiServe)
+func ServeRun(ctx context.Context) {
+	rspLock.Lock()
+	serveClients = make(map[chan *serveEvent]struct{})
+	rspLock.Unlock()
+
+	l, err := net.Listen("tcp", OptServe)
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", serveEvents)
+	mux.HandleFunc("/", webuiServe)
+
+	srv := &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	LogDebug("Serving at http://%s/", l.Addr())
+
+	go srv.Serve(l)
+}
+
+// serveEvents handles the /events requests
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe to events and obtain current records atomically
+	queue := make(chan *serveEvent, serveQueueSize)
+	now := time.Now()
+
+	rspLock.Lock()
+	for _, rr := range watchCache.Records(now) {
+		queue <- &serveEvent{"added", now, snapshotRecordNew(rr)}
+		if len(queue) == cap(queue) {
+			break
+		}
+	}
+	serveClients[queue] = struct{}{}
+	rspLock.Unlock()
+
+	defer func() {
+		rspLock.Lock()
+		delete(serveClients, queue)
+		rspLock.Unlock()
+	}()
+
+	LogDebug("%s: events client connected", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			LogDebug("%s: events client disconnected",
+				r.RemoteAddr)
+			return
+
+		case ev, ok := <-queue:
+			if !ok {
+				LogError("%s: events client too slow, "+
+					"disconnected", r.RemoteAddr)
+				return
+			}
+
+			data, _ := json.Marshal(ev)
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n",
+				ev.Event, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// serveInput sends Cache events to all connected clients. Clients,
+// whose queues are full, are disconnected. Must be called under rspLock
+func serveInput(events []CacheEvent) {
+	now := time.Now()
+
+	for _, ev := range events {
+		sev := &serveEvent{ev.Name(), now,
+			snapshotRecordNew(ev.RR)}
+
+		for queue := range serveClients {
+			select {
+			case queue <- sev:
+			default:
+				close(queue)
+				delete(serveClients, queue)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Saved sessions and their comparison
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SessionRecords returns records of the current session: alive
+// records in watch mode, or all records collected so far otherwise
+func SessionRecords() []dns.RR {
+	if OptWatch {
+		return ResponseRecords()
+	}
+
+	ans, auth, add := ResponseGet()
+
+	var records []dns.RR
+	for _, rr := range append(append(ans, auth...), add...) {
+		if _, ok := rr.(*dns.OPT); !ok {
+			records = append(records, rr)
+		}
+	}
+
+	return records
+}
+
+// SessionSave atomically saves records of the session into the
+// file, in the same format as snapshots
+func SessionSave(path string, question []dns.Question,
+	records []dns.RR) error {
+	return snapshotWrite(path, question, records)
+}
+
+// SessionPrintDiff prints changes of records since the session,
+// saved in the file, into io.Writer
+//
+// The returned error, if any, comes from file reading or w.Write()
+func SessionPrintDiff(w io.Writer, path string, records []dns.RR) error {
+	old, err := sessionLoad(path)
+	if err != nil {
+		return err
+	}
+
+	var cur []snapshotRecord
+	for _, rr := range records {
+		cur = append(cur, snapshotRecordNew(rr))
+	}
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, ";; CHANGES SINCE %s:\n", path)
+	sessionDiff(&buf, old.Records, cur)
+	buf.WriteByte('\n')
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// DiffRun compares two sessions (or snapshots), specified by
+// OptCommandArgs, and prints added (+), removed (-) and changed (~)
+// records to w
+//
+// It returns true, if sessions have the same records. Error is
+// returned, if sessions can't be loaded
+func DiffRun(w io.Writer) (bool, error) {
+	old, err := sessionLoad(OptCommandArgs[0])
+	if err != nil {
+		return false, fileError{err}
+	}
+
+	cur, err := sessionLoad(OptCommandArgs[1])
+	if err != nil {
+		return false, fileError{err}
+	}
+
+	fmt.Fprintf(w, ";; %s (%s) -> %s (%s)\n",
+		OptCommandArgs[0], old.Time.Format("2006-01-02 15:04:05"),
+		OptCommandArgs[1], cur.Time.Format("2006-01-02 15:04:05"))
+
+	return sessionDiff(w, old.Records, cur.Records) == 0, nil
+}
+
+// sessionLoad loads the saved session
+func sessionLoad(path string) (*snapshotFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &snapshotFile{}
+	err = json.Unmarshal(data, snap)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return snap, nil
+}
+
+// sessionDiff prints differences between old and new records
+// and returns count of printed lines
+//
+// Records are compared without TTL. New records of unique RRsets
+// (records of the same name, type and class, received with the
+// cache-flush bit), that existed before, are printed as changed (~),
+// like in watch mode. Removed records of such RRsets are considered
+// replaced and not printed. Records of shared RRsets (e.g., PTR
+// records of service instances) are added (+) and removed (-)
+// individually
+func sessionDiff(w io.Writer, old, cur []snapshotRecord) int {
+	oldRecs, oldSets := sessionIndex(old)
+	curRecs, curSets := sessionIndex(cur)
+
+	// replaced tells if the record's RRset is unique and exists
+	// in the other session, so the record was replaced there
+	replaced := func(rec *snapshotRecord,
+		other map[string]bool) bool {
+		set := sessionSetKey(rec)
+		_, exists := other[set]
+		return exists && (oldSets[set] || curSets[set])
+	}
+
+	type line struct {
+		mark byte
+		rec  snapshotRecord
+	}
+
+	var lines []line
+	for key, rec := range curRecs {
+		switch {
+		case oldRecs[key] != nil:
+		case replaced(rec, oldSets):
+			lines = append(lines, line{'~', *rec})
+		default:
+			lines = append(lines, line{'+', *rec})
+		}
+	}
+
+	for key, rec := range oldRecs {
+		if curRecs[key] == nil && !replaced(rec, curSets) {
+			lines = append(lines, line{'-', *rec})
+		}
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		ki := sessionKey(&lines[i].rec)
+		kj := sessionKey(&lines[j].rec)
+		if ki != kj {
+			return ki < kj
+		}
+		return lines[i].mark < lines[j].mark
+	})
+
+	for _, l := range lines {
+		fmt.Fprintf(w, "%c %s\t%d\t%s\t%s\t%s\n", l.mark,
+			l.rec.Name, l.rec.TTL, l.rec.Class, l.rec.Type,
+			l.rec.Data)
+	}
+
+	return len(lines)
+}
+
+// sessionIndex indexes records by key and RRsets by key. RRsets
+// map to true, if they are unique
+func sessionIndex(records []snapshotRecord) (map[string]*snapshotRecord,
+	map[string]bool) {
+
+	recs := make(map[string]*snapshotRecord)
+	sets := make(map[string]bool)
+
+	for i := range records {
+		rec := &records[i]
+		recs[sessionKey(rec)] = rec
+		set := sessionSetKey(rec)
+		sets[set] = sets[set] || rec.Unique
+	}
+
+	return recs, sets
+}
+
+// sessionKey returns the record key, for comparison
+func sessionKey(rec *snapshotRecord) string {
+	return sessionSetKey(rec) + " " + rec.Data
+}
+
+// sessionSetKey returns key of the record's RRset
+func sessionSetKey(rec *snapshotRecord) string {
+	return strings.ToLower(rec.Name) + " " + rec.Class + " " + rec.Type
+}
@@ -0,0 +1,83 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// File sharing services discovery preset
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sharesTimeout is the timeout of the reachability check
+const sharesTimeout = 500 * time.Millisecond
+
+// presetShares browses file servers
+var presetShares = &preset{
+	title: "FILE SHARES",
+	types: []string{
+		"_smb._tcp.local.",
+		"_afpovertcp._tcp.local.",
+		"_nfs._tcp.local.",
+		"_sftp-ssh._tcp.local.",
+	},
+	decode: sharesDecode,
+}
+
+// sharesSchemes are URL schemes of service types
+var sharesSchemes = map[string]string{
+	"_smb._tcp.local.":        "smb",
+	"_afpovertcp._tcp.local.": "afp",
+	"_nfs._tcp.local.":        "nfs",
+	"_sftp-ssh._tcp.local.":   "sftp",
+}
+
+// sharesDecode returns URL of the file server and checks, if it is
+// reachable, by connecting to its addresses
+func sharesDecode(svc DnssdService, txt map[string]string) []presetField {
+	if svc.Host == "" {
+		return nil
+	}
+
+	port := strconv.Itoa(int(svc.Port))
+	url := sharesSchemes[strings.ToLower(svc.Type)] + "://" +
+		net.JoinHostPort(strings.TrimSuffix(svc.Host, "."), port)
+
+	path := txt["path"]
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return []presetField{
+		{"url", url + path},
+		{"reachable", sharesReachable(svc.Addrs, port)},
+	}
+}
+
+// sharesReachable returns addresses, where TCP port accepts
+// connections, or "no"
+func sharesReachable(addrs []string, port string) string {
+	var ok []string
+	for _, addr := range addrs {
+		conn, err := net.DialTimeout("tcp",
+			net.JoinHostPort(addr, port), sharesTimeout)
+		if err != nil {
+			LogDebug("%s: %s", addr, err)
+			continue
+		}
+
+		conn.Close()
+		ok = append(ok, addr)
+	}
+
+	if len(ok) == 0 {
+		return "no"
+	}
+
+	return "yes (" + strings.Join(ok, ", ") + ")"
+}
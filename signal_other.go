@@ -0,0 +1,23 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Signals, version for platforms other than Windows
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SignalNotifySnapshot relays the snapshot request signal
+// (SIGUSR1) to c
+func SignalNotifySnapshot(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,18 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Signals, Windows version
+
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// SignalNotifySnapshot relays the snapshot request signal to c.
+// Windows has no SIGUSR1, so snapshots can't be requested by signal
+func SignalNotifySnapshot(c chan<- os.Signal) {
+}
@@ -0,0 +1,122 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Response sizes and compression statistics
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Safe sizes of MDNS messages: the Ethernet MTU minus IP and UDP
+// headers for IPv4, and the DNS Flag Day 2020 recommended size,
+// based on the IPv6 minimum MTU, for IPv6
+const (
+	sizesLimit4 = 1472
+	sizesLimit6 = 1232
+)
+
+// sizesNear is the fraction of the safe size, starting from which
+// response is considered to approach the limit
+const sizesNear = 0.9
+
+// sizesResponse contains sizes of the received response
+type sizesResponse struct {
+	from         string // Source address
+	size         int    // Wire size
+	uncompressed int    // Size without name compression
+	limit        int    // Safe size for the address family
+	truncated    bool   // TC bit set (multi-packet response)
+}
+
+// Sizes state
+var (
+	sizesResponses []sizesResponse // Received responses
+	sizesLock      sync.Mutex      // Access lock
+)
+
+// sizesInput records sizes of the received response packet.
+// It must be called for each packet, before multi-packet
+// responses are aggregated
+func sizesInput(msg *dns.Msg, meta SourceMeta) {
+	// Unpacked message has compression disabled, so Len
+	// returns the uncompressed size
+	rsp := sizesResponse{
+		from:         meta.From.String(),
+		size:         meta.Size,
+		uncompressed: msg.Len(),
+		limit:        sizesLimit4,
+		truncated:    msg.Truncated,
+	}
+
+	if meta.From.IP.To4() == nil {
+		rsp.limit = sizesLimit6
+	}
+
+	sizesLock.Lock()
+	sizesResponses = append(sizesResponses, rsp)
+	sizesLock.Unlock()
+}
+
+// SizesPrint prints the table of wire sizes of received responses,
+// savings by name compression and status against the safe size
+// limits (1472 bytes for IPv4, 1232 for IPv6) into io.Writer
+//
+// The returned error, if any, comes from w.Write()
+func SizesPrint(w io.Writer) error {
+	sizesLock.Lock()
+	responses := append([]sizesResponse(nil), sizesResponses...)
+	sizesLock.Unlock()
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; RESPONSE SIZES:\n")
+	fmt.Fprintf(&buf, ";; %-40s %6s %6s %6s  %s\n", "from", "bytes",
+		"uncomp", "saved", "limit")
+
+	max := 0
+	for _, rsp := range responses {
+		saved := 0.0
+		if rsp.uncompressed > 0 {
+			saved = float64(rsp.uncompressed-rsp.size) * 100 /
+				float64(rsp.uncompressed)
+		}
+
+		status := "ok"
+		switch {
+		case rsp.size > rsp.limit:
+			status = "EXCEEDS"
+		case float64(rsp.size) >= float64(rsp.limit)*sizesNear:
+			status = "near"
+		}
+
+		if rsp.truncated {
+			status += ", TC"
+		}
+
+		fmt.Fprintf(&buf, ";; %-40s %6d %6d %5.1f%%  %d %s\n", rsp.from,
+			rsp.size, rsp.uncompressed, saved, rsp.limit, status)
+
+		if rsp.size > max {
+			max = rsp.size
+		}
+	}
+
+	if len(responses) == 0 {
+		buf.WriteString(";; no responses received\n")
+	} else {
+		fmt.Fprintf(&buf, ";; %d responses, largest is %d bytes\n",
+			len(responses), max)
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,171 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Periodic snapshots of known records
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// snapshotFile is the JSON representation of the snapshot
+type snapshotFile struct {
+	Time     time.Time          `json:"time"`     // Snapshot time
+	Question []snapshotQuestion `json:"question"` // Questions asked
+	Records  []snapshotRecord   `json:"records"`  // Alive records
+}
+
+// snapshotQuestion is the JSON representation of the question
+type snapshotQuestion struct {
+	Name  string `json:"name"`  // Queried name
+	Type  string `json:"type"`  // Queried type
+	Class string `json:"class"` // Queried class
+}
+
+// snapshotRecord is the JSON representation of the record
+type snapshotRecord struct {
+	Name  string `json:"name"`  // Record name
+	Type  string `json:"type"`  // Record type
+	Class string `json:"class"` // Record class
+	TTL   uint32 `json:"ttl"`   // Remaining TTL, seconds
+	Data  string `json:"data"`  // Record data, in zone file format
+
+	// Member of the unique RRset (received with cache-flush bit)
+	Unique bool `json:"unique,omitempty"`
+}
+
+// SnapshotRun periodically, every OptSnapshotInterval, writes all
+// records, known in watch mode, to the OptOutput file, until ctx
+// is canceled
+//
+// The file is replaced atomically, so readers never see partially
+// written snapshot
+func SnapshotRun(ctx context.Context, question []dns.Question) {
+	ticker := time.NewTicker(OptSnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := snapshotWrite(OptOutput, question, ResponseRecords())
+		if err != nil {
+			LogError("%s", err)
+		}
+	}
+}
+
+// SnapshotPrint prints records as JSON, in the snapshot format,
+// into io.Writer. This is the json output format
+//
+// The returned error, if any, comes from w.Write()
+func SnapshotPrint(w io.Writer, question []dns.Question,
+	records []dns.RR) error {
+
+	data, err := snapshotMarshal(JournalNow(), question, records)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+
+	return err
+}
+
+// snapshotWrite atomically writes the snapshot into the file
+func snapshotWrite(path string, question []dns.Question,
+	records []dns.RR) error {
+
+	data, err := snapshotMarshal(time.Now(), question, records)
+	if err != nil {
+		return err
+	}
+
+	return snapshotWriteFile(path, data)
+}
+
+// snapshotMarshal returns JSON representation of the snapshot
+func snapshotMarshal(now time.Time, question []dns.Question,
+	records []dns.RR) ([]byte, error) {
+
+	snap := snapshotFile{
+		Time:    now,
+		Records: make([]snapshotRecord, 0, len(records)),
+	}
+
+	for _, q := range question {
+		snap.Question = append(snap.Question, snapshotQuestion{
+			Name:  q.Name,
+			Type:  dns.Type(q.Qtype).String(),
+			Class: dns.Class(q.Qclass).String(),
+		})
+	}
+
+	for _, rr := range records {
+		snap.Records = append(snap.Records, snapshotRecordNew(rr))
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// snapshotRecordNew creates JSON representation of the record
+func snapshotRecordNew(rr dns.RR) snapshotRecord {
+	hdr := rr.Header()
+	return snapshotRecord{
+		Name:  hdr.Name,
+		Type:  dns.Type(hdr.Rrtype).String(),
+		Class: dns.Class(hdr.Class &^ (1 << 15)).String(),
+		TTL:   hdr.Ttl,
+		Data:  strings.TrimPrefix(rr.String(), hdr.String()),
+
+		Unique: hdr.Class&(1<<15) != 0 || ResponseIsUnique(rr),
+	}
+}
+
+// snapshotWriteFile atomically writes data into the file: data
+// is written to the temporary file in the same directory, which
+// then is renamed over the destination
+func snapshotWriteFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path),
+		"."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
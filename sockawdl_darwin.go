@@ -0,0 +1,24 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// AWDL socket option, macOS version
+
+//go:build darwin
+// +build darwin
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// sockRecvAnyIf is the SO_RECV_ANYIF socket option, missed
+// in golang.org/x/sys/unix. See <sys/socket.h>
+const sockRecvAnyIf = 0x1104
+
+// SockRecvAnyIf sets SO_RECV_ANYIF socket option. Without it,
+// macOS doesn't deliver packets, received via the restricted
+// peer-to-peer interfaces (AWDL), to the socket
+func SockRecvAnyIf(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, sockRecvAnyIf, 1)
+}
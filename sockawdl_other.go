@@ -0,0 +1,17 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// AWDL socket option, version for platforms other than macOS
+
+//go:build !darwin
+// +build !darwin
+
+package main
+
+// SockRecvAnyIf sets SO_RECV_ANYIF socket option. AWDL is macOS
+// only, so it does nothing on this platform
+func SockRecvAnyIf(fd uintptr) error {
+	return nil
+}
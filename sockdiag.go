@@ -0,0 +1,69 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Socket errors diagnostics
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SockErrorHint returns the remediation hint for the error of
+// socket creation, binding or joining multicast group. If iface
+// is not nil, the error is related to this interface
+//
+// If cause of the error is not known, it returns empty string
+func SockErrorHint(err error, iface *net.Interface) string {
+	switch {
+	case iface != nil && iface.Flags&net.FlagMulticast == 0:
+		return fmt.Sprintf("interface is not multicast-capable; "+
+			"try: ip link set dev %s multicast on", iface.Name)
+
+	case iface != nil && iface.Flags&net.FlagUp == 0:
+		return fmt.Sprintf("interface is down; "+
+			"try: ip link set dev %s up", iface.Name)
+
+	case errors.Is(err, syscall.EADDRINUSE):
+		return "port is used by other program, that doesn't " +
+			"share it (e.g., old Avahi or mDNSResponder); " +
+			"stop it, or use --source-port for unicast queries"
+
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return "blocked by security policy; check firewall rules " +
+			"for UDP port 5353 and multicast, seccomp profile " +
+			"or container (network namespace) restrictions"
+
+	case errors.Is(err, syscall.ENOBUFS):
+		return "too many multicast groups joined; increase " +
+			"net.ipv4.igmp_max_memberships (Linux)"
+
+	case errors.Is(err, syscall.ENODEV),
+		errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "interface has gone, or has no address of this family"
+
+	case errors.Is(err, syscall.EAFNOSUPPORT):
+		return "address family is not supported; " +
+			"use -4 if IPv6 is disabled"
+	}
+
+	return ""
+}
+
+// sockErrorf formats the socket error message with the remediation
+// hint, if available (see SockErrorHint)
+func sockErrorf(err error, iface *net.Interface,
+	format string, args ...interface{}) string {
+
+	msg := fmt.Sprintf(format, args...)
+	if hint := SockErrorHint(err, iface); hint != "" {
+		msg += "; hint: " + hint
+	}
+
+	return msg
+}
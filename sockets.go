@@ -0,0 +1,300 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// MDNS sockets, that follow network configuration changes
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+// querySockets is the set of MDNS sockets and links, that can be
+// updated when network interfaces appear and disappear (see Update)
+type querySockets struct {
+	conns []Transport                // MDNS sockets
+	links []queryLink                // MDNS socket/interface pairs
+	input func(*dns.Msg, SourceMeta) // Receivers' input callback
+	wait  sync.WaitGroup             // Receivers termination
+	lock  sync.Mutex                 // Access lock
+}
+
+// querySocketsOpen creates sockets on the specified interfaces and
+// starts receivers, that pass received messages to the input
+// callback. Interfaces that have failed are skipped (see queryOpen)
+//
+// Messages, received via interfaces not in use, are dropped, as
+// well as messages from other programs on this host, unless enabled
+// (see SelfIsLocal)
+func querySocketsOpen(if4, if6 []net.Interface,
+	input func(*dns.Msg, SourceMeta)) *querySockets {
+
+	s := &querySockets{input: input}
+
+	conns4, links4 := queryOpen("udp4", queryMcast4, if4)
+	conns6, links6 := queryOpen("udp6", queryMcast6, if6)
+
+	s.links = append(links4, links6...)
+
+	for _, conn := range append(conns4, conns6...) {
+		s.start(conn)
+	}
+
+	return s
+}
+
+// Len returns count of links in use
+func (s *querySockets) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.links)
+}
+
+// Send sends the query message via all links (see querySend) and
+// returns count of links left
+func (s *querySockets) Send(rqBytes []byte) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.links = querySend(s.links, rqBytes)
+	return len(s.links)
+}
+
+// SendVia sends the query message, like Send, but only via links
+// of the named interface and address family ("udp4" or "udp6").
+// Empty ifname or network means any. It returns count of links,
+// the message was sent via
+func (s *querySockets) SendVia(rqBytes []byte,
+	ifname, network string) int {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sent := 0
+	links := s.links[:0]
+	for _, link := range s.links {
+		switch {
+		case ifname != "" && link.iface.Name != ifname:
+		case network == "udp4" && !link.conn.Is4(),
+			network == "udp6" && link.conn.Is4():
+		default:
+			sent++
+			links = append(links,
+				querySend([]queryLink{link}, rqBytes)...)
+			continue
+		}
+
+		links = append(links, link)
+	}
+
+	s.links = links
+	return sent
+}
+
+// Retransmit retransmits the query via all links (see
+// queryRetransmit) and returns count of links left
+func (s *querySockets) Retransmit(rq *dns.Msg) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.links = queryRetransmit(s.links, rq)
+	return len(s.links)
+}
+
+// Update updates sockets and links according to the new lists of
+// IPv4 and IPv6 interfaces, as reported by NetmonRun
+//
+// Multicast groups are joined on new interfaces and left on
+// interfaces that are gone. Sockets are created and closed
+// as needed
+func (s *querySockets) Update(if4, if6 []net.Interface) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.update("udp4", queryMcast4, if4)
+	s.update("udp6", queryMcast6, if6)
+}
+
+// Close closes all sockets and waits for receivers termination
+func (s *querySockets) Close() {
+	s.lock.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.links = nil
+	s.lock.Unlock()
+
+	s.wait.Wait()
+}
+
+// update updates sockets and links of the address family.
+// Must be called under lock
+func (s *querySockets) update(network string, group *net.UDPAddr,
+	ifaces []net.Interface) {
+
+	is4 := network == "udp4"
+
+	want := make(map[int]bool)
+	for _, iface := range ifaces {
+		want[iface.Index] = true
+	}
+
+	// Drop links of interfaces that are gone
+	var conn Transport
+	have := make(map[int]bool)
+	links := s.links[:0]
+
+	for _, link := range s.links {
+		switch {
+		case link.conn.Is4() != is4:
+		case want[link.iface.Index]:
+			have[link.iface.Index] = true
+			conn = link.conn
+		default:
+			LogDebug("%s: interface gone, %s left",
+				link.iface.Name, group.IP)
+
+			link.conn.LeaveGroup(&link.iface, group)
+			continue
+		}
+
+		links = append(links, link)
+	}
+
+	s.links = links
+
+	// With OptBindDevice, close sockets without links. Note, links
+	// may also be dropped by querySend, if interface has failed
+	if OptBindDevice {
+		for _, c := range append([]Transport(nil), s.conns...) {
+			if c.Is4() == is4 && !s.used(c) {
+				s.stop(c)
+			}
+		}
+	}
+
+	// Find the shared socket, even if it has no links left
+	if conn == nil && !OptBindDevice {
+		for _, c := range s.conns {
+			if c.Is4() == is4 {
+				conn = c
+				break
+			}
+		}
+	}
+
+	// Join the group on new interfaces
+	for _, iface := range ifaces {
+		if have[iface.Index] {
+			continue
+		}
+
+		c := conn
+		if c == nil || OptBindDevice {
+			ifname := ""
+			if OptBindDevice {
+				ifname = iface.Name
+			}
+
+			laddr := &net.UDPAddr{Port: group.Port}
+			var err error
+			c, err = TransportOpen(network, laddr, ifname)
+			if err != nil {
+				LogError("%s", sockErrorf(err, nil, "%s: %s",
+					iface.Name, err))
+				continue
+			}
+			s.start(c)
+
+			if !OptBindDevice {
+				conn = c
+			}
+		}
+
+		// The group may still be joined, if the link was
+		// dropped by querySend due to error
+		iface := iface
+		err := c.JoinGroup(&iface, group)
+		if err != nil && !errors.Is(err, syscall.EADDRINUSE) {
+			LogError("%s", sockErrorf(err, &iface,
+				"%s: joining %s: %s", iface.Name, group.IP, err))
+			if OptBindDevice {
+				s.stop(c)
+			}
+			continue
+		}
+
+		LogDebug("%s: new interface, %s joined", iface.Name, group.IP)
+		s.links = append(s.links, queryLink{c, iface})
+	}
+}
+
+// start starts the receiver of the socket. Must be called under lock
+func (s *querySockets) start(conn Transport) {
+	accept := func(meta SourceMeta) bool {
+		// Skip messages from this host
+		if SelfIsLocal(meta.From) {
+			return false
+		}
+
+		if meta.IfIndex != 0 && !s.uses(conn, meta.IfIndex) {
+			LogVerbose("Packet from %s: unexpected "+
+				"ifindex %d, dropped",
+				meta.From, meta.IfIndex)
+			return false
+		}
+
+		return true
+	}
+
+	s.conns = append(s.conns, conn)
+	s.wait.Add(1)
+	go queryRecv(conn, accept, s.input, &s.wait)
+}
+
+// stop closes the socket. Its receiver terminates asynchronously.
+// Must be called under lock
+func (s *querySockets) stop(conn Transport) {
+	for i, c := range s.conns {
+		if c == conn {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			break
+		}
+	}
+
+	conn.Close()
+}
+
+// uses tells if the socket is used on the interface. In degraded
+// mode (see IfAddrs), socket is used on all interfaces
+func (s *querySockets) uses(conn Transport, ifindex int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, link := range s.links {
+		if link.conn == conn &&
+			(link.iface.Index == ifindex || link.iface.Index == 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// used tells if the socket is used by some link. Must be called
+// under lock
+func (s *querySockets) used(conn Transport) bool {
+	for _, link := range s.links {
+		if link.conn == conn {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,86 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Socket options, Linux version
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SockPktInfoSupported tells if reception of the packet information
+// (receiving interface and destination address) and selection of
+// the outgoing interface per packet are supported on this platform
+const SockPktInfoSupported = true
+
+// SockBindToDeviceSupported tells if SockBindToDevice is
+// supported on this platform
+const SockBindToDeviceSupported = true
+
+// SockBindToDevice binds socket to the network interface, so
+// only packets, received via this interface, will be delivered
+// to the socket
+func SockBindToDevice(fd uintptr, ifname string) error {
+	return syscall.SetsockoptString(int(fd),
+		syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifname)
+}
+
+// SockReusePort sets SO_REUSEPORT socket option
+func SockReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd),
+		unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+// SockReuseAddr sets SO_REUSEADDR socket option
+func SockReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd),
+		syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+// SockRcvBuf returns the effective size of the socket receive buffer
+func SockRcvBuf(fd uintptr) (int, error) {
+	return syscall.GetsockoptInt(int(fd),
+		syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+}
+
+// SockRxqOvflSupported tells if SockRxqOvfl is supported on
+// this platform
+const SockRxqOvflSupported = true
+
+// SockRxqOvfl enables the SO_RXQ_OVFL socket option, so received
+// packets carry the count of packets, dropped by the kernel due to
+// the socket receive queue overflow (see SockRxqOvflParse)
+func SockRxqOvfl(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd),
+		unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+}
+
+// SockRxqOvflParse returns the count of dropped packets from the
+// control messages of the received packet. The count is cumulative
+// since the socket creation, and the control message is present
+// only if some packets have been dropped
+func SockRxqOvflParse(oob []byte) (uint32, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_SOCKET &&
+			m.Header.Type == unix.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			// The count is in the host byte order
+			return *(*uint32)(unsafe.Pointer(&m.Data[0])), true
+		}
+	}
+
+	return 0, false
+}
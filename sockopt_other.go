@@ -0,0 +1,65 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Socket options, version for platforms other than Unix and Windows
+
+//go:build !unix && !windows
+// +build !unix,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+// SockPktInfoSupported tells if reception of the packet information
+// (receiving interface and destination address) and selection of
+// the outgoing interface per packet are supported on this platform
+const SockPktInfoSupported = false
+
+// SockBindToDeviceSupported tells if SockBindToDevice is
+// supported on this platform
+const SockBindToDeviceSupported = false
+
+// SockBindToDevice binds socket to the network interface.
+// Not supported on this platform
+func SockBindToDevice(fd uintptr, ifname string) error {
+	return errors.New("SO_BINDTODEVICE not supported")
+}
+
+// SockReusePort sets SO_REUSEPORT socket option.
+// Not supported on this platform
+func SockReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT not supported")
+}
+
+// SockReuseAddr sets SO_REUSEADDR socket option.
+// Not supported on this platform
+func SockReuseAddr(fd uintptr) error {
+	return errors.New("SO_REUSEADDR not supported")
+}
+
+// SockRcvBuf returns the effective size of the socket receive buffer.
+// Not supported on this platform
+func SockRcvBuf(fd uintptr) (int, error) {
+	return 0, errors.New("SO_RCVBUF not supported")
+}
+
+// SockRxqOvflSupported tells if SockRxqOvfl is supported on
+// this platform
+const SockRxqOvflSupported = false
+
+// SockRxqOvfl enables the SO_RXQ_OVFL socket option.
+// Not supported on this platform
+func SockRxqOvfl(fd uintptr) error {
+	return errors.New("SO_RXQ_OVFL not supported")
+}
+
+// SockRxqOvflParse returns the count of dropped packets from the
+// control messages of the received packet. Not supported on this
+// platform
+func SockRxqOvflParse(oob []byte) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,68 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Socket options, version for Unix platforms other than Linux
+
+//go:build unix && !linux
+// +build unix,!linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SockPktInfoSupported tells if reception of the packet information
+// (receiving interface and destination address) and selection of
+// the outgoing interface per packet are supported on this platform
+const SockPktInfoSupported = true
+
+// SockBindToDeviceSupported tells if SockBindToDevice is
+// supported on this platform
+const SockBindToDeviceSupported = false
+
+// SockBindToDevice binds socket to the network interface.
+// Not supported on this platform
+func SockBindToDevice(fd uintptr, ifname string) error {
+	return errors.New("SO_BINDTODEVICE not supported")
+}
+
+// SockReusePort sets SO_REUSEPORT socket option
+func SockReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd),
+		unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+// SockReuseAddr sets SO_REUSEADDR socket option
+func SockReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd),
+		syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+// SockRcvBuf returns the effective size of the socket receive buffer
+func SockRcvBuf(fd uintptr) (int, error) {
+	return syscall.GetsockoptInt(int(fd),
+		syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+}
+
+// SockRxqOvflSupported tells if SockRxqOvfl is supported on
+// this platform
+const SockRxqOvflSupported = false
+
+// SockRxqOvfl enables the SO_RXQ_OVFL socket option.
+// Not supported on this platform
+func SockRxqOvfl(fd uintptr) error {
+	return errors.New("SO_RXQ_OVFL not supported")
+}
+
+// SockRxqOvflParse returns the count of dropped packets from the
+// control messages of the received packet. Not supported on this
+// platform
+func SockRxqOvflParse(oob []byte) (uint32, bool) {
+	return 0, false
+}
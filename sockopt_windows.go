@@ -0,0 +1,69 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Socket options, Windows version
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// SockPktInfoSupported tells if reception of the packet information
+// (receiving interface and destination address) and selection of
+// the outgoing interface per packet are supported on this platform
+//
+// golang.org/x/net doesn't implement control messages on Windows
+const SockPktInfoSupported = false
+
+// SockBindToDeviceSupported tells if SockBindToDevice is
+// supported on this platform
+const SockBindToDeviceSupported = false
+
+// SockBindToDevice binds socket to the network interface.
+// Not supported on this platform
+func SockBindToDevice(fd uintptr, ifname string) error {
+	return errors.New("SO_BINDTODEVICE not supported")
+}
+
+// SockReusePort does nothing. Windows has no SO_REUSEPORT, and
+// SO_REUSEADDR already allows sharing the port with other MDNS
+// responders (e.g., Bonjour service)
+func SockReusePort(fd uintptr) error {
+	return nil
+}
+
+// SockReuseAddr sets SO_REUSEADDR socket option
+func SockReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd),
+		syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+// SockRcvBuf returns the effective size of the socket receive buffer
+func SockRcvBuf(fd uintptr) (int, error) {
+	return syscall.GetsockoptInt(syscall.Handle(fd),
+		syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+}
+
+// SockRxqOvflSupported tells if SockRxqOvfl is supported on
+// this platform
+const SockRxqOvflSupported = false
+
+// SockRxqOvfl enables the SO_RXQ_OVFL socket option.
+// Not supported on this platform
+func SockRxqOvfl(fd uintptr) error {
+	return errors.New("SO_RXQ_OVFL not supported")
+}
+
+// SockRxqOvflParse returns the count of dropped packets from the
+// control messages of the received packet. Not supported on this
+// platform
+func SockRxqOvflParse(oob []byte) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,350 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The stress command
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stressWait specifies how long to wait for late responses
+// after the last query of each kind
+const stressWait = time.Second
+
+// stressKind describes a kind of stress queries
+//
+// Each query contains the valid question for the target host name,
+// so each query is expected to be answered, and some edge-case
+// additions, created by the build callback
+type stressKind struct {
+	name  string                     // Kind name
+	build func(q *dns.Msg, n string) // Adds edge-case stuff to q
+}
+
+// stressKinds lists all kinds of stress queries. The first and
+// the last kinds are the same plain queries, so degradation
+// after edge cases is visible
+var stressKinds = []stressKind{
+	{"baseline", func(q *dns.Msg, n string) {}},
+	{"max-length labels", stressLongLabels},
+	{"many questions", stressManyQuestions},
+	{"large known-answer section", stressKnownAnswers},
+	{"baseline (after)", func(q *dns.Msg, n string) {}},
+}
+
+// stress contains the stress test state
+type stress struct {
+	question dns.Question         // The valid question
+	pending  map[uint16]time.Time // Pending queries by ID
+	latency  []time.Duration      // Latencies of answered queries
+	resolved chan net.IP          // Target resolution result
+	answered chan struct{}        // Signaled on each answer
+	lock     sync.Mutex           // Access lock
+}
+
+// StressRun sends queries for the host name, specified by the first
+// of OptCommandArgs, to its responder at the OptRate rate, and prints
+// the answer rate and latency statistics to w
+//
+// Queries are sent via unicast to the responder's address (OptServer,
+// or resolved via MDNS), from the ephemeral port (or OptSourcePort),
+// so each response can be matched with its query by ID (RFC 6762,
+// section 6.7)
+//
+// Error is returned, if the test can't be started (e.g., the socket
+// can't be created or the target is not found)
+func StressRun(ctx context.Context, w io.Writer) error {
+	s, conn, target, wait, err := stressStart()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, ";; Stressing %s at %s, %d queries/s\n",
+		s.question.Name, target, OptRate)
+
+	// Run all kinds of queries
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, kind := range stressKinds {
+		if ctx.Err() != nil {
+			break
+		}
+
+		s.run(ctx, w, conn, target, kind, rnd)
+	}
+
+	conn.Close()
+	wait.Wait()
+
+	return nil
+}
+
+// stressStart creates the stress test state for the host name,
+// specified by the first of OptCommandArgs, opens the unicast
+// socket, starts its receiver and finds the target responder
+//
+// The caller must close conn and wait for receiver termination,
+// unless error is returned
+func stressStart() (s *stress, conn *Conn, target *net.UDPAddr,
+	wait *sync.WaitGroup, err error) {
+
+	host, err := QueryFqdn(OptCommandArgs[0])
+	if err != nil {
+		return
+	}
+
+	s = &stress{
+		question: dns.Question{
+			Name:   host,
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		},
+		pending:  make(map[uint16]time.Time),
+		resolved: make(chan net.IP, 1),
+		answered: make(chan struct{}, 1),
+	}
+
+	if !Opt4 {
+		s.question.Qtype = dns.TypeAAAA
+	}
+
+	network := "udp4"
+	if OptServer != nil && !AddrIs4UDP(OptServer) || !Opt4 {
+		network = "udp6"
+	}
+
+	conn, err = queryListen(network, QueryUnicastAddr(), "")
+	if err != nil {
+		err = querySocketError{err}
+		return
+	}
+
+	wait = &sync.WaitGroup{}
+	accept := func(meta SourceMeta) bool { return true }
+
+	wait.Add(1)
+	go queryRecv(conn, accept, s.input, wait)
+
+	// Find the target
+	target = OptServer
+	if target == nil {
+		target, err = s.resolve(conn)
+		if err != nil {
+			conn.Close()
+			wait.Wait()
+		}
+	}
+
+	return
+}
+
+// resolve resolves the target host name via legacy multicast
+// query
+func (s *stress) resolve(conn *Conn) (*net.UDPAddr, error) {
+	_, if4, if6, err := IfAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ifaces, group := if4, queryMcast4
+	if !conn.Is4() {
+		ifaces, group = if6, queryMcast6
+	}
+
+	q := &dns.Msg{}
+	q.Id = dns.Id()
+	q.Question = []dns.Question{s.question}
+
+	s.lock.Lock()
+	s.pending[q.Id] = time.Now()
+	s.lock.Unlock()
+
+	buf, _ := q.Pack()
+	for _, iface := range ifaces {
+		conn.WriteTo(buf, group, iface.Index)
+	}
+
+	select {
+	case ip := <-s.resolved:
+		return &net.UDPAddr{IP: ip, Port: mdnsPort}, nil
+	case <-time.After(stressWait):
+	}
+
+	return nil, fmt.Errorf("%s: not found", s.question.Name)
+}
+
+// run sends OptTxCount queries of the specified kind and prints
+// statistics
+func (s *stress) run(ctx context.Context, w io.Writer, conn *Conn,
+	target *net.UDPAddr, kind stressKind, rnd *rand.Rand) {
+
+	s.lock.Lock()
+	s.pending = make(map[uint16]time.Time)
+	s.latency = nil
+	s.lock.Unlock()
+
+	ticker := time.NewTicker(time.Second / time.Duration(OptRate))
+	defer ticker.Stop()
+
+	sent := 0
+	size := 0
+
+loop:
+	for sent < OptTxCount {
+		q := &dns.Msg{}
+		q.Id = uint16(rnd.Intn(65536))
+		q.Question = []dns.Question{s.question}
+		kind.build(q, s.question.Name)
+
+		buf, err := q.Pack()
+		if err != nil {
+			LogFatal("%s: %s", kind.name, err)
+		}
+		size = len(buf)
+
+		s.lock.Lock()
+		s.pending[q.Id] = time.Now()
+		s.lock.Unlock()
+
+		err = conn.WriteTo(buf, target, 0)
+		if err != nil {
+			LogError("%s: %s", target, err)
+		}
+		sent++
+
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(stressWait):
+	}
+
+	// Print statistics
+	s.lock.Lock()
+	latency := s.latency
+	s.lock.Unlock()
+
+	var min, max, sum time.Duration
+	for i, l := range latency {
+		if i == 0 || l < min {
+			min = l
+		}
+		if l > max {
+			max = l
+		}
+		sum += l
+	}
+
+	fmt.Fprintf(w, "%-28s %4d bytes: %d/%d answered (%d%%)",
+		kind.name, size, len(latency), sent,
+		100*len(latency)/stressMax(sent, 1))
+
+	if len(latency) != 0 {
+		avg := sum / time.Duration(len(latency))
+		fmt.Fprintf(w, ", latency min/avg/max %s/%s/%s",
+			min.Round(time.Microsecond), avg.Round(time.Microsecond),
+			max.Round(time.Microsecond))
+	}
+
+	fmt.Fprintf(w, "\n")
+}
+
+// input handles received message
+func (s *stress) input(msg *dns.Msg, meta SourceMeta) {
+	if !msg.Response {
+		return
+	}
+
+	answered := false
+	for _, rr := range msg.Answer {
+		if responseMatches(rr, []dns.Question{s.question}) {
+			answered = true
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sent, found := s.pending[msg.Id]
+	if !found || !answered {
+		return
+	}
+
+	delete(s.pending, msg.Id)
+	s.latency = append(s.latency, time.Since(sent))
+
+	select {
+	case s.answered <- struct{}{}:
+	default:
+	}
+
+	select {
+	case s.resolved <- meta.From.IP:
+	default:
+	}
+}
+
+// stressLongLabels adds question for the name of maximal length,
+// consisting of maximal length labels
+func stressLongLabels(q *dns.Msg, name string) {
+	label := strings.Repeat("x", 63)
+	long := label + "." + label + "." + label + "." +
+		strings.Repeat("y", 61) + "."
+
+	q.Question = append(q.Question, dns.Question{
+		Name:   long,
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+}
+
+// stressManyQuestions adds many questions for non-existent names
+func stressManyQuestions(q *dns.Msg, name string) {
+	for i := 0; i < 100; i++ {
+		q.Question = append(q.Question, dns.Question{
+			Name:   fmt.Sprintf("stress-%d.%s", i, name),
+			Qtype:  dns.TypeANY,
+			Qclass: dns.ClassINET,
+		})
+	}
+}
+
+// stressKnownAnswers adds large Known-Answer Section with
+// records of non-existent names
+func stressKnownAnswers(q *dns.Msg, name string) {
+	for i := 0; i < 200; i++ {
+		q.Answer = append(q.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   fmt.Sprintf("stress-%d.%s", i, name),
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    announceHostTTL,
+			},
+			A: net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+}
+
+// stressMax returns maximum of two integers
+func stressMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,106 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Per-interface results summary
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// summaryIface contains statistics of the interface
+type summaryIface struct {
+	responses int             // Count of responses
+	records   map[string]bool // Unique records, by dedupKey
+}
+
+// Summary state
+var (
+	summaryIfaces = make(map[int]*summaryIface) // By ifindex
+	summaryLock   sync.Mutex                    // Access lock
+)
+
+// summaryInput counts the received response and its unique records
+func summaryInput(msg *dns.Msg, meta SourceMeta) {
+	summaryLock.Lock()
+	defer summaryLock.Unlock()
+
+	stat := summaryIfaces[meta.IfIndex]
+	if stat == nil {
+		stat = &summaryIface{records: make(map[string]bool)}
+		summaryIfaces[meta.IfIndex] = stat
+	}
+
+	stat.responses++
+
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.OPT); ok {
+				continue
+			}
+
+			stat.records[dedupKeyNoFlush(rr)] = true
+		}
+	}
+}
+
+// SummaryPrint prints the table of responses and unique records,
+// received via each interface, and count of packets, dropped by the
+// kernel (where it is known, see ConnDrops), into io.Writer
+//
+// The returned error, if any, comes from w.Write()
+func SummaryPrint(w io.Writer) error {
+	type row struct {
+		name              string
+		responses, unique int
+	}
+
+	summaryLock.Lock()
+	var rows []row
+	for ifindex, stat := range summaryIfaces {
+		name := "(unknown)"
+		if iface, err := net.InterfaceByIndex(ifindex); err == nil {
+			name = iface.Name
+		} else if ifindex != 0 {
+			name = "#" + strconv.Itoa(ifindex)
+		}
+
+		rows = append(rows, row{name, stat.responses, len(stat.records)})
+	}
+	summaryLock.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].name < rows[j].name
+	})
+
+	buf := bytes.Buffer{}
+	buf.WriteString(";; INTERFACE SUMMARY:\n")
+	fmt.Fprintf(&buf, ";; %-16s %10s %10s\n", "interface", "responses",
+		"records")
+	for _, r := range rows {
+		fmt.Fprintf(&buf, ";; %-16s %10d %10d\n", r.name, r.responses,
+			r.unique)
+	}
+	if len(rows) == 0 {
+		buf.WriteString(";; no responses received\n")
+	}
+	if drops, ok := ConnDrops(); ok {
+		fmt.Fprintf(&buf, ";; %d packets dropped by the kernel "+
+			"(receive queue overflow)\n", drops)
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,45 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Logging to syslog, version for platforms other than Windows
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log/slog"
+	"log/syslog"
+	"strings"
+)
+
+// logSyslogSink writes messages to syslog
+type logSyslogSink struct {
+	w *syslog.Writer // Syslog connection
+}
+
+// logSyslogOpen connects to syslog
+func logSyslogOpen() (logSink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "mcdig")
+	if err != nil {
+		return nil, err
+	}
+	return &logSyslogSink{w: w}, nil
+}
+
+// write writes the message
+func (s *logSyslogSink) write(level slog.Level, msg []byte) error {
+	text := strings.TrimSuffix(string(msg), "\n")
+	switch {
+	case level >= slog.LevelError:
+		return s.w.Err(text)
+	case level >= slog.LevelWarn:
+		return s.w.Warning(text)
+	case level >= slog.LevelInfo:
+		return s.w.Info(text)
+	}
+	return s.w.Debug(text)
+}
@@ -0,0 +1,18 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Logging to syslog, Windows version
+
+//go:build windows
+// +build windows
+
+package main
+
+import "errors"
+
+// logSyslogOpen connects to syslog. Not supported on this platform
+func logSyslogOpen() (logSink, error) {
+	return nil, errors.New("not supported on Windows")
+}
@@ -0,0 +1,142 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// systemd integration
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// systemdListenFdsStart is the first file descriptor, passed
+// by the socket activation (SD_LISTEN_FDS_START)
+const systemdListenFdsStart = 3
+
+// Socket activation state
+var (
+	systemdFiles []*os.File // Passed files
+	systemdOnce  sync.Once  // Makes sure files are taken once
+)
+
+// SystemdListenFiles returns files (sockets), passed by systemd
+// socket activation (see sd_listen_fds(3)). If mcdig is not socket
+// activated, it returns nil
+//
+// Environment variables of the socket activation protocol are
+// removed, so they are not inherited by child processes
+func SystemdListenFiles() []*os.File {
+	systemdOnce.Do(func() {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count <= 0 {
+			return
+		}
+
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		for i := 0; i < count; i++ {
+			fd := systemdListenFdsStart + i
+			syscall.CloseOnExec(fd)
+
+			name := "LISTEN_FD_" + strconv.Itoa(fd)
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+
+			systemdFiles = append(systemdFiles,
+				os.NewFile(uintptr(fd), name))
+		}
+
+		LogDebug("systemd: %d sockets passed", count)
+	})
+
+	return systemdFiles
+}
+
+// SystemdListeners returns stream (TCP) listeners and datagram
+// (UDP) sockets, passed by systemd socket activation. Passed
+// files of other types are ignored. It doesn't return in a case
+// of errors
+func SystemdListeners() (listeners []net.Listener,
+	packetConns []net.PacketConn) {
+
+	for _, file := range SystemdListenFiles() {
+		typ, err := syscall.GetsockoptInt(int(file.Fd()),
+			syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if err != nil {
+			LogFatal("systemd: %s: %s", file.Name(), err)
+		}
+
+		switch typ {
+		case syscall.SOCK_STREAM:
+			l, err := net.FileListener(file)
+			if err != nil {
+				LogFatal("systemd: %s: %s", file.Name(), err)
+			}
+			listeners = append(listeners, l)
+
+		case syscall.SOCK_DGRAM:
+			pc, err := net.FilePacketConn(file)
+			if err != nil {
+				LogFatal("systemd: %s: %s", file.Name(), err)
+			}
+			packetConns = append(packetConns, pc)
+
+		default:
+			LogDebug("systemd: %s: unsupported socket type %d",
+				file.Name(), typ)
+		}
+
+		file.Close()
+	}
+
+	return
+}
+
+// SystemdNotify sends the state notification to systemd (see
+// sd_notify(3)), e.g., "READY=1" or "STOPPING=1". If mcdig is
+// not started by systemd with notification support, it does nothing
+func SystemdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+
+	// Abstract namespace socket
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		LogDebug("systemd: %s", err)
+		return
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		LogDebug("systemd: %s", err)
+	}
+}
@@ -0,0 +1,34 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// systemd integration, Windows version (does nothing)
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// SystemdListenFiles returns files, passed by systemd socket
+// activation. There is no systemd on Windows, so it returns nil
+func SystemdListenFiles() []*os.File {
+	return nil
+}
+
+// SystemdListeners returns listeners, passed by systemd socket
+// activation. There is no systemd on Windows, so it returns nil
+func SystemdListeners() (listeners []net.Listener,
+	packetConns []net.PacketConn) {
+	return nil, nil
+}
+
+// SystemdNotify sends the state notification to systemd.
+// There is no systemd on Windows, so it does nothing
+func SystemdNotify(state string) {
+}
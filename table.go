@@ -0,0 +1,200 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Table view of service instances
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/miekg/dns"
+)
+
+// tableTXTKeys are TXT keys, commonly used to identify devices and
+// services. If instance has some of them, only these are shown
+var tableTXTKeys = []string{
+	"fn", "ty", "md", "model", "product", "manufacturer", "usb_MDL",
+	"rp", "path", "adminurl", "note", "id", "deviceid",
+}
+
+// tableTXTMax is the max width of the TXT column
+const tableTXTMax = 60
+
+// TablePrint prints service instances, resolved from records (see
+// DnssdResolve), as aligned tables, one per service type, into
+// io.Writer
+//
+// Instances of SRV records without PTR records (e.g., the resolve
+// q-type output) are included as well
+//
+// The returned error, if any, comes from w.Write()
+func TablePrint(w io.Writer, records []dns.RR) error {
+	services, _ := DnssdResolve(records)
+
+	// Add instances, known only by SRV records
+	known := make(map[string]bool)
+	for _, svc := range services {
+		known[strings.ToLower(svc.Name)] = true
+	}
+
+	addrs := make(map[string][]string)
+	txts := make(map[string][]string)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs[name] = append(addrs[name], rr.A.String())
+		case *dns.AAAA:
+			addrs[name] = append(addrs[name], rr.AAAA.String())
+		case *dns.TXT:
+			txts[name] = append(txts[name], rr.Txt...)
+		}
+	}
+
+	for _, rr := range records {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+
+		name := strings.ToLower(srv.Hdr.Name)
+		labels := dns.Split(srv.Hdr.Name)
+		if known[name] || len(labels) < 2 {
+			continue
+		}
+
+		known[name] = true
+		svctype := srv.Hdr.Name[labels[1]:]
+		services = append(services, DnssdService{
+			Name:     srv.Hdr.Name,
+			Instance: dnssdInstanceName(srv.Hdr.Name, svctype),
+			Type:     svctype,
+			Host:     srv.Target,
+			Port:     srv.Port,
+			Addrs:    addrs[strings.ToLower(srv.Target)],
+			TXT:      txts[name],
+		})
+	}
+
+	// Group by service type
+	bytype := make(map[string][]DnssdService)
+	var types []string
+	for _, svc := range services {
+		key := strings.ToLower(svc.Type)
+		if bytype[key] == nil {
+			types = append(types, key)
+		}
+		bytype[key] = append(bytype[key], svc)
+	}
+
+	sort.Strings(types)
+
+	buf := bytes.Buffer{}
+	for _, svctype := range types {
+		tablePrintType(&buf, svctype, bytype[svctype])
+	}
+
+	if len(types) == 0 {
+		buf.WriteString(";; no service instances found\n\n")
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// tablePrintType prints table of instances of the service type
+func tablePrintType(buf *bytes.Buffer, svctype string, svcs []DnssdService) {
+	sort.Slice(svcs, func(i, j int) bool {
+		return svcs[i].Instance < svcs[j].Instance
+	})
+
+	fmt.Fprintf(buf, ";; %s (%d)\n", svctype, len(svcs))
+
+	// Models are shown, if known for some instances
+	models := false
+	for _, svc := range svcs {
+		models = models || svc.Model != ""
+	}
+
+	tw := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	if models {
+		fmt.Fprintf(tw, "INSTANCE\tHOST\tPORT\tADDRESSES\tMODEL\tTXT\n")
+	} else {
+		fmt.Fprintf(tw, "INSTANCE\tHOST\tPORT\tADDRESSES\tTXT\n")
+	}
+
+	for _, svc := range svcs {
+		host, port := "-", "-"
+		if svc.Host != "" {
+			host, port = svc.Host, fmt.Sprint(svc.Port)
+		}
+
+		addrs := strings.Join(svc.Addrs, ",")
+		if addrs == "" {
+			addrs = "-"
+		}
+
+		if models {
+			model := svc.Model
+			if model == "" {
+				model = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				svc.Instance, host, port, addrs, model,
+				tableTXT(svc.TXT))
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", svc.Instance,
+				host, port, addrs, tableTXT(svc.TXT))
+		}
+	}
+
+	tw.Flush()
+	buf.WriteByte('\n')
+}
+
+// tableTXT returns key TXT fields (see tableTXTKeys) for display.
+// If there are no such fields, all fields are returned. The result
+// is truncated to tableTXTMax characters
+func tableTXT(txt []string) string {
+	var fields []string
+	for _, key := range tableTXTKeys {
+		for _, s := range txt {
+			k := s
+			if i := strings.IndexByte(s, '='); i >= 0 {
+				k = s[:i]
+			}
+
+			if strings.EqualFold(k, key) {
+				fields = append(fields, s)
+				break
+			}
+		}
+	}
+
+	if fields == nil {
+		for _, s := range txt {
+			if s != "" && !strings.HasPrefix(s, "txtvers=") {
+				fields = append(fields, s)
+			}
+		}
+	}
+
+	s := strings.Join(fields, " ")
+	if runes := []rune(s); len(runes) > tableTXTMax {
+		s = string(runes[:tableTXTMax-3]) + "..."
+	}
+
+	if s == "" {
+		s = "-"
+	}
+
+	return s
+}
@@ -0,0 +1,52 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Terminal control, version for Linux
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// TermRaw switches terminal into the raw mode (no echo, no line
+// editing, no signals from keys except Ctrl-C) and returns function
+// that restores the previous mode
+func TermRaw(fd uintptr) (restore func(), err error) {
+	saved, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *saved
+	raw.Lflag &^= unix.ECHO | unix.ICANON | unix.IEXTEN
+	raw.Iflag &^= unix.IXON | unix.ICRNL
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+
+	err = unix.IoctlSetTermios(int(fd), unix.TCSETS, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	restore = func() {
+		unix.IoctlSetTermios(int(fd), unix.TCSETS, saved)
+	}
+
+	return restore, nil
+}
+
+// TermSize returns terminal size
+func TermSize(fd uintptr) (cols, rows int, err error) {
+	ws, err := unix.IoctlGetWinsize(int(fd), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(ws.Col), int(ws.Row), nil
+}
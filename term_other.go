@@ -0,0 +1,27 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Terminal control, version for platforms other than Linux
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// TermRaw switches terminal into the raw mode.
+// Not supported on this platform
+func TermRaw(fd uintptr) (restore func(), err error) {
+	return nil, errors.New("terminal control not supported")
+}
+
+// TermSize returns terminal size.
+// Not supported on this platform
+func TermSize(fd uintptr) (cols, rows int, err error) {
+	return 0, 0, errors.New("terminal control not supported")
+}
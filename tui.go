@@ -0,0 +1,488 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Terminal UI browser
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tuiRefresh is the screen refresh interval, so TTLs and expired
+// services are updated even if nothing is received
+const tuiRefresh = time.Second
+
+// tui contains the terminal UI state
+type tui struct {
+	daemon   *Daemon         // The daemon
+	svctype  string          // Browsed service type, "" for all
+	expanded map[string]bool // Expanded nodes, by key
+	selected string          // Key of the selected line
+	cursor   int             // Index of the selected line
+	top      int             // Index of the first displayed line
+	update   chan struct{}   // Signaled when records change
+	out      *bufio.Writer   // Terminal output
+}
+
+// tuiLine is the displayed line of the tree
+type tuiLine struct {
+	key    string // Unique line key
+	text   string // Line text
+	parent string // Key of the parent line, "" for top-level lines
+	node   bool   // Line can be expanded
+}
+
+// TuiRun runs the terminal UI browser until ctx is canceled or the
+// user quits. It presents the live tree of service types, their
+// instances and instance details, which is updated as records
+// arrive and expire
+//
+// If OptDomain is set, only instances of this service type are
+// browsed, otherwise all service types are discovered
+func TuiRun(ctx context.Context) {
+	if _, _, err := TermSize(os.Stdout.Fd()); err != nil {
+		LogFatal("--tui: stdout is not a terminal: %s", err)
+	}
+
+	svctype := ""
+	if OptDomain != "" {
+		var err error
+		svctype, err = QueryServiceFqdn(OptDomain)
+		if err != nil {
+			LogFatal("%s", err)
+		}
+	}
+
+	daemon, err := DaemonNew()
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	restore, err := TermRaw(os.Stdin.Fd())
+	if err != nil {
+		LogFatal("--tui: %s", err)
+	}
+	defer restore()
+
+	t := &tui{
+		daemon:   daemon,
+		svctype:  svctype,
+		expanded: make(map[string]bool),
+		update:   make(chan struct{}, 1),
+		out:      bufio.NewWriter(os.Stdout),
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		t.daemon.Run(ctx)
+		close(done)
+	}()
+
+	if t.svctype != "" {
+		t.expanded[t.svctype] = true
+		go t.browse(ctx, t.svctype)
+	} else {
+		go t.discover(ctx)
+	}
+
+	keys := make(chan string, 16)
+	go tuiReadKeys(os.Stdin, keys)
+
+	// Use alternate screen, hide cursor
+	t.out.WriteString("\x1b[?1049h\x1b[?25l")
+
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+
+loop:
+	for {
+		t.draw()
+
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		case <-t.update:
+		case key := <-keys:
+			if !t.key(key) {
+				break loop
+			}
+		}
+	}
+
+	// Restore screen and cursor
+	t.out.WriteString("\x1b[?25h\x1b[?1049l")
+	t.out.Flush()
+
+	cancel()
+	<-done
+}
+
+// discover discovers service types and browses each of them
+func (t *tui) discover(ctx context.Context) {
+	question := []dns.Question{{
+		Name:   announceServicesName,
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	}}
+
+	w := t.daemon.Watch(question)
+	defer t.daemon.Unwatch(w)
+
+	go t.daemon.Exchange(ctx, question)
+
+	browsed := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+
+			t.changed()
+
+			ptr, ok := ev.RR.(*dns.PTR)
+			if !ok || ev.Type == CacheRemoved {
+				continue
+			}
+
+			svctype := strings.ToLower(ptr.Ptr)
+			if !browsed[svctype] {
+				browsed[svctype] = true
+				go t.browse(ctx, ptr.Ptr)
+			}
+		}
+	}
+}
+
+// browse browses instances of the service type and watches
+// them, so the tree is redrawn when they change
+func (t *tui) browse(ctx context.Context, svctype string) {
+	question := []dns.Question{{
+		Name:   svctype,
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	}}
+
+	w := t.daemon.Watch(question)
+	defer t.daemon.Unwatch(w)
+
+	go func() {
+		t.daemon.Browse(ctx, svctype)
+		t.changed()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			t.changed()
+		}
+	}
+}
+
+// changed requests redraw
+func (t *tui) changed() {
+	select {
+	case t.update <- struct{}{}:
+	default:
+	}
+}
+
+// lines returns lines of the tree, according to the current
+// records and expanded nodes, and counts of service types and
+// instances
+func (t *tui) lines() (lines []tuiLine, types, instances int) {
+	records := t.daemon.Records(nil)
+	services, _ := DnssdResolve(records)
+
+	// Group instances by type. Discovered types without
+	// instances are shown as well
+	bytype := make(map[string][]DnssdService)
+	for _, rr := range records {
+		ptr, ok := rr.(*dns.PTR)
+		if ok && strings.EqualFold(ptr.Hdr.Name, announceServicesName) {
+			key := strings.ToLower(ptr.Ptr)
+			bytype[key] = bytype[key]
+		}
+	}
+
+	for _, svc := range services {
+		key := strings.ToLower(svc.Type)
+		bytype[key] = append(bytype[key], svc)
+	}
+
+	if t.svctype != "" {
+		key := strings.ToLower(t.svctype)
+		bytype = map[string][]DnssdService{key: bytype[key]}
+	}
+
+	keys := make([]string, 0, len(bytype))
+	for key := range bytype {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Build lines
+	for _, key := range keys {
+		svcs := bytype[key]
+		sort.Slice(svcs, func(i, j int) bool {
+			return svcs[i].Instance < svcs[j].Instance
+		})
+
+		types++
+		instances += len(svcs)
+
+		lines = append(lines, tuiLine{
+			key:  key,
+			text: fmt.Sprintf("%s %s (%d)", t.mark(key), key, len(svcs)),
+			node: true,
+		})
+
+		if !t.expanded[key] {
+			continue
+		}
+
+		for _, svc := range svcs {
+			ikey := strings.ToLower(svc.Name)
+			lines = append(lines, tuiLine{
+				key:    ikey,
+				text:   fmt.Sprintf("    %s %s", t.mark(ikey), svc.Instance),
+				parent: key,
+				node:   true,
+			})
+
+			if !t.expanded[ikey] {
+				continue
+			}
+
+			details := []string{"host: (unresolved)"}
+			if svc.Host != "" {
+				details[0] = fmt.Sprintf("host: %s port %d",
+					svc.Host, svc.Port)
+			}
+			if svc.Model != "" {
+				details = append(details, "model: "+svc.Model)
+			}
+			for _, addr := range svc.Addrs {
+				details = append(details, "addr: "+addr)
+			}
+			for _, txt := range svc.TXT {
+				details = append(details, "txt:  "+txt)
+			}
+
+			for i, text := range details {
+				lines = append(lines, tuiLine{
+					key:    fmt.Sprintf("%s/%d", ikey, i),
+					text:   "          " + text,
+					parent: ikey,
+				})
+			}
+		}
+	}
+
+	return
+}
+
+// mark returns the expanded/collapsed mark of the node
+func (t *tui) mark(key string) string {
+	if t.expanded[key] {
+		return "-"
+	}
+	return "+"
+}
+
+// locate finds the selected line. If it has disappeared, the
+// line at the same position is selected
+func (t *tui) locate(lines []tuiLine) {
+	for i, line := range lines {
+		if line.key == t.selected {
+			t.cursor = i
+			return
+		}
+	}
+
+	if t.cursor >= len(lines) {
+		t.cursor = len(lines) - 1
+	}
+	if t.cursor < 0 {
+		t.cursor = 0
+	}
+	if t.cursor < len(lines) {
+		t.selected = lines[t.cursor].key
+	}
+}
+
+// key handles the key press. It returns false, if user quits
+func (t *tui) key(key string) bool {
+	lines, _, _ := t.lines()
+	t.locate(lines)
+	if len(lines) == 0 {
+		return key != "q"
+	}
+
+	line := lines[t.cursor]
+
+	switch key {
+	case "q":
+		return false
+
+	case "up", "k":
+		t.cursor--
+
+	case "down", "j":
+		t.cursor++
+
+	case "pgup":
+		t.cursor -= 10
+
+	case "pgdn":
+		t.cursor += 10
+
+	case "right", "l":
+		if line.node {
+			t.expanded[line.key] = true
+		}
+
+	case "enter", " ":
+		if line.node {
+			t.expanded[line.key] = !t.expanded[line.key]
+		}
+
+	case "left", "h":
+		if line.node && t.expanded[line.key] {
+			t.expanded[line.key] = false
+		} else if line.parent != "" {
+			t.selected = line.parent
+			return true
+		}
+	}
+
+	if t.cursor >= len(lines) {
+		t.cursor = len(lines) - 1
+	}
+	if t.cursor < 0 {
+		t.cursor = 0
+	}
+	t.selected = lines[t.cursor].key
+
+	return true
+}
+
+// draw redraws the screen
+func (t *tui) draw() {
+	cols, rows, err := TermSize(os.Stdout.Fd())
+	if err != nil || rows < 3 || cols < 10 {
+		return
+	}
+
+	lines, types, instances := t.lines()
+	t.locate(lines)
+
+	// Scroll, so the selected line is visible. The first and the
+	// last rows are header and status
+	height := rows - 2
+	if t.cursor < t.top {
+		t.top = t.cursor
+	}
+	if t.cursor >= t.top+height {
+		t.top = t.cursor - height + 1
+	}
+
+	t.out.WriteString("\x1b[H")
+	t.row(fmt.Sprintf("mcdig: %d service types, %d instances",
+		types, instances), cols, true)
+
+	for i := t.top; i < t.top+height; i++ {
+		if i < len(lines) {
+			text := lines[i].text
+			if i == t.cursor {
+				t.out.WriteString("\x1b[7m")
+				t.row(text, cols, true)
+				t.out.WriteString("\x1b[0m")
+			} else {
+				t.row(text, cols, true)
+			}
+		} else {
+			t.row("", cols, true)
+		}
+	}
+
+	t.out.WriteString("\x1b[7m")
+	t.row("up/down: move  right/enter: expand  left: collapse  q: quit",
+		cols, false)
+	t.out.WriteString("\x1b[0m")
+
+	t.out.Flush()
+}
+
+// row writes the screen row, truncated to the screen width.
+// The last row is written without newline, to avoid scrolling
+func (t *tui) row(text string, cols int, newline bool) {
+	runes := []rune(text)
+	if len(runes) > cols {
+		runes = runes[:cols]
+	}
+
+	t.out.WriteString(string(runes))
+	t.out.WriteString("\x1b[K")
+	if newline {
+		t.out.WriteString("\r\n")
+	}
+}
+
+// tuiReadKeys reads keys from the terminal and sends their
+// names ("up", "down", "enter", ... or the character itself)
+// into the channel
+func tuiReadKeys(r io.Reader, keys chan<- string) {
+	escapes := map[string]string{
+		"\x1b[A":  "up",
+		"\x1b[B":  "down",
+		"\x1b[C":  "right",
+		"\x1b[D":  "left",
+		"\x1b[5~": "pgup",
+		"\x1b[6~": "pgdn",
+		"\r":      "enter",
+		"\n":      "enter",
+	}
+
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+
+		seq := string(buf[:n])
+		if name, ok := escapes[seq]; ok {
+			keys <- name
+			continue
+		}
+
+		for _, c := range seq {
+			if c != 0x1b {
+				keys <- string(c)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Linux VRF (Virtual Routing and Forwarding) devices
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vrfSysfs is where network devices are represented in sysfs
+const vrfSysfs = "/sys/class/net"
+
+// VrfIs tells if network interface is the VRF device
+func VrfIs(ifname string) bool {
+	uevent, err := os.ReadFile(filepath.Join(vrfSysfs, ifname, "uevent"))
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(uevent), "\n") {
+		if line == "DEVTYPE=vrf" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VrfMaster returns name of the VRF device, the network interface
+// is enslaved to, or empty string, if interface is not in VRF
+func VrfMaster(ifname string) string {
+	master, err := os.Readlink(filepath.Join(vrfSysfs, ifname, "master"))
+	if err != nil {
+		return ""
+	}
+
+	master = filepath.Base(master)
+	if !VrfIs(master) {
+		return ""
+	}
+
+	return master
+}
@@ -0,0 +1,23 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// VRF devices, version for platforms other than Linux
+
+//go:build !linux
+// +build !linux
+
+package main
+
+// VrfIs tells if network interface is the VRF device.
+// VRFs are not supported on this platform
+func VrfIs(ifname string) bool {
+	return false
+}
+
+// VrfMaster returns name of the VRF device, the network interface
+// is enslaved to. VRFs are not supported on this platform
+func VrfMaster(ifname string) string {
+	return ""
+}
@@ -0,0 +1,118 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Watch mode events
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Watch mode state. It is protected by rspLock
+var (
+	watchOut     io.Writer     // Events go here
+	watchCache   *Cache        // Records cache
+	watchRefresh chan struct{} // Signaled when re-query is needed
+)
+
+// ResponseWatch enables watch mode. In this mode, received records
+// are maintained in the Cache and, instead of printing new records,
+// as in streaming mode, events are printed to w as records appear
+// (+), disappear (-) by expiration or goodbye, or change (~) by
+// cache-flush replacement
+//
+// When answers to our question near expiration, re-query is
+// requested via ResponseRefreshChan
+func ResponseWatch(w io.Writer) {
+	rspLock.Lock()
+	watchOut = w
+	watchCache = CacheNew()
+	watchRefresh = make(chan struct{}, 1)
+	rspLock.Unlock()
+
+	go func() {
+		for now := range time.Tick(time.Second) {
+			rspLock.Lock()
+			watchPrint(watchCache.Expire(now))
+
+			if watchCache.NeedRefresh(rspQuestion, now) {
+				select {
+				case watchRefresh <- struct{}{}:
+				default:
+				}
+			}
+			rspLock.Unlock()
+		}
+	}()
+}
+
+// ResponseRefreshChan returns channel, which is signaled when
+// answers to the question near expiration and needs to be refreshed
+// by re-query. Outside of watch mode, it returns nil
+func ResponseRefreshChan() <-chan struct{} {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+	return watchRefresh
+}
+
+// watchInput handles received records. Must be called under rspLock
+func watchInput(rrs []dns.RR, now time.Time) {
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.OPT); !ok {
+			watchPrint(watchCache.Input(rr, SourceMeta{}, now))
+		}
+	}
+}
+
+// ResponseRemove removes all records of the name and type (of all
+// types, if rrtype is dns.TypeANY), as DNS Push requests (see
+// Cache.Remove). Outside of watch mode, it does nothing
+func ResponseRemove(name string, rrtype uint16) {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+
+	if watchCache != nil {
+		watchPrint(watchCache.Remove(name, rrtype))
+	}
+}
+
+// watchPrint prints events
+func watchPrint(events []CacheEvent) {
+	if webhookQueue != nil {
+		webhookInput(events)
+	}
+
+	if serveClients != nil {
+		serveInput(events)
+	}
+
+	if influxOut != nil {
+		influxEventsPrint(events)
+		return
+	}
+
+	for _, ev := range events {
+		fmt.Fprintf(watchOut, "%c %s\n", ev.Type, ResponseRRString(ev.RR))
+	}
+}
+
+// ResponseRecords returns all alive records, known in watch mode,
+// sorted by name, type and data, with TTLs adjusted to the remaining
+// lifetime. Outside of watch mode, it returns nil
+func ResponseRecords() []dns.RR {
+	rspLock.Lock()
+	defer rspLock.Unlock()
+
+	if watchCache == nil {
+		return nil
+	}
+
+	return watchCache.Records(time.Now())
+}
@@ -0,0 +1,127 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Webhook notifications
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout is the timeout of webhook HTTP requests
+const webhookTimeout = 10 * time.Second
+
+// webhookQueue contains notifications, pending for delivery.
+// It is non-nil when webhook notifications are enabled
+var webhookQueue chan *webhookEvent
+
+// webhookEvent is the JSON payload of the notification
+type webhookEvent struct {
+	Event    string    `json:"event"`    // "appeared" or "disappeared"
+	Service  string    `json:"service"`  // Service instance name
+	Type     string    `json:"type"`     // Service type
+	Time     time.Time `json:"time"`     // Event time
+	Question string    `json:"question"` // Name being watched
+}
+
+// WebhookRun enables webhook notifications: in watch mode, JSON
+// payload is POSTed to the OptWebhook URL whenever a service
+// instance appears or disappears. Notifications are delivered
+// in order on a separate goroutine, until ctx is canceled
+func WebhookRun(ctx context.Context) {
+	rspLock.Lock()
+	webhookQueue = make(chan *webhookEvent, 256)
+	queue := webhookQueue
+	rspLock.Unlock()
+
+	client := &http.Client{Timeout: webhookTimeout}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-queue:
+				webhookPost(ctx, client, ev)
+			}
+		}
+	}()
+}
+
+// webhookPost delivers the notification
+func webhookPost(ctx context.Context, client *http.Client,
+	ev *webhookEvent) {
+
+	data, _ := json.Marshal(ev)
+
+	rq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		OptWebhook, bytes.NewReader(data))
+	if err != nil {
+		LogError("webhook: %s", err)
+		return
+	}
+
+	rq.Header.Set("Content-Type", "application/json")
+
+	rsp, err := client.Do(rq)
+	if err != nil {
+		if ctx.Err() == nil {
+			LogError("webhook: %s", err)
+		}
+		return
+	}
+
+	rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		LogError("webhook: %s", rsp.Status)
+		return
+	}
+
+	LogDebug("webhook: %s %s delivered", ev.Service, ev.Event)
+}
+
+// webhookInput queues notifications for Cache events of service
+// instance PTR records. Must be called under rspLock
+func webhookInput(events []CacheEvent) {
+	now := time.Now()
+
+	for _, ev := range events {
+		ptr := dnssdInstancePTR(ev.RR)
+		if ptr == nil {
+			continue
+		}
+
+		wev := &webhookEvent{
+			Service: ptr.Ptr,
+			Type:    ptr.Hdr.Name,
+			Time:    now,
+		}
+
+		if len(rspQuestion) != 0 {
+			wev.Question = rspQuestion[0].Name
+		}
+
+		switch ev.Type {
+		case CacheAdded:
+			wev.Event = "appeared"
+		case CacheRemoved:
+			wev.Event = "disappeared"
+		default:
+			continue
+		}
+
+		select {
+		case webhookQueue <- wev:
+		default:
+			LogError("webhook: queue overflow, %s %s dropped",
+				wev.Service, wev.Event)
+		}
+	}
+}
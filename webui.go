@@ -0,0 +1,88 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Web browse UI
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// webuiPage is the page data
+type webuiPage struct {
+	Question string         // Question being watched
+	Services []DnssdService // Discovered services
+	Hosts    []DnssdHost    // Discovered hosts
+	Records  int            // Total count of records
+}
+
+// webuiTemplate is the page template. The page reloads itself
+// periodically, so it follows the live cache
+var webuiTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>mcdig: {{.Question}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left;
+	vertical-align: top; }
+th { background: #eee; }
+td.txt { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>mcdig: {{.Question}}</h1>
+<p>{{.Records}} records in cache. Live events: <a href="/events">/events</a></p>
+
+<h2>Services</h2>
+<table>
+<tr><th>Instance</th><th>Type</th><th>Host</th><th>Port</th><th>Addresses</th><th>TXT</th></tr>
+{{range .Services}}<tr>
+<td>{{.Instance}}</td><td>{{.Type}}</td><td>{{.Host}}</td>
+<td>{{if .Port}}{{.Port}}{{end}}</td>
+<td>{{range .Addrs}}{{.}}<br>{{end}}</td>
+<td class="txt">{{range .TXT}}{{.}}<br>{{end}}</td>
+</tr>
+{{else}}<tr><td colspan="6">None</td></tr>
+{{end}}</table>
+
+<h2>Hosts</h2>
+<table>
+<tr><th>Name</th><th>Addresses</th></tr>
+{{range .Hosts}}<tr><td>{{.Name}}</td><td>{{range .Addrs}}{{.}}<br>{{end}}</td></tr>
+{{else}}<tr><td colspan="2">None</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// webuiServe handles requests for the browse page. The page
+// lists services, hosts and TXT details from the watch mode cache
+func webuiServe(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	records := ResponseRecords()
+	page := webuiPage{Records: len(records)}
+
+	if question := ResponseQuestion(); len(question) != 0 {
+		page.Question = question[0].Name
+	}
+
+	page.Services, page.Hosts = DnssdResolve(records)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := webuiTemplate.Execute(w, page)
+	if err != nil {
+		LogDebug("%s: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,105 @@
+// MCDIG - DIG for MDNS (Multicast DNS lookup utility)
+//
+// Copyright (C) 2023 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Wide-area DNS-SD (RFC 6763, section 11)
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/miekg/dns"
+)
+
+// wideAreaPrefixes are the special names, used to discover
+// browse domains (RFC 6763, section 11):
+//
+//	b  - domains recommended for browsing
+//	db - default domain for browsing
+//	lb - legacy browse domains
+var wideAreaPrefixes = []string{
+	"b._dns-sd._udp.",
+	"db._dns-sd._udp.",
+	"lb._dns-sd._udp.",
+}
+
+// wideAreaError is returned, when the query via unicast DNS or
+// DNS Push can't be performed, so it can be told apart from other
+// errors (see mainExitStatus)
+type wideAreaError struct {
+	err error // The underlying error
+}
+
+// Error returns the error message
+func (e wideAreaError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e wideAreaError) Unwrap() error {
+	return e.err
+}
+
+// WideAreaDomains discovers browse domains in the host's domains
+// (search list of the OptResolvConf file) via unicast DNS and
+// prints results into io.Writer
+//
+// Error is returned, if the OptResolvConf file can't be used, or
+// comes from w.Write()
+func WideAreaDomains(w io.Writer) error {
+	conf, err := dns.ClientConfigFromFile(OptResolvConf)
+	if err != nil {
+		return fileError{err}
+	}
+
+	if len(conf.Search) == 0 {
+		err = fmt.Errorf("No search domains in %s", OptResolvConf)
+		return wideAreaError{err}
+	}
+
+	question := []dns.Question{}
+	ans := []dns.RR{}
+
+	for _, domain := range conf.Search {
+		for _, prefix := range wideAreaPrefixes {
+			q := dns.Question{
+				Name:   prefix + dns.Fqdn(domain),
+				Qtype:  dns.TypePTR,
+				Qclass: dns.ClassINET,
+			}
+
+			question = append(question, q)
+
+			rsp, err := FallbackExchange([]dns.Question{q})
+			if err != nil {
+				LogError("%s: %s", q.Name, err)
+				continue
+			}
+
+			ans = append(ans, rsp.Answer...)
+		}
+	}
+
+	return ResponsePrint(w, question, ans, nil, nil)
+}
+
+// WideAreaRun performs the wide-area query: the question of the
+// rq message is sent via unicast DNS, and response is handled
+// the same way, as MDNS responses
+//
+// Error is returned, if the query can't be performed
+func WideAreaRun(rq *dns.Msg) error {
+	rsp, server, err := fallbackExchange(rq.Question)
+	if err != nil {
+		return wideAreaError{err}
+	}
+
+	if RcodeInput(rsp, server) {
+		ResponseInput(rsp)
+	}
+
+	return nil
+}